@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"nsctl/pkg/ns"
+)
+
+// handleCheckCommand probes the host for what nsctl needs and prints each
+// check with a fix for what's missing; it exits 1 if a check failed
+func handleCheckCommand() {
+	checkFlags := flag.NewFlagSet("check", flag.ExitOnError)
+	jsonOutput := checkFlags.Bool("json", false, "Print the results as JSON")
+	parseFlags(checkFlags, os.Args[2:])
+
+	reportCheckResults(ns.RunHostChecks(), *jsonOutput)
+}
+
+// handleSelftestCommand runs a test container and checks its isolation,
+// limits and exit code; it exits 1 if a test failed
+func handleSelftestCommand() {
+	selftestFlags := flag.NewFlagSet("selftest", flag.ExitOnError)
+	jsonOutput := selftestFlags.Bool("json", false, "Print the results as JSON")
+	parseFlags(selftestFlags, os.Args[2:])
+
+	if !*jsonOutput {
+		fmt.Fprintf(os.Stderr, "[nsctl] Running a test container...\n")
+	}
+	reportCheckResults(ns.RunSelftest(os.Args[0]), *jsonOutput)
+}
+
+// reportCheckResults prints check or self-test results with a summary, and
+// exits 1 if any failed
+func reportCheckResults(results []ns.CheckResult, jsonOutput bool) {
+	counts := map[string]int{}
+	for _, result := range results {
+		counts[result.Status]++
+	}
+
+	if jsonOutput {
+		data, _ := json.MarshalIndent(results, "", "  ")
+		fmt.Println(string(data))
+	} else {
+		for _, result := range results {
+			fmt.Printf("[%s] %-30s %s\n", result.Status, result.Name, result.Detail)
+			if result.Fix != "" {
+				fmt.Printf("       fix: %s\n", result.Fix)
+			}
+		}
+		summary := fmt.Sprintf("%d checks: %d passed, %d warnings, %d failed", len(results), counts[ns.CheckPass], counts[ns.CheckWarn], counts[ns.CheckFail])
+		if counts[ns.CheckSkip] > 0 {
+			summary += fmt.Sprintf(", %d skipped", counts[ns.CheckSkip])
+		}
+		fmt.Printf("\n%s\n", summary)
+	}
+
+	if counts[ns.CheckFail] > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Docker and podman compatibility
+//
+// Muscle memory and scripts written for docker or podman mostly work:
+//
+//   - short flags can be combined, as in "run -dit", "rm -af" or "ps -lq"
+//   - "container <command>" is the command itself, with "container ls" (and
+//     list) for ps and "container prune" for "system prune"
+//   - run and create accept -i and -t, which nsctl doesn't need: a container
+//     gets the terminal whenever its stdin is one
+//   - image commands say that nsctl has no images, rather than "unknown
+//     command"
+
+// containerCommandAliases maps the "container" subcommands docker spells
+// differently to nsctl's commands
+var containerCommandAliases = map[string][]string{
+	"ls":    {"ps"},
+	"list":  {"ps"},
+	"prune": {"system", "prune"},
+}
+
+// resolveCommandAliases rewrites os.Args from the docker spelling of a
+// command to nsctl's
+func resolveCommandAliases() {
+	switch os.Args[1] {
+	case "container":
+		if len(os.Args) < 3 {
+			fmt.Fprintf(os.Stderr, "Usage: %s container <command> [args...]\n", os.Args[0])
+			os.Exit(1)
+		}
+		command := []string{os.Args[2]}
+		if alias, found := containerCommandAliases[os.Args[2]]; found {
+			command = alias
+		}
+		os.Args = append(append([]string{os.Args[0]}, command...), os.Args[3:]...)
+	case "image", "images", "pull", "push", "build":
+		fmt.Fprintf(os.Stderr, "nsctl has no images: containers run the host's binaries (see \"%s run\")\n", os.Args[0])
+		os.Exit(1)
+	}
+}
+
+// parseFlags parses arguments like flagSet.Parse, but also accepts
+// combined short flags
+func parseFlags(flagSet *flag.FlagSet, arguments []string) {
+	flagSet.Parse(splitShortFlags(flagSet, arguments))
+}
+
+// splitShortFlags splits combined short flags such as -dit into -d -i -t
+// Every letter but the last has to be a boolean flag; the last one may take
+// a value, from the next argument. Splitting stops where flag parsing does:
+// at "--" or the first argument that isn't a flag, so a container's own
+// arguments are never touched.
+func splitShortFlags(flagSet *flag.FlagSet, arguments []string) []string {
+	var split []string
+	for index := 0; index < len(arguments); index++ {
+		argument := arguments[index]
+		if argument == "--" || argument == "-" || !strings.HasPrefix(argument, "-") {
+			return append(split, arguments[index:]...)
+		}
+
+		name, _, hasValue := strings.Cut(strings.TrimLeft(argument, "-"), "=")
+		if defined := flagSet.Lookup(name); defined != nil || hasValue || strings.HasPrefix(argument, "--") {
+			split = append(split, argument)
+			// The value of a flag that takes one follows it
+			if defined != nil && !hasValue && !isBoolFlag(defined) && index+1 < len(arguments) {
+				index++
+				split = append(split, arguments[index])
+			}
+			continue
+		}
+
+		letters, ok := splitLetters(flagSet, name)
+		if !ok {
+			// Let flag report it
+			split = append(split, argument)
+			continue
+		}
+		split = append(split, letters...)
+		if last := flagSet.Lookup(name[len(name)-1:]); !isBoolFlag(last) && index+1 < len(arguments) {
+			index++
+			split = append(split, arguments[index])
+		}
+	}
+	return split
+}
+
+// splitLetters turns the letters of a combined short flag into flags, if
+// they all are flags and all but the last boolean ones
+func splitLetters(flagSet *flag.FlagSet, letters string) ([]string, bool) {
+	var flags []string
+	for index, letter := range letters {
+		defined := flagSet.Lookup(string(letter))
+		if defined == nil || (index < len(letters)-1 && !isBoolFlag(defined)) {
+			return nil, false
+		}
+		flags = append(flags, "-"+string(letter))
+	}
+	return flags, true
+}
+
+// isBoolFlag reports whether a flag takes no value
+func isBoolFlag(defined *flag.Flag) bool {
+	boolFlag, ok := defined.Value.(interface{ IsBoolFlag() bool })
+	return ok && boolFlag.IsBoolFlag()
+}
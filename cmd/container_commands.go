@@ -0,0 +1,348 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"nsctl/pkg/ns"
+)
+
+// handleInspectCommand prints the full record of one container as JSON
+func handleInspectCommand() {
+	if len(os.Args) < 3 {
+		fmt.Fprintf(os.Stderr, "Usage: %s inspect <container-id>\n", os.Args[0])
+		os.Exit(1)
+	}
+
+	container, err := ns.LookupContainer(os.Args[2])
+	if err != nil {
+		log.Fatalf("Failed to inspect container: %v", err)
+	}
+
+	data, err := json.MarshalIndent(container, "", "  ")
+	if err != nil {
+		log.Fatalf("Failed to encode container: %v", err)
+	}
+	fmt.Println(string(data))
+}
+
+// handleLogsCommand prints the captured output of containers,
+// merging the logs of several by time
+func handleLogsCommand() {
+	logsFlags := flag.NewFlagSet("logs", flag.ExitOnError)
+	var options ns.LogOptions
+	logsFlags.BoolVar(&options.Follow, "f", false, "Keep printing new output until the container exits")
+	logsFlags.BoolVar(&options.Follow, "follow", false, "Keep printing new output until the container exits")
+	var tail string
+	logsFlags.StringVar(&tail, "n", "all", "Print only this many lines from the end of the log")
+	logsFlags.StringVar(&tail, "tail", "all", "Print only this many lines from the end of the log")
+	since := logsFlags.String("since", "", "Print output written since a time (10m, 2006-01-02T15:04:05Z, a Unix timestamp)")
+	until := logsFlags.String("until", "", "Print output written until a time (same formats as --since)")
+	logsFlags.BoolVar(&options.Timestamps, "t", false, "Prefix each line with the time it was written")
+	logsFlags.BoolVar(&options.Timestamps, "timestamps", false, "Prefix each line with the time it was written")
+	stdoutOnly := logsFlags.Bool("stdout", false, "Print only what the container wrote to stdout")
+	stderrOnly := logsFlags.Bool("stderr", false, "Print only what the container wrote to stderr")
+	parseFlags(logsFlags, os.Args[2:])
+
+	if logsFlags.NArg() < 1 {
+		fmt.Fprintf(os.Stderr, "Usage: %s logs [-f] [-t] [--tail <n>] [--since <time>] [--until <time>] [--stdout|--stderr] <container-id>...\n", os.Args[0])
+		os.Exit(1)
+	}
+	if *stdoutOnly && *stderrOnly {
+		log.Fatalf("--stdout and --stderr cannot be used together")
+	}
+
+	var err error
+	if *since != "" {
+		if options.Since, err = parseTimeArgument(*since); err != nil {
+			log.Fatalf("Invalid --since: %v", err)
+		}
+	}
+	if *until != "" {
+		if options.Until, err = parseTimeArgument(*until); err != nil {
+			log.Fatalf("Invalid --until: %v", err)
+		}
+	}
+
+	options.Tail = -1
+	if tail != "all" {
+		lines, err := strconv.Atoi(tail)
+		if err != nil || lines < 0 {
+			log.Fatalf("Invalid --tail %q: expected a number of lines or \"all\"", tail)
+		}
+		options.Tail = lines
+	}
+
+	var containers []*ns.ContainerInfo
+	for _, idOrPrefix := range logsFlags.Args() {
+		container, err := ns.LookupContainer(idOrPrefix)
+		if err != nil {
+			log.Fatalf("Failed to read logs: %v", err)
+		}
+		containers = append(containers, container)
+	}
+
+	// A single stream, or both interleaved on a terminal, is printed on
+	// stdout; when stdout is a pipe or file, the container's stderr goes to
+	// our stderr so the two can be redirected apart
+	stderrOutput := os.Stdout
+	switch {
+	case *stdoutOnly:
+		options.Stream = ns.LogStreamStdout
+	case *stderrOnly:
+		options.Stream = ns.LogStreamStderr
+	case !ns.IsTerminal(os.Stdout):
+		stderrOutput = os.Stderr
+	}
+	if err := ns.WriteContainerLogs(containers, options, os.Stdout, stderrOutput); err != nil {
+		log.Fatalf("Failed to read logs: %v", err)
+	}
+}
+
+// handleRmCommand removes exited containers' records and files
+func handleRmCommand() {
+	rmFlags := flag.NewFlagSet("rm", flag.ExitOnError)
+	var force bool
+	rmFlags.BoolVar(&force, "f", false, "Kill the containers first if they are still running")
+	rmFlags.BoolVar(&force, "force", false, "Kill the containers first if they are still running")
+	var removeVolumes bool
+	rmFlags.BoolVar(&removeVolumes, "v", false, "Also remove the containers' anonymous volumes")
+	rmFlags.BoolVar(&removeVolumes, "volumes", false, "Also remove the containers' anonymous volumes")
+	var all bool
+	rmFlags.BoolVar(&all, "a", false, "Remove all exited containers (with --force, all containers)")
+	rmFlags.BoolVar(&all, "all", false, "Remove all exited containers (with --force, all containers)")
+	parseFlags(rmFlags, os.Args[2:])
+
+	if rmFlags.NArg() < 1 && !all || rmFlags.NArg() > 0 && all {
+		fmt.Fprintf(os.Stderr, "Usage: %s rm [-f] [-v] -a|<container-id>...\n", os.Args[0])
+		os.Exit(1)
+	}
+
+	containerIDs := rmFlags.Args()
+	if all {
+		containerIDs = allContainerIDs(func(container ns.ContainerInfo) bool {
+			return force || container.Status == ns.StatusExited
+		})
+	}
+	forEachContainer("remove", containerIDs, func(container *ns.ContainerInfo) error {
+		return ns.RemoveContainer(container.ID, force, removeVolumes)
+	})
+}
+
+// handleStopCommand stops running containers, killing those that don't
+// exit in time
+func handleStopCommand() {
+	stopFlags := flag.NewFlagSet("stop", flag.ExitOnError)
+	var timeout time.Duration
+	stopFlags.DurationVar(&timeout, "t", ns.DefaultStopTimeout, "How long to wait after SIGTERM before sending SIGKILL")
+	stopFlags.DurationVar(&timeout, "time", ns.DefaultStopTimeout, "How long to wait after SIGTERM before sending SIGKILL")
+	var all bool
+	stopFlags.BoolVar(&all, "a", false, "Stop all running and created containers")
+	stopFlags.BoolVar(&all, "all", false, "Stop all running and created containers")
+	parseFlags(stopFlags, os.Args[2:])
+
+	if stopFlags.NArg() < 1 && !all || stopFlags.NArg() > 0 && all {
+		fmt.Fprintf(os.Stderr, "Usage: %s stop [-t <duration>] -a|<container-id>...\n", os.Args[0])
+		os.Exit(1)
+	}
+
+	containerIDs := stopFlags.Args()
+	if all {
+		containerIDs = allContainerIDs(func(container ns.ContainerInfo) bool {
+			return container.Status != ns.StatusExited
+		})
+	}
+	forEachContainer("stop", containerIDs, func(container *ns.ContainerInfo) error {
+		return ns.StopContainer(container.ID, timeout)
+	})
+}
+
+// handleKillCommand sends a signal to running containers
+func handleKillCommand() {
+	killFlags := flag.NewFlagSet("kill", flag.ExitOnError)
+	var signalName string
+	killFlags.StringVar(&signalName, "s", "KILL", "Signal to send, by name (TERM, SIGHUP) or number")
+	killFlags.StringVar(&signalName, "signal", "KILL", "Signal to send, by name (TERM, SIGHUP) or number")
+	parseFlags(killFlags, os.Args[2:])
+
+	if killFlags.NArg() < 1 {
+		fmt.Fprintf(os.Stderr, "Usage: %s kill [-s <signal>] <container-id>...\n", os.Args[0])
+		os.Exit(1)
+	}
+	signal, err := ns.ParseSignal(signalName)
+	if err != nil {
+		log.Fatalf("Invalid --signal: %v", err)
+	}
+
+	forEachContainer("kill", killFlags.Args(), func(container *ns.ContainerInfo) error {
+		return ns.KillContainer(container.ID, signal)
+	})
+}
+
+// handleWaitCommand blocks until containers meet a condition, by default
+// until they exit, printing each one's exit code
+func handleWaitCommand() {
+	waitFlags := flag.NewFlagSet("wait", flag.ExitOnError)
+	condition := waitFlags.String("condition", ns.WaitExited, "Condition to wait for: exited, running, healthy or removed")
+	timeout := waitFlags.Duration("timeout", 0, "Give up after this long, for all the containers (0 waits forever)")
+	parseFlags(waitFlags, os.Args[2:])
+
+	if waitFlags.NArg() < 1 {
+		fmt.Fprintf(os.Stderr, "Usage: %s wait [--condition exited|running|healthy|removed] [--timeout <duration>] <container-id>...\n", os.Args[0])
+		os.Exit(1)
+	}
+
+	// Look all the containers up first: once removed, they can't be
+	containers := make([]*ns.ContainerInfo, 0, waitFlags.NArg())
+	for _, idOrPrefix := range waitFlags.Args() {
+		container, err := ns.LookupContainer(idOrPrefix)
+		if err != nil {
+			log.Fatalf("Failed to wait for container: %v", err)
+		}
+		containers = append(containers, container)
+	}
+
+	var deadline time.Time
+	if *timeout > 0 {
+		deadline = time.Now().Add(*timeout)
+	}
+	for _, container := range containers {
+		remaining := time.Duration(0)
+		if !deadline.IsZero() {
+			// Never 0, which would wait forever
+			remaining = max(time.Until(deadline), time.Nanosecond)
+		}
+		waited, err := ns.WaitForContainer(container.ID, *condition, remaining)
+		if err != nil {
+			log.Fatalf("Failed to wait for container %s: %v", ns.ShortID(container.ID), err)
+		}
+		if *condition == ns.WaitExited {
+			fmt.Println(waited.ExitCode)
+		}
+	}
+}
+
+// handleEnterCommand runs a command, by default the user's shell, in the
+// namespaces of a running container
+func handleEnterCommand() {
+	arguments := os.Args[2:]
+	if len(arguments) > 0 && arguments[0] == "--" {
+		arguments = arguments[1:]
+	}
+	if len(arguments) < 1 {
+		fmt.Fprintf(os.Stderr, "Usage: %s enter <container-id> [uts|ipc|net|pid|cgroup|mnt...] [-- <command> [args...]]\n", os.Args[0])
+		os.Exit(1)
+	}
+
+	containerID, namespaces := arguments[0], arguments[1:]
+	var command []string
+	for index, argument := range namespaces {
+		if argument == "--" {
+			namespaces, command = namespaces[:index], namespaces[index+1:]
+			break
+		}
+	}
+	if len(command) == 0 {
+		shell := os.Getenv("SHELL")
+		if shell == "" {
+			shell = "/bin/sh"
+		}
+		command = []string{shell}
+	}
+
+	exitCode, err := ns.EnterContainer(containerID, namespaces, command[0], command[1:])
+	if err != nil {
+		log.Fatalf("Failed to enter container: %v", err)
+	}
+	os.Exit(exitCode)
+}
+
+// handleAdoptCommand registers containers created by runc or crun, so nsctl
+// can manage them
+func handleAdoptCommand() {
+	if len(os.Args) < 3 {
+		fmt.Fprintf(os.Stderr, "Usage: %s adopt <runc-id>|<state-file>...\n", os.Args[0])
+		os.Exit(1)
+	}
+
+	failed := false
+	for _, source := range os.Args[2:] {
+		container, err := ns.AdoptContainer(source)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to adopt %s: %v\n", source, err)
+			failed = true
+			continue
+		}
+		fmt.Println(container.ID)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// allContainerIDs returns the full IDs of the containers that match, for
+// the --all of bulk commands
+func allContainerIDs(match func(container ns.ContainerInfo) bool) []string {
+	containers, err := ns.ListContainers()
+	if err != nil {
+		log.Fatalf("Failed to list containers: %v", err)
+	}
+	var containerIDs []string
+	for _, container := range containers {
+		if match(container) {
+			containerIDs = append(containerIDs, container.ID)
+		}
+	}
+	return containerIDs
+}
+
+// bulkWorkers is how many containers a bulk command works on at once
+const bulkWorkers = 8
+
+// forEachContainer runs an operation on the named containers, several at a
+// time, printing the ID of each container it succeeded on and the error of
+// each it failed on; it exits 1 if any failed
+func forEachContainer(action string, idsOrPrefixes []string, operation func(container *ns.ContainerInfo) error) {
+	var (
+		mu     sync.Mutex
+		failed bool
+	)
+	work := make(chan string)
+	var workers sync.WaitGroup
+	for range min(bulkWorkers, len(idsOrPrefixes)) {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for idOrPrefix := range work {
+				container, err := ns.LookupContainer(idOrPrefix)
+				if err == nil {
+					err = operation(container)
+				}
+
+				mu.Lock()
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Failed to %s %s: %v\n", action, idOrPrefix, err)
+					failed = true
+				} else {
+					fmt.Println(container.ID)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, idOrPrefix := range idsOrPrefixes {
+		work <- idOrPrefix
+	}
+	close(work)
+	workers.Wait()
+
+	if failed {
+		os.Exit(1)
+	}
+}
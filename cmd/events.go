@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"time"
+
+	"nsctl/pkg/ns"
+)
+
+// handleEventsCommand streams container events as they happen, after
+// replaying past ones with --since or --after-seq
+func handleEventsCommand() {
+	eventsFlags := flag.NewFlagSet("events", flag.ExitOnError)
+	jsonOutput := eventsFlags.Bool("json", false, "Print each event as a JSON object")
+	since := eventsFlags.String("since", "", "Replay events since a time (2h, 2006-01-02T15:04:05Z, a Unix timestamp), then follow")
+	until := eventsFlags.String("until", "", "Stop at a time (same formats as --since)")
+	afterSequence := eventsFlags.Uint64("after-seq", 0, "Replay events after this sequence number, then follow")
+	parseFlags(eventsFlags, os.Args[2:])
+
+	var filter ns.EventFilter
+	filter.AfterSequence = *afterSequence
+	var err error
+	if *since != "" {
+		if filter.Since, err = parseTimeArgument(*since); err != nil {
+			log.Fatalf("Invalid --since: %v", err)
+		}
+	}
+	if *until != "" {
+		if filter.Until, err = parseTimeArgument(*until); err != nil {
+			log.Fatalf("Invalid --until: %v", err)
+		}
+	}
+
+	err = ns.StreamEvents(filter, func(event ns.Event) {
+		if *jsonOutput {
+			data, _ := json.Marshal(event)
+			fmt.Println(string(data))
+			return
+		}
+		fmt.Println(event)
+	})
+	if err != nil {
+		log.Fatalf("Failed to follow events: %v", err)
+	}
+}
+
+// parseTimeArgument parses a point in time given on the command line: a
+// duration before now (10m, 2h), an RFC 3339 time, a local date and time
+// (2006-01-02T15:04:05 or 2006-01-02) or a Unix timestamp
+func parseTimeArgument(value string) (time.Time, error) {
+	if duration, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-duration), nil
+	}
+	if timestamp, err := strconv.ParseFloat(value, 64); err == nil {
+		seconds, fraction := math.Modf(timestamp)
+		return time.Unix(int64(seconds), int64(fraction*1e9)), nil
+	}
+	if parsed, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return parsed, nil
+	}
+	for _, layout := range []string{"2006-01-02T15:04:05", "2006-01-02"} {
+		if parsed, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return parsed, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q is neither a duration (2h), a time (2006-01-02T15:04:05Z) nor a Unix timestamp", value)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"os"
@@ -16,18 +17,103 @@ func main() {
 		return
 	}
 
+	// Special case: we're the per-container shim started by "run", or the
+	// short-lived intermediate process that daemonizes a detached shim
+	if isShimCall() {
+		handleShim()
+	}
+
+	// Special case: we're the test binary of "selftest", inside its container
+	if len(os.Args) == 3 && os.Args[1] == ns.SelftestProbeCommand {
+		os.Exit(ns.RunSelftestProbe(os.Args[2]))
+	}
+
+	// Special case: we're the infra container of a pod, holding its namespaces
+	if len(os.Args) == 2 && os.Args[1] == ns.PodInfraCommand {
+		os.Exit(ns.RunPodInfra())
+	}
+
+	// Global options come before the command; a remote host gets the
+	// others passed on
+	host := os.Getenv(hostEnvVar)
+	var remoteOptions []string
+	for len(os.Args) > 1 && (os.Args[1] == "--offline" || os.Args[1] == "--no-color" || os.Args[1] == "--host") {
+		switch os.Args[1] {
+		case "--offline":
+			ns.SetOffline()
+			remoteOptions = append(remoteOptions, os.Args[1])
+		case "--no-color":
+			ns.SetNoColor()
+			remoteOptions = append(remoteOptions, os.Args[1])
+		case "--host":
+			if len(os.Args) < 3 {
+				log.Fatalf("--host needs a value: ssh://[user@]server")
+			}
+			host = os.Args[2]
+			os.Args = append(os.Args[:1], os.Args[2:]...)
+		}
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+	if host != "" {
+		runRemote(host, append(remoteOptions, os.Args[1:]...))
+	}
+
 	// Normal execution: parse user commands
 	if len(os.Args) < 2 {
 		showUsage()
 		os.Exit(1)
 	}
 
+	resolveCommandAliases()
+
 	command := os.Args[1]
 	switch command {
 	case "run":
 		handleRunCommand()
+	case "create":
+		handleCreateCommand()
+	case "start":
+		handleStartCommand()
+	case "spec":
+		handleSpecCommand()
 	case "ps":
 		handlePsCommand()
+	case "inspect":
+		handleInspectCommand()
+	case "stats":
+		handleStatsCommand()
+	case "enter":
+		handleEnterCommand()
+	case "adopt":
+		handleAdoptCommand()
+	case "logs":
+		handleLogsCommand()
+	case "stop":
+		handleStopCommand()
+	case "kill":
+		handleKillCommand()
+	case "wait":
+		handleWaitCommand()
+	case "rm":
+		handleRmCommand()
+	case "events":
+		handleEventsCommand()
+	case "schedule":
+		handleScheduleCommand()
+	case "daemon":
+		handleDaemonCommand()
+	case "system":
+		handleSystemCommand()
+	case "state":
+		handleStateCommand()
+	case "check":
+		handleCheckCommand()
+	case "selftest":
+		handleSelftestCommand()
+	case "volume":
+		handleVolumeCommand()
+	case "pod":
+		handlePodCommand()
 	default:
 		fmt.Printf("Unknown command: %s\n", command)
 		showUsage()
@@ -40,48 +126,74 @@ func isNamespaceSetupCall() bool {
 	return len(os.Args) >= 3 && os.Args[1] == "setup-and-exec"
 }
 
-// handleNamespaceSetup processes the internal namespace setup call
-func handleNamespaceSetup() {
-	targetCmd := os.Args[2]
-	targetArgs := os.Args[3:]
-
-	if err := ns.HandleSetupAndExec(targetCmd, targetArgs); err != nil {
-		log.Fatalf("Failed to setup namespace: %v", err)
-	}
+// isShimCall checks if we're being called as a container's shim process
+func isShimCall() bool {
+	return len(os.Args) >= 3 && os.Args[1] == "shim"
 }
 
-// handleRunCommand processes the "run" command to start a container
-func handleRunCommand() {
-	if len(os.Args) < 3 {
-		fmt.Printf("Missing command to run\n")
-		fmt.Printf("Usage: %s run <command> [args...]\n", os.Args[0])
-		os.Exit(1)
+// handleShim runs "shim <id>" or "shim --daemonize <id>" and exits
+func handleShim() {
+	if len(os.Args) == 4 && os.Args[2] == "--daemonize" {
+		if err := ns.DaemonizeShim(os.Args[0], os.Args[3]); err != nil {
+			log.Fatalf("Failed to daemonize shim: %v", err)
+		}
+		os.Exit(0)
 	}
+	os.Exit(ns.RunShim(os.Args[0], os.Args[2]))
+}
 
+// handleNamespaceSetup processes the internal namespace setup call
+func handleNamespaceSetup() {
 	targetCmd := os.Args[2]
 	targetArgs := os.Args[3:]
 
-	fmt.Printf("[nsctl] Starting container with command: %s %v\n", targetCmd, targetArgs)
-
-	// Use current executable path for re-execution
-	execPath := os.Args[0]
-
-	// Create isolated environment and run the command
-	if err := ns.RunWithSetup(execPath, targetCmd, targetArgs); err != nil {
-		log.Fatalf("Container failed: %v", err)
+	if err := ns.HandleSetupAndExec(targetCmd, targetArgs); err != nil {
+		log.Fatalf("Failed to setup namespace: %v", err)
 	}
 }
 
 // handlePsCommand processes the "ps" command to list containers
 func handlePsCommand() {
-	fmt.Printf("[nsctl] Listing containers...\n")
+	psFlags := flag.NewFlagSet("ps", flag.ExitOnError)
+	var quiet bool
+	psFlags.BoolVar(&quiet, "q", false, "Only print container IDs, one per line")
+	psFlags.BoolVar(&quiet, "quiet", false, "Only print container IDs, one per line")
+	var showAll bool
+	psFlags.BoolVar(&showAll, "a", false, "Show all containers, including exited ones")
+	psFlags.BoolVar(&showAll, "all", false, "Show all containers, including exited ones")
+	var last int
+	psFlags.IntVar(&last, "n", 0, "Show the n most recently created containers, including exited ones")
+	psFlags.IntVar(&last, "last", 0, "Show the n most recently created containers, including exited ones")
+	offset := psFlags.Int("offset", 0, "Skip the n most recently created containers, for paging with -n")
+	var latest bool
+	psFlags.BoolVar(&latest, "l", false, "Show the most recently created container")
+	psFlags.BoolVar(&latest, "latest", false, "Show the most recently created container")
+	parseFlags(psFlags, os.Args[2:])
+	if latest {
+		last = 1
+	}
+
+	// Root and every other user have stores of their own, so say whose
+	// containers these are
+	fmt.Fprintf(os.Stderr, "[nsctl] Listing containers of the %s\n", ns.CurrentStore())
 
-	containers, err := ns.ListContainers()
+	// --last and --latest show the newest containers, including exited
+	// ones, which are otherwise kept until removed but only shown with -a
+	containers, _, err := ns.ListContainersPage(ns.ListOptions{All: showAll || last > 0, Offset: *offset, Limit: last})
 	if err != nil {
 		log.Fatalf("Failed to list containers: %v", err)
 	}
 
-	fmt.Print(ns.FormatContainerTable(containers))
+	// Quiet mode is meant for pipelines such as `nsctl stop $(nsctl ps -q)`,
+	// so print the full IDs and nothing else
+	if quiet {
+		for _, container := range containers {
+			fmt.Println(container.ID)
+		}
+		return
+	}
+
+	fmt.Print(ns.FormatContainerTable(containers, ns.StdoutTableStyle()))
 }
 
 // showUsage displays help information
@@ -89,7 +201,63 @@ func showUsage() {
 	fmt.Printf("[nsctl] Minimal Container Runtime\n\n")
 	fmt.Printf("Usage:\n")
 	fmt.Printf("  %s run <command> [args...]  # Run command in isolated container\n", os.Args[0])
+	fmt.Printf("  %s run -d <command> [args...] # Run in the background, print container ID\n", os.Args[0])
+	fmt.Printf("  %s run --dry-run <command> [args...] # Print what a run would do without starting anything\n", os.Args[0])
+	fmt.Printf("  %s run --trace-setup <command> [args...] # Log each setup step and syscall with its duration\n", os.Args[0])
+	fmt.Printf("  %s run --pressure-alert memory=150ms/1s <command> [args...] # Emit memory-pressure events when tasks stall on memory (cgroup v2)\n", os.Args[0])
+	fmt.Printf("  %s run --on-memory-event oom_kill=restart <command> [args...] # React to memory events: event, restart or hook:<path>\n", os.Args[0])
+	fmt.Printf("  %s run --tz Europe/Berlin <command> [args...] # Run with TZ and /etc/localtime of a zone (default: the host's)\n", os.Args[0])
+	fmt.Printf("  %s run -d --health-type http --health-target :8080/healthz <command> [args...] # Probe the container's health over http or tcp\n", os.Args[0])
+	fmt.Printf("  %s run --privileged <command> [args...] # Run with full access: all capabilities and devices, writable /sys and cgroup\n", os.Args[0])
+	fmt.Printf("  %s run --rootfs <dir> <command> [args...] # Run with a directory, e.g. an unpacked image, as the root filesystem\n", os.Args[0])
+	fmt.Printf("  %s run --read-only <command> [args...] # Make the root filesystem read-only, with tmpfs on /tmp and /run\n", os.Args[0])
+	fmt.Printf("  %s run --tmpfs /run:size=64m,mode=755 <command> [args...] # Mount a tmpfs scratch directory (repeatable)\n", os.Args[0])
+	fmt.Printf("  %s run --network none <command> [args...] # Only a loopback interface; host shares the host's network, bridge is the default\n", os.Args[0])
+	fmt.Printf("  %s run --net=false --pid <command> [args...] # Pick namespaces: --uts, --pid, --mnt, --net, --ipc, --cgroupns (=false shares the host's)\n", os.Args[0])
+	fmt.Printf("  %s run --pid=container:<id> --net=container:<id> <command> [args...] # Share a running container's processes and network\n", os.Args[0])
+	fmt.Printf("  %s run --ipc=false <command> [args...] # Share the host's SysV IPC and POSIX message queues\n", os.Args[0])
+	fmt.Printf("  %s run --cgroupns=false <command> [args...] # Show the container its cgroup's path on the host\n", os.Args[0])
+	fmt.Printf("  %s run --time-offset boottime=200d <command> [args...] # Shift the container's uptime in a time namespace\n", os.Args[0])
+	fmt.Printf("  %s run --keyring host <command> [args...] # Share nsctl's session keyring instead of giving the container its own\n", os.Args[0])
+	fmt.Printf("  %s run --sysfs none <command> [args...] # Give the container no /sys (bind: the host's, read-only, without mounting sysfs)\n", os.Args[0])
+	fmt.Printf("  %s run --isolation auto --rootfs <dir> <command> [args...] # Fall back to a chroot into the rootfs where the host forbids namespaces\n", os.Args[0])
+	fmt.Printf("  %s create <command> [args...] # Prepare a container without starting it\n", os.Args[0])
+	fmt.Printf("  %s start <id>               # Start a created container\n", os.Args[0])
+	fmt.Printf("  %s spec [--bundle <dir>] <command> [args...] # Print the equivalent OCI config.json\n", os.Args[0])
 	fmt.Printf("  %s ps                       # List running containers\n", os.Args[0])
+	fmt.Printf("  %s ps -a                    # Include exited containers\n", os.Args[0])
+	fmt.Printf("  %s ps -q                    # List only container IDs\n", os.Args[0])
+	fmt.Printf("  %s ps -n <n> | -l           # The n most recently created containers, or the newest\n", os.Args[0])
+	fmt.Printf("  %s ps -n <n> --offset <m>   # A page of n containers, after the m newest\n", os.Args[0])
+	fmt.Printf("  %s inspect <id>             # Show a container's full record\n", os.Args[0])
+	fmt.Printf("  %s enter <id> [uts|ipc|net|pid|cgroup|mnt...] [-- <command> [args...]] # Run a shell or command in a container's namespaces\n", os.Args[0])
+	fmt.Printf("  %s stats [--json] [<id>...] # Show CPU, memory, I/O, process counts and memory pressure of running containers\n", os.Args[0])
+	fmt.Printf("  %s adopt <runc-id>|<state-file>... # Manage containers created by runc or crun\n", os.Args[0])
+	fmt.Printf("  %s logs [-f] [-t] [--tail <n>] [--since <time>] [--until <time>] [--stdout|--stderr] <id>... # Show output of containers\n", os.Args[0])
+	fmt.Printf("  %s stop [-t <duration>] -a|<id>... # Stop (all) containers: SIGTERM, then SIGKILL after 10s\n", os.Args[0])
+	fmt.Printf("  %s kill [-s <signal>] <id>... # Send a signal (default KILL) to containers\n", os.Args[0])
+	fmt.Printf("  %s wait [--condition exited|running|healthy|removed] [--timeout <duration>] <id>... # Wait for containers to exit (printing their exit codes), start, pass their health check or be removed\n", os.Args[0])
+	fmt.Printf("  %s rm [-f] [-v] -a|<id>...  # Remove (all) exited containers (-v: and their anonymous volumes)\n", os.Args[0])
+	fmt.Printf("  %s events [--json] [--since <time>] [--until <time>] [--after-seq <n>] # Replay and stream container events\n", os.Args[0])
+	fmt.Printf("  %s schedule create --cron <expr> <command> [args...] # Run a command on a schedule\n", os.Args[0])
+	fmt.Printf("  %s schedule ls|history <id>|rm <id> # Manage schedules\n", os.Args[0])
+	fmt.Printf("  %s daemon                   # Run the scheduler\n", os.Args[0])
+	fmt.Printf("  %s system info              # Show runtime-wide information\n", os.Args[0])
+	fmt.Printf("  %s system df [-v]           # Show disk usage\n", os.Args[0])
+	fmt.Printf("  %s system prune [-f] [--volumes] # Remove stopped containers (and unused volumes)\n", os.Args[0])
+	fmt.Printf("  %s system binfmt [--install] # Show or register emulators for foreign architectures\n", os.Args[0])
+	fmt.Printf("  %s state fsck [--repair]    # Check container records against processes, cgroups and mounts\n", os.Args[0])
+	fmt.Printf("  %s check [--json]           # Diagnose kernel and host features, with fixes\n", os.Args[0])
+	fmt.Printf("  %s selftest [--json]        # Run a test container and check its isolation\n", os.Args[0])
+	fmt.Printf("  %s volume create|ls|inspect|rm|prune|export|import # Manage volumes\n", os.Args[0])
+	fmt.Printf("  %s pod create [--hostname <name>] [--network <mode>] # Create a pod: containers sharing a hostname, IPC and network\n", os.Args[0])
+	fmt.Printf("  %s pod run <pod-id> [run options] <command> [args...] # Run a container in a pod (= run --pod <pod-id>)\n", os.Args[0])
+	fmt.Printf("  %s pod ps|rm [-f] <pod-id>... # List or remove pods with their containers\n", os.Args[0])
+	fmt.Printf("  %s container <command> ...  # Docker spelling of the commands above (container ls = ps)\n", os.Args[0])
+	fmt.Printf("\nGlobal options (before the command):\n")
+	fmt.Printf("  --offline                    # Never use the network (also NSCTL_OFFLINE=1)\n")
+	fmt.Printf("  --no-color                   # Print tables without colors (also NO_COLOR=1)\n")
+	fmt.Printf("  --host ssh://[user@]server   # Run the command on another host over SSH (also NSCTL_HOST)\n")
 	fmt.Printf("\nExamples:\n")
 	fmt.Printf("  %s run /bin/bash           # Start isolated bash shell\n", os.Args[0])
 	fmt.Printf("  %s run ls -la              # Run ls command in container\n", os.Args[0])
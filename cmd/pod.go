@@ -0,0 +1,118 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+
+	"nsctl/pkg/ns"
+)
+
+// handlePodCommand dispatches the "pod" subcommands
+func handlePodCommand() {
+	if len(os.Args) < 3 {
+		showPodUsage()
+		os.Exit(1)
+	}
+
+	switch os.Args[2] {
+	case "create":
+		handlePodCreate()
+	case "run":
+		handlePodRun()
+	case "ps", "ls", "list":
+		handlePodList()
+	case "rm":
+		handlePodRemove()
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown pod command: %s\n", os.Args[2])
+		showPodUsage()
+		os.Exit(1)
+	}
+}
+
+// showPodUsage lists the pod subcommands
+func showPodUsage() {
+	fmt.Fprintf(os.Stderr, "Usage:\n")
+	fmt.Fprintf(os.Stderr, "  %s pod create [--hostname <name>] [--network bridge|host|none]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s pod run <pod-id> [run options] <command> [args...]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s pod ps\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s pod rm [-f] <pod-id>...\n", os.Args[0])
+}
+
+// handlePodCreate starts a pod's infra container and prints the pod's ID
+func handlePodCreate() {
+	createFlags := flag.NewFlagSet("pod create", flag.ExitOnError)
+	var podConfig ns.PodConfig
+	createFlags.StringVar(&podConfig.Hostname, "hostname", "", "Hostname of the pod's containers (default: the short pod ID)")
+	createFlags.StringVar(&podConfig.Network, "network", "", "Network of the pod: bridge, host or none (default: bridge)")
+	parseFlags(createFlags, os.Args[3:])
+	if createFlags.NArg() > 0 {
+		showPodUsage()
+		os.Exit(1)
+	}
+
+	podID, err := ns.CreatePod(os.Args[0], podConfig)
+	if err != nil {
+		log.Fatalf("Failed to create pod: %v", err)
+	}
+	fmt.Println(podID)
+}
+
+// handlePodRun runs a container in a pod: "pod run <pod-id> ..." is
+// "run --pod <pod-id> ..."
+func handlePodRun() {
+	if len(os.Args) < 5 {
+		showPodUsage()
+		os.Exit(1)
+	}
+	os.Args = append([]string{os.Args[0], "run", "--pod", os.Args[3]}, os.Args[4:]...)
+	handleRunCommand()
+}
+
+// handlePodList prints all pods
+func handlePodList() {
+	pods, err := ns.ListPods()
+	if err != nil {
+		log.Fatalf("Failed to list pods: %v", err)
+	}
+	if len(pods) == 0 {
+		fmt.Printf("No pods found.\n")
+		return
+	}
+
+	table := ns.NewTable("POD ID", "HOSTNAME", "STATUS", "CONTAINERS", "INFRA ID", "CREATED")
+	for _, pod := range pods {
+		table.AddRow(ns.ShortID(pod.ID), pod.Hostname, pod.Status, strconv.Itoa(pod.Containers), ns.ShortID(pod.InfraID), pod.Created.Format("2006-01-02 15:04:05"))
+	}
+	fmt.Print(table.Render(ns.StdoutTableStyle()))
+}
+
+// handlePodRemove removes pods with their containers
+func handlePodRemove() {
+	rmFlags := flag.NewFlagSet("pod rm", flag.ExitOnError)
+	var force bool
+	rmFlags.BoolVar(&force, "f", false, "Kill the pods' running containers first")
+	rmFlags.BoolVar(&force, "force", false, "Kill the pods' running containers first")
+	parseFlags(rmFlags, os.Args[3:])
+	if rmFlags.NArg() < 1 {
+		showPodUsage()
+		os.Exit(1)
+	}
+
+	failed := false
+	for _, idOrPrefix := range rmFlags.Args() {
+		podID, err := ns.RemovePod(idOrPrefix, force)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to remove pod %s: %v\n", idOrPrefix, err)
+			failed = true
+			continue
+		}
+		fmt.Println(podID)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
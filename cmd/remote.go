@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+
+	"nsctl/pkg/ns"
+)
+
+// Remote hosts (NSCTL_HOST=ssh://user@server, or --host)
+//
+// nsctl has no daemon or control socket to connect to: every command works
+// on the state directory of the host it runs on. To manage another host,
+// the CLI runs itself there over SSH, passing the command line, the
+// terminal (for interactive containers and colors) and the exit code
+// through, much like docker's ssh:// hosts. The remote nsctl is "nsctl" in
+// the remote PATH, or the URL's path: ssh://me@server:2222/opt/bin/nsctl.
+// SSH keys, agents and ~/.ssh/config apply as usual.
+//
+// Paths in the command line, such as -v sources or volume export files,
+// are the remote host's. Offline mode refuses remote hosts.
+
+// hostEnvVar names the remote host to manage, like --host
+const hostEnvVar = "NSCTL_HOST"
+
+// runRemote runs the nsctl command line arguments (global options
+// included) on host and exits with its exit code
+func runRemote(host string, arguments []string) {
+	target, err := url.Parse(host)
+	if err != nil || target.Scheme != "ssh" || target.Hostname() == "" {
+		log.Fatalf("Invalid host %q: expected ssh://[user@]server[:port][/path/to/nsctl]", host)
+	}
+	if err := ns.CheckOnline("--host"); err != nil {
+		log.Fatalf("Not connecting to %s: %v", target.Hostname(), err)
+	}
+
+	sshArgs := []string{"-T"}
+	// A terminal on our side gets one on the other side too
+	if ns.IsTerminal(os.Stdin) && ns.IsTerminal(os.Stdout) {
+		sshArgs = []string{"-t"}
+	}
+	if target.Port() != "" {
+		sshArgs = append(sshArgs, "-p", target.Port())
+	}
+	destination := target.Hostname()
+	if target.User != nil {
+		destination = target.User.Username() + "@" + destination
+	}
+
+	remoteCommand := "nsctl"
+	if target.Path != "" && target.Path != "/" {
+		remoteCommand = target.Path
+	}
+	quoted := []string{shellQuote(remoteCommand)}
+	for _, argument := range arguments {
+		quoted = append(quoted, shellQuote(argument))
+	}
+	sshArgs = append(sshArgs, destination, "--", strings.Join(quoted, " "))
+
+	ssh := exec.Command("ssh", sshArgs...)
+	ssh.Stdin = os.Stdin
+	ssh.Stdout = os.Stdout
+	ssh.Stderr = os.Stderr
+	if err := ssh.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			os.Exit(exitErr.ExitCode())
+		}
+		log.Fatalf("Failed to reach %s: %v", target.Hostname(), err)
+	}
+	os.Exit(0)
+}
+
+// shellQuote quotes an argument for the remote shell ssh runs commands with
+func shellQuote(argument string) string {
+	if argument != "" && strings.Trim(argument, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./:=,@%+") == "" {
+		return argument
+	}
+	return "'" + strings.ReplaceAll(argument, "'", `'\''`) + "'"
+}
@@ -0,0 +1,498 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"nsctl/pkg/cgroup"
+	"nsctl/pkg/ns"
+)
+
+// newContainerFlagSet declares the options shared by "run", "create" and
+// "schedule create", storing their values in config
+func newContainerFlagSet(commandName string, config *ns.ContainerConfig) *flag.FlagSet {
+	containerFlags := flag.NewFlagSet(commandName, flag.ExitOnError)
+
+	containerFlags.BoolVar(&config.PreserveEnv, "preserve-env", false, "Pass the full host environment into the container")
+	containerFlags.BoolVar(&config.PreserveEnv, "env-host", false, "Alias for --preserve-env")
+	containerFlags.BoolVar(&config.NoProxy, "no-proxy", false, "Don't pass the proxy settings of the runtime config (or, with --preserve-env, of the host) into the container")
+	containerFlags.StringVar(&config.User, "u", "", "User to run as: name|uid[:group|gid] from the container's /etc/passwd")
+	containerFlags.StringVar(&config.User, "user", "", "User to run as: name|uid[:group|gid] from the container's /etc/passwd")
+	containerFlags.Var((*stringListFlag)(&config.GroupAdd), "group-add", "Additional group to run with: name from the container's /etc/group or GID (repeatable)")
+	containerFlags.StringVar(&config.Rootfs, "rootfs", "", "Directory to use as the container's root filesystem, e.g. an unpacked image, which it must have a /proc directory in (default: the host's /)")
+	containerFlags.BoolVar(&config.ReadOnly, "read-only", false, "Make the container's root filesystem read-only, with writable tmpfs mounts on /tmp and /run unless they are mounted otherwise")
+	containerFlags.Var(&volumeFlag{mounts: &config.Mounts}, "v", "Bind-mount a host path or volume, /host/path|volume:/container/path[:ro,noexec,nosuid,nodev,z|Z,rslave,...], or /container/path for an anonymous volume (repeatable)")
+	containerFlags.Var(&volumeFlag{mounts: &config.Mounts}, "volume", "Bind-mount a host path or volume, /host/path|volume:/container/path[:ro,noexec,nosuid,nodev,z|Z,rslave,...], or /container/path for an anonymous volume (repeatable)")
+	containerFlags.Var(&mountFlag{mounts: &config.Mounts}, "mount", "Mount a host path, volume or tmpfs, e.g. type=bind,src=/a,dst=/b,ro,noexec,bind-propagation=rslave,relabel=private,create=true or type=tmpfs,dst=/scratch,tmpfs-size=1g (repeatable)")
+	containerFlags.Var(&tmpfsFlag{mounts: &config.Mounts}, "tmpfs", "Mount a tmpfs, /container/path[:size=64m,mode=1777,ro,noexec,nosuid,nodev] (repeatable; always nosuid,nodev; default size: half the RAM, mode: 1777)")
+	containerFlags.BoolVar(&config.Privileged, "privileged", false, "Give the container every capability, all host devices, a writable unmasked /sys and cgroup, and mounts anywhere")
+	containerFlags.Var(&annotationFlag{annotations: &config.Annotations}, "annotation", "Add key=value metadata to the container's record and OCI spec (repeatable)")
+	containerFlags.Var(&platformFlag{platform: &config.Platform}, "platform", "Platform the command is built for, os/arch[/variant], e.g. linux/arm64; a foreign one runs emulated (default: the host's)")
+	containerFlags.StringVar(&config.Hostname, "hostname", "", "Container hostname (default: the short container ID)")
+	containerFlags.StringVar(&config.Timezone, "tz", "", "Timezone of the container's TZ and /etc/localtime, a zone of the host's zoneinfo, e.g. Europe/Berlin (default: the host's /etc/localtime)")
+	containerFlags.BoolVar(&config.AutoRemove, "rm", false, "Remove the container once it exits")
+	containerFlags.DurationVar(&config.Timeout, "timeout", 0, "Stop the container after this long (SIGTERM, then SIGKILL), e.g. 300s")
+	containerFlags.StringVar(&config.HealthCheck.Type, "health-type", "", "Probe the container's health from its network namespace: http (a 2xx or 3xx answer to a GET) or tcp (an accepted connection)")
+	containerFlags.StringVar(&config.HealthCheck.Target, "health-target", "", "What the health check probes, [host]:port[/path], e.g. :8080/healthz (host default: 127.0.0.1)")
+	containerFlags.DurationVar(&config.HealthCheck.Interval, "health-interval", 0, "Time between health checks (default: 30s)")
+	containerFlags.DurationVar(&config.HealthCheck.Timeout, "health-timeout", 0, "Time a health check may take before it counts as failed (default: 5s)")
+	containerFlags.IntVar(&config.HealthCheck.Retries, "health-retries", 0, "Failed health checks in a row that make the container unhealthy (default: 3)")
+	containerFlags.DurationVar(&config.HealthCheck.StartPeriod, "health-start-period", 0, "Time after the start in which failed health checks don't count")
+	containerFlags.Var(&restartFlag{policy: &config.Restart}, "restart", "Restart the container when it exits: no, on-failure[:max] or always (default: no)")
+	containerFlags.StringVar(&config.Memory, "m", "", "Memory limit, e.g. 512m")
+	containerFlags.StringVar(&config.Memory, "memory", "", "Memory limit, e.g. 512m")
+	containerFlags.Float64Var(&config.CPUs, "cpus", 0, "Number of CPUs the container may use, e.g. 1.5")
+	containerFlags.Var(&pressureAlertFlag{triggers: &config.PressureAlerts}, "pressure-alert", "Emit a <resource>-pressure event when the container's tasks stall this long within a window, cpu|memory|io=[some:|full:]<stall>/<window>, e.g. memory=150ms/1s (repeatable; cgroup v2 only)")
+	containerFlags.Var(&memoryEventFlag{actions: &config.MemoryEventActions}, "on-memory-event", "React to the container's memory events, [local:]high|max|oom|oom_kill=event|restart|hook:<path>, e.g. oom_kill=restart (repeatable; high, max and local: need cgroup v2)")
+	containerFlags.StringVar(&config.Network, "network", "", "Network: bridge (own namespace on the nsctl0 bridge, with NAT), host (share the host's), none (only loopback) or container:<id> (share another container's) (default: bridge, host for rootless and chroot containers)")
+	containerFlags.Var(&namespaceFlag{mode: &config.UTSNamespace, joinable: true}, "uts", "UTS namespace of the container's own, for its hostname; --uts=false shares the host's, --uts=container:<id> another container's (default: true)")
+	containerFlags.Var(&namespaceFlag{mode: &config.PIDNamespace, joinable: true}, "pid", "PID namespace of the container's own; --pid=false shares the host's processes, --pid=container:<id> another container's (default: true)")
+	containerFlags.Var(&namespaceFlag{mode: &config.MountNamespace}, "mnt", "Mount namespace of the container's own, for its /proc, /sys, /etc files and -v; --mnt=false shares the host's mounts (default: true)")
+	containerFlags.Var(&namespaceFlag{mode: &config.Network, joinable: true}, "net", "Network namespace of the container's own, the default --network; --net=false is --network host, --net=container:<id> shares another container's (default: true, false for rootless containers)")
+	containerFlags.Var(&namespaceFlag{mode: &config.IPCNamespace, joinable: true}, "ipc", "IPC namespace of the container's own, with its own SysV IPC and POSIX message queues; --ipc=false shares the host's, --ipc=container:<id> another container's (default: true)")
+	containerFlags.Var(&namespaceFlag{mode: &config.CgroupNamespace}, "cgroupns", "Cgroup namespace of the container's own, where /proc/self/cgroup shows its cgroup as /; --cgroupns=false shows the host's paths (default: true, where the kernel supports it)")
+	containerFlags.StringVar(&config.PodID, "pod", "", "Pod to run the container in, sharing the hostname, IPC and network of its other containers (see nsctl pod create)")
+	containerFlags.Var(&timeOffsetFlag{offsets: &config.TimeOffsets}, "time-offset", "Shift a clock in a time namespace of the container's own, monotonic|boottime=<duration>, e.g. boottime=200d (repeatable; Linux 5.6+)")
+	containerFlags.StringVar(&config.Keyring, "keyring", "", "Session keyring: private (a new, empty one) or host (share the one nsctl runs with) (default: private)")
+	containerFlags.StringVar(&config.Sysfs, "sysfs", "", "How the container gets its read-only /sys: mount (a sysfs of its own, the host's bound where it can't be mounted), bind (the host's, e.g. for host-network containers) or none (default: mount)")
+	containerFlags.StringVar(&config.Isolation, "isolation", "", "Isolation backend: namespaces, chroot (into the --rootfs, without namespaces: reduced isolation for hosts that forbid them; root only) or auto (default: namespaces)")
+	containerFlags.StringVar(&config.UserNamespace, "userns", "", "User namespace mode of a rootless container: keep-id maps your uid/gid to the same IDs inside (default: you are root)")
+	containerFlags.Var(&idMapFlag{mappings: &config.UIDMappings}, "uidmap", "Map container UIDs to host UIDs, container:host:size (repeatable)")
+	containerFlags.Var(&idMapFlag{mappings: &config.GIDMappings}, "gidmap", "Map container GIDs to host GIDs, container:host:size (repeatable; default: as --uidmap)")
+	containerFlags.Var((*stringListFlag)(&config.CapAdd), "cap-add", "Capability a rootful container keeps, e.g. NET_ADMIN, or ALL (repeatable; default: none)")
+	containerFlags.Var((*stringListFlag)(&config.SecurityOpt), "security-opt", "Security option: seccomp=<profile.json>|unconfined, seccomp-listener=<agent socket>, landlock=<policy.json>, proc-opts=<hidepid=2,subset=pid>, mask=<path:...>, unmask=<path:...>|ALL (repeatable)")
+	containerFlags.StringVar(&config.LogMaxSize, "log-max-size", "", "Stop logging the container's output past this size, e.g. 10m; 0 for no limit (default: log_max_size from the runtime config)")
+
+	// Only "run" (and "spec", which describes a run) can choose between
+	// foreground and background
+	if commandName == "run" || commandName == "spec" {
+		containerFlags.BoolVar(&config.Detach, "d", false, "Run container in the background and print its ID")
+		containerFlags.BoolVar(&config.Detach, "detach", false, "Run container in the background and print its ID")
+	}
+
+	if commandName == "run" || commandName == "create" {
+		// Always on in nsctl when stdin is a terminal, and a no-op otherwise
+		for _, name := range []string{"i", "interactive", "t", "tty"} {
+			containerFlags.Bool(name, false, "Accepted for docker compatibility: the container gets the terminal whenever stdin is one")
+		}
+		containerFlags.BoolVar(&config.TraceSetup, "trace-setup", false, "Log each setup step and the syscalls it makes, with their durations, to stderr")
+	}
+
+	containerFlags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s %s [options] <command> [args...]\n\nOptions:\n", os.Args[0], commandName)
+		containerFlags.PrintDefaults()
+	}
+	return containerFlags
+}
+
+// stringListFlag collects the values of a repeatable option
+type stringListFlag []string
+
+func (f *stringListFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringListFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// idMapFlag collects the mappings of a repeatable --uidmap or --gidmap
+type idMapFlag struct {
+	mappings *[]ns.IDMap
+}
+
+func (f *idMapFlag) String() string {
+	if f.mappings == nil {
+		return ""
+	}
+	var specs []string
+	for _, mapping := range *f.mappings {
+		specs = append(specs, fmt.Sprintf("%d:%d:%d", mapping.ContainerID, mapping.HostID, mapping.Size))
+	}
+	return strings.Join(specs, ",")
+}
+
+func (f *idMapFlag) Set(value string) error {
+	mapping, err := ns.ParseIDMap(value)
+	if err != nil {
+		return err
+	}
+	*f.mappings = append(*f.mappings, mapping)
+	return nil
+}
+
+// volumeFlag collects the binds of a repeatable -v
+type volumeFlag struct {
+	mounts *[]ns.Mount
+}
+
+func (f *volumeFlag) String() string {
+	if f.mounts == nil {
+		return ""
+	}
+	var specs []string
+	for _, mount := range *f.mounts {
+		specs = append(specs, mount.Source+":"+mount.Destination)
+	}
+	return strings.Join(specs, ",")
+}
+
+func (f *volumeFlag) Set(value string) error {
+	mount, err := ns.ParseVolume(value)
+	if err != nil {
+		return err
+	}
+	*f.mounts = append(*f.mounts, mount)
+	return nil
+}
+
+// mountFlag collects the mounts of a repeatable --mount
+type mountFlag struct {
+	mounts *[]ns.Mount
+}
+
+func (f *mountFlag) String() string {
+	if f.mounts == nil {
+		return ""
+	}
+	var specs []string
+	for _, mount := range *f.mounts {
+		specs = append(specs, mount.Destination)
+	}
+	return strings.Join(specs, ",")
+}
+
+func (f *mountFlag) Set(value string) error {
+	mount, err := ns.ParseMount(value)
+	if err != nil {
+		return err
+	}
+	*f.mounts = append(*f.mounts, mount)
+	return nil
+}
+
+// tmpfsFlag collects the tmpfs mounts of a repeatable --tmpfs
+type tmpfsFlag struct {
+	mounts *[]ns.Mount
+}
+
+func (f *tmpfsFlag) String() string {
+	if f.mounts == nil {
+		return ""
+	}
+	var specs []string
+	for _, mount := range *f.mounts {
+		specs = append(specs, mount.Destination)
+	}
+	return strings.Join(specs, ",")
+}
+
+func (f *tmpfsFlag) Set(value string) error {
+	mount, err := ns.ParseTmpfs(value)
+	if err != nil {
+		return err
+	}
+	*f.mounts = append(*f.mounts, mount)
+	return nil
+}
+
+// annotationFlag collects the key=value pairs of a repeatable --annotation
+type annotationFlag struct {
+	annotations *map[string]string
+}
+
+func (f *annotationFlag) String() string {
+	if f.annotations == nil {
+		return ""
+	}
+	var pairs []string
+	for key, value := range *f.annotations {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (f *annotationFlag) Set(value string) error {
+	key, annotation, found := strings.Cut(value, "=")
+	if !found || key == "" {
+		return fmt.Errorf("invalid annotation %q: expected key=value", value)
+	}
+	if *f.annotations == nil {
+		*f.annotations = map[string]string{}
+	}
+	(*f.annotations)[key] = annotation
+	return nil
+}
+
+// pressureAlertFlag collects the thresholds of a repeatable --pressure-alert
+type pressureAlertFlag struct {
+	triggers *[]cgroup.PressureTrigger
+}
+
+func (f *pressureAlertFlag) String() string {
+	if f.triggers == nil {
+		return ""
+	}
+	var triggers []string
+	for _, trigger := range *f.triggers {
+		triggers = append(triggers, trigger.String())
+	}
+	return strings.Join(triggers, ",")
+}
+
+func (f *pressureAlertFlag) Set(value string) error {
+	trigger, err := cgroup.ParsePressureTrigger(value)
+	if err != nil {
+		return err
+	}
+	*f.triggers = append(*f.triggers, trigger)
+	return nil
+}
+
+// memoryEventFlag collects the actions of a repeatable --on-memory-event
+type memoryEventFlag struct {
+	actions *[]ns.MemoryEventAction
+}
+
+func (f *memoryEventFlag) String() string {
+	if f.actions == nil {
+		return ""
+	}
+	var actions []string
+	for _, action := range *f.actions {
+		actions = append(actions, action.String())
+	}
+	return strings.Join(actions, ",")
+}
+
+func (f *memoryEventFlag) Set(value string) error {
+	action, err := ns.ParseMemoryEventAction(value)
+	if err != nil {
+		return err
+	}
+	*f.actions = append(*f.actions, action)
+	return nil
+}
+
+// namespaceFlag sets the mode of one of the container's namespaces: true
+// or private for one of its own, false or host for the host's, and where
+// joinable container:<id> for another container's; like a boolean flag, it
+// needs "=" for a value
+type namespaceFlag struct {
+	mode     *string
+	joinable bool
+}
+
+func (f *namespaceFlag) IsBoolFlag() bool { return true }
+
+func (f *namespaceFlag) String() string {
+	if f.mode == nil {
+		return ""
+	}
+	return *f.mode
+}
+
+func (f *namespaceFlag) Set(value string) error {
+	if own, err := strconv.ParseBool(value); err == nil {
+		value = ns.NamespaceHost
+		if own {
+			value = ns.NamespacePrivate
+		}
+	}
+	if f.joinable && strings.HasPrefix(value, ns.NamespaceContainerPrefix) {
+		*f.mode = value
+		return nil
+	}
+	if value != ns.NamespacePrivate && value != ns.NamespaceHost {
+		if f.joinable {
+			return fmt.Errorf("expected true, false, %s, %s or %s<id>", ns.NamespacePrivate, ns.NamespaceHost, ns.NamespaceContainerPrefix)
+		}
+		return fmt.Errorf("expected true, false, %s or %s", ns.NamespacePrivate, ns.NamespaceHost)
+	}
+	*f.mode = value
+	return nil
+}
+
+// timeOffsetFlag collects the clock offsets of a repeatable --time-offset
+type timeOffsetFlag struct {
+	offsets *[]ns.TimeOffset
+}
+
+func (f *timeOffsetFlag) String() string {
+	if f.offsets == nil {
+		return ""
+	}
+	var offsets []string
+	for _, offset := range *f.offsets {
+		offsets = append(offsets, offset.String())
+	}
+	return strings.Join(offsets, ",")
+}
+
+func (f *timeOffsetFlag) Set(value string) error {
+	offset, err := ns.ParseTimeOffset(value)
+	if err != nil {
+		return err
+	}
+	*f.offsets = append(*f.offsets, offset)
+	return nil
+}
+
+// platformFlag parses --platform
+type platformFlag struct {
+	platform *ns.Platform
+}
+
+func (f *platformFlag) String() string {
+	if f.platform == nil || f.platform.Architecture == "" {
+		return ""
+	}
+	return f.platform.String()
+}
+
+func (f *platformFlag) Set(value string) error {
+	platform, err := ns.ParsePlatform(value)
+	if err != nil {
+		return err
+	}
+	*f.platform = platform
+	return nil
+}
+
+// restartFlag parses --restart
+type restartFlag struct {
+	policy *ns.RestartPolicy
+}
+
+func (f *restartFlag) String() string {
+	if f.policy == nil || f.policy.Name == "" {
+		return ""
+	}
+	return f.policy.String()
+}
+
+func (f *restartFlag) Set(value string) error {
+	policy, err := ns.ParseRestartPolicy(value)
+	if err != nil {
+		return err
+	}
+	*f.policy = policy
+	return nil
+}
+
+// parseContainerArgs parses arguments with a flag set from newContainerFlagSet
+// Flag parsing stops at the first non-flag argument, so everything from the
+// command onwards is passed to the container untouched
+func parseContainerArgs(containerFlags *flag.FlagSet, config *ns.ContainerConfig, arguments []string) {
+	parseFlags(containerFlags, arguments)
+	if containerFlags.NArg() < 1 {
+		fmt.Fprintf(os.Stderr, "Missing command to run\n")
+		containerFlags.Usage()
+		os.Exit(1)
+	}
+
+	if config.Timeout < 0 {
+		log.Fatalf("--timeout must not be negative")
+	}
+	if config.CPUs < 0 {
+		log.Fatalf("--cpus must not be negative")
+	}
+	if _, err := ns.ParseSize(config.Memory); err != nil {
+		log.Fatalf("Invalid --memory: %v", err)
+	}
+	if _, err := ns.ParseSize(config.LogMaxSize); err != nil {
+		log.Fatalf("Invalid --log-max-size: %v", err)
+	}
+
+	config.Command = containerFlags.Arg(0)
+	config.Args = containerFlags.Args()[1:]
+}
+
+// parseContainerFlags parses the options of "run" or "create"
+func parseContainerFlags(commandName string, arguments []string) ns.ContainerConfig {
+	var config ns.ContainerConfig
+	parseContainerArgs(newContainerFlagSet(commandName, &config), &config, arguments)
+	return config
+}
+
+// handleRunCommand processes the "run" command to start a container
+func handleRunCommand() {
+	var config ns.ContainerConfig
+	runFlags := newContainerFlagSet("run", &config)
+	dryRun := runFlags.Bool("dry-run", false, "Print what the run would do (namespaces, mounts, cgroup, network, environment, argv) without starting anything")
+	parseContainerArgs(runFlags, &config, os.Args[2:])
+
+	if *dryRun {
+		plan, err := ns.PlanContainer(config)
+		if err != nil {
+			log.Fatalf("Dry run failed: %v", err)
+		}
+		fmt.Print(plan)
+		return
+	}
+
+	fmt.Fprintf(os.Stderr, "[nsctl] Starting container with command: %s %v\n", config.Command, config.Args)
+
+	// Use current executable path for re-execution
+	execPath := os.Args[0]
+
+	// Create isolated environment and run the command
+	containerID, err := ns.RunWithConfig(execPath, config)
+	if err != nil {
+		// A foreground container's exit code becomes ours, so scripts can
+		// check it just like for a command run without nsctl
+		var exitErr *ns.ContainerExitError
+		if errors.As(err, &exitErr) {
+			os.Exit(exitErr.ExitCode)
+		}
+		log.Fatalf("Container failed: %v", err)
+	}
+
+	// Detached mode prints only the full ID on stdout so scripts can capture it:
+	//   ID=$(nsctl run -d sleep 60)
+	if config.Detach {
+		fmt.Println(containerID)
+	}
+}
+
+// handleCreateCommand prepares a container that waits for "start"
+func handleCreateCommand() {
+	config := parseContainerFlags("create", os.Args[2:])
+	config.CreateOnly = true
+
+	fmt.Fprintf(os.Stderr, "[nsctl] Creating container with command: %s %v\n", config.Command, config.Args)
+
+	containerID, err := ns.RunWithConfig(os.Args[0], config)
+	if err != nil {
+		log.Fatalf("Failed to create container: %v", err)
+	}
+
+	// Like "run -d", print just the ID for scripts
+	fmt.Println(containerID)
+}
+
+// handleStartCommand starts a container prepared by "create"
+func handleStartCommand() {
+	if len(os.Args) != 3 {
+		fmt.Fprintf(os.Stderr, "Usage: %s start <container-id>\n", os.Args[0])
+		os.Exit(1)
+	}
+
+	container, err := ns.LookupContainer(os.Args[2])
+	if err != nil {
+		log.Fatalf("Failed to start container: %v", err)
+	}
+
+	if err := ns.StartContainer(container.ID); err != nil {
+		log.Fatalf("Failed to start container: %v", err)
+	}
+	fmt.Println(container.ID)
+}
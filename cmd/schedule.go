@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"nsctl/pkg/ns"
+	"nsctl/pkg/schedule"
+)
+
+// handleScheduleCommand dispatches the "schedule" subcommands
+func handleScheduleCommand() {
+	if len(os.Args) < 3 {
+		showScheduleUsage()
+		os.Exit(1)
+	}
+
+	switch os.Args[2] {
+	case "create":
+		handleScheduleCreate()
+	case "ls", "list":
+		handleScheduleList()
+	case "history":
+		handleScheduleHistory()
+	case "rm":
+		handleScheduleRemove()
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown schedule command: %s\n", os.Args[2])
+		showScheduleUsage()
+		os.Exit(1)
+	}
+}
+
+// showScheduleUsage lists the schedule subcommands
+func showScheduleUsage() {
+	fmt.Fprintf(os.Stderr, "Usage:\n")
+	fmt.Fprintf(os.Stderr, "  %s schedule create --cron <expr> [run options] <command> [args...]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s schedule ls\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s schedule history <schedule-id>\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s schedule rm <schedule-id>\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "\nSchedules are run by \"%s daemon\".\n", os.Args[0])
+}
+
+// handleScheduleCreate stores a new schedule and prints its ID
+func handleScheduleCreate() {
+	var config ns.ContainerConfig
+	createFlags := newContainerFlagSet("schedule create", &config)
+	var cronExpression string
+	createFlags.StringVar(&cronExpression, "cron", "", "When to run, as a 5-field cron expression (e.g. '*/5 * * * *') or @hourly/@daily/...")
+	parseContainerArgs(createFlags, &config, os.Args[3:])
+
+	if cronExpression == "" {
+		log.Fatalf("--cron is required")
+	}
+
+	created, err := schedule.Create(cronExpression, config)
+	if err != nil {
+		log.Fatalf("Failed to create schedule: %v", err)
+	}
+
+	fmt.Fprintf(os.Stderr, "[nsctl] Next run at %s\n", created.NextRun(time.Now()).Format(time.RFC3339))
+	fmt.Println(created.ID)
+}
+
+// handleScheduleList prints all schedules with their next run
+func handleScheduleList() {
+	schedules, err := schedule.List()
+	if err != nil {
+		log.Fatalf("Failed to list schedules: %v", err)
+	}
+	if len(schedules) == 0 {
+		fmt.Printf("No schedules found.\n")
+		return
+	}
+
+	table := ns.NewTable("SCHEDULE ID", "CRON", "NEXT RUN", "RUNS", "COMMAND")
+	for _, entry := range schedules {
+		commandStr := strings.TrimSpace(entry.Container.Command + " " + strings.Join(entry.Container.Args, " "))
+		nextRun := entry.NextRun(time.Now()).Format("2006-01-02 15:04")
+		table.AddRow(entry.ID, entry.Cron, nextRun, strconv.Itoa(len(entry.History)), commandStr)
+	}
+	fmt.Print(table.Render(ns.StdoutTableStyle()))
+}
+
+// handleScheduleHistory prints the recent runs of a schedule
+func handleScheduleHistory() {
+	if len(os.Args) != 4 {
+		showScheduleUsage()
+		os.Exit(1)
+	}
+
+	entry, err := schedule.Lookup(os.Args[3])
+	if err != nil {
+		log.Fatalf("Failed to read schedule: %v", err)
+	}
+	if len(entry.History) == 0 {
+		fmt.Printf("Schedule %s has not run yet.\n", entry.ID)
+		return
+	}
+
+	table := ns.NewTable("SCHEDULED FOR", "CONTAINER ID", "RESULT")
+	for _, run := range entry.History {
+		table.AddRow(run.ScheduledFor.Format("2006-01-02 15:04"), ns.ShortID(run.ContainerID), runResult(run))
+	}
+	fmt.Print(table.Render(ns.StdoutTableStyle()))
+}
+
+// runResult describes how a scheduled run went, using the container record
+// for runs that actually started a container
+func runResult(run schedule.Run) string {
+	switch {
+	case run.Skipped:
+		return "skipped (overlap)"
+	case run.Error != "":
+		return "failed: " + run.Error
+	}
+
+	container, err := ns.LookupContainer(run.ContainerID)
+	if err != nil {
+		return "removed"
+	}
+	if container.Status == ns.StatusExited {
+		if container.FinishReason != "" {
+			return fmt.Sprintf("%s (%d)", container.FinishReason, container.ExitCode)
+		}
+		return fmt.Sprintf("exited (%d)", container.ExitCode)
+	}
+	return container.Status
+}
+
+// handleScheduleRemove deletes a schedule
+func handleScheduleRemove() {
+	if len(os.Args) != 4 {
+		showScheduleUsage()
+		os.Exit(1)
+	}
+
+	entry, err := schedule.Lookup(os.Args[3])
+	if err != nil {
+		log.Fatalf("Failed to remove schedule: %v", err)
+	}
+	if err := schedule.Remove(entry.ID); err != nil {
+		log.Fatalf("Failed to remove schedule: %v", err)
+	}
+	fmt.Println(entry.ID)
+}
+
+// handleDaemonCommand runs the long-lived daemon, which currently drives
+// scheduled containers; it runs in the foreground until killed
+func handleDaemonCommand() {
+	schedule.RunScheduler(os.Args[0])
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"nsctl/pkg/ns"
+)
+
+// handleSpecCommand prints the OCI runtime config.json equivalent to a "run"
+// with the same options, or writes it as a bundle with --bundle <dir>
+// Nothing is started, so this is safe for checking what nsctl would do
+func handleSpecCommand() {
+	var config ns.ContainerConfig
+	specFlags := newContainerFlagSet("spec", &config)
+	bundleDir := specFlags.String("bundle", "", "Write config.json and the managed /etc files to this bundle directory instead of printing the spec")
+	parseContainerArgs(specFlags, &config, os.Args[2:])
+
+	spec, err := ns.GenerateSpec(config)
+	if err != nil {
+		log.Fatalf("Failed to generate spec: %v", err)
+	}
+
+	if *bundleDir != "" {
+		if err := ns.WriteBundle(*bundleDir, spec); err != nil {
+			log.Fatalf("Failed to write bundle: %v", err)
+		}
+		fmt.Fprintf(os.Stderr, "[nsctl] Wrote OCI bundle to %s\n", *bundleDir)
+		return
+	}
+
+	data, err := ns.MarshalSpec(spec)
+	if err != nil {
+		log.Fatalf("Failed to generate spec: %v", err)
+	}
+	os.Stdout.Write(data)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"nsctl/pkg/ns"
+)
+
+// handleStateCommand dispatches the "state" subcommands
+func handleStateCommand() {
+	if len(os.Args) < 3 || os.Args[2] != "fsck" {
+		fmt.Fprintf(os.Stderr, "Usage:\n")
+		fmt.Fprintf(os.Stderr, "  %s state fsck [--repair] [--json] # Check container records against the host\n", os.Args[0])
+		os.Exit(1)
+	}
+	handleStateFsck()
+}
+
+// handleStateFsck checks the state directory against the host and prints
+// the problems found; it exits 1 if problems are left unrepaired
+func handleStateFsck() {
+	fsckFlags := flag.NewFlagSet("state fsck", flag.ExitOnError)
+	repair := fsckFlags.Bool("repair", false, "Repair what can be repaired: quarantine broken records, remove leftovers")
+	jsonOutput := fsckFlags.Bool("json", false, "Print the problems as JSON")
+	parseFlags(fsckFlags, os.Args[3:])
+
+	problems, err := ns.CheckState(*repair)
+	if err != nil {
+		log.Fatalf("Failed to check state: %v", err)
+	}
+
+	left := 0
+	for _, problem := range problems {
+		if !problem.Repaired {
+			left++
+		}
+	}
+
+	if *jsonOutput {
+		data, _ := json.MarshalIndent(problems, "", "  ")
+		fmt.Println(string(data))
+	} else {
+		for _, problem := range problems {
+			fmt.Printf("%s: %s\n", problem.Subject, problem.Problem)
+			switch {
+			case problem.Repaired:
+				fmt.Printf("  repaired: %s\n", problem.Repair)
+			case problem.RepairError != "":
+				fmt.Printf("  repair failed: %s\n", problem.RepairError)
+			case problem.Repair != "":
+				fmt.Printf("  repair: %s (with --repair)\n", problem.Repair)
+			case problem.Fix != "":
+				fmt.Printf("  fix: %s\n", problem.Fix)
+			}
+		}
+		if len(problems) == 0 {
+			fmt.Printf("State is consistent with the host.\n")
+		} else {
+			fmt.Printf("\n%d problems: %d repaired, %d left\n", len(problems), len(problems)-left, left)
+		}
+	}
+
+	if left > 0 {
+		os.Exit(1)
+	}
+}
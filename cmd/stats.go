@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"nsctl/pkg/ns"
+)
+
+// statsSampleInterval is how far apart the two measurements CPU usage is
+// computed from are
+const statsSampleInterval = 500 * time.Millisecond
+
+// handleStatsCommand prints the resource usage of running containers, by
+// default all of them
+func handleStatsCommand() {
+	statsFlags := flag.NewFlagSet("stats", flag.ExitOnError)
+	jsonOutput := statsFlags.Bool("json", false, "Print the raw counters as JSON")
+	parseFlags(statsFlags, os.Args[2:])
+
+	ids := statsFlags.Args()
+	if len(ids) == 0 {
+		containers, _, err := ns.ListContainersPage(ns.ListOptions{})
+		if err != nil {
+			log.Fatalf("Failed to list containers: %v", err)
+		}
+		for _, container := range containers {
+			if container.Status == ns.StatusRunning {
+				ids = append(ids, container.ID)
+			}
+		}
+	}
+
+	collect := func() []*ns.Metrics {
+		all := make([]*ns.Metrics, 0, len(ids))
+		for _, id := range ids {
+			metrics, err := ns.CollectStats(id)
+			if err != nil {
+				log.Fatalf("Failed to collect stats: %v", err)
+			}
+			all = append(all, metrics)
+		}
+		return all
+	}
+
+	if *jsonOutput {
+		data, _ := json.MarshalIndent(collect(), "", "  ")
+		fmt.Println(string(data))
+		return
+	}
+	if len(ids) == 0 {
+		fmt.Printf("No running containers.\n")
+		return
+	}
+
+	earlier := collect()
+	time.Sleep(statsSampleInterval)
+	table := ns.NewTable("CONTAINER ID", "CPU %", "MEM USAGE / LIMIT", "MEM %", "BLOCK I/O", "NET I/O", "PIDS", "MEM PRESSURE")
+	for index, metrics := range collect() {
+		memory, memoryPercent := ns.FormatSize(int64(metrics.Memory.Usage))+" / -", "-"
+		if metrics.Memory.Limit > 0 {
+			memory = ns.FormatSize(int64(metrics.Memory.Usage)) + " / " + ns.FormatSize(int64(metrics.Memory.Limit))
+			memoryPercent = fmt.Sprintf("%.2f%%", float64(metrics.Memory.Usage)/float64(metrics.Memory.Limit)*100)
+		}
+		blockIO := "-"
+		if metrics.IO != nil {
+			blockIO = ns.FormatSize(int64(metrics.IO.ReadBytes)) + " / " + ns.FormatSize(int64(metrics.IO.WriteBytes))
+		}
+		netIO := "host"
+		if metrics.Network != nil {
+			var received, sent uint64
+			for _, counters := range metrics.Network {
+				received += counters.RxBytes
+				sent += counters.TxBytes
+			}
+			netIO = ns.FormatSize(int64(received)) + " / " + ns.FormatSize(int64(sent))
+		}
+		pids := "-"
+		if metrics.PIDs != nil {
+			pids = fmt.Sprint(metrics.PIDs.Current)
+		}
+		// The share of the last 10s some of its tasks waited for memory
+		memoryPressure := "-"
+		if metrics.Pressure != nil && metrics.Pressure.Memory != nil {
+			memoryPressure = fmt.Sprintf("%.2f%%", metrics.Pressure.Memory.Some.Avg10)
+		}
+		table.AddRow(ns.ShortID(metrics.ContainerID), fmt.Sprintf("%.2f%%", metrics.CPUPercent(earlier[index])),
+			memory, memoryPercent, blockIO, netIO, pids, memoryPressure)
+	}
+	fmt.Print(table.Render(ns.StdoutTableStyle()))
+}
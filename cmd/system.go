@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"nsctl/pkg/ns"
+)
+
+// handleSystemCommand dispatches the "system" subcommands
+func handleSystemCommand() {
+	if len(os.Args) < 3 {
+		showSystemUsage()
+		os.Exit(1)
+	}
+
+	switch os.Args[2] {
+	case "info":
+		handleSystemInfo()
+	case "df":
+		handleSystemDf()
+	case "prune":
+		handleSystemPrune()
+	case "binfmt":
+		handleSystemBinfmt()
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown system command: %s\n", os.Args[2])
+		showSystemUsage()
+		os.Exit(1)
+	}
+}
+
+// showSystemUsage lists the system subcommands
+func showSystemUsage() {
+	fmt.Fprintf(os.Stderr, "Usage:\n")
+	fmt.Fprintf(os.Stderr, "  %s system info    # Show runtime-wide information\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s system df [-v] # Show disk usage\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s system prune [-f] [--volumes] # Remove stopped containers (and unused volumes)\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s system binfmt [--install [arch...]] # Show or register emulators for foreign architectures\n", os.Args[0])
+}
+
+// handleSystemInfo prints kernel, cgroup, storage and security information
+func handleSystemInfo() {
+	info, err := ns.GetSystemInfo()
+	if err != nil {
+		log.Fatalf("Failed to collect system info: %v", err)
+	}
+
+	mode := "rootful"
+	if info.Rootless {
+		mode = "rootless"
+	}
+
+	fmt.Printf("Kernel Version:   %s\n", info.KernelVersion)
+	fmt.Printf("Architecture:     %s\n", info.Architecture)
+	fmt.Printf("Cgroup Version:   %s\n", info.CgroupVersion)
+	fmt.Printf("Mode:             %s\n", mode)
+	fmt.Printf("Store:            %s\n", info.Store)
+	fmt.Printf("State Dir:        %s\n", info.StateDir)
+	fmt.Printf("Data Root:        %s\n", info.DataRoot)
+	fmt.Printf("Storage Driver:   %s\n", info.StorageDriver)
+	fmt.Printf("Network:          %s\n", info.Network)
+	if info.Offline {
+		fmt.Printf("Offline:          yes (nsctl makes no network connections)\n")
+	}
+	fmt.Printf("Security:\n")
+	fmt.Printf("  seccomp:        %s\n", availability(info.Seccomp))
+	fmt.Printf("  AppArmor:       %s\n", availability(info.AppArmor))
+	fmt.Printf("  SELinux:        %s\n", availability(info.SELinux))
+	if info.LandlockABI > 0 {
+		fmt.Printf("  Landlock:       available (ABI version %d)\n", info.LandlockABI)
+	} else {
+		fmt.Printf("  Landlock:       %s\n", availability(false))
+	}
+	fmt.Printf("Containers:       %d\n", info.Containers)
+	fmt.Printf("  Running:        %d\n", info.ContainersRunning)
+	fmt.Printf("  Created:        %d\n", info.ContainersCreated)
+	fmt.Printf("  Exited:         %d\n", info.ContainersExited)
+
+	fmt.Printf("Rootless:\n")
+	for _, feature := range info.RootlessFeatures {
+		fmt.Printf("  %-20s %-14s %s\n", feature.Name+":", availability(feature.Available), feature.Detail)
+	}
+
+	for _, warning := range info.Warnings {
+		fmt.Printf("WARNING: %s\n", warning)
+	}
+}
+
+// handleSystemDf prints how much disk space nsctl's objects use
+func handleSystemDf() {
+	dfFlags := flag.NewFlagSet("system df", flag.ExitOnError)
+	var verbose bool
+	dfFlags.BoolVar(&verbose, "v", false, "List the usage of every object")
+	dfFlags.BoolVar(&verbose, "verbose", false, "List the usage of every object")
+	parseFlags(dfFlags, os.Args[3:])
+
+	categories, err := ns.GetDiskUsage()
+	if err != nil {
+		log.Fatalf("Failed to collect disk usage: %v", err)
+	}
+
+	table := ns.NewTable("TYPE", "TOTAL", "ACTIVE", "SIZE", "RECLAIMABLE")
+	for _, category := range categories {
+		table.AddRow(category.Type, strconv.Itoa(category.Total), strconv.Itoa(category.Active),
+			ns.FormatSize(category.Size), ns.FormatSize(category.Reclaimable))
+	}
+	fmt.Print(table.Render(ns.StdoutTableStyle()))
+
+	if !verbose {
+		return
+	}
+	for _, category := range categories {
+		fmt.Printf("\n%s:\n", category.Type)
+		if len(category.Items) == 0 {
+			fmt.Printf("  (none)\n")
+			continue
+		}
+		fmt.Printf("  %-14s %-10s %-8s\n", "NAME", "SIZE", "ACTIVE")
+		for _, item := range category.Items {
+			fmt.Printf("  %-14s %-10s %-8t\n", item.Name, ns.FormatSize(item.Size), item.Active)
+		}
+	}
+}
+
+// handleSystemPrune removes unused objects after asking for confirmation;
+// volumes only with --volumes
+func handleSystemPrune() {
+	pruneFlags := flag.NewFlagSet("system prune", flag.ExitOnError)
+	var force, volumes bool
+	pruneFlags.BoolVar(&force, "f", false, "Do not prompt for confirmation")
+	pruneFlags.BoolVar(&force, "force", false, "Do not prompt for confirmation")
+	pruneFlags.BoolVar(&volumes, "volumes", false, "Remove the volumes no container refers to as well")
+	parseFlags(pruneFlags, os.Args[3:])
+
+	if !force {
+		fmt.Fprintf(os.Stderr, "WARNING! This will remove all stopped containers.\n")
+		if volumes {
+			fmt.Fprintf(os.Stderr, "It will also remove all volumes not used by any container, and their data.\n")
+		}
+		if !confirm("Are you sure you want to continue?") {
+			fmt.Fprintf(os.Stderr, "Aborted.\n")
+			os.Exit(1)
+		}
+	}
+
+	removedIDs, reclaimed, err := ns.PruneContainers()
+	if err != nil {
+		log.Fatalf("Failed to prune containers: %v", err)
+	}
+
+	if len(removedIDs) > 0 {
+		fmt.Printf("Deleted Containers:\n")
+		for _, containerID := range removedIDs {
+			fmt.Println(containerID)
+		}
+		fmt.Println()
+	}
+
+	// Volumes come after the containers, so those just removed no longer
+	// hold on to theirs
+	if volumes {
+		removedVolumes, volumesReclaimed, err := ns.PruneVolumes()
+		if err != nil {
+			log.Fatalf("Failed to prune volumes: %v", err)
+		}
+		if len(removedVolumes) > 0 {
+			fmt.Printf("Deleted Volumes:\n")
+			for _, name := range removedVolumes {
+				fmt.Println(name)
+			}
+			fmt.Println()
+		}
+		reclaimed += volumesReclaimed
+	}
+	fmt.Printf("Total reclaimed space: %s\n", ns.FormatSize(reclaimed))
+}
+
+// handleSystemBinfmt shows which architectures can run, and with --install
+// registers qemu emulators for the missing ones
+func handleSystemBinfmt() {
+	binfmtFlags := flag.NewFlagSet("system binfmt", flag.ExitOnError)
+	var install bool
+	binfmtFlags.BoolVar(&install, "install", false, "Register the host's qemu-user emulators for architectures without a handler")
+	parseFlags(binfmtFlags, os.Args[3:])
+
+	if install {
+		installed, err := ns.InstallBinfmtHandlers(binfmtFlags.Args())
+		if err != nil {
+			log.Fatalf("Failed to register emulators: %v", err)
+		}
+		if len(installed) == 0 {
+			fmt.Printf("Nothing to register.\n")
+		}
+	} else if binfmtFlags.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "Usage: %s system binfmt [--install [arch...]]\n", os.Args[0])
+		os.Exit(1)
+	}
+
+	statuses, err := ns.GetBinfmtStatus()
+	if err != nil {
+		log.Fatalf("Failed to read binfmt_misc handlers: %v", err)
+	}
+	fmt.Printf("%-10s %-10s %s\n", "ARCH", "SUPPORT", "INTERPRETER")
+	for _, status := range statuses {
+		support, interpreter := "none", "-"
+		switch {
+		case status.Native:
+			support = "native"
+		case status.Handler != "":
+			support, interpreter = "emulated", status.Interpreter
+		}
+		fmt.Printf("%-10s %-10s %s\n", status.Architecture, support, interpreter)
+	}
+}
+
+// confirm asks a yes/no question on the terminal; anything but y/yes is no
+func confirm(question string) bool {
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// availability renders a detected feature for humans
+func availability(available bool) string {
+	if available {
+		return "available"
+	}
+	return "not available"
+}
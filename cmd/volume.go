@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"nsctl/pkg/ns"
+)
+
+// handleVolumeCommand dispatches the "volume" subcommands
+func handleVolumeCommand() {
+	if len(os.Args) < 3 {
+		showVolumeUsage()
+		os.Exit(1)
+	}
+
+	switch os.Args[2] {
+	case "create":
+		handleVolumeCreate()
+	case "ls", "list":
+		handleVolumeList()
+	case "inspect":
+		handleVolumeInspect()
+	case "rm":
+		handleVolumeRemove()
+	case "prune":
+		handleVolumePrune()
+	case "export":
+		handleVolumeExport()
+	case "import":
+		handleVolumeImport()
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown volume command: %s\n", os.Args[2])
+		showVolumeUsage()
+		os.Exit(1)
+	}
+}
+
+// showVolumeUsage lists the volume subcommands
+func showVolumeUsage() {
+	fmt.Fprintf(os.Stderr, "Usage:\n")
+	fmt.Fprintf(os.Stderr, "  %s volume create <name>\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s volume ls\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s volume inspect <name>\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s volume rm <name>\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s volume prune [-f]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s volume export [-o <file>] <name>\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s volume import [-i <file>] <name>\n", os.Args[0])
+}
+
+// handleVolumeCreate creates a named volume and prints its name
+func handleVolumeCreate() {
+	if len(os.Args) != 4 {
+		fmt.Fprintf(os.Stderr, "Usage: %s volume create <name>\n", os.Args[0])
+		os.Exit(1)
+	}
+
+	volume, err := ns.CreateVolume(os.Args[3])
+	if err != nil {
+		log.Fatalf("Failed to create volume: %v", err)
+	}
+	fmt.Println(volume.Name)
+}
+
+// handleVolumeList prints all volumes
+func handleVolumeList() {
+	volumes, err := ns.ListVolumes()
+	if err != nil {
+		log.Fatalf("Failed to list volumes: %v", err)
+	}
+	if len(volumes) == 0 {
+		fmt.Printf("No volumes found.\n")
+		return
+	}
+
+	table := ns.NewTable("VOLUME NAME", "KIND", "CREATED")
+	for _, volume := range volumes {
+		kind := "named"
+		if volume.Anonymous {
+			kind = "anonymous"
+		}
+		table.AddRow(volume.Name, kind, volume.CreatedAt.Format("2006-01-02 15:04:05"))
+	}
+	fmt.Print(table.Render(ns.StdoutTableStyle()))
+}
+
+// handleVolumeInspect prints a volume's record as JSON
+func handleVolumeInspect() {
+	if len(os.Args) != 4 {
+		fmt.Fprintf(os.Stderr, "Usage: %s volume inspect <name>\n", os.Args[0])
+		os.Exit(1)
+	}
+
+	volume, err := ns.LookupVolume(os.Args[3])
+	if err != nil {
+		log.Fatalf("Failed to inspect volume: %v", err)
+	}
+	data, err := json.MarshalIndent(volume, "", "  ")
+	if err != nil {
+		log.Fatalf("Failed to encode volume: %v", err)
+	}
+	fmt.Println(string(data))
+}
+
+// handleVolumeRemove deletes a volume no container refers to
+func handleVolumeRemove() {
+	if len(os.Args) != 4 {
+		fmt.Fprintf(os.Stderr, "Usage: %s volume rm <name>\n", os.Args[0])
+		os.Exit(1)
+	}
+
+	if err := ns.RemoveVolume(os.Args[3]); err != nil {
+		log.Fatalf("Failed to remove volume: %v", err)
+	}
+	fmt.Println(os.Args[3])
+}
+
+// handleVolumePrune removes unused volumes after asking for confirmation
+func handleVolumePrune() {
+	pruneFlags := flag.NewFlagSet("volume prune", flag.ExitOnError)
+	var force bool
+	pruneFlags.BoolVar(&force, "f", false, "Do not prompt for confirmation")
+	pruneFlags.BoolVar(&force, "force", false, "Do not prompt for confirmation")
+	parseFlags(pruneFlags, os.Args[3:])
+
+	if !force {
+		fmt.Fprintf(os.Stderr, "WARNING! This will remove all volumes not used by any container, and their data.\n")
+		if !confirm("Are you sure you want to continue?") {
+			fmt.Fprintf(os.Stderr, "Aborted.\n")
+			os.Exit(1)
+		}
+	}
+
+	removed, reclaimed, err := ns.PruneVolumes()
+	if err != nil {
+		log.Fatalf("Failed to prune volumes: %v", err)
+	}
+
+	if len(removed) > 0 {
+		fmt.Printf("Deleted Volumes:\n")
+		for _, name := range removed {
+			fmt.Println(name)
+		}
+		fmt.Println()
+	}
+	fmt.Printf("Total reclaimed space: %s\n", ns.FormatSize(reclaimed))
+}
+
+// handleVolumeExport writes a volume's contents as a tarball to a file or
+// to standard output
+func handleVolumeExport() {
+	exportFlags := flag.NewFlagSet("volume export", flag.ExitOnError)
+	var output string
+	exportFlags.StringVar(&output, "o", "", "Write to a file instead of standard output")
+	exportFlags.StringVar(&output, "output", "", "Write to a file instead of standard output")
+	parseFlags(exportFlags, os.Args[3:])
+	if exportFlags.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: %s volume export [-o <file>] <name>\n", os.Args[0])
+		os.Exit(1)
+	}
+
+	writer := os.Stdout
+	if output == "" || output == "-" {
+		if info, err := os.Stdout.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+			log.Fatalf("Refusing to write a tarball to a terminal; use -o or redirect the output")
+		}
+	} else {
+		file, err := os.Create(output)
+		if err != nil {
+			log.Fatalf("Failed to export volume: %v", err)
+		}
+		defer file.Close()
+		writer = file
+	}
+
+	progress := ns.NewProgress("Exporting "+exportFlags.Arg(0), 0)
+	if err := ns.ExportVolume(exportFlags.Arg(0), io.MultiWriter(writer, progress)); err != nil {
+		if writer != os.Stdout {
+			os.Remove(output)
+		}
+		log.Fatalf("Failed to export volume: %v", err)
+	}
+	progress.Finish()
+	if err := writer.Close(); err != nil {
+		log.Fatalf("Failed to export volume: %v", err)
+	}
+}
+
+// handleVolumeImport unpacks a tarball from a file or standard input into a
+// volume, creating it if needed
+func handleVolumeImport() {
+	importFlags := flag.NewFlagSet("volume import", flag.ExitOnError)
+	var input string
+	importFlags.StringVar(&input, "i", "", "Read from a file instead of standard input")
+	importFlags.StringVar(&input, "input", "", "Read from a file instead of standard input")
+	parseFlags(importFlags, os.Args[3:])
+	if importFlags.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: %s volume import [-i <file>] <name>\n", os.Args[0])
+		os.Exit(1)
+	}
+
+	reader := os.Stdin
+	if input != "" && input != "-" {
+		file, err := os.Open(input)
+		if err != nil {
+			log.Fatalf("Failed to import volume: %v", err)
+		}
+		defer file.Close()
+		reader = file
+	}
+
+	// The percentage is known when reading a file rather than a pipe
+	var total int64
+	if info, err := reader.Stat(); err == nil && info.Mode().IsRegular() {
+		total = info.Size()
+	}
+	progress := ns.NewProgress("Importing "+importFlags.Arg(0), total)
+	if err := ns.ImportVolume(importFlags.Arg(0), io.TeeReader(reader, progress)); err != nil {
+		log.Fatalf("Failed to import volume: %v", err)
+	}
+	progress.Finish()
+	fmt.Println(importFlags.Arg(0))
+}
@@ -0,0 +1,405 @@
+//go:build linux
+
+// Package cgroup places containers in their own control group, which is how
+// nsctl applies resource limits, learns about OOM kills and measures usage.
+//
+// Both hierarchies are supported. On the unified (v2) hierarchy a container
+// gets /sys/fs/cgroup/nsctl/<id> (or, rootless, a group inside the systemd
+// scope delegated to it, see rootless.go); on v1 (including hybrid setups)
+// it gets a group in each controller nsctl uses, /sys/fs/cgroup/memory,
+// /sys/fs/cgroup/cpu, /sys/fs/cgroup/freezer, /sys/fs/cgroup/devices and
+// the accounting ones.
+package cgroup
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// mountPoint is where the cgroup filesystems are mounted
+	mountPoint = "/sys/fs/cgroup"
+
+	// parentName groups all nsctl containers under one cgroup
+	parentName = "nsctl"
+
+	// cpuPeriod is the CFS period --cpus quotas are expressed in (100ms)
+	cpuPeriod = 100000
+)
+
+// controllers are the controllers nsctl uses, in v1 hierarchy / v2 name form
+// v2 has no freezer controller; every group can be frozen there. Nor does
+// it have a devices controller, see devices.go. cpuacct, pids and blkio (io
+// on v2) only account for usage, see stats.go; the names one hierarchy
+// doesn't have are skipped.
+var controllers = []string{"memory", "cpu", "freezer", "devices", "cpuacct", "pids", "blkio", "io"}
+
+// Resources are the limits applied to a container's cgroup
+type Resources struct {
+	// MemoryLimit in bytes; 0 means unlimited
+	MemoryLimit int64
+
+	// CPUs is the number of CPUs' worth of time the container may use,
+	// e.g. 1.5; 0 means unlimited
+	CPUs float64
+
+	// Devices are the only devices the container may access, see
+	// devices.go; nil leaves it all of the host's
+	Devices []DeviceRule
+}
+
+// Cgroup is the control group of one container
+type Cgroup struct {
+	// Path is the group's directory (the memory controller's on v1)
+	Path string
+
+	unified bool
+
+	// v1Paths holds the group of each controller on v1
+	v1Paths map[string]string
+}
+
+// IsUnified reports whether the host uses the unified (v2) hierarchy
+func IsUnified() bool {
+	var stat unix.Statfs_t
+	return unix.Statfs(mountPoint, &stat) == nil && stat.Type == unix.CGROUP2_SUPER_MAGIC
+}
+
+// Create makes a new cgroup for the container and applies its limits
+func Create(containerID string, resources Resources) (*Cgroup, error) {
+	cgroup := &Cgroup{unified: IsUnified()}
+
+	if cgroup.unified {
+		parentPath, err := unifiedParent()
+		if err != nil {
+			return nil, err
+		}
+		cgroup.Path = filepath.Join(parentPath, containerID)
+		if err := os.Mkdir(cgroup.Path, 0755); err != nil && !os.IsExist(err) {
+			return nil, fmt.Errorf("failed to create cgroup %s: %v", cgroup.Path, err)
+		}
+	} else {
+		cgroup.v1Paths = map[string]string{}
+		for _, controller := range controllers {
+			// Hierarchies that aren't mounted are simply not used
+			hierarchy := filepath.Join(mountPoint, controller)
+			if _, err := os.Stat(hierarchy); err != nil {
+				continue
+			}
+
+			path := filepath.Join(hierarchy, parentName, containerID)
+			if err := os.MkdirAll(path, 0755); err != nil {
+				cgroup.Delete()
+				return nil, fmt.Errorf("failed to create cgroup %s: %v", path, err)
+			}
+			cgroup.v1Paths[controller] = path
+		}
+		cgroup.Path = cgroup.v1Paths["memory"]
+		if cgroup.Path == "" {
+			cgroup.Delete()
+			return nil, fmt.Errorf("the memory cgroup controller is not mounted")
+		}
+	}
+
+	if err := cgroup.apply(resources); err != nil {
+		cgroup.Delete()
+		return nil, err
+	}
+	return cgroup, nil
+}
+
+// Paths returns the group's directories by hierarchy: one per controller
+// on v1, and just the group itself, under "", on the unified hierarchy
+func (c *Cgroup) Paths() map[string]string {
+	if c.unified {
+		return map[string]string{"": c.Path}
+	}
+	paths := map[string]string{}
+	for controller, path := range c.v1Paths {
+		paths[controller] = path
+	}
+	return paths
+}
+
+// unifiedParent prepares the v2 group that container groups are created in
+func unifiedParent() (string, error) {
+	if os.Geteuid() != 0 {
+		return delegatedParent()
+	}
+
+	parentPath := filepath.Join(mountPoint, parentName)
+	if err := os.MkdirAll(parentPath, 0755); err != nil {
+		return "", fmt.Errorf("failed to create cgroup %s: %v", parentPath, err)
+	}
+
+	// Controllers must be enabled for the children of every level above the
+	// container's group before its interface files appear
+	for _, path := range []string{mountPoint, parentPath} {
+		if err := enableControllers(path); err != nil {
+			return "", err
+		}
+	}
+	return parentPath, nil
+}
+
+// enableControllers enables nsctl's controllers for a v2 group's children,
+// as far as they are available to the group
+func enableControllers(path string) error {
+	available, err := os.ReadFile(filepath.Join(path, "cgroup.controllers"))
+	if err != nil {
+		return fmt.Errorf("failed to read the controllers of %s: %v", path, err)
+	}
+	enabled, err := os.ReadFile(filepath.Join(path, "cgroup.subtree_control"))
+	if err != nil {
+		return fmt.Errorf("failed to read the controllers of %s: %v", path, err)
+	}
+
+	var toEnable []string
+	for _, controller := range controllers {
+		if hasWord(string(available), controller) && !hasWord(string(enabled), controller) {
+			toEnable = append(toEnable, "+"+controller)
+		}
+	}
+	if len(toEnable) == 0 {
+		return nil
+	}
+
+	controlPath := filepath.Join(path, "cgroup.subtree_control")
+	if err := os.WriteFile(controlPath, []byte(strings.Join(toEnable, " ")), 0644); err != nil {
+		return fmt.Errorf("failed to enable cgroup controllers in %s: %v", path, err)
+	}
+	return nil
+}
+
+// hasWord reports whether a space-separated list contains word
+func hasWord(list string, word string) bool {
+	for _, field := range strings.Fields(list) {
+		if field == word {
+			return true
+		}
+	}
+	return false
+}
+
+// Setting is a limit as it is written to a group's interface file
+type Setting struct {
+	Controller string
+	File       string
+	Value      string
+}
+
+// Settings returns the interface files Create writes resources to, on the
+// unified hierarchy or on v1
+func Settings(resources Resources, unified bool) []Setting {
+	var settings []Setting
+	if resources.MemoryLimit > 0 {
+		limit := strconv.FormatInt(resources.MemoryLimit, 10)
+		if unified {
+			settings = append(settings, Setting{"memory", "memory.max", limit})
+		} else {
+			settings = append(settings, Setting{"memory", "memory.limit_in_bytes", limit})
+		}
+	}
+
+	if resources.CPUs > 0 {
+		quota := strconv.FormatInt(int64(resources.CPUs*cpuPeriod), 10)
+		if unified {
+			settings = append(settings, Setting{"cpu", "cpu.max", quota + " " + strconv.Itoa(cpuPeriod)})
+		} else {
+			settings = append(settings,
+				Setting{"cpu", "cpu.cfs_period_us", strconv.Itoa(cpuPeriod)},
+				Setting{"cpu", "cpu.cfs_quota_us", quota})
+		}
+	}
+
+	// The unified hierarchy filters devices with a program instead
+	if resources.Devices != nil && !unified {
+		settings = append(settings, deviceSettings(resources.Devices)...)
+	}
+	return settings
+}
+
+// GroupPath returns the group Create makes for a container when running as
+// root: the group itself on the unified hierarchy, the memory controller's
+// on v1. Rootless groups live in a scope only systemd can name.
+func GroupPath(containerID string) string {
+	if IsUnified() {
+		return filepath.Join(mountPoint, parentName, containerID)
+	}
+	return filepath.Join(mountPoint, "memory", parentName, containerID)
+}
+
+// ContainerGroups returns the groups Create made as root that still exist,
+// as GroupPath returns them, by container ID
+func ContainerGroups() (map[string]string, error) {
+	parent := filepath.Join(mountPoint, "memory", parentName)
+	if IsUnified() {
+		parent = filepath.Join(mountPoint, parentName)
+	}
+	entries, err := os.ReadDir(parent)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read cgroup %s: %v", parent, err)
+	}
+
+	groups := map[string]string{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			groups[entry.Name()] = filepath.Join(parent, entry.Name())
+		}
+	}
+	return groups, nil
+}
+
+// Empty reports whether no process is left in the group
+func (cgroup *Cgroup) Empty() (bool, error) {
+	procs, err := os.ReadFile(filepath.Join(cgroup.Path, "cgroup.procs"))
+	if err != nil {
+		return false, fmt.Errorf("failed to read cgroup %s: %v", cgroup.Path, err)
+	}
+	return strings.TrimSpace(string(procs)) == "", nil
+}
+
+// Kill kills every process left in the group, with cgroup.kill where the
+// kernel has it (v2, Linux 5.14) and one by one elsewhere
+func (cgroup *Cgroup) Kill() error {
+	if cgroup.unified && cgroup.write(cgroup.Path, "cgroup.kill", "1") == nil {
+		return nil
+	}
+
+	// Killing them one by one races with their forks, so go round again
+	// until none is left
+	for attempt := 0; attempt < 20; attempt++ {
+		procs, err := os.ReadFile(filepath.Join(cgroup.Path, "cgroup.procs"))
+		if err != nil {
+			return fmt.Errorf("failed to read cgroup %s: %v", cgroup.Path, err)
+		}
+		pids := strings.Fields(string(procs))
+		if len(pids) == 0 {
+			return nil
+		}
+		for _, pid := range pids {
+			if pid, err := strconv.Atoi(pid); err == nil {
+				syscall.Kill(pid, syscall.SIGKILL)
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return fmt.Errorf("failed to kill the processes in cgroup %s", cgroup.Path)
+}
+
+// apply writes the resource limits into the group
+func (cgroup *Cgroup) apply(resources Resources) error {
+	for _, setting := range Settings(resources, cgroup.unified) {
+		if err := cgroup.writeController(setting.Controller, setting.File, setting.Value); err != nil {
+			return err
+		}
+	}
+	if resources.Devices != nil && cgroup.unified {
+		return cgroup.attachDeviceFilter(resources.Devices)
+	}
+	return nil
+}
+
+// AddProcess moves a process (and the children it creates from now on)
+// into the cgroup
+func (cgroup *Cgroup) AddProcess(pid int) error {
+	if cgroup.unified {
+		return cgroup.write(cgroup.Path, "cgroup.procs", strconv.Itoa(pid))
+	}
+	for _, path := range cgroup.v1Paths {
+		if err := cgroup.write(path, "cgroup.procs", strconv.Itoa(pid)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// OOMKillCount returns how many processes in the cgroup the kernel's OOM
+// killer has killed. v2 reports it in memory.events, v1 (since Linux 4.13)
+// in memory.oom_control.
+func (cgroup *Cgroup) OOMKillCount() (int, error) {
+	eventsFile := "memory.oom_control"
+	if cgroup.unified {
+		eventsFile = "memory.events"
+	}
+
+	data, err := os.ReadFile(filepath.Join(cgroup.Path, eventsFile))
+	if err != nil {
+		return 0, fmt.Errorf("failed to read OOM events: %v", err)
+	}
+
+	// Both files hold "key value" lines
+	for _, line := range strings.Split(string(data), "\n") {
+		if value, found := strings.CutPrefix(line, "oom_kill "); found {
+			return strconv.Atoi(value)
+		}
+	}
+	return 0, nil
+}
+
+// Delete removes the cgroup
+// A group can only be removed once its processes are gone, and processes
+// killed along with the container's init may take a moment to exit
+func (cgroup *Cgroup) Delete() error {
+	paths := []string{cgroup.Path}
+	if !cgroup.unified {
+		paths = nil
+		for _, path := range cgroup.v1Paths {
+			paths = append(paths, path)
+		}
+	}
+
+	for _, path := range paths {
+		if err := removeGroup(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeGroup removes one cgroup directory, waiting for it to empty
+func removeGroup(path string) error {
+	var err error
+	for attempt := 0; attempt < 20; attempt++ {
+		err = os.Remove(path)
+		if err == nil || os.IsNotExist(err) {
+			return nil
+		}
+		if !errors.Is(err, syscall.EBUSY) {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return fmt.Errorf("failed to remove cgroup %s: %v", path, err)
+}
+
+// writeController sets an interface file of one controller
+// A missing file means the controller isn't available to the group
+func (cgroup *Cgroup) writeController(controller string, fileName string, value string) error {
+	path := cgroup.Path
+	if !cgroup.unified {
+		path = cgroup.v1Paths[controller]
+	}
+
+	if _, err := os.Stat(filepath.Join(path, fileName)); path == "" || os.IsNotExist(err) {
+		return fmt.Errorf("the %s cgroup controller is not available", controller)
+	}
+	return cgroup.write(path, fileName, value)
+}
+
+// write sets one interface file of a group
+func (cgroup *Cgroup) write(path string, fileName string, value string) error {
+	filePath := filepath.Join(path, fileName)
+	if err := os.WriteFile(filePath, []byte(value), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", filePath, err)
+	}
+	return nil
+}
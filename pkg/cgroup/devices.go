@@ -0,0 +1,233 @@
+//go:build linux
+
+package cgroup
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Device access
+//
+// A group with Resources.Devices may open, read, write and create only the
+// device nodes its rules allow. On v1 that takes the devices controller:
+// everything is denied in devices.deny, then each rule is allowed in
+// devices.allow. v2 has no such controller; a BPF_PROG_TYPE_CGROUP_DEVICE
+// program is attached to the group instead, which the kernel runs on every
+// device access and which allows exactly what the rules match. It stays
+// attached until the group is removed.
+
+// DeviceRule allows access to some devices
+type DeviceRule struct {
+	// Type is 'c' for character devices, 'b' for block devices, 'a' for
+	// both
+	Type rune
+
+	// Major and Minor number the devices; -1 matches any
+	Major int64
+	Minor int64
+
+	// Access is some of "rwm": read, write, mknod
+	Access string
+}
+
+// String renders a rule the way devices.allow takes it, e.g. "c 1:3 rwm"
+func (rule DeviceRule) String() string {
+	number := func(n int64) string {
+		if n < 0 {
+			return "*"
+		}
+		return strconv.FormatInt(n, 10)
+	}
+	return fmt.Sprintf("%c %s:%s %s", rule.Type, number(rule.Major), number(rule.Minor), rule.Access)
+}
+
+// DefaultDeviceRules are the devices every container may use: creating
+// nodes (which still takes CAP_MKNOD), the standard character devices and
+// pseudo terminals
+var DefaultDeviceRules = []DeviceRule{
+	{Type: 'c', Major: -1, Minor: -1, Access: "m"},
+	{Type: 'b', Major: -1, Minor: -1, Access: "m"},
+	{Type: 'c', Major: 1, Minor: 3, Access: "rwm"},    // /dev/null
+	{Type: 'c', Major: 1, Minor: 5, Access: "rwm"},    // /dev/zero
+	{Type: 'c', Major: 1, Minor: 7, Access: "rwm"},    // /dev/full
+	{Type: 'c', Major: 1, Minor: 8, Access: "rwm"},    // /dev/random
+	{Type: 'c', Major: 1, Minor: 9, Access: "rwm"},    // /dev/urandom
+	{Type: 'c', Major: 5, Minor: 0, Access: "rwm"},    // /dev/tty
+	{Type: 'c', Major: 5, Minor: 1, Access: "rwm"},    // /dev/console
+	{Type: 'c', Major: 5, Minor: 2, Access: "rwm"},    // /dev/ptmx
+	{Type: 'c', Major: 136, Minor: -1, Access: "rwm"}, // /dev/pts/*
+}
+
+// deviceSettings are the v1 interface file writes of a device allow list
+func deviceSettings(rules []DeviceRule) []Setting {
+	settings := []Setting{{"devices", "devices.deny", "a"}}
+	for _, rule := range rules {
+		settings = append(settings, Setting{"devices", "devices.allow", rule.String()})
+	}
+	return settings
+}
+
+// bpfInstruction is one eBPF instruction, struct bpf_insn
+type bpfInstruction struct {
+	code      uint8
+	registers uint8 // destination in the low nibble, source in the high one
+	offset    int16
+	immediate int32
+}
+
+// Instructions of the device filter
+func bpfLoadWord(destination, source uint8, offset int16) bpfInstruction {
+	return bpfInstruction{code: unix.BPF_LDX | unix.BPF_MEM | unix.BPF_W, registers: destination | source<<4, offset: offset}
+}
+
+func bpfMoveRegister(destination, source uint8) bpfInstruction {
+	return bpfInstruction{code: unix.BPF_ALU64 | unix.BPF_MOV | unix.BPF_X, registers: destination | source<<4}
+}
+
+func bpfMoveImmediate(destination uint8, value int32) bpfInstruction {
+	return bpfInstruction{code: unix.BPF_ALU64 | unix.BPF_MOV | unix.BPF_K, registers: destination, immediate: value}
+}
+
+func bpfALUImmediate(operation uint8, destination uint8, value int32) bpfInstruction {
+	return bpfInstruction{code: unix.BPF_ALU64 | operation | unix.BPF_K, registers: destination, immediate: value}
+}
+
+// bpfJumpIfNotEqual jumps over offset instructions unless the register
+// holds value
+func bpfJumpIfNotEqual(register uint8, value int32, offset int16) bpfInstruction {
+	return bpfInstruction{code: unix.BPF_JMP | unix.BPF_JNE | unix.BPF_K, registers: register, offset: offset, immediate: value}
+}
+
+var bpfExit = bpfInstruction{code: unix.BPF_JMP | unix.BPF_EXIT}
+
+// deviceAccessBits are the access bits of the device program's context
+var deviceAccessBits = map[rune]int32{
+	'r': unix.BPF_DEVCG_ACC_READ,
+	'w': unix.BPF_DEVCG_ACC_WRITE,
+	'm': unix.BPF_DEVCG_ACC_MKNOD,
+}
+
+const allDeviceAccess = unix.BPF_DEVCG_ACC_READ | unix.BPF_DEVCG_ACC_WRITE | unix.BPF_DEVCG_ACC_MKNOD
+
+// deviceFilterProgram compiles an allow list into a device program
+// The program gets a struct bpf_cgroup_dev_ctx in r1: the access type
+// (device type in the low 16 bits, access in the high ones), major and
+// minor. It returns 1 from the first rule that matches, 0 if none does.
+func deviceFilterProgram(rules []DeviceRule) []bpfInstruction {
+	program := []bpfInstruction{
+		bpfLoadWord(2, 1, 0),
+		bpfMoveRegister(3, 2),
+		bpfALUImmediate(unix.BPF_AND, 3, 0xffff), // r3: device type
+		bpfMoveRegister(4, 2),
+		bpfALUImmediate(unix.BPF_RSH, 4, 16), // r4: access
+		bpfLoadWord(5, 1, 4),                 // r5: major
+		bpfLoadWord(6, 1, 8),                 // r6: minor
+	}
+
+	for _, rule := range rules {
+		// Each test jumps to the next rule, past the end of this one
+		var block []bpfInstruction
+		switch rule.Type {
+		case 'c':
+			block = append(block, bpfJumpIfNotEqual(3, unix.BPF_DEVCG_DEV_CHAR, 0))
+		case 'b':
+			block = append(block, bpfJumpIfNotEqual(3, unix.BPF_DEVCG_DEV_BLOCK, 0))
+		}
+		var allowed int32
+		for _, access := range rule.Access {
+			allowed |= deviceAccessBits[access]
+		}
+		if allowed != allDeviceAccess {
+			// Any access outside the rule's leaves a bit in r7
+			block = append(block,
+				bpfMoveRegister(7, 4),
+				bpfALUImmediate(unix.BPF_AND, 7, allDeviceAccess&^allowed),
+				bpfJumpIfNotEqual(7, 0, 0))
+		}
+		if rule.Major >= 0 {
+			block = append(block, bpfJumpIfNotEqual(5, int32(rule.Major), 0))
+		}
+		if rule.Minor >= 0 {
+			block = append(block, bpfJumpIfNotEqual(6, int32(rule.Minor), 0))
+		}
+		block = append(block, bpfMoveImmediate(0, 1), bpfExit)
+
+		for index := range block {
+			if block[index].code == unix.BPF_JMP|unix.BPF_JNE|unix.BPF_K {
+				block[index].offset = int16(len(block) - index - 1)
+			}
+		}
+		program = append(program, block...)
+	}
+	return append(program, bpfMoveImmediate(0, 0), bpfExit)
+}
+
+// bpfProgramLoadAttr is the part of union bpf_attr BPF_PROG_LOAD reads
+type bpfProgramLoadAttr struct {
+	programType        uint32
+	instructionCount   uint32
+	instructions       uint64
+	license            uint64
+	logLevel           uint32
+	logSize            uint32
+	logBuffer          uint64
+	kernelVersion      uint32
+	programFlags       uint32
+	programName        [unix.BPF_OBJ_NAME_LEN]byte
+	programIfindex     uint32
+	expectedAttachType uint32
+}
+
+// bpfProgramAttachAttr is the part of union bpf_attr BPF_PROG_ATTACH reads
+type bpfProgramAttachAttr struct {
+	targetFD     uint32
+	attachBPFFD  uint32
+	attachType   uint32
+	attachFlags  uint32
+	replaceBPFFD uint32
+}
+
+// attachDeviceFilter restricts the v2 group to the devices rules allow
+func (cgroup *Cgroup) attachDeviceFilter(rules []DeviceRule) error {
+	program := deviceFilterProgram(rules)
+	license := []byte("GPL\x00")
+	loadAttr := bpfProgramLoadAttr{
+		programType:        unix.BPF_PROG_TYPE_CGROUP_DEVICE,
+		instructionCount:   uint32(len(program)),
+		instructions:       uint64(uintptr(unsafe.Pointer(&program[0]))),
+		license:            uint64(uintptr(unsafe.Pointer(&license[0]))),
+		expectedAttachType: unix.BPF_CGROUP_DEVICE,
+	}
+	copy(loadAttr.programName[:], "nsctl_devices")
+	programFD, _, errno := unix.Syscall(unix.SYS_BPF, unix.BPF_PROG_LOAD, uintptr(unsafe.Pointer(&loadAttr)), unsafe.Sizeof(loadAttr))
+	runtime.KeepAlive(program)
+	runtime.KeepAlive(license)
+	if errno != 0 {
+		return fmt.Errorf("failed to load device filter: %v", errno)
+	}
+	defer unix.Close(int(programFD))
+
+	group, err := os.Open(cgroup.Path)
+	if err != nil {
+		return fmt.Errorf("failed to open cgroup %s: %v", cgroup.Path, err)
+	}
+	defer group.Close()
+
+	// Filters of the groups above still apply as well
+	attachAttr := bpfProgramAttachAttr{
+		targetFD:    uint32(group.Fd()),
+		attachBPFFD: uint32(programFD),
+		attachType:  unix.BPF_CGROUP_DEVICE,
+		attachFlags: unix.BPF_F_ALLOW_MULTI,
+	}
+	if _, _, errno := unix.Syscall(unix.SYS_BPF, unix.BPF_PROG_ATTACH, uintptr(unsafe.Pointer(&attachAttr)), unsafe.Sizeof(attachAttr)); errno != 0 {
+		return fmt.Errorf("failed to attach device filter to cgroup %s: %v", cgroup.Path, errno)
+	}
+	return nil
+}
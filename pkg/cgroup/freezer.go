@@ -0,0 +1,82 @@
+//go:build linux
+
+package cgroup
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Freezing
+//
+// A frozen group's processes are stopped where they are, without a signal
+// they could notice, until the group is thawed. On v2 every group has a
+// cgroup.freeze file; on v1 it takes the freezer controller, which nsctl
+// creates a group in alongside memory and cpu.
+
+// freezeTimeout bounds how long Freeze waits for the group to settle
+const freezeTimeout = 5 * time.Second
+
+// Load returns the cgroup at path, as recorded for a container, so another
+// process than the shim that created it can work with it
+// On v1, path is the memory controller's group, as in Cgroup.Path; the
+// other controllers' groups are at the same place in their hierarchies.
+func Load(path string) *Cgroup {
+	if IsUnified() {
+		return &Cgroup{Path: path, unified: true}
+	}
+
+	cgroup := &Cgroup{Path: path, v1Paths: map[string]string{}}
+	relativePath, err := filepath.Rel(filepath.Join(mountPoint, "memory"), path)
+	if err != nil || strings.HasPrefix(relativePath, "..") {
+		cgroup.v1Paths["memory"] = path
+		return cgroup
+	}
+	for _, controller := range controllers {
+		controllerPath := filepath.Join(mountPoint, controller, relativePath)
+		if _, err := os.Stat(controllerPath); err == nil {
+			cgroup.v1Paths[controller] = controllerPath
+		}
+	}
+	return cgroup
+}
+
+// Freeze stops every process in the group, or with frozen false resumes
+// them, and waits until the kernel reports the group in that state
+func (cgroup *Cgroup) Freeze(frozen bool) error {
+	// The file to write, its value, and the state line to wait for
+	path, controlFile, stateFile := cgroup.v1Paths["freezer"], "freezer.state", "freezer.state"
+	value, settled := "THAWED", "THAWED"
+	if frozen {
+		value, settled = "FROZEN", "FROZEN"
+	}
+	if cgroup.unified {
+		path, controlFile, stateFile = cgroup.Path, "cgroup.freeze", "cgroup.events"
+		value, settled = "0", "frozen 0"
+		if frozen {
+			value, settled = "1", "frozen 1"
+		}
+	}
+	if path == "" {
+		return fmt.Errorf("the freezer cgroup controller is not available")
+	}
+
+	if err := cgroup.write(path, controlFile, value); err != nil {
+		return err
+	}
+	for deadline := time.Now().Add(freezeTimeout); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		state, err := os.ReadFile(filepath.Join(path, stateFile))
+		if err != nil {
+			return fmt.Errorf("failed to read the freezer state of %s: %v", path, err)
+		}
+		for _, line := range strings.Split(string(state), "\n") {
+			if strings.TrimSpace(line) == settled {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("cgroup %s did not reach %q within %v", path, settled, freezeTimeout)
+}
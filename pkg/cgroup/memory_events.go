@@ -0,0 +1,152 @@
+//go:build linux
+
+package cgroup
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Memory events
+//
+// v2 counts in memory.events how often the group's memory use reached
+// memory.high ("high") and memory.max ("max"), ran out of memory ("oom")
+// and had a process OOM-killed ("oom_kill"), for the group and the groups
+// below it; memory.events.local counts the group's own. v1 only notifies
+// OOMs, which the watcher counts itself, and counts OOM kills in
+// memory.oom_control, so "high", "max" and local counters are v2 only.
+
+// Memory event names
+const (
+	MemoryEventHigh    = "high"
+	MemoryEventMax     = "max"
+	MemoryEventOOM     = "oom"
+	MemoryEventOOMKill = "oom_kill"
+)
+
+// MemoryEventsWatcher reports the memory events of a cgroup as they happen
+type MemoryEventsWatcher struct {
+	// Events receives the counters that went up, by event name, with their
+	// new totals; it is closed when the watcher stops
+	Events <-chan map[string]uint64
+
+	notifications *os.File
+	eventControl  *os.File // v1: keeps the memory.oom_control registration alive
+}
+
+// HasMemoryEvent reports whether the group's hierarchy counts an event,
+// locally or including the groups below
+func (cgroup *Cgroup) HasMemoryEvent(event string, local bool) bool {
+	if cgroup.unified {
+		return true
+	}
+	return !local && (event == MemoryEventOOM || event == MemoryEventOOMKill)
+}
+
+// MemoryEvents reads the group's memory event counters (v1: just oom_kill)
+func (cgroup *Cgroup) MemoryEvents(local bool) (map[string]uint64, error) {
+	if !cgroup.unified {
+		count, err := cgroup.OOMKillCount()
+		return map[string]uint64{MemoryEventOOMKill: uint64(count)}, err
+	}
+	path := filepath.Join(cgroup.Path, memoryEventsFile(local))
+	if _, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("failed to read memory events: %v", err)
+	}
+	return readKeyValues(path), nil
+}
+
+// memoryEventsFile is the v2 file of the hierarchical or local counters
+func memoryEventsFile(local bool) string {
+	if local {
+		return "memory.events.local"
+	}
+	return "memory.events"
+}
+
+// WatchMemoryEvents starts watching the group's memory event counters
+func (cgroup *Cgroup) WatchMemoryEvents(local bool) (*MemoryEventsWatcher, error) {
+	if local && !cgroup.unified {
+		return nil, fmt.Errorf("local memory events need the unified cgroup hierarchy")
+	}
+	reported, err := cgroup.MemoryEvents(local)
+	if err != nil {
+		return nil, err
+	}
+	notifications, eventControl, err := cgroup.memoryNotifications(memoryEventsFile(local))
+	if err != nil {
+		return nil, err
+	}
+	watcher := &MemoryEventsWatcher{notifications: notifications, eventControl: eventControl}
+
+	events := make(chan map[string]uint64, 1)
+	watcher.Events = events
+	go watcher.run(cgroup, local, reported, events)
+	return watcher, nil
+}
+
+// run forwards increases of the counters until Close
+func (watcher *MemoryEventsWatcher) run(cgroup *Cgroup, local bool, reported map[string]uint64, events chan<- map[string]uint64) {
+	defer close(events)
+
+	var oomCount uint64 // v1: the OOM notifications so far
+	reportIncreases := func() bool {
+		counters, err := cgroup.MemoryEvents(local)
+		if err != nil {
+			return false
+		}
+		if !cgroup.unified {
+			counters[MemoryEventOOM] = oomCount
+		}
+		increased := map[string]uint64{}
+		for event, count := range counters {
+			if count > reported[event] {
+				increased[event] = count
+			}
+		}
+		reported = counters
+		if len(increased) == 0 {
+			return false
+		}
+		events <- increased
+		return true
+	}
+
+	buffer := make([]byte, 4096)
+	for {
+		count, err := watcher.notifications.Read(buffer)
+		if err != nil {
+			// Closed: catch what happened just before the watcher was stopped
+			reportIncreases()
+			return
+		}
+		if cgroup.unified {
+			reportIncreases()
+			continue
+		}
+
+		// An eventfd read returns the number of notifications since the
+		// last one. They arrive before the OOM killer has picked and
+		// counted its victim, so look again for a moment.
+		if count == 8 {
+			oomCount += binary.NativeEndian.Uint64(buffer[:8])
+		}
+		reportIncreases()
+		before := reported[MemoryEventOOMKill]
+		for attempt := 0; attempt < 10 && reported[MemoryEventOOMKill] == before; attempt++ {
+			time.Sleep(10 * time.Millisecond)
+			reportIncreases()
+		}
+	}
+}
+
+// Close stops the watcher
+func (watcher *MemoryEventsWatcher) Close() {
+	watcher.notifications.Close()
+	if watcher.eventControl != nil {
+		watcher.eventControl.Close()
+	}
+}
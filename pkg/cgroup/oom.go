@@ -0,0 +1,131 @@
+//go:build linux
+
+package cgroup
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// OOMWatcher reports OOM kills in a cgroup as they happen
+//
+// On v2 the kernel signals every change of memory.events as an inotify
+// modification. v1 has no such file to watch; instead an eventfd is
+// registered for OOM notifications through cgroup.event_control. Either way
+// the watcher wakes up, re-reads the oom_kill counter and reports it when it
+// went up.
+type OOMWatcher struct {
+	// Kills receives the cgroup's total oom_kill count after every kill;
+	// it is closed when the watcher stops
+	Kills <-chan int
+
+	notifications *os.File
+	eventControl  *os.File // v1: keeps the memory.oom_control registration alive
+}
+
+// WatchOOM starts watching the cgroup for OOM kills
+func (cgroup *Cgroup) WatchOOM() (*OOMWatcher, error) {
+	notifications, eventControl, err := cgroup.memoryNotifications("memory.events")
+	if err != nil {
+		return nil, err
+	}
+	watcher := &OOMWatcher{notifications: notifications, eventControl: eventControl}
+
+	kills := make(chan int, 1)
+	watcher.Kills = kills
+	go watcher.run(cgroup, kills)
+	return watcher, nil
+}
+
+// memoryNotifications returns a file that becomes readable when the group's
+// memory events change: an inotify watch on eventsFile on v2, an OOM eventfd
+// on v1, with the memory.oom_control file that keeps its registration alive
+func (cgroup *Cgroup) memoryNotifications(eventsFile string) (*os.File, *os.File, error) {
+	if cgroup.unified {
+		notifications, err := watchModifications(filepath.Join(cgroup.Path, eventsFile))
+		return notifications, nil, err
+	}
+	return registerOOMEventFD(cgroup.Path)
+}
+
+// watchModifications sets up an inotify watch on a v2 events file
+// Non-blocking descriptors wrapped in os.File go through the runtime's
+// poller, so Close interrupts a pending Read
+func watchModifications(eventsPath string) (*os.File, error) {
+	inotifyFD, err := unix.InotifyInit1(unix.IN_NONBLOCK | unix.IN_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create inotify instance: %v", err)
+	}
+	if _, err := unix.InotifyAddWatch(inotifyFD, eventsPath, unix.IN_MODIFY); err != nil {
+		unix.Close(inotifyFD)
+		return nil, fmt.Errorf("failed to watch %s: %v", eventsPath, err)
+	}
+	return os.NewFile(uintptr(inotifyFD), "inotify"), nil
+}
+
+// registerOOMEventFD asks a v1 memory cgroup to signal OOMs on an eventfd
+func registerOOMEventFD(path string) (*os.File, *os.File, error) {
+	oomControl, err := os.Open(filepath.Join(path, "memory.oom_control"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open memory.oom_control: %v", err)
+	}
+
+	eventFD, err := unix.Eventfd(0, unix.EFD_NONBLOCK|unix.EFD_CLOEXEC)
+	if err != nil {
+		oomControl.Close()
+		return nil, nil, fmt.Errorf("failed to create eventfd: %v", err)
+	}
+
+	registration := strconv.Itoa(eventFD) + " " + strconv.Itoa(int(oomControl.Fd()))
+	if err := os.WriteFile(filepath.Join(path, "cgroup.event_control"), []byte(registration), 0); err != nil {
+		unix.Close(eventFD)
+		oomControl.Close()
+		return nil, nil, fmt.Errorf("failed to register for OOM notifications: %v", err)
+	}
+	return os.NewFile(uintptr(eventFD), "eventfd"), oomControl, nil
+}
+
+// run forwards increases of the oom_kill counter until Close
+func (watcher *OOMWatcher) run(cgroup *Cgroup, kills chan<- int) {
+	defer close(kills)
+
+	reported, _ := cgroup.OOMKillCount()
+	reportNewKills := func() bool {
+		count, err := cgroup.OOMKillCount()
+		if err != nil || count <= reported {
+			return false
+		}
+		reported = count
+		kills <- count
+		return true
+	}
+
+	buffer := make([]byte, 4096)
+	for {
+		if _, err := watcher.notifications.Read(buffer); err != nil {
+			// Closed: catch a kill that happened just before the workload
+			// exited and the watcher was stopped
+			reportNewKills()
+			return
+		}
+
+		// v1 notifies when the cgroup runs out of memory, which is before
+		// the OOM killer has picked and counted its victim
+		for attempt := 0; attempt < 10 && !reportNewKills(); attempt++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+// Close stops the watcher
+func (watcher *OOMWatcher) Close() {
+	watcher.notifications.Close()
+	if watcher.eventControl != nil {
+		watcher.eventControl.Close()
+	}
+}
@@ -0,0 +1,296 @@
+//go:build linux
+
+package cgroup
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Pressure stall information
+//
+// On the unified hierarchy every group has cpu.pressure, memory.pressure and
+// io.pressure (Linux 4.20+ with PSI enabled): the share of time some (or
+// all, "full") of the group's tasks were stalled waiting for the resource,
+// averaged over 10s, 60s and 300s, and the total stall time. Rising memory
+// pressure is the warning before the OOM killer steps in.
+//
+// A trigger asks the kernel to signal when tasks stalled for at least a
+// given time within a time window, e.g. 150ms in 1s; the kernel then wakes
+// pollers of the pressure file with POLLPRI, at most once per window.
+// v1 groups have no pressure files.
+
+// pressureResources are the resources with pressure files
+var pressureResources = []string{"cpu", "memory", "io"}
+
+// PressureStats holds the pressure of each resource; a resource is nil if
+// the kernel doesn't report it
+type PressureStats struct {
+	CPU    *Pressure `json:"cpu,omitempty"`
+	Memory *Pressure `json:"memory,omitempty"`
+	IO     *Pressure `json:"io,omitempty"`
+}
+
+// Resource returns the pressure of cpu, memory or io
+func (stats *PressureStats) Resource(name string) *Pressure {
+	if field := stats.resource(name); field != nil {
+		return *field
+	}
+	return nil
+}
+
+func (stats *PressureStats) resource(name string) **Pressure {
+	switch name {
+	case "cpu":
+		return &stats.CPU
+	case "memory":
+		return &stats.Memory
+	case "io":
+		return &stats.IO
+	}
+	return nil
+}
+
+// Pressure is the stall information of one resource
+type Pressure struct {
+	Some PressureLine `json:"some"`
+
+	// Full is nil for cpu before Linux 5.13
+	Full *PressureLine `json:"full,omitempty"`
+}
+
+// Line returns the some or the full line; full falls back to some where
+// the kernel has none
+func (pressure *Pressure) Line(full bool) PressureLine {
+	if full && pressure.Full != nil {
+		return *pressure.Full
+	}
+	return pressure.Some
+}
+
+// PressureLine is the stall share averaged over 10s, 60s and 300s, in
+// percent, and the total stall time
+type PressureLine struct {
+	Avg10       float64 `json:"avg10"`
+	Avg60       float64 `json:"avg60"`
+	Avg300      float64 `json:"avg300"`
+	TotalMicros uint64  `json:"total_us"`
+}
+
+// Pressure reads the group's pressure files
+func (cgroup *Cgroup) Pressure() (*PressureStats, error) {
+	if !cgroup.unified {
+		return nil, fmt.Errorf("pressure stall information needs the unified cgroup hierarchy")
+	}
+	stats := &PressureStats{}
+	for _, resource := range pressureResources {
+		pressure, err := readPressure(filepath.Join(cgroup.Path, resource+".pressure"))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		*stats.resource(resource) = pressure
+	}
+	if stats.CPU == nil && stats.Memory == nil && stats.IO == nil {
+		return nil, fmt.Errorf("the kernel reports no pressure stall information (PSI disabled?)")
+	}
+	return stats, nil
+}
+
+// readPressure parses a pressure file:
+// "some avg10=0.00 avg60=0.00 avg300=0.00 total=0", then the "full" line
+func readPressure(path string) (*Pressure, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pressure := &Pressure{}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		var parsed PressureLine
+		for _, field := range fields[1:] {
+			key, value, _ := strings.Cut(field, "=")
+			switch key {
+			case "avg10":
+				parsed.Avg10, _ = strconv.ParseFloat(value, 64)
+			case "avg60":
+				parsed.Avg60, _ = strconv.ParseFloat(value, 64)
+			case "avg300":
+				parsed.Avg300, _ = strconv.ParseFloat(value, 64)
+			case "total":
+				parsed.TotalMicros, _ = strconv.ParseUint(value, 10, 64)
+			}
+		}
+		switch fields[0] {
+		case "some":
+			pressure.Some = parsed
+		case "full":
+			pressure.Full = &parsed
+		}
+	}
+	return pressure, nil
+}
+
+// PressureTrigger is a pressure threshold to be notified of
+type PressureTrigger struct {
+	// Resource is cpu, memory or io
+	Resource string `json:"resource"`
+
+	// Full counts only the time all tasks were stalled, rather than some
+	Full bool `json:"full,omitempty"`
+
+	// Stall is how long tasks have to stall within Window
+	Stall  time.Duration `json:"stall"`
+	Window time.Duration `json:"window"`
+}
+
+// The kernel's bounds on trigger windows; since Linux 6.5, processes
+// without CAP_SYS_RESOURCE (such as rootless shims) are held to multiples of
+// unprivilegedPressureWindow
+const (
+	minPressureWindow          = 500 * time.Millisecond
+	maxPressureWindow          = 10 * time.Second
+	unprivilegedPressureWindow = 2 * time.Second
+)
+
+// ParsePressureTrigger parses a trigger in the form
+// <resource>=[some:|full:]<stall>/<window>, e.g. memory=150ms/1s
+func ParsePressureTrigger(value string) (PressureTrigger, error) {
+	var trigger PressureTrigger
+	resource, threshold, found := strings.Cut(value, "=")
+	if !found {
+		return trigger, fmt.Errorf("invalid pressure trigger %q: expected <resource>=[some:|full:]<stall>/<window>", value)
+	}
+	if !hasWord(strings.Join(pressureResources, " "), resource) {
+		return trigger, fmt.Errorf("invalid pressure trigger %q: resource must be cpu, memory or io", value)
+	}
+	trigger.Resource = resource
+
+	if kind, rest, found := strings.Cut(threshold, ":"); found {
+		if kind != "some" && kind != "full" {
+			return trigger, fmt.Errorf("invalid pressure trigger %q: expected some or full, not %q", value, kind)
+		}
+		trigger.Full = kind == "full"
+		threshold = rest
+	}
+
+	stall, window, found := strings.Cut(threshold, "/")
+	var err error
+	if trigger.Stall, err = time.ParseDuration(stall); err != nil || !found {
+		return trigger, fmt.Errorf("invalid pressure trigger %q: expected <stall>/<window>, e.g. 150ms/1s", value)
+	}
+	if trigger.Window, err = time.ParseDuration(window); err != nil {
+		return trigger, fmt.Errorf("invalid pressure trigger %q: expected <stall>/<window>, e.g. 150ms/1s", value)
+	}
+	if trigger.Window < minPressureWindow || trigger.Window > maxPressureWindow {
+		return trigger, fmt.Errorf("invalid pressure trigger %q: the window must be between %s and %s", value, minPressureWindow, maxPressureWindow)
+	}
+	if trigger.Stall <= 0 || trigger.Stall > trigger.Window {
+		return trigger, fmt.Errorf("invalid pressure trigger %q: the stall must be within the window", value)
+	}
+	return trigger, nil
+}
+
+// String formats a trigger as ParsePressureTrigger takes it
+func (trigger PressureTrigger) String() string {
+	kind := "some"
+	if trigger.Full {
+		kind = "full"
+	}
+	return fmt.Sprintf("%s=%s:%s/%s", trigger.Resource, kind, trigger.Stall, trigger.Window)
+}
+
+// PressureWatcher reports each time a pressure trigger fires
+type PressureWatcher struct {
+	// Fired receives a value each time; it is closed when the watcher
+	// stops
+	Fired <-chan struct{}
+
+	pressureFile *os.File
+	stop         *os.File // closing the write end ends the poll
+	stopped      chan struct{}
+}
+
+// WatchPressure registers a pressure trigger on the group
+func (cgroup *Cgroup) WatchPressure(trigger PressureTrigger) (*PressureWatcher, error) {
+	if !cgroup.unified {
+		return nil, fmt.Errorf("pressure triggers need the unified cgroup hierarchy")
+	}
+	path := filepath.Join(cgroup.Path, trigger.Resource+".pressure")
+	pressureFile, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %v", path, err)
+	}
+	kind := "some"
+	if trigger.Full {
+		kind = "full"
+	}
+	// The trigger lives as long as the file stays open
+	registration := fmt.Sprintf("%s %d %d", kind, trigger.Stall.Microseconds(), trigger.Window.Microseconds())
+	if _, err := pressureFile.Write(append([]byte(registration), 0)); err != nil {
+		pressureFile.Close()
+		if errors.Is(err, unix.EINVAL) && trigger.Window%unprivilegedPressureWindow != 0 {
+			return nil, fmt.Errorf("failed to register pressure trigger %s: without CAP_SYS_RESOURCE the window must be a multiple of %s", trigger, unprivilegedPressureWindow)
+		}
+		return nil, fmt.Errorf("failed to register pressure trigger %s: %v", trigger, err)
+	}
+
+	stopReader, stopWriter, err := os.Pipe()
+	if err != nil {
+		pressureFile.Close()
+		return nil, fmt.Errorf("failed to create pipe: %v", err)
+	}
+	fired := make(chan struct{}, 1)
+	watcher := &PressureWatcher{Fired: fired, pressureFile: pressureFile, stop: stopWriter, stopped: make(chan struct{})}
+	go watcher.run(stopReader, fired)
+	return watcher, nil
+}
+
+// run polls the pressure file until Close
+func (watcher *PressureWatcher) run(stopReader *os.File, fired chan<- struct{}) {
+	defer close(watcher.stopped)
+	defer close(fired)
+	defer stopReader.Close()
+
+	fds := []unix.PollFd{
+		{Fd: int32(watcher.pressureFile.Fd()), Events: unix.POLLPRI},
+		{Fd: int32(stopReader.Fd()), Events: unix.POLLIN},
+	}
+	for {
+		if _, err := unix.Poll(fds, -1); err != nil {
+			if err == unix.EINTR {
+				continue
+			}
+			return
+		}
+		if fds[1].Revents != 0 || fds[0].Revents&(unix.POLLERR|unix.POLLNVAL) != 0 {
+			return
+		}
+		if fds[0].Revents&unix.POLLPRI != 0 {
+			// A slow receiver misses nothing it hasn't already been told
+			select {
+			case fired <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// Close removes the trigger
+func (watcher *PressureWatcher) Close() {
+	watcher.stop.Close()
+	<-watcher.stopped
+	watcher.pressureFile.Close()
+}
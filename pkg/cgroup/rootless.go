@@ -0,0 +1,133 @@
+//go:build linux
+
+package cgroup
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Rootless cgroups
+//
+// An unprivileged user can't write to /sys/fs/cgroup, but on a systemd host
+// the user's service manager (user@<uid>.service) owns a subtree of the v2
+// hierarchy and can hand parts of it out. A shim started through
+//
+//	systemd-run --user --scope --property=Delegate=yes nsctl shim <id>
+//
+// lands in a fresh transient scope that the user may manage. The shim then
+// moves itself into a "supervisor" leaf of that scope, because v2 only lets
+// a group without processes enable controllers for its children, and
+// creates the container's group next to it:
+//
+//	user@1000.service/app.slice/nsctl-<id>.scope/
+//	├── supervisor/    the shim
+//	└── <id>/          the container, with memory and cpu limits
+
+// ScopePrefix starts the name of every transient scope nsctl asks systemd
+// for; only such scopes are treated as delegated to nsctl
+const ScopePrefix = "nsctl-"
+
+// supervisorGroupName is the leaf the shim moves itself into
+const supervisorGroupName = "supervisor"
+
+// ErrNotDelegated means no cgroup has been delegated to this process
+var ErrNotDelegated = errors.New("no cgroup is delegated to nsctl (limits unavailable)")
+
+// CanDelegate reports whether rootless nsctl can get a delegated cgroup
+// That requires the v2 hierarchy, systemd-run and a systemd user instance
+// reachable over the user's D-Bus session bus
+func CanDelegate() error {
+	if !IsUnified() {
+		return fmt.Errorf("rootless cgroups need the unified (v2) hierarchy; boot with systemd.unified_cgroup_hierarchy=1")
+	}
+	if _, err := exec.LookPath("systemd-run"); err != nil {
+		return fmt.Errorf("systemd-run was not found; rootless cgroups need systemd")
+	}
+	if !userBusAvailable() {
+		return fmt.Errorf("no systemd user session bus; log in through systemd-logind or run \"loginctl enable-linger %d\"", os.Getuid())
+	}
+	return nil
+}
+
+// userBusAvailable checks for the user's D-Bus session bus
+func userBusAvailable() bool {
+	if os.Getenv("DBUS_SESSION_BUS_ADDRESS") != "" {
+		return true
+	}
+	runtimeDir := os.Getenv("XDG_RUNTIME_DIR")
+	if runtimeDir == "" {
+		runtimeDir = filepath.Join("/run/user", strconv.Itoa(os.Getuid()))
+	}
+	_, err := os.Stat(filepath.Join(runtimeDir, "bus"))
+	return err == nil
+}
+
+// DelegatedScopeCommand returns the command line that runs argv inside a
+// new delegated transient scope named after the container
+func DelegatedScopeCommand(containerID string, argv []string) []string {
+	return append([]string{
+		"systemd-run", "--user", "--scope", "--quiet", "--collect",
+		"--property=Delegate=yes",
+		"--unit=" + ScopePrefix + containerID,
+	}, argv...)
+}
+
+// delegatedParent prepares the scope the current process runs in for
+// container groups, as described above
+func delegatedParent() (string, error) {
+	ownGroup, err := ownCgroup()
+	if err != nil {
+		return "", err
+	}
+
+	// Only ever reorganize a scope systemd made for us, never e.g. the
+	// scope of the terminal nsctl was started from
+	scopePath := ownGroup
+	if filepath.Base(ownGroup) == supervisorGroupName {
+		scopePath = filepath.Dir(ownGroup)
+	}
+	scopeName := filepath.Base(scopePath)
+	if !strings.HasPrefix(scopeName, ScopePrefix) || !strings.HasSuffix(scopeName, ".scope") {
+		return "", ErrNotDelegated
+	}
+	if unix.Access(filepath.Join(scopePath, "cgroup.subtree_control"), unix.W_OK) != nil {
+		return "", ErrNotDelegated
+	}
+
+	if scopePath == ownGroup {
+		supervisorPath := filepath.Join(scopePath, supervisorGroupName)
+		if err := os.Mkdir(supervisorPath, 0755); err != nil && !os.IsExist(err) {
+			return "", fmt.Errorf("failed to create cgroup %s: %v", supervisorPath, err)
+		}
+		if err := os.WriteFile(filepath.Join(supervisorPath, "cgroup.procs"), []byte(strconv.Itoa(os.Getpid())), 0644); err != nil {
+			return "", fmt.Errorf("failed to move into cgroup %s: %v", supervisorPath, err)
+		}
+	}
+
+	if err := enableControllers(scopePath); err != nil {
+		return "", err
+	}
+	return scopePath, nil
+}
+
+// ownCgroup returns the directory of the v2 group we run in
+func ownCgroup() (string, error) {
+	data, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", fmt.Errorf("failed to read own cgroup: %v", err)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if path, found := strings.CutPrefix(line, "0::"); found {
+			return filepath.Join(mountPoint, path), nil
+		}
+	}
+	return "", fmt.Errorf("not in a cgroup v2 hierarchy")
+}
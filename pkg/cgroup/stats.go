@@ -0,0 +1,250 @@
+//go:build linux
+
+package cgroup
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Usage statistics
+//
+// The kernel accounts a group's usage in its interface files, named and
+// shaped differently on each hierarchy; Stats reads them into one form. On
+// v1 each kind of usage is in its controller's group (cpuacct, memory,
+// blkio, pids), and a controller that isn't mounted leaves its part empty.
+
+// clockTicksPerSecond is USER_HZ, the unit of v1's cpuacct.stat; it is 100
+// on every architecture Linux exposes it on
+const clockTicksPerSecond = 100
+
+// Stats are a group's resource usage counters
+type Stats struct {
+	CPU    CPUStats    `json:"cpu"`
+	Memory MemoryStats `json:"memory"`
+
+	// IO and PIDs are nil when their controller isn't available
+	IO   *IOStats  `json:"io,omitempty"`
+	PIDs *PIDStats `json:"pids,omitempty"`
+
+	// Pressure is nil on v1, which has no pressure files
+	Pressure *PressureStats `json:"pressure,omitempty"`
+}
+
+// CPUStats is the CPU time the group used and how often its quota held it
+// back
+type CPUStats struct {
+	UsageNanos  uint64 `json:"usage_ns"`
+	UserNanos   uint64 `json:"user_ns"`
+	SystemNanos uint64 `json:"system_ns"`
+
+	// Periods counts the quota periods the group ran in, ThrottledPeriods
+	// those it used up its quota in
+	Periods          uint64 `json:"periods"`
+	ThrottledPeriods uint64 `json:"throttled_periods"`
+	ThrottledNanos   uint64 `json:"throttled_ns"`
+}
+
+// MemoryStats is the group's memory use
+type MemoryStats struct {
+	Usage uint64 `json:"usage"`
+
+	// MaxUsage is the highest usage so far, where the kernel keeps it
+	MaxUsage uint64 `json:"max_usage,omitempty"`
+
+	// Limit is 0 for none
+	Limit uint64 `json:"limit"`
+
+	// Cache is the page cache included in Usage, which the kernel reclaims
+	// before it runs out of memory
+	Cache uint64 `json:"cache"`
+
+	OOMKills int `json:"oom_kills"`
+}
+
+// IOStats is the block I/O the group did
+type IOStats struct {
+	ReadBytes  uint64 `json:"read_bytes"`
+	WriteBytes uint64 `json:"write_bytes"`
+	ReadOps    uint64 `json:"read_ops"`
+	WriteOps   uint64 `json:"write_ops"`
+}
+
+// PIDStats is the number of processes (or threads) in the group
+type PIDStats struct {
+	Current uint64 `json:"current"`
+
+	// Limit is 0 for none
+	Limit uint64 `json:"limit"`
+}
+
+// Stats reads the group's usage counters
+func (cgroup *Cgroup) Stats() (*Stats, error) {
+	if _, err := os.Stat(cgroup.Path); err != nil {
+		return nil, fmt.Errorf("failed to read cgroup %s: %v", cgroup.Path, err)
+	}
+	if cgroup.unified {
+		return cgroup.unifiedStats(), nil
+	}
+	return cgroup.v1Stats(), nil
+}
+
+// unifiedStats reads the counters of a v2 group
+func (cgroup *Cgroup) unifiedStats() *Stats {
+	stats := &Stats{}
+	path := cgroup.Path
+
+	cpu := readKeyValues(filepath.Join(path, "cpu.stat"))
+	stats.CPU = CPUStats{
+		UsageNanos:       cpu["usage_usec"] * 1000,
+		UserNanos:        cpu["user_usec"] * 1000,
+		SystemNanos:      cpu["system_usec"] * 1000,
+		Periods:          cpu["nr_periods"],
+		ThrottledPeriods: cpu["nr_throttled"],
+		ThrottledNanos:   cpu["throttled_usec"] * 1000,
+	}
+
+	stats.Memory.Usage, _ = readCounter(filepath.Join(path, "memory.current"))
+	stats.Memory.MaxUsage, _ = readCounter(filepath.Join(path, "memory.peak"))
+	stats.Memory.Limit, _ = readCounter(filepath.Join(path, "memory.max"))
+	stats.Memory.Cache = readKeyValues(filepath.Join(path, "memory.stat"))["file"]
+	stats.Memory.OOMKills, _ = cgroup.OOMKillCount()
+
+	// io.stat has a line of "key=value" counters per device
+	if data, err := os.ReadFile(filepath.Join(path, "io.stat")); err == nil {
+		stats.IO = &IOStats{}
+		for _, field := range strings.Fields(string(data)) {
+			key, value, found := strings.Cut(field, "=")
+			if !found {
+				continue
+			}
+			count, _ := strconv.ParseUint(value, 10, 64)
+			switch key {
+			case "rbytes":
+				stats.IO.ReadBytes += count
+			case "wbytes":
+				stats.IO.WriteBytes += count
+			case "rios":
+				stats.IO.ReadOps += count
+			case "wios":
+				stats.IO.WriteOps += count
+			}
+		}
+	}
+
+	stats.PIDs = readPIDStats(path)
+	stats.Pressure, _ = cgroup.Pressure()
+	return stats
+}
+
+// v1Stats reads the counters of a group's v1 controllers
+func (cgroup *Cgroup) v1Stats() *Stats {
+	stats := &Stats{}
+
+	if path, found := cgroup.v1Paths["cpuacct"]; found {
+		stats.CPU.UsageNanos, _ = readCounter(filepath.Join(path, "cpuacct.usage"))
+		ticks := readKeyValues(filepath.Join(path, "cpuacct.stat"))
+		stats.CPU.UserNanos = ticks["user"] * 1e9 / clockTicksPerSecond
+		stats.CPU.SystemNanos = ticks["system"] * 1e9 / clockTicksPerSecond
+	}
+	if path, found := cgroup.v1Paths["cpu"]; found {
+		cpu := readKeyValues(filepath.Join(path, "cpu.stat"))
+		stats.CPU.Periods = cpu["nr_periods"]
+		stats.CPU.ThrottledPeriods = cpu["nr_throttled"]
+		stats.CPU.ThrottledNanos = cpu["throttled_time"]
+	}
+
+	path := cgroup.Path
+	stats.Memory.Usage, _ = readCounter(filepath.Join(path, "memory.usage_in_bytes"))
+	stats.Memory.MaxUsage, _ = readCounter(filepath.Join(path, "memory.max_usage_in_bytes"))
+	stats.Memory.Limit, _ = readCounter(filepath.Join(path, "memory.limit_in_bytes"))
+	// Without a limit, the file holds the largest page-aligned value
+	if stats.Memory.Limit >= 1<<62 {
+		stats.Memory.Limit = 0
+	}
+	stats.Memory.Cache = readKeyValues(filepath.Join(path, "memory.stat"))["cache"]
+	stats.Memory.OOMKills, _ = cgroup.OOMKillCount()
+
+	if path, found := cgroup.v1Paths["blkio"]; found {
+		stats.IO = &IOStats{}
+		stats.IO.ReadBytes, stats.IO.WriteBytes = readBlkioCounters(filepath.Join(path, "blkio.throttle.io_service_bytes_recursive"))
+		stats.IO.ReadOps, stats.IO.WriteOps = readBlkioCounters(filepath.Join(path, "blkio.throttle.io_serviced_recursive"))
+	}
+
+	if path, found := cgroup.v1Paths["pids"]; found {
+		stats.PIDs = readPIDStats(path)
+	}
+	return stats
+}
+
+// readPIDStats reads the pids controller's files in a group, if it has them
+func readPIDStats(path string) *PIDStats {
+	current, err := readCounter(filepath.Join(path, "pids.current"))
+	if err != nil {
+		return nil
+	}
+	limit, _ := readCounter(filepath.Join(path, "pids.max"))
+	return &PIDStats{Current: current, Limit: limit}
+}
+
+// readBlkioCounters sums the Read and Write lines of a v1 blkio file, which
+// has "major:minor Read|Write|Sync|Async|Discard|Total count" lines per
+// device
+func readBlkioCounters(path string) (uint64, uint64) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, 0
+	}
+	var read, write uint64
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			continue
+		}
+		count, _ := strconv.ParseUint(fields[2], 10, 64)
+		switch fields[1] {
+		case "Read":
+			read += count
+		case "Write":
+			write += count
+		}
+	}
+	return read, write
+}
+
+// readCounter reads a file holding a single number; "max", meaning no
+// limit, reads as 0
+func readCounter(path string) (uint64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	value := strings.TrimSpace(string(data))
+	if value == "max" {
+		return 0, nil
+	}
+	return strconv.ParseUint(value, 10, 64)
+}
+
+// readKeyValues reads a flat-keyed file of "key value" lines, such as
+// cpu.stat; a missing file reads as empty
+func readKeyValues(path string) map[string]uint64 {
+	values := map[string]uint64{}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return values
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		key, value, found := strings.Cut(line, " ")
+		if !found {
+			continue
+		}
+		if count, err := strconv.ParseUint(strings.TrimSpace(value), 10, 64); err == nil {
+			values[key] = count
+		}
+	}
+	return values
+}
@@ -0,0 +1,151 @@
+//go:build linux
+
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// EnsureBridge creates the bridge name with the address gateway, unless it
+// exists, and brings it up; concurrent callers may race to create it
+func EnsureBridge(name string, gateway *net.IPNet) error {
+	if _, err := net.InterfaceByName(name); err != nil {
+		info := unix.IfInfomsg{Family: unix.AF_UNSPEC}
+		err := execute(unix.RTM_NEWLINK, unix.NLM_F_CREATE|unix.NLM_F_EXCL, append(structBytes(&info),
+			append(stringAttribute(unix.IFLA_IFNAME, name),
+				nested(unix.IFLA_LINKINFO, stringAttribute(unix.IFLA_INFO_KIND, "bridge"))...)...))
+		if err != nil && !errors.Is(err, unix.EEXIST) {
+			return fmt.Errorf("failed to create bridge %s: %v", name, err)
+		}
+	}
+
+	bridge, err := net.InterfaceByName(name)
+	if err != nil {
+		return fmt.Errorf("failed to find bridge %s: %v", name, err)
+	}
+	addresses, err := bridge.Addrs()
+	if err != nil {
+		return fmt.Errorf("failed to read the addresses of bridge %s: %v", name, err)
+	}
+	hasGateway := false
+	for _, address := range addresses {
+		if ipNet, ok := address.(*net.IPNet); ok && ipNet.String() == gateway.String() {
+			hasGateway = true
+		}
+	}
+	if !hasGateway {
+		if err := AddAddress(name, gateway); err != nil && !errors.Is(err, unix.EEXIST) {
+			return err
+		}
+	}
+	return SetUp(name)
+}
+
+// CreateVeth creates a veth pair: hostName in the caller's network
+// namespace, attached to bridge and up, and peerName in the network
+// namespace of the process peerPID
+// A pair left over from an earlier container of the same name is removed
+// first; it lives on for a moment after its namespace is gone.
+func CreateVeth(hostName string, peerName string, peerPID int, bridge string) error {
+	master, err := net.InterfaceByName(bridge)
+	if err != nil {
+		return fmt.Errorf("failed to find bridge %s: %v", bridge, err)
+	}
+	if _, err := net.InterfaceByName(hostName); err == nil {
+		if err := DeleteLink(hostName); err != nil {
+			return err
+		}
+	}
+
+	info := unix.IfInfomsg{Family: unix.AF_UNSPEC}
+	peerInfo := unix.IfInfomsg{Family: unix.AF_UNSPEC}
+	peer := append(structBytes(&peerInfo),
+		append(stringAttribute(unix.IFLA_IFNAME, peerName), uint32Attribute(unix.IFLA_NET_NS_PID, uint32(peerPID))...)...)
+	linkInfo := nested(unix.IFLA_LINKINFO,
+		stringAttribute(unix.IFLA_INFO_KIND, "veth"),
+		nested(unix.IFLA_INFO_DATA, attribute(vethInfoPeer, peer)))
+	request := append(structBytes(&info), stringAttribute(unix.IFLA_IFNAME, hostName)...)
+	request = append(request, uint32Attribute(unix.IFLA_MASTER, uint32(master.Index))...)
+	request = append(request, linkInfo...)
+	if err := execute(unix.RTM_NEWLINK, unix.NLM_F_CREATE|unix.NLM_F_EXCL, request); err != nil {
+		return fmt.Errorf("failed to create veth pair %s/%s: %v", hostName, peerName, err)
+	}
+	return SetUp(hostName)
+}
+
+// DeleteLink removes the link name, and with a veth its peer too
+func DeleteLink(name string) error {
+	link, err := net.InterfaceByName(name)
+	if err != nil {
+		return fmt.Errorf("failed to find link %s: %v", name, err)
+	}
+	info := unix.IfInfomsg{Family: unix.AF_UNSPEC, Index: int32(link.Index)}
+	if err := execute(unix.RTM_DELLINK, 0, structBytes(&info)); err != nil && !errors.Is(err, unix.ENODEV) {
+		return fmt.Errorf("failed to remove link %s: %v", name, err)
+	}
+	return nil
+}
+
+// SetUp brings the link name up
+func SetUp(name string) error {
+	link, err := net.InterfaceByName(name)
+	if err != nil {
+		return fmt.Errorf("failed to find link %s: %v", name, err)
+	}
+	info := unix.IfInfomsg{Family: unix.AF_UNSPEC, Index: int32(link.Index), Flags: unix.IFF_UP, Change: unix.IFF_UP}
+	if err := execute(unix.RTM_NEWLINK, 0, structBytes(&info)); err != nil {
+		return fmt.Errorf("failed to bring up %s: %v", name, err)
+	}
+	return nil
+}
+
+// AddAddress assigns an IPv4 address, with its prefix, to the link name
+// The error of an address that is already there is EEXIST, as it is.
+func AddAddress(name string, address *net.IPNet) error {
+	link, err := net.InterfaceByName(name)
+	if err != nil {
+		return fmt.Errorf("failed to find link %s: %v", name, err)
+	}
+	ip := address.IP.To4()
+	if ip == nil {
+		return fmt.Errorf("%s is not an IPv4 address", address)
+	}
+	prefixLength, _ := address.Mask.Size()
+	info := unix.IfAddrmsg{Family: unix.AF_INET, Prefixlen: uint8(prefixLength), Index: uint32(link.Index)}
+	request := append(structBytes(&info), attribute(unix.IFA_LOCAL, ip)...)
+	request = append(request, attribute(unix.IFA_ADDRESS, ip)...)
+	err = execute(unix.RTM_NEWADDR, unix.NLM_F_CREATE|unix.NLM_F_EXCL, request)
+	if errors.Is(err, unix.EEXIST) {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("failed to add address %s to %s: %v", address, name, err)
+	}
+	return nil
+}
+
+// AddDefaultRoute routes everything without a more specific route through
+// gateway, on the link name
+func AddDefaultRoute(name string, gateway net.IP) error {
+	link, err := net.InterfaceByName(name)
+	if err != nil {
+		return fmt.Errorf("failed to find link %s: %v", name, err)
+	}
+	route := unix.RtMsg{
+		Family:   unix.AF_INET,
+		Table:    unix.RT_TABLE_MAIN,
+		Protocol: unix.RTPROT_BOOT,
+		Scope:    unix.RT_SCOPE_UNIVERSE,
+		Type:     unix.RTN_UNICAST,
+	}
+	request := append(structBytes(&route), attribute(unix.RTA_GATEWAY, gateway.To4())...)
+	request = append(request, uint32Attribute(unix.RTA_OIF, uint32(link.Index))...)
+	if err := execute(unix.RTM_NEWROUTE, unix.NLM_F_CREATE|unix.NLM_F_EXCL, request); err != nil {
+		return fmt.Errorf("failed to add default route via %s: %v", gateway, err)
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+//go:build linux
+
+package network
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Forwarding and NAT
+//
+// Containers on the bridge have addresses only the host knows about. For
+// them to reach anything beyond it, the host has to forward their packets
+// and masquerade them behind its own address, like Docker and Podman do:
+// IPv4 forwarding is switched on, and iptables gets a MASQUERADE rule for
+// the bridge's subnet plus FORWARD rules that let its traffic through a
+// restrictive policy. Rules are only added when missing, so every
+// container can make sure of them.
+
+// ipForwardPath switches IPv4 forwarding between interfaces
+const ipForwardPath = "/proc/sys/net/ipv4/ip_forward"
+
+// ErrNoIptables is returned by EnsureMasquerade on hosts without iptables
+var ErrNoIptables = errors.New("iptables is not installed")
+
+// EnableForwarding switches on IPv4 forwarding, and reports whether it was
+// off
+func EnableForwarding() (bool, error) {
+	current, err := os.ReadFile(ipForwardPath)
+	if err != nil {
+		return false, fmt.Errorf("failed to read %s: %v", ipForwardPath, err)
+	}
+	if strings.TrimSpace(string(current)) == "1" {
+		return false, nil
+	}
+	if err := os.WriteFile(ipForwardPath, []byte("1"), 0644); err != nil {
+		return false, fmt.Errorf("failed to enable IPv4 forwarding: %v", err)
+	}
+	return true, nil
+}
+
+// EnsureMasquerade adds the iptables rules that NAT and forward the
+// traffic of the bridge's subnet, where they are missing
+func EnsureMasquerade(subnet string, bridge string) error {
+	iptables, err := exec.LookPath("iptables")
+	if err != nil {
+		return ErrNoIptables
+	}
+
+	rules := [][]string{
+		{"-t", "nat", "POSTROUTING", "-s", subnet, "!", "-o", bridge, "-j", "MASQUERADE"},
+		{"-t", "filter", "FORWARD", "-i", bridge, "-j", "ACCEPT"},
+		{"-t", "filter", "FORWARD", "-o", bridge, "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT"},
+	}
+	for _, rule := range rules {
+		// -C fails when the rule isn't there yet; -w waits for the xtables
+		// lock that other tools may hold
+		table, chain, match := rule[:2], rule[2], rule[3:]
+		check := append(append([]string{"-w"}, table...), append([]string{"-C", chain}, match...)...)
+		if exec.Command(iptables, check...).Run() == nil {
+			continue
+		}
+		add := append(append([]string{"-w"}, table...), append([]string{"-A", chain}, match...)...)
+		if output, err := exec.Command(iptables, add...).CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to add iptables rule %q: %v: %s", strings.Join(rule, " "), err, strings.TrimSpace(string(output)))
+		}
+	}
+	return nil
+}
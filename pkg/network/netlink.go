@@ -0,0 +1,104 @@
+//go:build linux
+
+// Package network connects containers to the host: a bridge on the host,
+// a veth pair per container with one end on the bridge and the other in the
+// container's network namespace, and the addresses and routes on both.
+//
+// Links, addresses and routes are managed over rtnetlink, in the network
+// namespace of the calling thread; forwarding and NAT use the host's
+// sysctl and iptables, see nat.go.
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// vethInfoPeer is VETH_INFO_PEER, the attribute of a veth link's info data
+// that describes its peer
+const vethInfoPeer = 1
+
+// attribute encodes one rtnetlink attribute, padded to 4 bytes
+func attribute(kind uint16, data []byte) []byte {
+	length := unix.SizeofRtAttr + len(data)
+	encoded := make([]byte, (length+unix.RTA_ALIGNTO-1)&^(unix.RTA_ALIGNTO-1))
+	binary.NativeEndian.PutUint16(encoded[0:2], uint16(length))
+	binary.NativeEndian.PutUint16(encoded[2:4], kind)
+	copy(encoded[unix.SizeofRtAttr:], data)
+	return encoded
+}
+
+// nested encodes an attribute that holds others
+func nested(kind uint16, attributes ...[]byte) []byte {
+	return attribute(kind, bytes.Join(attributes, nil))
+}
+
+// stringAttribute encodes a NUL-terminated string attribute
+func stringAttribute(kind uint16, value string) []byte {
+	return attribute(kind, append([]byte(value), 0))
+}
+
+// uint32Attribute encodes a 32-bit attribute
+func uint32Attribute(kind uint16, value uint32) []byte {
+	return attribute(kind, binary.NativeEndian.AppendUint32(nil, value))
+}
+
+// structBytes returns the memory of a fixed-size netlink header, such as
+// unix.IfInfomsg, to put in front of a message's attributes
+func structBytes[T any](header *T) []byte {
+	return unsafe.Slice((*byte)(unsafe.Pointer(header)), unsafe.Sizeof(*header))
+}
+
+// execute sends one rtnetlink request and waits for the kernel to
+// acknowledge it
+func execute(messageType uint16, flags uint16, body []byte) error {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return fmt.Errorf("failed to open netlink socket: %v", err)
+	}
+	defer unix.Close(fd)
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return fmt.Errorf("failed to bind netlink socket: %v", err)
+	}
+
+	message := make([]byte, unix.SizeofNlMsghdr, unix.SizeofNlMsghdr+len(body))
+	header := unix.NlMsghdr{
+		Len:   uint32(unix.SizeofNlMsghdr + len(body)),
+		Type:  messageType,
+		Flags: unix.NLM_F_REQUEST | unix.NLM_F_ACK | flags,
+		Seq:   1,
+	}
+	copy(message, structBytes(&header))
+	message = append(message, body...)
+	if err := unix.Sendto(fd, message, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return fmt.Errorf("failed to send netlink request: %v", err)
+	}
+
+	buffer := make([]byte, os.Getpagesize())
+	for {
+		n, _, err := unix.Recvfrom(fd, buffer, 0)
+		if err != nil {
+			return fmt.Errorf("failed to read netlink reply: %v", err)
+		}
+		replies, err := syscall.ParseNetlinkMessage(buffer[:n])
+		if err != nil {
+			return fmt.Errorf("failed to parse netlink reply: %v", err)
+		}
+		for _, reply := range replies {
+			if reply.Header.Seq != header.Seq || reply.Header.Type != unix.NLMSG_ERROR {
+				continue
+			}
+			// The acknowledgement is an error message with errno 0
+			if errno := -int32(binary.NativeEndian.Uint32(reply.Data[0:4])); errno != 0 {
+				return syscall.Errno(errno)
+			}
+			return nil
+		}
+	}
+}
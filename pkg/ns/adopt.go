@@ -0,0 +1,239 @@
+//go:build linux
+
+package ns
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Adopting containers of other runtimes ("nsctl adopt")
+//
+// Containers started by hand with runc or crun can be handed over to nsctl,
+// to ease moving such scripts over. Adopting reads the runtime's state
+// (runc's /run/runc/<id>/state.json, crun's /run/crun/<id>/status, or the
+// OCI state "runc state <id>" prints) and the bundle's config.json, and
+// registers the container under a new nsctl ID. ps, inspect, wait, kill,
+// stop and rm then work on it like on any other container.
+//
+// There is no shim watching an adopted container: nsctl notices its exit
+// only when it looks, and can't tell the exit code, which shows as 0. Its
+// output went wherever runc sent it, so "logs" has nothing to show. The
+// other runtime's state is left alone; "runc delete" cleans it up.
+
+// Well-known state locations of runtimes, by runtime name
+var foreignStateFiles = []struct {
+	runtime string
+	path    string // with %s for the container ID
+}{
+	{runtime: "runc", path: "/run/runc/%s/state.json"},
+	{runtime: "crun", path: "/run/crun/%s/status"},
+}
+
+// AdoptedContainer records where an adopted container came from
+type AdoptedContainer struct {
+	// Runtime is the runtime that created the container, e.g. runc
+	Runtime string `json:"runtime"`
+
+	// ID is the container's ID in that runtime
+	ID string `json:"id"`
+
+	// Bundle is the container's OCI bundle directory
+	Bundle string `json:"bundle,omitempty"`
+
+	// StatePath is the state file the container was adopted from
+	StatePath string `json:"state_path"`
+}
+
+// foreignState holds the fields nsctl needs from runc's state.json, crun's
+// status file or an OCI state document, whichever it is
+type foreignState struct {
+	ID      string    `json:"id"`
+	Created time.Time `json:"created"`
+
+	// runc's state.json
+	InitProcessPID   int             `json:"init_process_pid"`
+	InitProcessStart json.RawMessage `json:"init_process_start"`
+	Config           struct {
+		Labels []string `json:"labels"`
+	} `json:"config"`
+	CgroupPaths map[string]string `json:"cgroup_paths"`
+
+	// crun's status file and the OCI state
+	PID              int             `json:"pid"`
+	ProcessStartTime json.RawMessage `json:"process-start-time"`
+	Bundle           string          `json:"bundle"`
+	CgroupPath       string          `json:"cgroup-path"`
+}
+
+// AdoptContainer registers a container created by another runtime; source
+// is the path of its state file (or of the directory holding it) or its
+// ID in runc or crun. It returns the container's new record.
+func AdoptContainer(source string) (*ContainerInfo, error) {
+	runtime, statePath, err := findForeignState(source)
+	if err != nil {
+		return nil, err
+	}
+	if statePath, err = filepath.Abs(statePath); err != nil {
+		return nil, fmt.Errorf("invalid state file path: %v", err)
+	}
+
+	data, err := os.ReadFile(statePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read container state: %v", err)
+	}
+	var state foreignState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse container state %s: %v", statePath, err)
+	}
+
+	pid, expectedStart, bundle := state.PID, state.ProcessStartTime, state.Bundle
+	if state.InitProcessPID != 0 {
+		pid, expectedStart = state.InitProcessPID, state.InitProcessStart
+		for _, label := range state.Config.Labels {
+			if value, found := strings.CutPrefix(label, "bundle="); found {
+				bundle = value
+			}
+		}
+	}
+	if pid <= 0 {
+		return nil, fmt.Errorf("%s has no container process", statePath)
+	}
+	if !isProcessRunning(pid) {
+		return nil, fmt.Errorf("container %s isn't running (PID %d is gone)", state.ID, pid)
+	}
+	// A PID that has since been reused by another process starts later
+	startTime, err := strconv.ParseUint(strings.Trim(string(expectedStart), `"`), 10, 64)
+	if err != nil {
+		startTime, _ = processStartTime(pid)
+	} else if !isSameProcess(pid, startTime) {
+		return nil, fmt.Errorf("container %s isn't running (PID %d now belongs to another process)", state.ID, pid)
+	}
+
+	containers, err := ListContainers()
+	if err != nil {
+		return nil, err
+	}
+	for _, container := range containers {
+		if container.PID == pid && refreshStatus(&container) != StatusExited {
+			return nil, fmt.Errorf("PID %d is already container %s", pid, ShortID(container.ID))
+		}
+	}
+
+	containerID, err := generateContainerID()
+	if err != nil {
+		return nil, err
+	}
+	created := state.Created
+	if created.IsZero() {
+		created = time.Now()
+	}
+	containerInfo := ContainerInfo{
+		ID:           containerID,
+		PID:          pid,
+		PIDStartTime: startTime,
+		StartTime:    created,
+		Created:      created,
+		Status:       StatusRunning,
+		Adopted: &AdoptedContainer{
+			Runtime:   runtime,
+			ID:        state.ID,
+			Bundle:    bundle,
+			StatePath: statePath,
+		},
+	}
+	containerInfo.CgroupPath = state.CgroupPath
+	if path, found := state.CgroupPaths[""]; found {
+		containerInfo.CgroupPath = path
+	} else if path, found := state.CgroupPaths["memory"]; found {
+		containerInfo.CgroupPath = path
+	}
+
+	// The bundle's config says what runs; without it, /proc does
+	if spec, err := readBundleSpec(bundle); err == nil && len(spec.Process.Args) > 0 {
+		containerInfo.Command = spec.Process.Args[0]
+		containerInfo.Args = spec.Process.Args[1:]
+		containerInfo.Hostname = spec.Hostname
+		containerInfo.Annotations = spec.Annotations
+	} else if argv, err := processArgs(pid); err == nil && len(argv) > 0 {
+		containerInfo.Command = argv[0]
+		containerInfo.Args = argv[1:]
+	}
+
+	if err := saveContainerInfo(containerInfo); err != nil {
+		return nil, err
+	}
+	logf("[ns] Adopted %s container %s (PID %d) as %s\n", runtime, state.ID, pid, ShortID(containerID))
+	emitEvent(EventCreate, containerID, map[string]string{"adopted_from": runtime + ":" + state.ID})
+	return &containerInfo, nil
+}
+
+// findForeignState locates the state file source refers to, and guesses
+// the runtime that wrote it
+func findForeignState(source string) (string, string, error) {
+	info, err := os.Stat(source)
+	switch {
+	case err == nil && info.IsDir():
+		for _, name := range []string{"state.json", "status"} {
+			if _, err := os.Stat(filepath.Join(source, name)); err == nil {
+				return runtimeOfStateFile(name), filepath.Join(source, name), nil
+			}
+		}
+		return "", "", fmt.Errorf("no state.json or status file in %s", source)
+	case err == nil:
+		return runtimeOfStateFile(filepath.Base(source)), source, nil
+	}
+
+	// Not a path: a container ID
+	if strings.Contains(source, "/") {
+		return "", "", fmt.Errorf("no such state file: %s", source)
+	}
+	for _, stateFile := range foreignStateFiles {
+		path := fmt.Sprintf(stateFile.path, source)
+		if _, err := os.Stat(path); err == nil {
+			return stateFile.runtime, path, nil
+		}
+	}
+	return "", "", fmt.Errorf("no runc or crun container %s (pass the path of its state file instead)", source)
+}
+
+// runtimeOfStateFile guesses the runtime from the name of its state file
+func runtimeOfStateFile(name string) string {
+	switch name {
+	case "state.json":
+		return "runc"
+	case "status":
+		return "crun"
+	}
+	return "oci"
+}
+
+// readBundleSpec reads the config.json of an OCI bundle
+func readBundleSpec(bundle string) (*OCISpec, error) {
+	if bundle == "" {
+		return nil, fmt.Errorf("no bundle")
+	}
+	data, err := os.ReadFile(filepath.Join(bundle, containerConfigFileName))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read bundle config: %v", err)
+	}
+	var spec OCISpec
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return nil, fmt.Errorf("failed to parse bundle config: %v", err)
+	}
+	return &spec, nil
+}
+
+// processArgs returns the argv of a process
+func processArgs(pid int) ([]string, error) {
+	cmdline, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "cmdline"))
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(strings.TrimSuffix(string(cmdline), "\x00"), "\x00"), nil
+}
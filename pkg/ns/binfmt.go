@@ -0,0 +1,307 @@
+//go:build linux
+
+package ns
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Emulating foreign architectures (nsctl system binfmt)
+//
+// The kernel runs a binary built for another architecture by handing it to
+// the interpreter binfmt_misc has registered for its ELF header, which for
+// containers is one of qemu-user-static's emulators. "system binfmt" shows
+// which architectures have a handler, and with --install registers the
+// qemu emulators found on the host for those that don't. Handlers are
+// registered with the F flag, so the kernel opens the emulator right away
+// and containers don't need it in their own filesystem.
+
+// binfmtDir is where binfmt_misc is mounted
+const binfmtDir = "/proc/sys/fs/binfmt_misc"
+
+// elfTarget describes the ELF headers of one architecture's executables
+type elfTarget struct {
+	// qemuName is the architecture in the names of qemu's emulators
+	qemuName  string
+	class     byte // 1 for 32-bit, 2 for 64-bit
+	bigEndian bool
+	machine   uint16
+}
+
+// elfTargets are the architectures nsctl can register emulators for
+var elfTargets = map[string]elfTarget{
+	"amd64":   {"x86_64", 2, false, 62},
+	"386":     {"i386", 1, false, 3},
+	"arm64":   {"aarch64", 2, false, 183},
+	"arm":     {"arm", 1, false, 40},
+	"ppc64le": {"ppc64le", 2, false, 21},
+	"ppc64":   {"ppc64", 2, true, 21},
+	"s390x":   {"s390x", 2, true, 22},
+	"riscv64": {"riscv64", 2, false, 243},
+	"mips":    {"mips", 1, true, 8},
+	"mipsle":  {"mipsel", 1, false, 8},
+	"loong64": {"loongarch64", 2, false, 258},
+}
+
+// magic returns the first 20 bytes of the target's executables, and the
+// mask of the bytes that identify them: the ELF ident (without the OS ABI),
+// the type (executable or shared object) and the machine
+func (t elfTarget) magic() ([]byte, []byte) {
+	var order binary.AppendByteOrder = binary.LittleEndian
+	data := byte(1)
+	if t.bigEndian {
+		order, data = binary.BigEndian, 2
+	}
+
+	magic := append([]byte{0x7f, 'E', 'L', 'F', t.class, data, 1}, make([]byte, 9)...)
+	magic = order.AppendUint16(magic, uint16(elfTypeExec))
+	magic = order.AppendUint16(magic, t.machine)
+
+	mask := append(bytes.Repeat([]byte{0xff}, 7), 0)
+	mask = append(mask, bytes.Repeat([]byte{0xff}, 8)...)
+	// ET_EXEC (2) and ET_DYN (3) differ only in the lowest bit
+	mask = order.AppendUint16(mask, 0xfffe)
+	mask = append(mask, 0xff, 0xff)
+	return magic, mask
+}
+
+// elfTypeExec is the ELF type of (non-PIE) executables
+const elfTypeExec = 2
+
+// BinfmtStatus is whether binaries of one architecture can run on the host
+type BinfmtStatus struct {
+	Architecture string
+
+	// Native is set for the architectures the host runs itself
+	Native bool
+
+	// Handler and Interpreter are the registered binfmt_misc handler and
+	// its emulator, if there is one
+	Handler     string
+	Interpreter string
+}
+
+// binfmtHandler is a registered binfmt_misc handler
+type binfmtHandler struct {
+	name        string
+	interpreter string
+	offset      int
+	magic       []byte
+	mask        []byte
+}
+
+// matches reports whether the handler takes binaries with the given header
+func (h binfmtHandler) matches(header []byte) bool {
+	if h.offset+len(h.magic) > len(header) {
+		return false
+	}
+	for i, magicByte := range h.magic {
+		maskByte := byte(0xff)
+		if i < len(h.mask) {
+			maskByte = h.mask[i]
+		}
+		if header[h.offset+i]&maskByte != magicByte&maskByte {
+			return false
+		}
+	}
+	return true
+}
+
+// readBinfmtHandlers returns the enabled binfmt_misc handlers; none if
+// binfmt_misc isn't mounted
+func readBinfmtHandlers() ([]binfmtHandler, error) {
+	entries, err := os.ReadDir(binfmtDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read %s: %v", binfmtDir, err)
+	}
+
+	var handlers []binfmtHandler
+	for _, entry := range entries {
+		if entry.Name() == "register" || entry.Name() == "status" {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(binfmtDir, entry.Name()))
+		if err != nil {
+			continue
+		}
+
+		// Lines like "enabled", "interpreter /usr/bin/qemu-aarch64-static",
+		// "offset 0", "magic 7f454c46..." and "mask ffffff..."
+		handler := binfmtHandler{name: entry.Name()}
+		enabled := false
+		for _, line := range strings.Split(string(data), "\n") {
+			key, value, _ := strings.Cut(line, " ")
+			switch key {
+			case "enabled":
+				enabled = true
+			case "interpreter":
+				handler.interpreter = value
+			case "offset":
+				handler.offset, _ = strconv.Atoi(value)
+			case "magic":
+				handler.magic, _ = hex.DecodeString(value)
+			case "mask":
+				handler.mask, _ = hex.DecodeString(value)
+			}
+		}
+		if enabled && len(handler.magic) > 0 {
+			handlers = append(handlers, handler)
+		}
+	}
+	return handlers, nil
+}
+
+// findBinfmtHandler returns the handler that runs binaries of an
+// architecture, if one is registered
+func findBinfmtHandler(handlers []binfmtHandler, architecture string) (binfmtHandler, bool) {
+	target, known := elfTargets[architecture]
+	if !known {
+		return binfmtHandler{}, false
+	}
+	header, _ := target.magic()
+	for _, handler := range handlers {
+		if handler.matches(header) {
+			return handler, true
+		}
+	}
+	return binfmtHandler{}, false
+}
+
+// GetBinfmtStatus reports for each architecture nsctl knows whether its
+// binaries can run on the host, natively or emulated
+func GetBinfmtStatus() ([]BinfmtStatus, error) {
+	handlers, err := readBinfmtHandlers()
+	if err != nil {
+		return nil, err
+	}
+
+	var statuses []BinfmtStatus
+	for architecture := range elfTargets {
+		status := BinfmtStatus{Architecture: architecture, Native: runsNatively(architecture)}
+		if handler, found := findBinfmtHandler(handlers, architecture); found {
+			status.Handler = handler.name
+			status.Interpreter = handler.interpreter
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Architecture < statuses[j].Architecture })
+	return statuses, nil
+}
+
+// findQemuEmulator looks for the host's qemu-user emulator of a target,
+// preferring the static build, which works whatever the container's
+// filesystem holds
+func findQemuEmulator(target elfTarget) (string, bool) {
+	for _, name := range []string{"qemu-" + target.qemuName + "-static", "qemu-" + target.qemuName} {
+		if path, err := exec.LookPath(name); err == nil {
+			return path, true
+		}
+	}
+	return "", false
+}
+
+// ensureBinfmtMounted mounts binfmt_misc if it isn't yet
+func ensureBinfmtMounted() error {
+	if _, err := os.Stat(filepath.Join(binfmtDir, "register")); err == nil {
+		return nil
+	}
+	if err := unix.Mount("binfmt_misc", binfmtDir, "binfmt_misc", unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, ""); err != nil {
+		return fmt.Errorf("failed to mount binfmt_misc on %s: %v", binfmtDir, err)
+	}
+	return nil
+}
+
+// InstallBinfmtHandlers registers the host's qemu emulators for the given
+// foreign architectures, or all of them when none are given, skipping
+// those that already have a handler. It returns the architectures it
+// registered.
+func InstallBinfmtHandlers(architectures []string) ([]string, error) {
+	if os.Geteuid() != 0 {
+		return nil, fmt.Errorf("registering binfmt_misc handlers needs root")
+	}
+	if err := ensureBinfmtMounted(); err != nil {
+		return nil, err
+	}
+	handlers, err := readBinfmtHandlers()
+	if err != nil {
+		return nil, err
+	}
+
+	explicit := len(architectures) > 0
+	if !explicit {
+		for architecture := range elfTargets {
+			architectures = append(architectures, architecture)
+		}
+		sort.Strings(architectures)
+	}
+
+	var installed []string
+	for _, architecture := range architectures {
+		architecture = normalizeArchitecture(architecture)
+		target, known := elfTargets[architecture]
+		if !known {
+			return installed, fmt.Errorf("unknown architecture %s", architecture)
+		}
+		if runsNatively(architecture) {
+			continue
+		}
+		if _, found := findBinfmtHandler(handlers, architecture); found {
+			continue
+		}
+		emulator, found := findQemuEmulator(target)
+		if !found {
+			if explicit {
+				return installed, fmt.Errorf("no qemu emulator for %s found (install qemu-user-static)", architecture)
+			}
+			continue
+		}
+
+		magic, mask := target.magic()
+		registration := fmt.Sprintf(":qemu-%s:M:0:%s:%s:%s:F", target.qemuName, escapeBinfmt(magic), escapeBinfmt(mask), emulator)
+		if err := os.WriteFile(filepath.Join(binfmtDir, "register"), []byte(registration), 0200); err != nil {
+			return installed, fmt.Errorf("failed to register %s for %s: %v", emulator, architecture, err)
+		}
+		logf("[ns] Registered %s for %s binaries\n", emulator, architecture)
+		installed = append(installed, architecture)
+	}
+	return installed, nil
+}
+
+// escapeBinfmt writes bytes in the \xHH form binfmt_misc registrations use
+func escapeBinfmt(data []byte) string {
+	var escaped strings.Builder
+	for _, b := range data {
+		fmt.Fprintf(&escaped, "\\x%02x", b)
+	}
+	return escaped.String()
+}
+
+// checkEmulation makes sure a container of a foreign platform can run,
+// i.e. that an emulator is registered for its architecture
+func checkEmulation(platform Platform) error {
+	if runsNatively(platform.Architecture) {
+		return nil
+	}
+	handlers, err := readBinfmtHandlers()
+	if err != nil {
+		return err
+	}
+	if _, found := findBinfmtHandler(handlers, platform.Architecture); !found {
+		return fmt.Errorf("no emulator is registered for %s binaries (install qemu-user-static and run \"nsctl system binfmt --install %s\")", platform.Architecture, platform.Architecture)
+	}
+	return nil
+}
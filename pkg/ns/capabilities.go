@@ -0,0 +1,147 @@
+//go:build linux
+
+package ns
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Capabilities of rootful containers
+//
+// A rootful container's workload would otherwise run as real root with every
+// capability. Once setup is done, the setup process therefore drops all
+// capabilities from its bounding set except the ones asked for with
+// --cap-add, so the workload (and anything it execs, setuid binaries
+// included) can never hold more. Root in the container still owns the
+// files root owns, but can't mount, load modules, change the clock, etc.
+//
+// Rootless containers keep their capabilities: they only apply inside the
+// container's user namespace and are needed for things like chown within it.
+
+// capabilityNames maps capability names, without the CAP_ prefix, to numbers
+var capabilityNames = map[string]int{
+	"CHOWN":              unix.CAP_CHOWN,
+	"DAC_OVERRIDE":       unix.CAP_DAC_OVERRIDE,
+	"DAC_READ_SEARCH":    unix.CAP_DAC_READ_SEARCH,
+	"FOWNER":             unix.CAP_FOWNER,
+	"FSETID":             unix.CAP_FSETID,
+	"KILL":               unix.CAP_KILL,
+	"SETGID":             unix.CAP_SETGID,
+	"SETUID":             unix.CAP_SETUID,
+	"SETPCAP":            unix.CAP_SETPCAP,
+	"LINUX_IMMUTABLE":    unix.CAP_LINUX_IMMUTABLE,
+	"NET_BIND_SERVICE":   unix.CAP_NET_BIND_SERVICE,
+	"NET_BROADCAST":      unix.CAP_NET_BROADCAST,
+	"NET_ADMIN":          unix.CAP_NET_ADMIN,
+	"NET_RAW":            unix.CAP_NET_RAW,
+	"IPC_LOCK":           unix.CAP_IPC_LOCK,
+	"IPC_OWNER":          unix.CAP_IPC_OWNER,
+	"SYS_MODULE":         unix.CAP_SYS_MODULE,
+	"SYS_RAWIO":          unix.CAP_SYS_RAWIO,
+	"SYS_CHROOT":         unix.CAP_SYS_CHROOT,
+	"SYS_PTRACE":         unix.CAP_SYS_PTRACE,
+	"SYS_PACCT":          unix.CAP_SYS_PACCT,
+	"SYS_ADMIN":          unix.CAP_SYS_ADMIN,
+	"SYS_BOOT":           unix.CAP_SYS_BOOT,
+	"SYS_NICE":           unix.CAP_SYS_NICE,
+	"SYS_RESOURCE":       unix.CAP_SYS_RESOURCE,
+	"SYS_TIME":           unix.CAP_SYS_TIME,
+	"SYS_TTY_CONFIG":     unix.CAP_SYS_TTY_CONFIG,
+	"MKNOD":              unix.CAP_MKNOD,
+	"LEASE":              unix.CAP_LEASE,
+	"AUDIT_WRITE":        unix.CAP_AUDIT_WRITE,
+	"AUDIT_CONTROL":      unix.CAP_AUDIT_CONTROL,
+	"SETFCAP":            unix.CAP_SETFCAP,
+	"MAC_OVERRIDE":       unix.CAP_MAC_OVERRIDE,
+	"MAC_ADMIN":          unix.CAP_MAC_ADMIN,
+	"SYSLOG":             unix.CAP_SYSLOG,
+	"WAKE_ALARM":         unix.CAP_WAKE_ALARM,
+	"BLOCK_SUSPEND":      unix.CAP_BLOCK_SUSPEND,
+	"AUDIT_READ":         unix.CAP_AUDIT_READ,
+	"PERFMON":            unix.CAP_PERFMON,
+	"BPF":                unix.CAP_BPF,
+	"CHECKPOINT_RESTORE": unix.CAP_CHECKPOINT_RESTORE,
+}
+
+// capabilityAll is the --cap-add value that keeps every capability
+const capabilityAll = "ALL"
+
+// parseCapabilities resolves --cap-add names ("NET_ADMIN", "cap_net_admin"
+// or "ALL") to the set of capability numbers to keep
+func parseCapabilities(names []string) (map[int]bool, error) {
+	keep := map[int]bool{}
+	for _, name := range names {
+		normalized := strings.TrimPrefix(strings.ToUpper(name), "CAP_")
+		if normalized == capabilityAll {
+			for capability := 0; capability <= lastCapability(); capability++ {
+				keep[capability] = true
+			}
+			continue
+		}
+		capability, found := capabilityNames[normalized]
+		if !found {
+			return nil, fmt.Errorf("unknown capability %q", name)
+		}
+		keep[capability] = true
+	}
+	return keep, nil
+}
+
+// capabilityList renders a set of capabilities as sorted CAP_ names, the
+// form the OCI spec uses
+func capabilityList(keep map[int]bool) []string {
+	var list []string
+	for name, capability := range capabilityNames {
+		if keep[capability] {
+			list = append(list, "CAP_"+name)
+		}
+	}
+	sort.Strings(list)
+	return list
+}
+
+// dropCapabilities removes everything but keep from the bounding set, which
+// caps what the workload can gain on exec. Exec also hands a root workload
+// the inheritable set, and any workload the ambient set, whatever the
+// bounding set says, so the ambient set is cleared and the inheritable one
+// cut down to keep as well. It needs CAP_SETPCAP, so it runs before
+// switching to the container user.
+func dropCapabilities(keep map[int]bool) error {
+	var inheritable [2]uint32
+	for capability := 0; capability <= lastCapability(); capability++ {
+		if keep[capability] {
+			inheritable[capability/32] |= 1 << (capability % 32)
+			continue
+		}
+		if err := unix.Prctl(unix.PR_CAPBSET_DROP, uintptr(capability), 0, 0, 0); err != nil {
+			return fmt.Errorf("failed to drop capability %d: %v", capability, err)
+		}
+	}
+
+	if err := unix.Prctl(unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_CLEAR_ALL, 0, 0, 0); err != nil {
+		return fmt.Errorf("failed to drop ambient capabilities: %v", err)
+	}
+	header := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var data [2]unix.CapUserData
+	if err := unix.Capget(&header, &data[0]); err != nil {
+		return fmt.Errorf("failed to read capabilities: %v", err)
+	}
+	data[0].Inheritable = inheritable[0] & data[0].Permitted
+	data[1].Inheritable = inheritable[1] & data[1].Permitted
+	if err := unix.Capset(&header, &data[0]); err != nil {
+		return fmt.Errorf("failed to drop inheritable capabilities: %v", err)
+	}
+	return nil
+}
+
+// lastCapability returns the highest capability number the kernel knows
+func lastCapability() int {
+	if value, err := readSysctlInt("kernel/cap_last_cap"); err == nil {
+		return value
+	}
+	return unix.CAP_LAST_CAP
+}
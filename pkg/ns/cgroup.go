@@ -0,0 +1,189 @@
+//go:build linux
+
+package ns
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"nsctl/pkg/cgroup"
+)
+
+// setUpCgroup moves the container's process into a cgroup of its own
+// The cgroup carries the --memory and --cpus limits and the devices a
+// rootful container may use, and tells the shim about OOM kills. Without
+// anything to enforce, a host where nsctl can't create cgroups only costs
+// OOM reporting, so that is a warning rather than an error, and so is a
+// rootless shim that got no delegated cgroup from systemd; nil is returned
+// in those cases.
+func setUpCgroup(config ContainerConfig, pid int) (*cgroup.Cgroup, error) {
+	memoryLimit, err := ParseSize(config.Memory)
+	if err != nil {
+		return nil, fmt.Errorf("invalid memory limit: %v", err)
+	}
+	devices := containerDevices(config)
+	resources := cgroup.Resources{MemoryLimit: memoryLimit, CPUs: config.CPUs, Devices: devices}
+
+	containerCgroup, err := cgroup.Create(config.ID, resources)
+	if err == nil {
+		err = containerCgroup.AddProcess(pid)
+		if err != nil {
+			containerCgroup.Delete()
+		}
+	}
+	if err != nil {
+		hasLimits := memoryLimit > 0 || config.CPUs > 0
+		if hasLimits && os.Geteuid() == 0 {
+			return nil, fmt.Errorf("cannot apply resource limits: %v", err)
+		}
+		if devices != nil {
+			return nil, fmt.Errorf("cannot restrict the container's devices (--privileged gives it all of the host's): %v", err)
+		}
+		if hasLimits {
+			logf("[shim] Warning: resource limits unavailable, running without them: %v\n", err)
+		} else {
+			logf("[shim] Warning: running without a cgroup, OOM kills will not be reported: %v\n", err)
+		}
+		return nil, nil
+	}
+
+	logf("[shim] Container %s is in cgroup %s\n", ShortID(config.ID), containerCgroup.Path)
+	return containerCgroup, nil
+}
+
+// cgroupWatch is the shim's watch on a container's cgroup while the
+// workload runs
+type cgroupWatch struct {
+	stops []func()
+
+	restartOnce sync.Once
+
+	// restartRequested is set when a memory event action killed the
+	// workload to have it restarted; it is safe to read after stop
+	restartRequested bool
+}
+
+// watchCgroupEvents watches the container's cgroup for OOM kills, the
+// container's pressure alerts and its memory event actions, until stop is
+// called
+func watchCgroupEvents(config ContainerConfig, process *os.Process, containerCgroup *cgroup.Cgroup) *cgroupWatch {
+	watch := &cgroupWatch{stops: []func(){watchOOMKills(config.ID, containerCgroup)}}
+	for _, trigger := range config.PressureAlerts {
+		watch.stops = append(watch.stops, watchPressure(config.ID, containerCgroup, trigger))
+	}
+	watch.stops = append(watch.stops, watchMemoryEvents(config, process, containerCgroup, watch)...)
+	return watch
+}
+
+// stop ends the watch
+func (watch *cgroupWatch) stop() {
+	for _, stop := range watch.stops {
+		stop()
+	}
+}
+
+// requestRestart stops the workload with kill, once, for the restart loop
+// to start it again
+func (watch *cgroupWatch) requestRestart(kill func()) {
+	watch.restartOnce.Do(func() {
+		watch.restartRequested = true
+		kill()
+	})
+}
+
+// pressureEvents are the event types of each resource's pressure alerts
+var pressureEvents = map[string]string{
+	"cpu":    EventCPUPressure,
+	"memory": EventMemoryPressure,
+	"io":     EventIOPressure,
+}
+
+// watchPressure emits a pressure event each time the container's cgroup
+// crosses a pressure alert's threshold, until the returned stop function is
+// called
+func watchPressure(containerID string, containerCgroup *cgroup.Cgroup, trigger cgroup.PressureTrigger) (stop func()) {
+	if containerCgroup == nil {
+		return func() {}
+	}
+
+	watcher, err := containerCgroup.WatchPressure(trigger)
+	if err != nil {
+		logf("[shim] Warning: pressure alert %s disabled: %v\n", trigger, err)
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range watcher.Fired {
+			logf("[shim] Container %s crossed pressure threshold %s\n", ShortID(containerID), trigger)
+			attributes := map[string]string{"threshold": trigger.String()}
+			// The averages say how bad it has got, beyond the threshold
+			if stats, err := containerCgroup.Pressure(); err == nil && stats.Resource(trigger.Resource) != nil {
+				line := stats.Resource(trigger.Resource).Line(trigger.Full)
+				attributes["avg10"] = strconv.FormatFloat(line.Avg10, 'f', 2, 64)
+			}
+			emitEvent(pressureEvents[trigger.Resource], containerID, attributes)
+		}
+	}()
+
+	return func() {
+		watcher.Close()
+		<-done
+	}
+}
+
+// watchOOMKills emits an "oom" event whenever the OOM killer kills a
+// process in the container's cgroup, until the returned stop function is
+// called
+func watchOOMKills(containerID string, containerCgroup *cgroup.Cgroup) (stop func()) {
+	if containerCgroup == nil {
+		return func() {}
+	}
+
+	watcher, err := containerCgroup.WatchOOM()
+	if err != nil {
+		logf("[shim] Warning: OOM kills will only be detected on exit: %v\n", err)
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for count := range watcher.Kills {
+			logf("[shim] OOM killer killed a process in container %s\n", ShortID(containerID))
+			emitEvent(EventOOM, containerID, map[string]string{"oom_kills": strconv.Itoa(count)})
+		}
+	}()
+
+	return func() {
+		watcher.Close()
+		<-done
+	}
+}
+
+// releaseCgroup checks the container's cgroup for OOM kills and removes it
+// The container counts as OOM-killed when the kernel killed something in
+// its cgroup and the workload itself died of SIGKILL, which is how the OOM
+// killer ends a process
+func releaseCgroup(containerCgroup *cgroup.Cgroup, exit *containerExit) {
+	if containerCgroup == nil {
+		return
+	}
+
+	oomKills, err := containerCgroup.OOMKillCount()
+	if err != nil {
+		logf("[shim] Warning: %v\n", err)
+	}
+	if oomKills > 0 {
+		logf("[shim] OOM killer killed %d process(es) in the container\n", oomKills)
+		exit.OOMKilled = exit.Signal == int(syscall.SIGKILL)
+	}
+
+	if err := containerCgroup.Delete(); err != nil {
+		logf("[shim] Warning: %v\n", err)
+	}
+}
@@ -0,0 +1,50 @@
+//go:build linux
+
+package ns
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Cgroup namespaces (--cgroupns)
+//
+// A process reads its cgroup from /proc/self/cgroup, and software that
+// sizes itself to its limits, like the JVM or systemd, looks that path up
+// under /sys/fs/cgroup. Without a cgroup namespace the path is the host's,
+// e.g. /nsctl/<id>, which gives away the host's hierarchy and doesn't exist
+// in the container's /sys/fs/cgroup, where only its own group is mounted.
+// In a cgroup namespace rooted at the container's group the path is just /.
+//
+// A cgroup namespace is rooted at the cgroup of the process that creates
+// it. The shim only moves the setup process into the container's cgroup
+// after cloning it, so setup unshares the namespace itself, once it has
+// its config and with it knows it has been moved. --cgroupns=host keeps
+// the host's view (see namespaces.go); kernels without cgroup namespaces
+// (before 4.6) always do.
+
+// hasOwnCgroupNamespace reports whether a container gets a cgroup namespace
+func hasOwnCgroupNamespace(config ContainerConfig) bool {
+	return isOwnNamespace(config.CgroupNamespace)
+}
+
+// kernelHasNamespace reports whether the kernel supports a namespace type,
+// by its name under /proc/self/ns
+func kernelHasNamespace(name string) bool {
+	_, err := os.Stat("/proc/self/ns/" + name)
+	return err == nil
+}
+
+// unshareCgroupNamespace moves the calling thread into a new cgroup
+// namespace rooted at its current cgroup, the container's
+func unshareCgroupNamespace(config ContainerConfig) error {
+	if !hasOwnCgroupNamespace(config) {
+		return nil
+	}
+	if err := unix.Unshare(unix.CLONE_NEWCGROUP); err != nil {
+		return fmt.Errorf("failed to create cgroup namespace (--cgroupns=%s keeps the host's): %v", NamespaceHost, err)
+	}
+	return nil
+}
@@ -0,0 +1,373 @@
+//go:build linux
+
+package ns
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"nsctl/pkg/cgroup"
+)
+
+// Host diagnostics (nsctl check)
+//
+// CheckHostFeatures only looks for what would stop one container from
+// running. "nsctl check" goes through everything nsctl can use, actually
+// trying what can be tried (cloning a process into new namespaces, for
+// example), and says for each feature whether it works and how to fix it
+// when it doesn't. A missing feature nsctl can't do without in the current
+// mode (rootful or rootless) fails the check; one only some containers or
+// the other mode need is a warning.
+
+// Check result statuses
+const (
+	CheckPass = "PASS"
+	CheckWarn = "WARN"
+	CheckFail = "FAIL"
+
+	// CheckSkip is for self-tests that don't apply to the host
+	CheckSkip = "SKIP"
+)
+
+// CheckResult is the outcome of one host check
+type CheckResult struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+
+	// Detail says what was found, and Fix how to get what's missing
+	Detail string `json:"detail"`
+	Fix    string `json:"fix,omitempty"`
+}
+
+// cgroupControllers are the controllers nsctl uses: memory and cpu for
+// limits, and the freezer for exporting volumes in use
+var cgroupControllers = []string{"memory", "cpu", "freezer"}
+
+// RunHostChecks probes the host for everything nsctl relies on
+func RunHostChecks() []CheckResult {
+	rootless := os.Geteuid() != 0
+
+	var results []CheckResult
+	results = append(results, checkNamespaceSupport()...)
+	results = append(results, checkCloneFlags(rootless))
+	results = append(results, checkUserNamespaceSupport(rootless))
+	results = append(results, checkCgroups(rootless)...)
+	results = append(results, checkOverlay()...)
+	results = append(results, checkSeccompSupport())
+	results = append(results, checkIDMapHelpers(rootless)...)
+	return results
+}
+
+// failOrWarn is a failure for what the current mode needs, and a warning
+// for what it doesn't
+func failOrWarn(needed bool) string {
+	if needed {
+		return CheckFail
+	}
+	return CheckWarn
+}
+
+// checkNamespaceSupport looks for the namespace types containers use
+func checkNamespaceSupport() []CheckResult {
+	var results []CheckResult
+	for _, namespace := range requiredNamespaces {
+		result := CheckResult{Name: namespace.name + " namespace", Status: CheckPass, Detail: "supported"}
+		if _, err := os.Stat(filepath.Join("/proc/self/ns", namespace.name)); err != nil {
+			result.Status = CheckFail
+			result.Detail = "the kernel does not support it"
+			result.Fix = fmt.Sprintf("use a kernel built with %s=y", namespace.kernelOption)
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// checkCloneFlags clones a process with the flags containers are created
+// with, which is the only way to be sure namespaces can be created here
+// (seccomp filters of an outer container runtime, for example, may forbid it)
+func checkCloneFlags(rootless bool) CheckResult {
+	flags := uintptr(unix.CLONE_NEWUTS | unix.CLONE_NEWPID | unix.CLONE_NEWNS)
+	names := "CLONE_NEWUTS, CLONE_NEWPID, CLONE_NEWNS"
+	if rootless {
+		flags |= unix.CLONE_NEWUSER
+		names += ", CLONE_NEWUSER"
+	}
+
+	result := CheckResult{Name: "Clone flags", Status: CheckPass, Detail: names}
+	if err := probeClone(flags); err != nil {
+		result.Status = CheckFail
+		result.Detail = fmt.Sprintf("clone with %s failed: %v", names, err)
+		if rootless {
+			result.Fix = "see the user namespace check below"
+		} else {
+			result.Fix = "run nsctl with full root privileges (CAP_SYS_ADMIN), outside of seccomp-restricted containers"
+		}
+	}
+	return result
+}
+
+// probeClone runs true(1) in new namespaces of the given types
+func probeClone(flags uintptr) error {
+	truePath, err := exec.LookPath("true")
+	if err != nil {
+		return fmt.Errorf("no true(1) to probe with: %v", err)
+	}
+	cmd := exec.Command(truePath)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: flags}
+	return cmd.Run()
+}
+
+// checkUserNamespaceSupport checks that user namespaces can be created,
+// which rootless containers (and --userns) are built on
+func checkUserNamespaceSupport(rootless bool) CheckResult {
+	result := CheckResult{Name: "User namespaces", Status: CheckPass, Detail: "unprivileged users can create them"}
+	if problem := checkUserNamespaces(); problem != nil {
+		result.Status = failOrWarn(rootless)
+		result.Detail = problem.problem
+		result.Fix = problem.fix
+		return result
+	}
+	if err := probeClone(unix.CLONE_NEWUSER); err != nil {
+		result.Status = failOrWarn(rootless)
+		result.Detail = fmt.Sprintf("creating one failed: %v", err)
+		result.Fix = "check for a seccomp profile or LSM blocking unshare(CLONE_NEWUSER)"
+	}
+	return result
+}
+
+// checkCgroups checks the cgroup hierarchy, its controllers and, rootless,
+// whether a cgroup can be delegated to nsctl
+func checkCgroups(rootless bool) []CheckResult {
+	version := detectCgroupVersion()
+	hierarchy := CheckResult{Name: "Cgroup hierarchy", Status: CheckPass, Detail: "cgroup v" + version}
+	if version == "unknown" {
+		hierarchy.Status = CheckWarn
+		hierarchy.Detail = "no cgroup filesystem is mounted at /sys/fs/cgroup"
+		hierarchy.Fix = "mount one with: mount -t cgroup2 none /sys/fs/cgroup"
+		return []CheckResult{hierarchy}
+	}
+	results := []CheckResult{hierarchy}
+
+	if rootless {
+		delegation := CheckResult{Name: "Cgroup delegation", Status: CheckPass, Detail: "systemd can delegate a cgroup to nsctl"}
+		if err := cgroup.CanDelegate(); err != nil {
+			delegation.Status = CheckWarn
+			delegation.Detail = "--memory and --cpus are unavailable"
+			delegation.Fix = err.Error()
+			return append(results, delegation)
+		}
+		results = append(results, delegation)
+	}
+
+	available, where := availableControllers(rootless)
+	var missing []string
+	for _, controller := range cgroupControllers {
+		if !available[controller] {
+			missing = append(missing, controller)
+		}
+	}
+	controllers := CheckResult{Name: "Cgroup controllers", Status: CheckPass, Detail: strings.Join(cgroupControllers, ", ") + " " + where}
+	if len(missing) > 0 {
+		controllers.Status = CheckWarn
+		controllers.Detail = fmt.Sprintf("%s not available %s", strings.Join(missing, ", "), where)
+		switch {
+		case rootless:
+			controllers.Fix = "delegate them to user sessions: add Delegate=" + strings.Join(missing, " ") + " to a drop-in for user@.service"
+		case cgroup.IsUnified():
+			controllers.Fix = "enable them in the parent cgroup's cgroup.subtree_control, or boot with cgroup_enable=<controller>"
+		default:
+			controllers.Fix = "mount them with: mount -t cgroup -o <controller> none /sys/fs/cgroup/<controller>"
+		}
+	}
+	results = append(results, controllers)
+
+	if !rootless {
+		writable := CheckResult{Name: "Cgroup access", Status: CheckPass, Detail: "the hierarchy is writable"}
+		if problem := checkMemoryCgroup(); problem != nil {
+			writable.Status = CheckWarn
+			writable.Detail = problem.problem
+			writable.Fix = problem.fix
+		}
+		results = append(results, writable)
+	}
+	return results
+}
+
+// availableControllers returns the cgroup controllers nsctl can use, and
+// says where it looked
+func availableControllers(rootless bool) (map[string]bool, string) {
+	available := map[string]bool{}
+	if !cgroup.IsUnified() {
+		for _, controller := range cgroupControllers {
+			var stat unix.Statfs_t
+			path := filepath.Join("/sys/fs/cgroup", controller)
+			if err := unix.Statfs(path, &stat); err == nil && stat.Type == unix.CGROUP_SUPER_MAGIC {
+				available[controller] = true
+			}
+		}
+		return available, "(v1 hierarchies)"
+	}
+
+	// The freezer is built into v2 groups rather than a controller
+	available["freezer"] = true
+	path := "/sys/fs/cgroup/cgroup.controllers"
+	if rootless {
+		uid := strconv.Itoa(os.Getuid())
+		path = filepath.Join("/sys/fs/cgroup/user.slice", "user-"+uid+".slice", "user@"+uid+".service", "cgroup.controllers")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return available, fmt.Sprintf("(can't read %s)", path)
+	}
+	for _, controller := range strings.Fields(string(data)) {
+		available[controller] = true
+	}
+	if rootless {
+		return available, "(delegated to user sessions)"
+	}
+	return available, "(root cgroup)"
+}
+
+// checkOverlay checks for overlayfs, and whether it can be mounted in a
+// user namespace as rootless containers would need to; nothing uses it
+// until nsctl gets images, so neither is a failure
+func checkOverlay() []CheckResult {
+	overlay := CheckResult{Name: "Overlayfs", Status: CheckPass, Detail: "supported"}
+	filesystems, _ := os.ReadFile("/proc/filesystems")
+	if !strings.Contains(string(filesystems), "\toverlay\n") {
+		if _, err := os.Stat("/sys/module/overlay"); err != nil {
+			overlay.Status = CheckWarn
+			overlay.Detail = "the overlay filesystem is not available"
+			overlay.Fix = "load it with: modprobe overlay"
+			return []CheckResult{overlay}
+		}
+	}
+
+	userns := CheckResult{Name: "Overlayfs in user namespaces", Status: CheckPass, Detail: "Linux 5.11 or later"}
+	permitted, err := os.ReadFile("/sys/module/overlay/parameters/permit_mounts_in_userns")
+	switch {
+	case err == nil && strings.TrimSpace(string(permitted)) == "Y":
+		userns.Detail = "permitted by the overlay module (permit_mounts_in_userns)"
+	case !kernelAtLeast(5, 11):
+		userns.Status = CheckWarn
+		userns.Detail = "needs Linux 5.11 or later"
+		userns.Fix = "upgrade the kernel, or install fuse-overlayfs"
+	}
+	return []CheckResult{overlay, userns}
+}
+
+// kernelAtLeast reports whether the running kernel is the given version or
+// later; unknown versions are assumed recent
+func kernelAtLeast(major int, minor int) bool {
+	var uname unix.Utsname
+	if err := unix.Uname(&uname); err != nil {
+		return true
+	}
+	release := unix.ByteSliceToString(uname.Release[:])
+	parts := strings.SplitN(release, ".", 3)
+	if len(parts) < 2 {
+		return true
+	}
+	kernelMajor, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return true
+	}
+	kernelMinor, err := strconv.Atoi(strings.TrimRightFunc(parts[1], func(r rune) bool { return r < '0' || r > '9' }))
+	if err != nil {
+		return true
+	}
+	return kernelMajor > major || (kernelMajor == major && kernelMinor >= minor)
+}
+
+// checkSeccompSupport checks for seccomp filters, and for the notify action
+// --security-opt seccomp profiles may use
+func checkSeccompSupport() CheckResult {
+	result := CheckResult{Name: "Seccomp", Status: CheckPass, Detail: "filters are supported"}
+	if !detectSeccomp() {
+		result.Status = CheckWarn
+		result.Detail = "the kernel does not support seccomp; --security-opt seccomp=... is unavailable"
+		result.Fix = "use a kernel built with CONFIG_SECCOMP_FILTER=y"
+		return result
+	}
+	actions, err := os.ReadFile("/proc/sys/kernel/seccomp/actions_avail")
+	if err == nil && !strings.Contains(string(actions), "user_notif") {
+		result.Status = CheckWarn
+		result.Detail = "filters are supported, but not SCMP_ACT_NOTIFY"
+		result.Fix = "use Linux 5.0 or later for profiles with notify actions"
+	}
+	return result
+}
+
+// checkIDMapHelpers checks newuidmap/newgidmap and the user's subordinate
+// IDs, which rootless containers need to map more than one ID
+func checkIDMapHelpers(rootless bool) []CheckResult {
+	var results []CheckResult
+	for _, helper := range []string{"newuidmap", "newgidmap"} {
+		// Without the helpers, rootless containers can still map the user's
+		// own IDs, so they are never a failure
+		result := CheckResult{Name: helper, Status: CheckPass}
+		path, err := exec.LookPath(helper)
+		if err != nil {
+			result.Status = CheckWarn
+			result.Detail = "not found; rootless containers can only map your own IDs"
+			result.Fix = "install the uidmap package (shadow-utils on Fedora)"
+		} else if !isPrivilegedHelper(path) {
+			result.Status = CheckWarn
+			result.Detail = path + " is neither setuid root nor has file capabilities"
+			result.Fix = "chmod u+s " + path + ", or reinstall the uidmap package"
+		} else {
+			result.Detail = path
+		}
+		results = append(results, result)
+	}
+
+	if !rootless {
+		return results
+	}
+	subIDs := CheckResult{Name: "Subordinate IDs", Status: CheckPass}
+	userName := strconv.Itoa(os.Getuid())
+	if currentUser, err := user.Current(); err == nil {
+		userName = currentUser.Username
+	}
+	var found []string
+	for _, file := range []string{subUIDFile, subGIDFile} {
+		ranges, err := readSubIDRanges(file, userName, os.Getuid())
+		if err != nil {
+			subIDs.Status = CheckWarn
+			subIDs.Detail = err.Error() + "; containers can only map your own IDs"
+			subIDs.Fix = "usermod --add-subuids 100000-165535 --add-subgids 100000-165535 " + userName
+			break
+		}
+		var formatted []string
+		for _, subIDRange := range ranges {
+			formatted = append(formatted, subIDRange.String())
+		}
+		found = append(found, fmt.Sprintf("%s %s", file, strings.Join(formatted, ", ")))
+	}
+	if subIDs.Status == CheckPass {
+		subIDs.Detail = strings.Join(found, "; ")
+	}
+	return append(results, subIDs)
+}
+
+// isPrivilegedHelper reports whether an ID mapping helper can do its job:
+// it must be setuid root, or have file capabilities
+func isPrivilegedHelper(path string) bool {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && stat.Uid == 0 && info.Mode()&os.ModeSetuid != 0 {
+		return true
+	}
+	size, err := unix.Getxattr(path, "security.capability", nil)
+	return err == nil && size > 0
+}
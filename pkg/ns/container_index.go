@@ -0,0 +1,298 @@
+//go:build linux
+
+package ns
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Container index
+//
+// Listing containers means reading every record in the state directory,
+// which gets slow with hundreds of them. The index caches all records in one
+// file, index/containers.json in the state directory, and is valid for as
+// long as the state directory's modification time is the one it was built
+// at: every record write renames a file into the directory, which updates
+// it. ListContainers reads the index when it is valid, and the records (and
+// then rebuilds the index) when it isn't.
+//
+// "nsctl daemon" keeps the index valid: it watches the state directory with
+// inotify, re-reads only the records that changed into its in-memory copy
+// and writes the index out again once the changes settle, so ps reads one
+// file however many containers there are. Statuses are still checked against
+// the process table on every listing.
+
+const (
+	indexDirName  = "index"
+	indexFileName = "containers.json"
+
+	// indexSettleTime is how long the state directory has to be unchanged
+	// before an index of it is written. Directory times move in clock ticks,
+	// so a record written in the tick the directory was looked at might not
+	// change its time.
+	indexSettleTime = 100 * time.Millisecond
+)
+
+// containerIndex is the content of the index file
+type containerIndex struct {
+	// SchemaVersion is the version of the records in the index
+	SchemaVersion int `json:"schema_version"`
+
+	// StateDirModTime is the state directory's modification time the index
+	// was built at, in nanoseconds
+	StateDirModTime int64 `json:"state_dir_mod_time"`
+
+	Containers []ContainerInfo `json:"containers"`
+}
+
+// ListOptions select a page of containers for ListContainersPage
+type ListOptions struct {
+	// All includes created and exited containers, not just running and
+	// restarting ones
+	All bool
+
+	// Offset skips that many of the newest containers; Limit returns at
+	// most that many (0 for all)
+	Offset int
+	Limit  int
+}
+
+// ListContainersPage returns a page of the containers, newest first, and
+// how many there are in all
+func ListContainersPage(options ListOptions) ([]ContainerInfo, int, error) {
+	containers, err := ListContainers()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	selected := containers[:0]
+	for _, container := range containers {
+		if options.All || container.Status == StatusRunning || container.Status == StatusRestarting {
+			selected = append(selected, container)
+		}
+	}
+	sort.SliceStable(selected, func(i, j int) bool {
+		return selected[i].CreatedTime().After(selected[j].CreatedTime())
+	})
+
+	total := len(selected)
+	selected = selected[min(options.Offset, total):]
+	if options.Limit > 0 {
+		selected = selected[:min(options.Limit, len(selected))]
+	}
+	return selected, total, nil
+}
+
+// indexedContainerRecords returns all container records, from the index if
+// it is up to date
+func indexedContainerRecords() ([]ContainerInfo, error) {
+	modTime, err := stateDirModTime()
+	if err != nil {
+		return nil, err
+	}
+	if containers, ok := loadContainerIndex(modTime); ok {
+		return containers, nil
+	}
+
+	containers, err := readContainerRecords()
+	if err != nil {
+		return nil, err
+	}
+	saveContainerIndex(modTime, containers)
+	return containers, nil
+}
+
+// stateDirModTime returns the state directory's modification time
+func stateDirModTime() (int64, error) {
+	info, err := os.Stat(currentStateDir)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read state directory: %v", err)
+	}
+	return info.ModTime().UnixNano(), nil
+}
+
+// containerIndexPath returns where the index is kept
+// It is in a directory of its own, so writing it leaves the state
+// directory's modification time alone.
+func containerIndexPath() string {
+	return filepath.Join(currentStateDir, indexDirName, indexFileName)
+}
+
+// loadContainerIndex returns the indexed records, if the index was built at
+// modTime
+func loadContainerIndex(modTime int64) ([]ContainerInfo, bool) {
+	data, err := os.ReadFile(containerIndexPath())
+	if err != nil {
+		return nil, false
+	}
+	var index containerIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, false
+	}
+	if index.SchemaVersion != containerSchemaVersion || index.StateDirModTime != modTime {
+		return nil, false
+	}
+	return index.Containers, true
+}
+
+// saveContainerIndex writes the index of the records read at modTime
+// The index is only a cache, so failing to write it is not an error.
+func saveContainerIndex(modTime int64, containers []ContainerInfo) {
+	if time.Since(time.Unix(0, modTime)) < indexSettleTime {
+		return
+	}
+	data, err := json.Marshal(containerIndex{
+		SchemaVersion:   containerSchemaVersion,
+		StateDirModTime: modTime,
+		Containers:      containers,
+	})
+	if err != nil {
+		return
+	}
+
+	indexPath := containerIndexPath()
+	// The index holds every record, so only the store's user may read it
+	if err := os.MkdirAll(filepath.Dir(indexPath), 0700); err != nil {
+		return
+	}
+	tempPath := indexPath + ".tmp"
+	if err := os.WriteFile(tempPath, data, 0600); err != nil {
+		return
+	}
+	if err := os.Rename(tempPath, indexPath); err != nil {
+		os.Remove(tempPath)
+	}
+}
+
+// MaintainContainerIndex keeps the container index up to date as records
+// change; it only returns if it can't watch the state directory
+func MaintainContainerIndex() error {
+	if err := ensureStateDir(); err != nil {
+		return err
+	}
+	inotifyFD, err := unix.InotifyInit1(unix.IN_NONBLOCK | unix.IN_CLOEXEC)
+	if err != nil {
+		return fmt.Errorf("failed to create inotify instance: %v", err)
+	}
+	changes := unix.IN_MOVED_TO | unix.IN_MOVED_FROM | unix.IN_DELETE | unix.IN_CLOSE_WRITE
+	if _, err := unix.InotifyAddWatch(inotifyFD, currentStateDir, uint32(changes)); err != nil {
+		unix.Close(inotifyFD)
+		return fmt.Errorf("failed to watch %s: %v", currentStateDir, err)
+	}
+	// Non-blocking, the descriptor goes through the runtime's poller, which
+	// gives reads a deadline
+	notifications := os.NewFile(uintptr(inotifyFD), "inotify")
+	defer notifications.Close()
+
+	index := &watchedIndex{records: map[string]ContainerInfo{}, newer: map[string]bool{}}
+	rereadAll := true
+	changed := map[string]bool{}
+	buffer := make([]byte, 64*1024)
+	for {
+		if rereadAll || len(changed) > 0 {
+			notifications.SetReadDeadline(time.Now().Add(indexSettleTime))
+		} else {
+			notifications.SetReadDeadline(time.Time{})
+		}
+
+		count, err := notifications.Read(buffer)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			// Quiet for a moment: bring the index up to date
+			if err := index.update(changed, rereadAll); err != nil {
+				logf("[ns] Warning: failed to update the container index: %v\n", err)
+			} else {
+				rereadAll = false
+			}
+			changed = map[string]bool{}
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to watch %s: %v", currentStateDir, err)
+		}
+
+		for offset := 0; offset+unix.SizeofInotifyEvent <= count; {
+			event := (*unix.InotifyEvent)(unsafe.Pointer(&buffer[offset]))
+			nameBytes := buffer[offset+unix.SizeofInotifyEvent : offset+unix.SizeofInotifyEvent+int(event.Len)]
+			name := strings.TrimRight(string(nameBytes), "\x00")
+			offset += unix.SizeofInotifyEvent + int(event.Len)
+
+			if event.Mask&unix.IN_Q_OVERFLOW != 0 {
+				rereadAll = true
+			} else if strings.HasSuffix(name, containerFileExt) {
+				changed[name] = true
+			}
+		}
+	}
+}
+
+// watchedIndex is the daemon's in-memory copy of the index
+type watchedIndex struct {
+	// records by file name
+	records map[string]ContainerInfo
+
+	// newer holds the records of a newer nsctl, by file name; while there
+	// are any, no index is written, so listing reports them
+	newer map[string]bool
+}
+
+// update re-reads the changed records (or all of them) and writes the index
+func (index *watchedIndex) update(changed map[string]bool, rereadAll bool) error {
+	// Taken before reading, so that later changes invalidate the index
+	modTime, err := stateDirModTime()
+	if err != nil {
+		return err
+	}
+
+	if rereadAll {
+		clear(index.records)
+		clear(index.newer)
+		entries, err := os.ReadDir(currentStateDir)
+		if err != nil {
+			return fmt.Errorf("failed to read state directory: %v", err)
+		}
+		for _, entry := range entries {
+			if strings.HasSuffix(entry.Name(), containerFileExt) {
+				changed[entry.Name()] = true
+			}
+		}
+	}
+	for fileName := range changed {
+		delete(index.records, fileName)
+		delete(index.newer, fileName)
+		if _, err := os.Stat(filepath.Join(currentStateDir, fileName)); os.IsNotExist(err) {
+			continue
+		}
+		container, err := readContainerRecord(fileName)
+		if err != nil {
+			if _, newer := err.(*NewerSchemaError); newer {
+				index.newer[fileName] = true
+			} else {
+				// Listing skips broken records too
+				logf("[ns] Warning: container file %s: %v\n", fileName, err)
+			}
+			continue
+		}
+		index.records[fileName] = container
+	}
+	if len(index.newer) > 0 {
+		return nil
+	}
+
+	containers := make([]ContainerInfo, 0, len(index.records))
+	for _, container := range index.records {
+		containers = append(containers, container)
+	}
+	sort.Slice(containers, func(i, j int) bool { return containers[i].ID < containers[j].ID })
+	saveContainerIndex(modTime, containers)
+	return nil
+}
@@ -0,0 +1,213 @@
+//go:build linux
+
+package ns
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Log quotas
+//
+// Containers don't write to their log file directly. Their stdout and
+// stderr go into pipes that the shim copies to the log, so the shim can stop
+// one chatty container from filling the host filesystem. Two limits
+// apply: the container's own maximum log size (--log-max-size, defaulting to
+// log_max_size in the runtime config) and log_max_total_size, which bounds
+// the logs of all containers together. Once a limit is hit, the rest of the
+// output is read and discarded so the workload never blocks on a full pipe.
+
+// totalLogCheckInterval is how many bytes a container may log between two
+// checks of the combined log size, which has to walk the state directory
+const totalLogCheckInterval = 1 << 20
+
+// logQuotaWriter appends to a container log until one of its limits is hit
+type logQuotaWriter struct {
+	mu   sync.Mutex
+	file *os.File
+
+	// written counts the bytes in the log, including earlier runs
+	written int64
+	maxSize int64 // 0 means no limit
+
+	stateDir         string
+	maxTotalSize     int64 // 0 means no limit
+	sinceTotalChecks int64
+
+	// exceeded is set once the log is full; later output is discarded
+	exceeded bool
+}
+
+// newLogQuotaWriter opens the log of the container in containerDir
+func newLogQuotaWriter(containerDir string, maxSize int64, maxTotalSize int64) (*logQuotaWriter, error) {
+	logPath := filepath.Join(containerDir, containerLogFileName)
+	logFile, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open container log: %v", err)
+	}
+
+	writer := &logQuotaWriter{
+		file:         logFile,
+		written:      fileSize(logPath),
+		maxSize:      maxSize,
+		stateDir:     filepath.Dir(containerDir),
+		maxTotalSize: maxTotalSize,
+	}
+
+	// Check the combined size straight away, so a container started when
+	// the logs are already full doesn't get its first megabyte for free
+	writer.sinceTotalChecks = totalLogCheckInterval
+	return writer, nil
+}
+
+// Write appends a log record to the log, unless it would exceed the quota
+// It always reports success so that io.Copy keeps draining the pipe
+func (w *logQuotaWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.exceeded {
+		return len(p), nil
+	}
+
+	if w.maxTotalSize > 0 {
+		w.sinceTotalChecks += int64(len(p))
+		if w.sinceTotalChecks >= totalLogCheckInterval {
+			w.sinceTotalChecks = 0
+			if totalLogSize(w.stateDir) >= w.maxTotalSize {
+				w.stop(fmt.Sprintf("total log size of all containers reached %s", FormatSize(w.maxTotalSize)))
+				return len(p), nil
+			}
+		}
+	}
+
+	// p is a whole log record, which is kept or dropped as a whole
+	if w.maxSize > 0 && w.written+int64(len(p)) > w.maxSize {
+		w.stop(fmt.Sprintf("log reached its limit of %s", FormatSize(w.maxSize)))
+		return len(p), nil
+	}
+
+	count, err := w.file.Write(p)
+	w.written += int64(count)
+	if err != nil {
+		// Most likely the disk is full; there is nothing more we can log
+		logf("[shim] Warning: failed to write container log: %v\n", err)
+		w.exceeded = true
+	}
+	return len(p), nil
+}
+
+// stop marks the log as full, noting why at its end
+func (w *logQuotaWriter) stop(reason string) {
+	w.exceeded = true
+	logf("[shim] Container log is full (%s); discarding further output\n", reason)
+	w.file.Write(formatLogRecord(time.Now(), LogStreamStderr, false, []byte("[nsctl] "+reason+"; further output discarded")))
+}
+
+// Close closes the log file
+func (w *logQuotaWriter) Close() error {
+	return w.file.Close()
+}
+
+// logsOutput reports whether a container's output goes into its log; only
+// that of interactive containers, which have the terminal, doesn't
+func logsOutput(config ContainerConfig) bool {
+	return config.Detach || config.CreateOnly || !hasTerminal(config)
+}
+
+// logStreamWriter turns the output of one of the container's streams into
+// log records, one per line, stamped with the time it was read; output that
+// doesn't end in a newline yet becomes a partial record
+type logStreamWriter struct {
+	stream string
+	log    io.Writer
+
+	// echo, if set, gets the output as it is, for a foreground container
+	echo io.Writer
+}
+
+// Write logs p, which may hold any number of lines
+func (w *logStreamWriter) Write(p []byte) (int, error) {
+	if w.echo != nil {
+		// The terminal may go away (a dropped SSH session); keep logging
+		if _, err := w.echo.Write(p); err != nil {
+			w.echo = nil
+		}
+	}
+
+	now := time.Now()
+	for remaining := p; len(remaining) > 0; {
+		line, rest, complete := bytes.Cut(remaining, []byte{'\n'})
+		if _, err := w.log.Write(formatLogRecord(now, w.stream, !complete, line)); err != nil {
+			return 0, err
+		}
+		remaining = rest
+	}
+	return len(p), nil
+}
+
+// copyContainerOutput drains the container's stdout and stderr pipes into
+// the log, each record tagged with its stream, and echoes them to
+// echoStdout and echoStderr unless those are nil
+// The returned channel is closed once both pipes reach EOF, i.e. once every
+// process in the container has exited or closed its stdout and stderr
+func copyContainerOutput(stdout *os.File, stderr *os.File, log *logQuotaWriter, echoStdout io.Writer, echoStderr io.Writer) <-chan struct{} {
+	var copies sync.WaitGroup
+	copyStream := func(output *os.File, writer *logStreamWriter) {
+		defer copies.Done()
+		defer output.Close()
+		if _, err := io.Copy(writer, output); err != nil {
+			logf("[shim] Warning: failed to copy container %s: %v\n", writer.stream, err)
+		}
+	}
+	copies.Add(2)
+	go copyStream(stdout, &logStreamWriter{stream: LogStreamStdout, log: log, echo: echoStdout})
+	go copyStream(stderr, &logStreamWriter{stream: LogStreamStderr, log: log, echo: echoStderr})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		copies.Wait()
+		log.Close()
+	}()
+	return done
+}
+
+// totalLogSize adds up the logs of all containers in the state directory
+func totalLogSize(stateDir string) int64 {
+	logPaths, _ := filepath.Glob(filepath.Join(stateDir, "*", containerLogFileName))
+
+	var total int64
+	for _, logPath := range logPaths {
+		total += fileSize(logPath)
+	}
+	return total
+}
+
+// containerLogLimits resolves the log quotas that apply to a container
+func containerLogLimits(config ContainerConfig) (int64, int64, error) {
+	runtimeConfig, err := LoadRuntimeConfig()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	maxSizeText := runtimeConfig.LogMaxSize
+	if config.LogMaxSize != "" {
+		maxSizeText = config.LogMaxSize
+	}
+	maxSize, err := ParseSize(maxSizeText)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid log size limit: %v", err)
+	}
+
+	maxTotalSize, err := ParseSize(runtimeConfig.LogMaxTotalSize)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid total log size limit: %v", err)
+	}
+	return maxSize, maxTotalSize, nil
+}
@@ -3,65 +3,176 @@
 package ns
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
+
+	"golang.org/x/sys/unix"
 )
 
-// ContainerInfo holds information about a running container
+// ContainerInfo holds information about a running or exited container
 type ContainerInfo struct {
+	// SchemaVersion is the version of the record's format (see
+	// state_schema.go)
+	SchemaVersion int `json:"schema_version"`
+
 	ID        string    `json:"id"`
 	PID       int       `json:"pid"`
 	Command   string    `json:"command"`
 	Args      []string  `json:"args"`
+	Hostname  string    `json:"hostname"`
 	StartTime time.Time `json:"start_time"`
 	Status    string    `json:"status"`
+
+	// Created is when the container was created; StartTime moves on to
+	// when it was started
+	Created time.Time `json:"created,omitempty"`
+
+	// OwnerUID is the user who created the container, behind sudo if it was
+	// used (see limits.go)
+	OwnerUID int `json:"owner_uid"`
+
+	// ShimPID is the per-container shim process that waits for the container
+	ShimPID int `json:"shim_pid"`
+
+	// Start times of the workload and the shim, in clock ticks after boot,
+	// which tell them apart from later processes that reuse their PIDs;
+	// records from before they were kept have 0
+	PIDStartTime  uint64 `json:"pid_start_time,omitempty"`
+	ShimStartTime uint64 `json:"shim_start_time,omitempty"`
+
+	// Filled in by the shim once the container has exited
+	ExitCode     int       `json:"exit_code"`
+	FinishedAt   time.Time `json:"finished_at,omitempty"`
+	FinishReason string    `json:"finish_reason,omitempty"`
+
+	// OOMKilled is set when the kernel's OOM killer ended the container
+	OOMKilled bool `json:"oom_killed"`
+
+	// AutoRemove deletes the record as soon as the container exits (--rm)
+	AutoRemove bool `json:"auto_remove"`
+
+	// RestartPolicy is the container's --restart; RestartCount counts its
+	// restarts and PreviousExits holds how the last runs before them ended
+	RestartPolicy string         `json:"restart_policy,omitempty"`
+	RestartCount  int            `json:"restart_count"`
+	PreviousExits []PreviousExit `json:"previous_exits,omitempty"`
+
+	// ManuallyStopped is set by "stop" and "rm -f", so the container isn't
+	// restarted
+	ManuallyStopped bool `json:"manually_stopped,omitempty"`
+
+	// Adopted is set for a container another runtime created (nsctl adopt)
+	Adopted *AdoptedContainer `json:"adopted,omitempty"`
+
+	// LogPath holds the output of containers that aren't interactive
+	LogPath string `json:"log_path,omitempty"`
+
+	// CgroupPath is the container's cgroup, if nsctl could create one
+	CgroupPath string `json:"cgroup_path,omitempty"`
+
+	// Volumes names the managed volumes the container uses
+	Volumes []string `json:"volumes,omitempty"`
+
+	// Rootfs is the container's --rootfs, if it has one, and ReadOnly is
+	// set when its root is read-only (--read-only)
+	Rootfs   string `json:"rootfs,omitempty"`
+	ReadOnly bool   `json:"read_only,omitempty"`
+
+	// Platform is the os/arch the container's binaries are built for
+	Platform string `json:"platform,omitempty"`
+
+	// Annotations are the container's --annotation metadata
+	Annotations map[string]string `json:"annotations,omitempty"`
+
+	// ID mappings of the container's user namespace, if it has one
+	UIDMappings []IDMap `json:"uid_mappings,omitempty"`
+	GIDMappings []IDMap `json:"gid_mappings,omitempty"`
+
+	// Isolation is the container's backend (see isolation.go); containers
+	// that run without namespaces are marked ReducedIsolation, and those
+	// of them chrooted into the host's / (--rootfs /) NoFilesystemConfinement
+	Isolation               string `json:"isolation,omitempty"`
+	ReducedIsolation        bool   `json:"reduced_isolation,omitempty"`
+	NoFilesystemConfinement bool   `json:"no_filesystem_confinement,omitempty"`
+
+	// Network is the container's --network mode and IPAddress its address
+	// on the bridge, with the prefix, if it has one (see network.go)
+	Network   string `json:"network,omitempty"`
+	IPAddress string `json:"ip_address,omitempty"`
+
+	// PodID is the pod the container runs in, and PodInfra is set for the
+	// pod's infra container (see pod.go)
+	PodID    string `json:"pod_id,omitempty"`
+	PodInfra bool   `json:"pod_infra,omitempty"`
+
+	// Health is the outcome of the container's health check, if it has one;
+	// it is read from the shim's health file (see health.go)
+	Health *HealthStatus `json:"health,omitempty"`
+
+	// Host paths of the managed files mounted over the container's /etc
+	HostnamePath   string `json:"hostname_path"`
+	HostsPath      string `json:"hosts_path"`
+	ResolvConfPath string `json:"resolv_conf_path"`
 }
 
+// Container lifecycle states stored in ContainerInfo.Status
+const (
+	StatusCreated    = "created"
+	StatusRunning    = "running"
+	StatusRestarting = "restarting"
+	StatusExited     = "exited"
+)
+
 const (
 	// Standard Linux runtime directory for container metadata
 	// Following Filesystem Hierarchy Standard (FHS) - cleared on reboot
 	defaultStateDir  = "/var/run/nsctl"
 	containerFileExt = ".json"
+
+	// Number of ID characters shown by ps and used for hostnames
+	shortIDLength = 12
 )
 
 var (
-	// Current state directory (can be changed at runtime for fallback)
-	currentStateDir = defaultStateDir
+	// currentStateDir is the state directory of the store in use (see
+	// store.go)
+	currentStateDir = defaultStore.StateDir
 )
 
 // ensureStateDir creates the state directory if it doesn't exist
-// Uses /var/run/nsctl (standard location) with fallback to user directory if no permissions
 func ensureStateDir() error {
-	// Try to create the standard system directory first
-	if err := os.MkdirAll(currentStateDir, 0755); err != nil {
-		// If we can't write to /var/run (permission denied), use user fallback
-		if os.IsPermission(err) {
-			fmt.Printf("[ns] Permission denied for %s, using user directory fallback\n", currentStateDir)
-			userStateDir := filepath.Join(os.Getenv("HOME"), ".nsctl", "run")
-			if fallbackErr := os.MkdirAll(userStateDir, 0755); fallbackErr != nil {
-				return fmt.Errorf("failed to create state directory: %v (fallback failed: %v)", err, fallbackErr)
-			}
-			// Update to use the fallback directory
-			currentStateDir = userStateDir
-			fmt.Printf("[ns] Using fallback state directory: %s\n", currentStateDir)
-			return nil
-		}
-		return fmt.Errorf("failed to create state directory %s: %v", currentStateDir, err)
+	if err := ensureStoreDir("state", currentStateDir); err != nil {
+		return err
 	}
-
-	fmt.Printf("[ns] Using state directory: %s\n", currentStateDir)
+	logf("[ns] Using %s\n", CurrentStore())
 	return nil
 }
 
-// generateContainerID creates a simple container ID based on timestamp and PID
-func generateContainerID(pid int) string {
-	return fmt.Sprintf("nsctl_%d_%d", time.Now().Unix(), pid)
+// generateContainerID creates a random 64-character hex container ID
+// The first 12 characters (the "short ID") are what ps displays
+func generateContainerID() (string, error) {
+	randomBytes := make([]byte, 32)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return "", fmt.Errorf("failed to generate container ID: %v", err)
+	}
+	return hex.EncodeToString(randomBytes), nil
+}
+
+// ShortID returns the 12-character abbreviation of a container ID
+func ShortID(containerID string) string {
+	if len(containerID) > shortIDLength {
+		return containerID[:shortIDLength]
+	}
+	return containerID
 }
 
 // getContainerFilePath returns the path to a container's metadata file
@@ -69,101 +180,419 @@ func getContainerFilePath(containerID string) string {
 	return filepath.Join(currentStateDir, containerID+containerFileExt)
 }
 
-// RegisterContainer saves container information to persistent storage
-func RegisterContainer(pid int, command string, args []string) (string, error) {
+// getContainerDir returns the per-container directory holding runtime files
+// (such as the hostname file) that are bind-mounted into the container
+func getContainerDir(containerID string) string {
+	return filepath.Join(currentStateDir, containerID)
+}
+
+// createContainerDir prepares the per-container directory before the
+// container starts, so setup inside the namespace can mount files from it
+func createContainerDir(containerID string) (string, error) {
 	if err := ensureStateDir(); err != nil {
 		return "", err
 	}
 
-	containerID := generateContainerID(pid)
+	containerDir := getContainerDir(containerID)
+	if err := os.MkdirAll(containerDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create container directory %s: %v", containerDir, err)
+	}
+	return containerDir, nil
+}
+
+// RegisterContainer saves container information to persistent storage
+func RegisterContainer(config ContainerConfig, pid int) error {
+	if err := ensureStateDir(); err != nil {
+		return err
+	}
 
+	now := time.Now()
 	containerInfo := ContainerInfo{
-		ID:        containerID,
-		PID:       pid,
-		Command:   command,
-		Args:      args,
-		StartTime: time.Now(),
-		Status:    "running",
+		ID:         config.ID,
+		PID:        pid,
+		Command:    config.Command,
+		Args:       config.Args,
+		Hostname:   config.Hostname,
+		StartTime:  now,
+		Created:    now,
+		Status:     StatusCreated,
+		ShimPID:    os.Getpid(),
+		OwnerUID:   config.OwnerUID,
+		AutoRemove: config.AutoRemove,
+		CgroupPath: config.CgroupPath,
+		Volumes:    config.Volumes,
+		Rootfs:     config.Rootfs,
+		ReadOnly:   config.ReadOnly,
+		Platform:   config.Platform.String(),
+
+		Isolation:               config.Isolation,
+		ReducedIsolation:        config.Isolation == IsolationChroot,
+		NoFilesystemConfinement: config.Isolation == IsolationChroot && hasHostRoot(config),
+
+		RestartPolicy: config.Restart.String(),
+
+		Network:   config.Network,
+		IPAddress: config.IPAddress,
+
+		PodID:    config.PodID,
+		PodInfra: config.PodInfra,
+
+		Annotations: config.Annotations,
+
+		UIDMappings: config.UIDMappings,
+		GIDMappings: config.GIDMappings,
+
+		HostnamePath:   filepath.Join(getContainerDir(config.ID), "hostname"),
+		HostsPath:      filepath.Join(getContainerDir(config.ID), "hosts"),
+		ResolvConfPath: filepath.Join(getContainerDir(config.ID), "resolv.conf"),
+	}
+	// Neither can have exited yet: the shim is us, and it reaps the workload
+	containerInfo.PIDStartTime, _ = processStartTime(pid)
+	containerInfo.ShimStartTime, _ = processStartTime(containerInfo.ShimPID)
+	if logsOutput(config) {
+		containerInfo.LogPath = filepath.Join(getContainerDir(config.ID), containerLogFileName)
 	}
 
-	// Save container info to JSON file
+	if err := saveContainerInfo(containerInfo); err != nil {
+		return err
+	}
+
+	logf("[ns] Registered container %s with PID %d\n", config.ID, pid)
+	emitEvent(EventCreate, config.ID, nil)
+	return nil
+}
+
+// saveContainerInfo writes a container record to its JSON file
+// The record is written to a temporary file and renamed into place so that
+// a concurrent ps never sees a half-written file; it holds the container's
+// environment, so only the store's user may read it
+func saveContainerInfo(containerInfo ContainerInfo) error {
+	containerInfo.SchemaVersion = containerSchemaVersion
 	data, err := json.MarshalIndent(containerInfo, "", "  ")
 	if err != nil {
-		return "", fmt.Errorf("failed to marshal container info: %v", err)
+		return fmt.Errorf("failed to marshal container info: %v", err)
 	}
 
-	filePath := getContainerFilePath(containerID)
-	if err := ioutil.WriteFile(filePath, data, 0644); err != nil {
-		return "", fmt.Errorf("failed to write container info: %v", err)
+	filePath := getContainerFilePath(containerInfo.ID)
+	tempPath := filePath + ".tmp"
+	if err := ioutil.WriteFile(tempPath, data, 0600); err != nil {
+		return fmt.Errorf("failed to write container info: %v", err)
+	}
+	if err := os.Rename(tempPath, filePath); err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("failed to write container info: %v", err)
+	}
+	return nil
+}
+
+// loadContainerInfo reads a single container record by its full ID
+func loadContainerInfo(containerID string) (ContainerInfo, error) {
+	data, err := ioutil.ReadFile(getContainerFilePath(containerID))
+	if err != nil {
+		return ContainerInfo{}, fmt.Errorf("failed to read container info: %v", err)
+	}
+	return decodeContainerInfo(containerID, data)
+}
+
+// decodeContainerInfo parses a container record, migrating and rewriting
+// it if an older nsctl wrote it
+func decodeContainerInfo(containerID string, data []byte) (ContainerInfo, error) {
+	var containerInfo ContainerInfo
+	migrated, err := decodeRecord("container", ShortID(containerID), data, containerMigrations, &containerInfo)
+	if err != nil {
+		if _, newer := err.(*NewerSchemaError); newer {
+			return containerInfo, err
+		}
+		return containerInfo, fmt.Errorf("failed to parse container info: %v", err)
+	}
+	if migrated {
+		if err := saveContainerInfo(containerInfo); err != nil {
+			logf("[ns] Warning: failed to save migrated record of container %s: %v\n", ShortID(containerID), err)
+		} else {
+			logf("[ns] Migrated record of container %s to schema version %d\n", ShortID(containerID), containerSchemaVersion)
+		}
+	}
+	return containerInfo, nil
+}
+
+// markContainerExited records how a container exited in its record
+func markContainerExited(containerID string, exit containerExit) error {
+	containerInfo, err := loadContainerInfo(containerID)
+	if err != nil {
+		return err
 	}
 
-	fmt.Printf("[ns] Registered container %s with PID %d\n", containerID, pid)
-	return containerID, nil
+	applyContainerExit(&containerInfo, exit)
+	return saveContainerInfo(containerInfo)
 }
 
-// UnregisterContainer removes container information when it stops
+// applyContainerExit copies an exit file's content into a record
+func applyContainerExit(containerInfo *ContainerInfo, exit containerExit) {
+	containerInfo.Status = StatusExited
+	containerInfo.ExitCode = exit.ExitCode
+	containerInfo.FinishedAt = exit.FinishedAt
+	containerInfo.FinishReason = exit.FinishReason
+	containerInfo.OOMKilled = exit.OOMKilled
+}
+
+// UnregisterContainer removes a container's record and its container directory
 func UnregisterContainer(containerID string) error {
 	filePath := getContainerFilePath(containerID)
 	if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
 		return fmt.Errorf("failed to remove container info: %v", err)
 	}
-	fmt.Printf("[ns] Unregistered container %s\n", containerID)
+	if err := os.RemoveAll(getContainerDir(containerID)); err != nil {
+		return fmt.Errorf("failed to remove container directory: %v", err)
+	}
+	logf("[ns] Unregistered container %s\n", containerID)
 	return nil
 }
 
-// ListContainers returns information about all tracked containers
+// RemoveContainer deletes an exited container, and with removeVolumes its
+// anonymous volumes
+// A running container is refused unless force is set, in which case it is
+// killed first and its shim records the exit before the record is removed
+func RemoveContainer(containerID string, force bool, removeVolumes bool) error {
+	containerInfo, err := loadContainerInfo(containerID)
+	if err != nil {
+		return err
+	}
+
+	if status := refreshStatus(&containerInfo); status != StatusExited {
+		if !force {
+			return fmt.Errorf("container %s is %s: stop it first or use --force", ShortID(containerID), status)
+		}
+		if err := requestStop(&containerInfo); err != nil {
+			return err
+		}
+		if status != StatusRestarting {
+			logf("[ns] Killing running container %s (PID %d)\n", ShortID(containerID), containerInfo.PID)
+			if err := signalProcess(containerInfo.PID, containerInfo.PIDStartTime, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+				return fmt.Errorf("failed to kill container: %v", err)
+			}
+		}
+		waitForShimExit(containerInfo)
+	}
+
+	if err := UnregisterContainer(containerID); err != nil {
+		return err
+	}
+	if removeVolumes {
+		removeAnonymousVolumes(containerInfo.Volumes)
+	}
+	return nil
+}
+
+// waitForShimExit gives a container's shim a moment to record its exit
+func waitForShimExit(containerInfo ContainerInfo) {
+	// Adopted containers have no shim
+	if containerInfo.ShimPID <= 0 {
+		return
+	}
+	for attempt := 0; attempt < 50 && containerInfo.shimRunning(); attempt++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// ListContainers returns information about all tracked containers,
+// including exited ones
 func ListContainers() ([]ContainerInfo, error) {
 	if err := ensureStateDir(); err != nil {
 		return nil, err
 	}
 
-	files, err := ioutil.ReadDir(currentStateDir)
+	containers, err := indexedContainerRecords()
+	if err != nil {
+		return nil, err
+	}
+	for index := range containers {
+		refreshStatus(&containers[index])
+	}
+	return containers, nil
+}
+
+// readContainerRecords reads every container record in the state directory
+func readContainerRecords() ([]ContainerInfo, error) {
+	entries, err := os.ReadDir(currentStateDir)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read state directory: %v", err)
 	}
 
 	var containers []ContainerInfo
-
-	for _, file := range files {
-		if !strings.HasSuffix(file.Name(), containerFileExt) {
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), containerFileExt) {
 			continue
 		}
-
-		filePath := filepath.Join(currentStateDir, file.Name())
-		data, err := ioutil.ReadFile(filePath)
+		containerInfo, err := readContainerRecord(entry.Name())
 		if err != nil {
-			fmt.Printf("[ns] Warning: failed to read container file %s: %v\n", filePath, err)
+			// Acting on some containers only would be worse than on none
+			if _, newer := err.(*NewerSchemaError); newer {
+				return nil, err
+			}
+			logf("[ns] Warning: container file %s: %v\n", entry.Name(), err)
 			continue
 		}
+		containers = append(containers, containerInfo)
+	}
+	return containers, nil
+}
 
-		var containerInfo ContainerInfo
-		if err := json.Unmarshal(data, &containerInfo); err != nil {
-			fmt.Printf("[ns] Warning: failed to parse container file %s: %v\n", filePath, err)
-			continue
-		}
+// readContainerRecord reads the record file of that name in the state
+// directory
+func readContainerRecord(fileName string) (ContainerInfo, error) {
+	filePath := filepath.Join(currentStateDir, fileName)
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return ContainerInfo{}, fmt.Errorf("failed to read container file %s: %v", filePath, err)
+	}
+	return decodeContainerInfo(strings.TrimSuffix(fileName, containerFileExt), data)
+}
 
-		// Check if the process is still running
-		if isProcessRunning(containerInfo.PID) {
-			containerInfo.Status = "running"
+// CreatedTime returns when a container was created; records from before
+// Created was kept only have StartTime
+func (c ContainerInfo) CreatedTime() time.Time {
+	if c.Created.IsZero() {
+		return c.StartTime
+	}
+	return c.Created
+}
+
+// refreshStatus double-checks a live record against the process table
+// Normally the shim updates the record when the container exits; if the shim
+// died after writing the exit file, or before it could write anything, the
+// record would otherwise claim "running" forever
+func refreshStatus(containerInfo *ContainerInfo) string {
+	isLive := containerInfo.Status == StatusRunning || containerInfo.Status == StatusCreated
+	if isLive && !containerInfo.workloadRunning() {
+		if exit, err := readExitFile(getContainerDir(containerInfo.ID)); err == nil {
+			applyContainerExit(containerInfo, exit)
 		} else {
-			containerInfo.Status = "exited"
-			// Clean up dead container info
-			go func(id string) {
-				UnregisterContainer(id)
-			}(containerInfo.ID)
+			containerInfo.Status = StatusExited
 		}
-
-		containers = append(containers, containerInfo)
 	}
-
-	return containers, nil
+	// A restarting container's shim is the one waiting to restart it
+	if containerInfo.Status == StatusRestarting && !containerInfo.shimRunning() {
+		containerInfo.Status = StatusExited
+	}
+	if health, err := readHealthFile(getContainerDir(containerInfo.ID)); err == nil {
+		containerInfo.Health = health
+	}
+	return containerInfo.Status
 }
 
 // isProcessRunning checks if a process with the given PID is still running
 func isProcessRunning(pid int) bool {
 	// Try to send signal 0 to the process (doesn't actually send a signal, just checks if process exists)
-	err := syscall.Kill(pid, 0)
-	return err == nil
+	if err := syscall.Kill(pid, 0); err != nil {
+		return false
+	}
+
+	// A zombie still answers signal 0 but has already exited; this happens
+	// while its parent (e.g. the shim) hasn't collected it yet.
+	// /proc/<pid>/stat looks like "1234 (comm) S ...": the state follows
+	// the last ')' since the command name itself may contain parentheses
+	stat, err := ioutil.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return true
+	}
+	afterComm := string(stat[strings.LastIndexByte(string(stat), ')')+1:])
+	return !strings.HasPrefix(strings.TrimSpace(afterComm), "Z")
+}
+
+// workloadRunning reports whether the container's workload is still running
+func (c ContainerInfo) workloadRunning() bool {
+	return isSameProcess(c.PID, c.PIDStartTime)
+}
+
+// shimRunning reports whether the container's shim is still running
+func (c ContainerInfo) shimRunning() bool {
+	return c.ShimPID > 0 && isSameProcess(c.ShimPID, c.ShimStartTime)
+}
+
+// isSameProcess reports whether the process that started at startTime
+// still runs as pid; a 0 startTime can only check the PID
+// Once a process has exited its PID is free for the next one, and after a
+// few weeks of uptime a PID from a record easily names a stranger.
+func isSameProcess(pid int, startTime uint64) bool {
+	if !isProcessRunning(pid) {
+		return false
+	}
+	if startTime == 0 {
+		return true
+	}
+	actual, err := processStartTime(pid)
+	return err != nil || actual == startTime
+}
+
+// processStartTime returns when a process started, in clock ticks after
+// boot: field 22 of /proc/<pid>/stat
+func processStartTime(pid int) (uint64, error) {
+	stat, err := ioutil.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return 0, err
+	}
+	// The fields after the command name, which may contain spaces, start
+	// with the state, field 3
+	fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+	if len(fields) < 20 {
+		return 0, fmt.Errorf("unexpected /proc/%d/stat", pid)
+	}
+	return strconv.ParseUint(fields[19], 10, 64)
+}
+
+// signalProcess sends a signal to the process that started at startTime,
+// failing with ESRCH if pid is now another process's
+// The process is pinned with a pidfd before its start time is checked, so
+// the PID can't be reused between the check and the signal.
+func signalProcess(pid int, startTime uint64, signal syscall.Signal) error {
+	pidfd, err := unix.PidfdOpen(pid, 0)
+	if err == unix.ENOSYS {
+		// Before Linux 5.3 there is no closing the window
+		if !isSameProcess(pid, startTime) {
+			return syscall.ESRCH
+		}
+		return syscall.Kill(pid, signal)
+	}
+	if err != nil {
+		return err
+	}
+	defer unix.Close(pidfd)
+
+	if !isSameProcess(pid, startTime) {
+		return syscall.ESRCH
+	}
+	return unix.PidfdSendSignal(pidfd, signal, nil, 0)
+}
+
+// LookupContainer finds a container by its full ID or a unique ID prefix
+func LookupContainer(idOrPrefix string) (*ContainerInfo, error) {
+	if idOrPrefix == "" {
+		return nil, fmt.Errorf("empty container ID")
+	}
+
+	containers, err := ListContainers()
+	if err != nil {
+		return nil, err
+	}
+
+	var matches []ContainerInfo
+	for _, container := range containers {
+		if container.ID == idOrPrefix {
+			return &container, nil
+		}
+		if strings.HasPrefix(container.ID, idOrPrefix) {
+			matches = append(matches, container)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("no such container: %s", idOrPrefix)
+	case 1:
+		return &matches[0], nil
+	default:
+		return nil, fmt.Errorf("container ID prefix %s is ambiguous (%d matches)", idOrPrefix, len(matches))
+	}
 }
 
 // GetContainerByPID finds a container by its PID
@@ -183,41 +612,61 @@ func GetContainerByPID(pid int) (*ContainerInfo, error) {
 }
 
 // FormatContainerTable formats container information as a table
-func FormatContainerTable(containers []ContainerInfo) string {
+func FormatContainerTable(containers []ContainerInfo, style TableStyle) string {
 	if len(containers) == 0 {
 		return "No containers found.\n"
 	}
 
-	// Header
-	output := fmt.Sprintf("%-20s %-8s %-10s %-20s %-30s\n",
-		"CONTAINER ID", "PID", "STATUS", "STARTED", "COMMAND")
-	output += strings.Repeat("-", 90) + "\n"
-
-	// Container rows
+	table := NewTable("CONTAINER ID", "PID", "STATUS", "RESTARTS", "STARTED", "COMMAND")
 	for _, container := range containers {
-		// Format start time
-		startTime := container.StartTime.Format("15:04:05")
-
-		// Build command string
 		commandStr := container.Command
 		if len(container.Args) > 0 {
 			commandStr += " " + strings.Join(container.Args, " ")
 		}
 
-		// Truncate command if too long
-		if len(commandStr) > 28 {
-			commandStr = commandStr[:25] + "..."
+		// Exited containers show how they ended, e.g. "exited (137)" or,
+		// when they were killed for a reason, that reason: "timed out (137)",
+		// "OOMKilled (137)"; running ones their health, and either whether
+		// they lack namespaces and a root of their own: "running (healthy,
+		// reduced isolation, no filesystem confinement)"
+		status := container.Status
+		var details []string
+		if status == StatusExited {
+			if container.OOMKilled {
+				status = "OOMKilled"
+			} else if container.FinishReason != "" {
+				status = container.FinishReason
+			}
+			details = append(details, strconv.Itoa(container.ExitCode))
+		} else if status == StatusRunning && container.Health != nil {
+			details = append(details, container.Health.Status)
 		}
-
-		// Truncate container ID for display
-		displayID := container.ID
-		if len(displayID) > 18 {
-			displayID = displayID[:15] + "..."
+		if container.ReducedIsolation {
+			details = append(details, "reduced isolation")
+		}
+		if container.NoFilesystemConfinement {
+			details = append(details, "no filesystem confinement")
+		}
+		if len(details) > 0 {
+			status = fmt.Sprintf("%s (%s)", status, strings.Join(details, ", "))
 		}
 
-		output += fmt.Sprintf("%-20s %-8d %-10s %-20s %-30s\n",
-			displayID, container.PID, container.Status, startTime, commandStr)
+		table.AddRow(ShortID(container.ID), strconv.Itoa(container.PID), status, strconv.Itoa(container.RestartCount),
+			container.StartTime.Format("15:04:05"), commandStr)
+		table.SetColor(2, statusColor(container.Status))
 	}
+	return table.Render(style)
+}
 
-	return output
+// statusColor is the color a container's status is shown in
+func statusColor(status string) string {
+	switch status {
+	case StatusRunning:
+		return ColorGreen
+	case StatusRestarting:
+		return ColorYellow
+	case StatusExited:
+		return ColorRed
+	}
+	return ColorNone
 }
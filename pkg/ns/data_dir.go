@@ -0,0 +1,26 @@
+//go:build linux
+
+package ns
+
+// The state directory (/var/run/nsctl, for the rootful store) is cleared on
+// reboot, which is right for running containers. Things that must survive a
+// reboot, such as schedules, live in the data directory instead.
+
+const (
+	// Standard Linux location for persistent application data (FHS)
+	defaultDataDir = "/var/lib/nsctl"
+)
+
+var (
+	// currentDataDir is the data directory of the store in use (see
+	// store.go)
+	currentDataDir = defaultStore.DataDir
+)
+
+// EnsureDataDir creates the persistent data directory and returns its path
+func EnsureDataDir() (string, error) {
+	if err := ensureStoreDir("data", currentDataDir); err != nil {
+		return "", err
+	}
+	return currentDataDir, nil
+}
@@ -0,0 +1,188 @@
+//go:build linux
+
+package ns
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// /dev inside a --rootfs
+//
+// Without --rootfs a container sees the host's /dev, with its device
+// cgroup deciding which of the nodes it may use. A --rootfs gets a /dev of
+// its own instead, a small tmpfs holding only what programs expect to
+// find there:
+//
+//   - the null, zero, full, random, urandom and tty nodes, made with
+//     mknod(2), or in a rootless container, which may not, bound from the
+//     host's /dev onto empty files
+//   - /dev/console, the terminal the container was started on, if any
+//   - a devpts instance of its own on /dev/pts, with /dev/ptmx linking to
+//     its ptmx, so the workload can open pseudo terminals (sshd, script,
+//     tmux) without seeing the host's
+//   - a /dev/shm tmpfs for POSIX shared memory, and the /dev/mqueue mount
+//     point of ipc.go
+//   - the fd, stdin, stdout and stderr links to /proc/self/fd
+//
+// A privileged container may use all of the host's devices, so its rootfs
+// gets the host's /dev bound at its /dev instead.
+
+// Mount options of a --rootfs container's /dev, /dev/shm and /dev/pts
+// The devpts gid is the host's tty group, which a rootless container's
+// user namespace doesn't map.
+const (
+	devTmpfsFlags   = unix.MS_NOSUID | unix.MS_STRICTATIME
+	devTmpfsOptions = "mode=755,size=65536k"
+
+	shmTmpfsFlags   = unix.MS_NOSUID | unix.MS_NODEV | unix.MS_NOEXEC
+	shmTmpfsOptions = "mode=1777,size=65536k"
+
+	devPtsFlags          = unix.MS_NOSUID | unix.MS_NOEXEC
+	devPtsOptions        = "newinstance,ptmxmode=0666,mode=0620"
+	devPtsRootfulOptions = devPtsOptions + ",gid=5"
+)
+
+// containerDevice is a device node created in a --rootfs container's /dev
+type containerDevice struct {
+	name         string
+	major, minor uint32
+}
+
+// containerDeviceNodes are the nodes of a --rootfs container's /dev, all of
+// them in cgroup.DefaultDeviceRules
+var containerDeviceNodes = []containerDevice{
+	{"null", 1, 3},
+	{"zero", 1, 5},
+	{"full", 1, 7},
+	{"random", 1, 8},
+	{"urandom", 1, 9},
+	{"tty", 5, 0},
+}
+
+// containerDevLinks are the symlinks of a --rootfs container's /dev, by
+// name
+var containerDevLinks = [][2]string{
+	{"fd", "/proc/self/fd"},
+	{"stdin", "/proc/self/fd/0"},
+	{"stdout", "/proc/self/fd/1"},
+	{"stderr", "/proc/self/fd/2"},
+	{"ptmx", "pts/ptmx"},
+}
+
+// mountDev gives the container's root filesystem its /dev: one of its own,
+// or the host's for a privileged container; a rootfs without a /dev
+// directory is left alone
+func mountDev(config ContainerConfig) error {
+	target := filepath.Join(config.Rootfs, "dev")
+	if info, err := os.Stat(target); err != nil || !info.IsDir() {
+		logf("[ns] No /dev in root filesystem, skipping\n")
+		return nil
+	}
+	if config.Privileged {
+		if err := mountTraced("/dev", target, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+			return fmt.Errorf("failed to bind /dev: %v", err)
+		}
+		return nil
+	}
+
+	if err := mountTraced("tmpfs", target, "tmpfs", devTmpfsFlags, devTmpfsOptions); err != nil {
+		return fmt.Errorf("failed to mount /dev: %v", err)
+	}
+	for _, device := range containerDeviceNodes {
+		if err := createDevice(target, device, config.Rootless); err != nil {
+			return err
+		}
+	}
+	if err := bindConsole(target); err != nil {
+		return err
+	}
+	for _, link := range containerDevLinks {
+		if err := os.Symlink(link[1], filepath.Join(target, link[0])); err != nil {
+			return fmt.Errorf("failed to create /dev/%s: %v", link[0], err)
+		}
+	}
+
+	for _, dir := range []string{"pts", "shm", "mqueue"} {
+		if err := os.Mkdir(filepath.Join(target, dir), 0755); err != nil {
+			return fmt.Errorf("failed to create /dev/%s: %v", dir, err)
+		}
+	}
+	ptsOptions := devPtsRootfulOptions
+	if config.Rootless {
+		ptsOptions = devPtsOptions
+	}
+	if err := mountTraced("devpts", filepath.Join(target, "pts"), "devpts", devPtsFlags, ptsOptions); err != nil {
+		return fmt.Errorf("failed to mount /dev/pts: %v", err)
+	}
+	if err := mountTraced("shm", filepath.Join(target, "shm"), "tmpfs", shmTmpfsFlags, shmTmpfsOptions); err != nil {
+		return fmt.Errorf("failed to mount /dev/shm: %v", err)
+	}
+	return nil
+}
+
+// createDevice creates a device node in the container's /dev at dev, or
+// with bind binds the host's onto an empty file
+func createDevice(dev string, device containerDevice, bind bool) error {
+	path := filepath.Join(dev, device.name)
+	if bind {
+		if err := createEmptyFile(path); err != nil {
+			return fmt.Errorf("failed to create /dev/%s: %v", device.name, err)
+		}
+		if err := mountTraced(filepath.Join("/dev", device.name), path, "", unix.MS_BIND, ""); err != nil {
+			return fmt.Errorf("failed to bind /dev/%s: %v", device.name, err)
+		}
+		return nil
+	}
+
+	started := time.Now()
+	err := unix.Mknod(path, unix.S_IFCHR|0666, int(unix.Mkdev(device.major, device.minor)))
+	traceSyscall(started, err, "mknod(%q, S_IFCHR|0666, %d:%d)", path, device.major, device.minor)
+	if err != nil {
+		return fmt.Errorf("failed to create /dev/%s: %v", device.name, err)
+	}
+	// mknod(2) applies the umask
+	if err := os.Chmod(path, 0666); err != nil {
+		return fmt.Errorf("failed to create /dev/%s: %v", device.name, err)
+	}
+	return nil
+}
+
+// bindConsole binds the terminal on the container's stdin, if it has one,
+// at /dev/console in the container's /dev at dev
+func bindConsole(dev string) error {
+	if !IsTerminal(os.Stdin) {
+		return nil
+	}
+	// The terminal's own mount is the host's, which can't be bound from
+	// the container's mount namespace; its copy there can
+	terminal, err := os.Readlink("/proc/self/fd/0")
+	if err != nil {
+		return fmt.Errorf("failed to find the terminal for /dev/console: %v", err)
+	}
+	if _, err := os.Stat(terminal); err != nil {
+		logf("[ns] Terminal %s isn't reachable, no /dev/console\n", terminal)
+		return nil
+	}
+	path := filepath.Join(dev, "console")
+	if err := createEmptyFile(path); err != nil {
+		return fmt.Errorf("failed to create /dev/console: %v", err)
+	}
+	if err := mountTraced(terminal, path, "", unix.MS_BIND, ""); err != nil {
+		return fmt.Errorf("failed to bind the terminal at /dev/console: %v", err)
+	}
+	return nil
+}
+
+// createEmptyFile creates an empty file to bind something onto
+func createEmptyFile(path string) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,163 @@
+//go:build linux
+
+package ns
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// DiskUsageCategory summarizes the space used by one kind of object
+type DiskUsageCategory struct {
+	Type   string `json:"type"`
+	Total  int    `json:"total"`
+	Active int    `json:"active"`
+	Size   int64  `json:"size"`
+
+	// Reclaimable is the space that removing inactive objects would free
+	Reclaimable int64 `json:"reclaimable"`
+
+	Items []DiskUsageItem `json:"items"`
+}
+
+// DiskUsageItem is the space used by a single object
+type DiskUsageItem struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	Active bool   `json:"active"`
+}
+
+// GetDiskUsage reports how much space containers, their logs and volumes
+// take up
+// Container directories hold the config, managed /etc files and exit file;
+// logs are counted separately because they are what usually grows.
+func GetDiskUsage() ([]DiskUsageCategory, error) {
+	containers, err := ListContainers()
+	if err != nil {
+		return nil, err
+	}
+
+	containerUsage := DiskUsageCategory{Type: "Containers"}
+	logUsage := DiskUsageCategory{Type: "Logs"}
+
+	for _, container := range containers {
+		containerDir := getContainerDir(container.ID)
+		isActive := container.Status == StatusRunning || container.Status == StatusCreated
+
+		logSize := fileSize(filepath.Join(containerDir, containerLogFileName)) +
+			fileSize(filepath.Join(containerDir, shimLogFileName))
+		dirSize, err := directorySize(containerDir)
+		if err != nil {
+			logf("[ns] Warning: failed to measure %s: %v\n", containerDir, err)
+		}
+		// The record file lives next to the directory, not in it
+		dirSize += fileSize(getContainerFilePath(container.ID))
+
+		addDiskUsageItem(&containerUsage, ShortID(container.ID), dirSize-logSize, isActive)
+		addDiskUsageItem(&logUsage, ShortID(container.ID), logSize, isActive)
+	}
+
+	volumeUsage := DiskUsageCategory{Type: "Volumes"}
+	volumes, err := ListVolumes()
+	if err != nil {
+		return nil, err
+	}
+	inUse, err := volumesInUse()
+	if err != nil {
+		return nil, err
+	}
+	for _, volume := range volumes {
+		size, err := directorySize(volume.Mountpoint)
+		if err != nil {
+			logf("[ns] Warning: failed to measure volume %s: %v\n", volume.Name, err)
+		}
+		addDiskUsageItem(&volumeUsage, volume.Name, size, inUse[volume.Name])
+	}
+
+	return []DiskUsageCategory{containerUsage, logUsage, volumeUsage}, nil
+}
+
+// addDiskUsageItem adds one object to a category's totals
+func addDiskUsageItem(category *DiskUsageCategory, name string, size int64, active bool) {
+	category.Items = append(category.Items, DiskUsageItem{Name: name, Size: size, Active: active})
+	category.Total++
+	category.Size += size
+	if active {
+		category.Active++
+	} else {
+		category.Reclaimable += size
+	}
+}
+
+// directorySize adds up the sizes of all regular files below a directory
+func directorySize(dir string) (int64, error) {
+	var total int64
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if entry.Type().IsRegular() {
+			if info, infoErr := entry.Info(); infoErr == nil {
+				total += info.Size()
+			}
+		}
+		return nil
+	})
+	return total, err
+}
+
+// fileSize returns the size of a file, or 0 if it doesn't exist
+func fileSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// FormatSize renders a byte count for humans, e.g. "12.3MB"
+func FormatSize(bytes int64) string {
+	const unit = 1000
+	if bytes < unit {
+		return fmt.Sprintf("%dB", bytes)
+	}
+	divisor, exponent := int64(unit), 0
+	for remaining := bytes / unit; remaining >= unit; remaining /= unit {
+		divisor *= unit
+		exponent++
+	}
+	return fmt.Sprintf("%.1f%cB", float64(bytes)/float64(divisor), "kMGTPE"[exponent])
+}
+
+// PruneContainers removes every exited container and reports which ones were
+// removed and how much space that freed
+func PruneContainers() ([]string, int64, error) {
+	containers, err := ListContainers()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var removedIDs []string
+	var reclaimed int64
+	for _, container := range containers {
+		if container.Status != StatusExited {
+			continue
+		}
+
+		size, _ := directorySize(getContainerDir(container.ID))
+		size += fileSize(getContainerFilePath(container.ID))
+
+		if err := RemoveContainer(container.ID, false, false); err != nil {
+			logf("[ns] Warning: failed to remove container %s: %v\n", ShortID(container.ID), err)
+			continue
+		}
+		removedIDs = append(removedIDs, container.ID)
+		reclaimed += size
+	}
+	return removedIDs, reclaimed, nil
+}
@@ -0,0 +1,162 @@
+//go:build linux
+
+package ns
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Entering a running container (nsctl enter)
+//
+// nsctl enter runs a command, by default $SHELL, in namespaces of a
+// running container, like nsenter(1) given a container ID or prefix
+// rather than a PID, e.g. to debug a workload with the host's tools:
+//
+//	nsctl enter <id> [uts|ipc|net|pid|cgroup|mnt ...] [-- <command> [args...]]
+//
+// Without a list it enters every namespace the container's workload
+// doesn't share with nsctl. As for a container joining another's (see
+// join.go), the namespaces are entered on a thread the command is started
+// from, which puts it in the PID namespace as well. Entering a mount
+// namespace takes a single-threaded process, which a Go process never is,
+// so for mnt the command is started through nsenter(1) from util-linux,
+// which enters the mount namespace and then execs it, looking it up in
+// $PATH in the container's filesystem. User and time namespaces can't be
+// entered at all. Entering takes root, and with it the rootful store:
+// rootless containers can't be entered. The command keeps nsctl's user,
+// environment and cgroup.
+
+// enterableNamespaces are the namespaces nsctl enter can enter, by their
+// name under /proc/<pid>/ns; mnt has no flag, being entered by nsenter(1)
+var enterableNamespaces = []struct {
+	name string
+	flag int
+}{
+	{"uts", unix.CLONE_NEWUTS},
+	{"ipc", unix.CLONE_NEWIPC},
+	{"net", unix.CLONE_NEWNET},
+	{"cgroup", unix.CLONE_NEWCGROUP},
+	{"pid", unix.CLONE_NEWPID},
+	{"mnt", 0},
+}
+
+// EnterContainer runs a command in namespaces of a running container, all
+// of those it doesn't share with nsctl when names is empty, and returns
+// its exit code
+func EnterContainer(idOrPrefix string, names []string, command string, args []string) (int, error) {
+	container, err := LookupContainer(idOrPrefix)
+	if err != nil {
+		return 0, err
+	}
+	if !container.workloadRunning() {
+		return 0, fmt.Errorf("container %s isn't running", ShortID(container.ID))
+	}
+	if os.Geteuid() != 0 {
+		return 0, fmt.Errorf("entering a container's namespaces needs root")
+	}
+
+	nsDir := filepath.Join("/proc", strconv.Itoa(container.PID), "ns")
+	if len(names) == 0 {
+		names = unsharedNamespaces(nsDir)
+	}
+	var flags []int
+	var paths []string
+	enterMounts := false
+	for _, name := range names {
+		flag, ok := enterableFlag(name)
+		switch {
+		case !ok && (name == "user" || name == "time"):
+			return 0, fmt.Errorf("the %s namespace of a container can't be entered", name)
+		case !ok:
+			return 0, fmt.Errorf("unknown namespace %q: expected uts, ipc, net, cgroup, pid or mnt", name)
+		case name == "mnt":
+			enterMounts = true
+		default:
+			flags = append(flags, flag)
+			paths = append(paths, filepath.Join(nsDir, name))
+		}
+	}
+
+	cmd := exec.Command(command, args...)
+	if enterMounts {
+		nsenter, err := exec.LookPath("nsenter")
+		if err != nil {
+			return 0, fmt.Errorf("entering a mount namespace needs nsenter(1) from util-linux: %v", err)
+		}
+		cmd = exec.Command(nsenter, append([]string{"--mount=" + filepath.Join(nsDir, "mnt"), "--", command}, args...)...)
+	}
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if len(names) == 0 {
+		logf("[ns] Container %s shares all its namespaces with the host\n", ShortID(container.ID))
+	} else {
+		noun := "namespaces"
+		if len(names) == 1 {
+			noun = "namespace"
+		}
+		logf("[ns] Entering the %s %s of container %s\n", strings.Join(names, ", "), noun, ShortID(container.ID))
+	}
+	err = startInNamespaces(cmd, func() error {
+		for index, path := range paths {
+			if err := setns(path, flags[index]); err != nil {
+				return fmt.Errorf("failed to enter %s: %v", path, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// Ctrl-C is the command's to handle; nsctl waits for it to exit
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGQUIT)
+	defer signal.Stop(signals)
+
+	// Exit codes are shell-style, 128+N for a command killed by signal N
+	err = cmd.Wait()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return containerExitFromState(exitErr.ProcessState).ExitCode, nil
+	}
+	return 0, err
+}
+
+// enterableFlag returns the setns flag of a namespace nsctl enter can enter
+func enterableFlag(name string) (int, bool) {
+	for _, namespace := range enterableNamespaces {
+		if namespace.name == name {
+			return namespace.flag, true
+		}
+	}
+	return 0, false
+}
+
+// unsharedNamespaces lists the enterable namespaces of a process, by its
+// /proc/<pid>/ns directory, that differ from nsctl's own
+func unsharedNamespaces(nsDir string) []string {
+	var names []string
+	for _, namespace := range enterableNamespaces {
+		theirs, err := os.Stat(filepath.Join(nsDir, namespace.name))
+		if err != nil {
+			continue
+		}
+		ours, err := os.Stat(filepath.Join("/proc/self/ns", namespace.name))
+		if err != nil || !os.SameFile(theirs, ours) {
+			names = append(names, namespace.name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,105 @@
+//go:build linux
+
+package ns
+
+import (
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// defaultContainerPath is the conventional PATH for container workloads
+// The host's PATH is meaningless inside the container (it often points at
+// things like ~/go/bin or /opt/... that don't exist there)
+const defaultContainerPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// buildContainerEnv computes the environment the container process starts with
+//
+// By default the container gets a minimal, predictable environment instead of
+// a copy of ours: the host environment routinely carries secrets (AWS keys,
+// tokens, SSH agent sockets) that have no business inside a container.
+// preserveEnv restores the old behaviour of passing everything through.
+// Proxy settings come from the runtime config rather than whatever shell
+// nsctl happened to be started from (see resolveProxyEnv).
+// HOME is added later, inside the container, from the --user's passwd entry.
+func buildContainerEnv(config ContainerConfig) []string {
+	if config.PreserveEnv {
+		logf("[ns] Passing the full host environment into the container\n")
+		var containerEnv []string
+		for _, variable := range os.Environ() {
+			// Configured proxies take precedence; --no-proxy drops them all
+			if isProxyVariable(variable) && (config.NoProxy || len(config.ProxyEnv) > 0) {
+				continue
+			}
+			// and so does --tz
+			if strings.HasPrefix(variable, "TZ=") && config.Timezone != "" {
+				continue
+			}
+			containerEnv = append(containerEnv, variable)
+		}
+		return append(append(containerEnv, config.ProxyEnv...), timezoneEnv(config)...)
+	}
+
+	containerEnv := []string{
+		"PATH=" + defaultContainerPath,
+		"HOSTNAME=" + config.Hostname,
+	}
+	containerEnv = append(containerEnv, config.ProxyEnv...)
+	containerEnv = append(containerEnv, timezoneEnv(config)...)
+
+	// TERM only makes sense when the container is actually talking to a
+	// terminal; a detached or piped container gets none
+	if term, ok := os.LookupEnv("TERM"); ok && hasTerminal(config) {
+		containerEnv = append(containerEnv, "TERM="+term)
+	}
+
+	return containerEnv
+}
+
+// timezoneEnv returns the TZ setting of a container with --tz
+func timezoneEnv(config ContainerConfig) []string {
+	if config.Timezone == "" {
+		return nil
+	}
+	return []string{"TZ=" + config.Timezone}
+}
+
+// hasTerminal reports whether the container's stdin will be our terminal
+func hasTerminal(config ContainerConfig) bool {
+	if config.Detach {
+		return false
+	}
+	return IsTerminal(os.Stdin)
+}
+
+// IsTerminal reports whether a file is a terminal
+func IsTerminal(file *os.File) bool {
+	_, err := unix.IoctlGetTermios(int(file.Fd()), unix.TCGETS)
+	return err == nil
+}
+
+// withDefaultHome appends HOME=<home> unless the environment already sets it
+func withDefaultHome(env []string, home string) []string {
+	for _, variable := range env {
+		if strings.HasPrefix(variable, "HOME=") {
+			return env
+		}
+	}
+	return append(env, "HOME="+home)
+}
+
+// resolveProxyEnv fills in the proxy variables of the runtime config, unless
+// the container was started with --no-proxy
+func resolveProxyEnv(config *ContainerConfig) error {
+	if config.NoProxy {
+		config.ProxyEnv = nil
+		return nil
+	}
+	runtimeConfig, err := LoadRuntimeConfig()
+	if err != nil {
+		return err
+	}
+	config.ProxyEnv = runtimeConfig.Proxy.Environment()
+	return nil
+}
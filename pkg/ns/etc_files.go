@@ -0,0 +1,165 @@
+//go:build linux
+
+package ns
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// managedEtcFiles lists the files nsctl maintains per container
+// Each one lives in the container directory under the state dir and is
+// bind-mounted over the path inside the container. The image's own copies
+// are never modified, which keeps working with read-only root filesystems
+// and lets `nsctl inspect` point at the exact files the container sees.
+var managedEtcFiles = []struct {
+	fileName      string // name inside the container directory
+	containerPath string // mount target inside the container
+}{
+	{fileName: "hostname", containerPath: "/etc/hostname"},
+	{fileName: "hosts", containerPath: "/etc/hosts"},
+	{fileName: "resolv.conf", containerPath: "/etc/resolv.conf"},
+	{fileName: "localtime", containerPath: hostLocaltimePath},
+}
+
+const (
+	// Host resolver configuration copied into every container
+	hostResolvConfPath = "/etc/resolv.conf"
+
+	// systemdResolvConfPath lists the servers systemd-resolved forwards to;
+	// its stub at 127.0.0.53 only answers in the host's network namespace
+	systemdResolvConfPath = "/run/systemd/resolve/resolv.conf"
+)
+
+// writeEtcFiles generates the managed /etc files in the container directory;
+// ownNetwork is set for a container with a network namespace of its own
+func writeEtcFiles(containerDir string, hostname string, timezone string, ownNetwork bool) error {
+	// /etc/hostname: just the name, so it agrees with the UTS namespace
+	hostnameContent := hostname + "\n"
+
+	// /etc/resolv.conf: start from the host's resolver configuration
+	resolvContent := resolvConfContent(ownNetwork)
+
+	// /etc/localtime: the --tz zone's, or the host's (see timezone.go)
+	localtimeContent, err := localtimeContent(timezone)
+	if err != nil {
+		return err
+	}
+
+	contents := map[string][]byte{
+		"hostname":    []byte(hostnameContent),
+		"hosts":       []byte(hostsContent(hostname, "")),
+		"resolv.conf": resolvContent,
+		"localtime":   localtimeContent,
+	}
+
+	for _, managedFile := range managedEtcFiles {
+		filePath := filepath.Join(containerDir, managedFile.fileName)
+		if err := os.WriteFile(filePath, contents[managedFile.fileName], 0644); err != nil {
+			return fmt.Errorf("failed to write %s: %v", filePath, err)
+		}
+	}
+	return nil
+}
+
+// hostsContent returns a container's /etc/hosts: loopback entries plus its
+// own hostname, so resolving it doesn't hang waiting for DNS, at address or,
+// until it has one, 127.0.1.1
+func hostsContent(hostname string, address string) string {
+	if address == "" {
+		address = "127.0.1.1"
+	}
+	return "127.0.0.1\tlocalhost\n" +
+		"::1\tlocalhost ip6-localhost ip6-loopback\n" +
+		address + "\t" + hostname + "\n"
+}
+
+// writeHostsFile rewrites a container's /etc/hosts once it has an address
+func writeHostsFile(containerDir string, hostname string, address string) error {
+	hostsPath := filepath.Join(containerDir, "hosts")
+	if err := os.WriteFile(hostsPath, []byte(hostsContent(hostname, address)), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", hostsPath, err)
+	}
+	return nil
+}
+
+// resolvConfContent returns a container's /etc/resolv.conf: the host's, or
+// for a container with a network of its own, where the host's only names
+// servers on its loopback interface, the ones systemd-resolved uses
+func resolvConfContent(ownNetwork bool) []byte {
+	content, err := os.ReadFile(hostResolvConfPath)
+	if err != nil {
+		logf("[ns] Warning: could not read %s, container gets an empty one: %v\n", hostResolvConfPath, err)
+		return nil
+	}
+	if !ownNetwork || !onlyLoopbackNameservers(content) {
+		return content
+	}
+	if upstream, err := os.ReadFile(systemdResolvConfPath); err == nil && !onlyLoopbackNameservers(upstream) {
+		return upstream
+	}
+	logf("[ns] Warning: the nameservers in %s are on the host's loopback interface, which the container can't reach\n", hostResolvConfPath)
+	return content
+}
+
+// onlyLoopbackNameservers reports whether all nameservers of a
+// resolv.conf are loopback addresses
+func onlyLoopbackNameservers(resolvConf []byte) bool {
+	found := false
+	for _, line := range strings.Split(string(resolvConf), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "nameserver" {
+			continue
+		}
+		found = true
+		if ip := net.ParseIP(fields[1]); ip == nil || !ip.IsLoopback() {
+			return false
+		}
+	}
+	return found
+}
+
+// mountEtcFiles bind-mounts the managed files over their /etc counterparts
+// in the root filesystem at rootfs (the host's for "")
+// Runs inside the mount namespace; a target missing from the root filesystem
+// is skipped because creating the mount point would mean writing to it
+func mountEtcFiles(rootfs string, containerDir string) error {
+	for _, managedFile := range managedEtcFiles {
+		targetPath := filepath.Join(rootfs, managedFile.containerPath)
+		info, err := os.Lstat(targetPath)
+		if err != nil {
+			logf("[ns] No %s in root filesystem, skipping\n", managedFile.containerPath)
+			continue
+		}
+
+		sourcePath := filepath.Join(containerDir, managedFile.fileName)
+		logf("[ns] Bind-mounting %s over %s\n", sourcePath, managedFile.containerPath)
+		if info.Mode()&os.ModeSymlink != 0 {
+			err = mountOverSymlink(sourcePath, targetPath)
+		} else {
+			err = mountTraced(sourcePath, targetPath, "", unix.MS_BIND, "")
+		}
+		if err != nil {
+			return fmt.Errorf("failed to bind-mount %s: %v", managedFile.containerPath, err)
+		}
+	}
+	return nil
+}
+
+// mountOverSymlink bind-mounts source over the symlink at path itself
+// A mount on path would land on what the symlink points at, e.g. the
+// zoneinfo file of /etc/localtime or systemd-resolved's resolv.conf, and
+// change it for everyone in the container who uses it by its own name.
+func mountOverSymlink(source string, path string) error {
+	fd, err := unix.Open(path, unix.O_PATH|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	return mountTraced(source, fmt.Sprintf("/proc/self/fd/%d", fd), "", unix.MS_BIND, "")
+}
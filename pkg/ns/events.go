@@ -0,0 +1,365 @@
+//go:build linux
+
+package ns
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Container events
+//
+// Every noteworthy moment in a container's life is appended as one JSON line
+// to the event journal, events.log in the data directory, so history
+// survives reboots. Writers are the shims and the CLI, all of them separate
+// processes; each takes an exclusive lock on the journal to give its event
+// the next sequence number, so sequence numbers only ever grow and a
+// consumer can resume after the last one it saw. Once the journal reaches
+// eventsMaxSize it is rotated to events.log.1, replacing the previous one.
+// "nsctl events" replays the journal and follows it.
+
+// Event types
+const (
+	EventCreate = "create"
+	EventStart  = "start"
+	EventKill   = "kill"
+	EventDie    = "die"
+	EventOOM    = "oom"
+
+	// Pressure events are emitted when a --pressure-alert threshold is
+	// crossed
+	EventCPUPressure    = "cpu-pressure"
+	EventMemoryPressure = "memory-pressure"
+	EventIOPressure     = "io-pressure"
+
+	// EventMemory is emitted by the event action of --on-memory-event
+	EventMemory = "memory"
+
+	// EventHealthStatus is emitted when a health check's outcome changes
+	EventHealthStatus = "health_status"
+)
+
+const (
+	eventsFileName = "events.log"
+
+	// eventsMaxSize is the size at which the journal is rotated
+	eventsMaxSize = 16 << 20
+
+	// eventsTailSize is how much of the journal's end is read to find the
+	// last sequence number; more than any event takes
+	eventsTailSize = 64 << 10
+)
+
+// Event is one entry of the event journal
+type Event struct {
+	// Sequence numbers the events of the journal, starting at 1
+	Sequence uint64 `json:"seq"`
+
+	Time        time.Time         `json:"time"`
+	Type        string            `json:"type"`
+	ContainerID string            `json:"container_id"`
+	Attributes  map[string]string `json:"attributes,omitempty"`
+}
+
+// String formats an event like "<time> container oom <id> (key=value, ...)"
+func (event Event) String() string {
+	line := fmt.Sprintf("%s container %s %s", event.Time.Format(time.RFC3339Nano), event.Type, event.ContainerID)
+	if len(event.Attributes) == 0 {
+		return line
+	}
+
+	keys := make([]string, 0, len(event.Attributes))
+	for key := range event.Attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	attributes := make([]string, 0, len(keys))
+	for _, key := range keys {
+		attributes = append(attributes, key+"="+event.Attributes[key])
+	}
+	return line + " (" + strings.Join(attributes, ", ") + ")"
+}
+
+// eventsFilePath returns the path of the event journal
+func eventsFilePath() (string, error) {
+	dataDir, err := EnsureDataDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dataDir, eventsFileName), nil
+}
+
+// emitEvent appends an event to the event journal
+// Events are informational, so failures are logged rather than returned
+func emitEvent(eventType string, containerID string, attributes map[string]string) {
+	event := Event{
+		Time:        time.Now(),
+		Type:        eventType,
+		ContainerID: containerID,
+		Attributes:  attributes,
+	}
+
+	journalPath, err := eventsFilePath()
+	if err != nil {
+		logf("[ns] Warning: failed to record %s event: %v\n", eventType, err)
+		return
+	}
+	journal, err := openEventJournal(journalPath)
+	if err != nil {
+		logf("[ns] Warning: failed to record %s event: %v\n", eventType, err)
+		return
+	}
+	defer journal.Close()
+
+	event.Sequence = lastEventSequence(journal, journalPath) + 1
+	data, err := json.Marshal(event)
+	if err != nil {
+		logf("[ns] Warning: failed to encode %s event: %v\n", eventType, err)
+		return
+	}
+
+	// Webhooks get the event once it is in the journal (see webhooks.go),
+	// and the lock has been released
+	defer notifyWebhooks(event, data)
+
+	if _, err := journal.Write(append(data, '\n')); err != nil {
+		logf("[ns] Warning: failed to record %s event: %v\n", eventType, err)
+		return
+	}
+	journal.Sync()
+
+	if info, err := journal.Stat(); err == nil && info.Size() >= eventsMaxSize {
+		if err := os.Rename(journalPath, journalPath+".1"); err != nil {
+			logf("[ns] Warning: failed to rotate %s: %v\n", journalPath, err)
+		}
+	}
+}
+
+// openEventJournal opens the journal for appending, locked against other
+// writers; it is unlocked when closed
+// A writer may have rotated the journal while we waited for the lock, in
+// which case the file we locked is no longer the journal and we start over.
+func openEventJournal(journalPath string) (*os.File, error) {
+	for {
+		journal, err := os.OpenFile(journalPath, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, err
+		}
+		if err := unix.Flock(int(journal.Fd()), unix.LOCK_EX); err != nil {
+			journal.Close()
+			return nil, fmt.Errorf("failed to lock %s: %v", journalPath, err)
+		}
+		if sameFile(journal, journalPath) {
+			// Older versions left the journal readable by anyone
+			journal.Chmod(0600)
+			return journal, nil
+		}
+		journal.Close()
+	}
+}
+
+// sameFile reports whether an open file is (still) the one at path
+func sameFile(file *os.File, path string) bool {
+	openInfo, err := file.Stat()
+	if err != nil {
+		return false
+	}
+	pathInfo, err := os.Stat(path)
+	return err == nil && os.SameFile(openInfo, pathInfo)
+}
+
+// lastEventSequence returns the sequence number of the journal's last
+// event, looking into the rotated journal if the current one is empty
+func lastEventSequence(journal *os.File, journalPath string) uint64 {
+	if sequence, found := readLastSequence(journal); found {
+		return sequence
+	}
+	rotated, err := os.Open(journalPath + ".1")
+	if err != nil {
+		return 0
+	}
+	defer rotated.Close()
+	sequence, _ := readLastSequence(rotated)
+	return sequence
+}
+
+// readLastSequence reads the sequence number of the last event in a file
+func readLastSequence(file *os.File) (uint64, bool) {
+	info, err := file.Stat()
+	if err != nil || info.Size() == 0 {
+		return 0, false
+	}
+	offset := max(info.Size()-eventsTailSize, 0)
+	tail := make([]byte, info.Size()-offset)
+	if _, err := file.ReadAt(tail, offset); err != nil && err != io.EOF {
+		return 0, false
+	}
+
+	lines := strings.Split(strings.TrimRight(string(tail), "\n"), "\n")
+	for i := len(lines) - 1; i >= 0; i-- {
+		var event Event
+		if err := json.Unmarshal([]byte(lines[i]), &event); err == nil {
+			return event.Sequence, true
+		}
+	}
+	return 0, false
+}
+
+// EventFilter selects the events StreamEvents passes on
+type EventFilter struct {
+	// Since and AfterSequence replay the journal from a point in time, or
+	// from after an event; without either only new events are streamed
+	Since         time.Time
+	AfterSequence uint64
+
+	// Until stops the stream at a point in time, which may be in the past
+	Until time.Time
+}
+
+// replays reports whether the filter asks for past events
+func (filter EventFilter) replays() bool {
+	return !filter.Since.IsZero() || filter.AfterSequence > 0
+}
+
+// matches reports whether an event passes the filter
+func (filter EventFilter) matches(event Event) bool {
+	return event.Sequence > filter.AfterSequence && !event.Time.Before(filter.Since)
+}
+
+// FollowEvents calls handle for every event emitted from now on
+// It polls the event journal and only returns if reading it fails
+func FollowEvents(handle func(Event)) error {
+	return StreamEvents(EventFilter{}, handle)
+}
+
+// StreamEvents calls handle for the journal's events that pass the filter,
+// past ones first, and then for new ones as they are emitted. It returns
+// once an event after filter.Until shows up or, with nothing more to read,
+// that time has passed; without Until it only returns if reading fails.
+func StreamEvents(filter EventFilter, handle func(Event)) error {
+	journalPath, err := eventsFilePath()
+	if err != nil {
+		return err
+	}
+
+	// pass hands an event on, and reports whether the stream is over; the
+	// journal is in time order, so it is at the first event past Until
+	pass := func(event Event) bool {
+		if !filter.Until.IsZero() && event.Time.After(filter.Until) {
+			return true
+		}
+		if filter.matches(event) {
+			handle(event)
+		}
+		return false
+	}
+
+	if filter.replays() {
+		if rotated, err := os.Open(journalPath + ".1"); err == nil {
+			reader := &journalReader{reader: bufio.NewReader(rotated)}
+			for {
+				event, err := reader.next()
+				if err != nil {
+					rotated.Close()
+					if err != io.EOF {
+						return fmt.Errorf("failed to read event journal: %v", err)
+					}
+					break
+				}
+				if pass(event) {
+					rotated.Close()
+					return nil
+				}
+			}
+		}
+	}
+
+	journal, err := os.OpenFile(journalPath, os.O_CREATE|os.O_RDONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open event journal: %v", err)
+	}
+	defer func() { journal.Close() }()
+
+	if !filter.replays() {
+		if _, err := journal.Seek(0, io.SeekEnd); err != nil {
+			return fmt.Errorf("failed to read event journal: %v", err)
+		}
+	}
+
+	reader := &journalReader{reader: bufio.NewReader(journal)}
+	for {
+		event, err := reader.next()
+		if err == nil {
+			if pass(event) {
+				return nil
+			}
+			continue
+		}
+		if err != io.EOF {
+			return fmt.Errorf("failed to read event journal: %v", err)
+		}
+		if !filter.Until.IsZero() && time.Now().After(filter.Until) {
+			return nil
+		}
+
+		// Nothing new yet. If the journal has been rotated, whatever was
+		// written to the old one before is read, then the new one from its
+		// start.
+		if !sameFile(journal, journalPath) {
+			if current, err := os.Open(journalPath); err == nil {
+				for {
+					event, err := reader.next()
+					if err != nil {
+						break
+					}
+					if pass(event) {
+						current.Close()
+						return nil
+					}
+				}
+				journal.Close()
+				journal = current
+				reader = &journalReader{reader: bufio.NewReader(journal)}
+				continue
+			}
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+// journalReader reads events from a journal that is still being written
+type journalReader struct {
+	reader *bufio.Reader
+
+	// partial is the start of a line whose end hasn't been written yet
+	partial string
+}
+
+// next returns the next event, or io.EOF if there's no complete line left
+// Lines that aren't events are skipped
+func (r *journalReader) next() (Event, error) {
+	for {
+		line, err := r.reader.ReadString('\n')
+		r.partial += line
+		if err != nil {
+			return Event{}, err
+		}
+
+		var event Event
+		err = json.Unmarshal([]byte(r.partial), &event)
+		r.partial = ""
+		if err == nil {
+			return event, nil
+		}
+	}
+}
@@ -0,0 +1,304 @@
+//go:build linux
+
+package ns
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Health checks (--health-type, --health-target)
+//
+// The shim probes a running container every --health-interval, from the
+// container's network namespace, so the workload needs no shell or client
+// of its own:
+//
+//	--health-type http --health-target :8080/healthz   GET answered with 2xx or 3xx
+//	--health-type tcp --health-target :5432            connection accepted
+//
+// A target without a host is probed at 127.0.0.1. The container is
+// "starting" until a probe passes, "healthy" after one passed and
+// "unhealthy" after --health-retries failed in a row; failures within
+// --health-start-period of the start don't count while it is starting. The
+// shim keeps the status and the last probes in the container directory,
+// where ps, inspect and "nsctl wait --condition healthy" find them, and
+// emits a health_status event at each change. Probes that run a command in
+// the container aren't supported: nsctl can't run one there yet.
+
+// Health probe types
+const (
+	HealthTypeHTTP = "http"
+	HealthTypeTCP  = "tcp"
+)
+
+// Health states
+const (
+	HealthStarting  = "starting"
+	HealthHealthy   = "healthy"
+	HealthUnhealthy = "unhealthy"
+)
+
+const (
+	// containerHealthFileName holds the HealthStatus, in the container
+	// directory
+	containerHealthFileName = "health"
+
+	// Defaults of the health check options
+	defaultHealthInterval = 30 * time.Second
+	defaultHealthTimeout  = 5 * time.Second
+	defaultHealthRetries  = 3
+
+	// maxHealthLog is how many probes HealthStatus keeps
+	maxHealthLog = 5
+)
+
+// HealthCheck is a container's health check; a zero Type means none
+type HealthCheck struct {
+	// Type is http or tcp; Target is what is probed, [host]:port[/path]
+	Type   string `json:"type,omitempty"`
+	Target string `json:"target,omitempty"`
+
+	Interval    time.Duration `json:"interval,omitempty"`
+	Timeout     time.Duration `json:"timeout,omitempty"`
+	Retries     int           `json:"retries,omitempty"`
+	StartPeriod time.Duration `json:"start_period,omitempty"`
+}
+
+// HealthStatus is the outcome of a container's health checks so far
+type HealthStatus struct {
+	Status        string        `json:"status"`
+	FailingStreak int           `json:"failing_streak"`
+	Log           []HealthProbe `json:"log,omitempty"`
+}
+
+// HealthProbe is the result of one probe
+type HealthProbe struct {
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Healthy bool      `json:"healthy"`
+	Output  string    `json:"output"`
+}
+
+// prepareHealthCheck checks a container's health check options and fills
+// in the defaults
+func prepareHealthCheck(check *HealthCheck) error {
+	if check.Type == "" {
+		if check.Target != "" {
+			return fmt.Errorf("--health-target needs a --health-type")
+		}
+		return nil
+	}
+	if check.Type != HealthTypeHTTP && check.Type != HealthTypeTCP {
+		return fmt.Errorf("invalid health check type %q: expected %s or %s", check.Type, HealthTypeHTTP, HealthTypeTCP)
+	}
+	if check.Target == "" {
+		return fmt.Errorf("--health-type %s needs a --health-target", check.Type)
+	}
+	if _, err := parseHealthTarget(*check); err != nil {
+		return err
+	}
+	if check.Interval < 0 || check.Timeout < 0 || check.Retries < 0 || check.StartPeriod < 0 {
+		return fmt.Errorf("health check intervals, timeouts and retries must not be negative")
+	}
+
+	if check.Interval == 0 {
+		check.Interval = defaultHealthInterval
+	}
+	if check.Timeout == 0 {
+		check.Timeout = defaultHealthTimeout
+	}
+	if check.Retries == 0 {
+		check.Retries = defaultHealthRetries
+	}
+	return nil
+}
+
+// parseHealthTarget turns a health check's target into the URL it probes,
+// with scheme http or tcp
+func parseHealthTarget(check HealthCheck) (*url.URL, error) {
+	target, err := url.Parse(check.Type + "://" + check.Target)
+	if err != nil || target.Port() == "" {
+		return nil, fmt.Errorf("invalid health check target %q: expected [host]:port, with a /path for http", check.Target)
+	}
+	if check.Type == HealthTypeTCP && (target.Path != "" || target.RawQuery != "") {
+		return nil, fmt.Errorf("invalid health check target %q: a tcp target has no path", check.Target)
+	}
+	if target.Hostname() == "" {
+		target.Host = net.JoinHostPort("127.0.0.1", target.Port())
+	}
+	return target, nil
+}
+
+// runHealthCheck probes the container while it runs, until exited is
+// closed, keeping its health status up to date
+func runHealthCheck(config ContainerConfig, process *os.Process, exited <-chan struct{}) {
+	check := config.HealthCheck
+	if check.Type == "" {
+		return
+	}
+	target, err := parseHealthTarget(check)
+	if err != nil {
+		logf("[shim] Warning: health check disabled: %v\n", err)
+		return
+	}
+
+	health := HealthStatus{Status: HealthStarting}
+	if err := writeHealthFile(config.ContainerDir, health); err != nil {
+		logf("[shim] Warning: %v\n", err)
+	}
+	// A created container is probed once it is started
+	if !waitUntilStarted(config.ID, exited) {
+		return
+	}
+
+	started := time.Now()
+	for {
+		select {
+		case <-exited:
+			return
+		case <-time.After(check.Interval):
+		}
+
+		probe := runHealthProbe(target, process.Pid, check.Timeout)
+		health.Log = append(health.Log, probe)
+		if len(health.Log) > maxHealthLog {
+			health.Log = health.Log[len(health.Log)-maxHealthLog:]
+		}
+
+		previous := health.Status
+		if probe.Healthy {
+			health.Status = HealthHealthy
+			health.FailingStreak = 0
+		} else if health.Status != HealthStarting || time.Since(started) >= check.StartPeriod {
+			health.FailingStreak++
+			if health.FailingStreak >= check.Retries {
+				health.Status = HealthUnhealthy
+			}
+		}
+		if err := writeHealthFile(config.ContainerDir, health); err != nil {
+			logf("[shim] Warning: %v\n", err)
+		}
+
+		if health.Status != previous {
+			logf("[shim] Container %s is %s: %s\n", ShortID(config.ID), health.Status, probe.Output)
+			emitEvent(EventHealthStatus, config.ID, map[string]string{"health_status": health.Status})
+		}
+	}
+}
+
+// runHealthProbe probes target from the network namespace of the process
+// pid
+func runHealthProbe(target *url.URL, pid int, timeout time.Duration) (probe HealthProbe) {
+	probe.Start = time.Now()
+	defer func() { probe.End = time.Now() }()
+
+	conn, err := dialInNetwork(pid, target.Host, timeout)
+	if err != nil {
+		probe.Output = err.Error()
+		return probe
+	}
+	defer conn.Close()
+	if target.Scheme == HealthTypeTCP {
+		probe.Healthy = true
+		probe.Output = "connected to " + target.Host
+		return probe
+	}
+
+	// The request goes over the connection made in the namespace, rather
+	// than one http.Client would dial from wherever it likes
+	conn.SetDeadline(probe.Start.Add(timeout))
+	request, err := http.NewRequest(http.MethodGet, target.String(), nil)
+	if err != nil {
+		probe.Output = err.Error()
+		return probe
+	}
+	request.Header.Set("User-Agent", "nsctl-healthcheck")
+	request.Close = true
+	if err := request.Write(conn); err != nil {
+		probe.Output = fmt.Sprintf("failed to send request: %v", err)
+		return probe
+	}
+	response, err := http.ReadResponse(bufio.NewReader(conn), request)
+	if err != nil {
+		probe.Output = fmt.Sprintf("failed to read response: %v", err)
+		return probe
+	}
+	response.Body.Close()
+	probe.Healthy = response.StatusCode >= 200 && response.StatusCode < 400
+	probe.Output = "HTTP " + response.Status
+	return probe
+}
+
+// dialInNetwork connects to a TCP address from the network namespace of the
+// process pid
+func dialInNetwork(pid int, address string, timeout time.Duration) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: timeout}
+	if !hasOwnNetwork(pid) {
+		return dialer.Dial("tcp", address)
+	}
+
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+	dialed := make(chan dialResult, 1)
+	go func() {
+		// A socket belongs to the namespace of the thread that creates it.
+		// The thread stays locked, so it exits with this goroutine rather
+		// than running others in the container's namespace.
+		runtime.LockOSThread()
+		netns, err := os.Open(filepath.Join("/proc", strconv.Itoa(pid), "ns", "net"))
+		if err == nil {
+			err = unix.Setns(int(netns.Fd()), unix.CLONE_NEWNET)
+			netns.Close()
+		}
+		if err != nil {
+			dialed <- dialResult{err: fmt.Errorf("failed to enter the container's network namespace: %v", err)}
+			return
+		}
+		conn, err := dialer.Dial("tcp", address)
+		dialed <- dialResult{conn: conn, err: err}
+	}()
+	result := <-dialed
+	return result.conn, result.err
+}
+
+// writeHealthFile stores a container's health status in its container
+// directory
+func writeHealthFile(containerDir string, health HealthStatus) error {
+	data, err := json.MarshalIndent(health, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal health status: %v", err)
+	}
+
+	healthPath := filepath.Join(containerDir, containerHealthFileName)
+	tempPath := healthPath + ".tmp"
+	if err := os.WriteFile(tempPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write health status: %v", err)
+	}
+	return os.Rename(tempPath, healthPath)
+}
+
+// readHealthFile loads the health status written by writeHealthFile
+func readHealthFile(containerDir string) (*HealthStatus, error) {
+	data, err := os.ReadFile(filepath.Join(containerDir, containerHealthFileName))
+	if err != nil {
+		return nil, err
+	}
+	var health HealthStatus
+	if err := json.Unmarshal(data, &health); err != nil {
+		return nil, fmt.Errorf("failed to parse health status: %v", err)
+	}
+	return &health, nil
+}
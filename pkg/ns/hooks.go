@@ -0,0 +1,350 @@
+//go:build linux
+
+package ns
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// OCI hooks
+//
+// Hooks are programs run at points of a container's life, each given the
+// container's OCI state ({"id", "status", "pid", "bundle", "annotations"})
+// on stdin:
+//
+//	prestart, createRuntime  the container's namespaces exist but the
+//	                         workload hasn't started; a failing hook
+//	                         aborts the container
+//	poststart                the workload has started
+//	poststop                 the workload has exited
+//
+// All of them run on the host, from the shim (or "start"); nsctl has no
+// createContainer or startContainer stage, which would run inside the
+// container.
+//
+// Hooks are not given per run but come from drop-in definitions, so a
+// device or driver vendor can hook into every container that needs it.
+// Every *.json file in the hooks directories (/etc/nsctl/hooks.d, or the
+// runtime config's "hooks_dirs") is one definition, in the format of
+// oci-hooks(5) other runtimes read too:
+//
+//	{
+//	  "version": "1.0.0",
+//	  "hook": {"path": "/usr/bin/gpu-hook", "args": ["gpu-hook", "prestart"], "timeout": 10},
+//	  "when": {"annotations": {"^com\\.example\\.gpu$": "^true$"}},
+//	  "stages": ["prestart"]
+//	}
+//
+// A definition applies to a container when any of its "when" conditions
+// holds: "always", an annotation whose key and value match the regular
+// expressions, a command matching one of "commands", or "hasBindMounts".
+// Definitions are applied in file name order; a file in a later directory
+// replaces one of the same name in an earlier one. They are matched when the
+// container is created, and the hooks picked are kept with the container
+// and show up in its OCI spec.
+
+// hookDefinitionVersion is the oci-hooks(5) format version nsctl reads
+const hookDefinitionVersion = "1.0.0"
+
+// defaultHookTimeout bounds hooks that don't set a timeout of their own
+const defaultHookTimeout = 30 * time.Second
+
+// Hook stages
+const (
+	HookPrestart      = "prestart"
+	HookCreateRuntime = "createRuntime"
+	HookPoststart     = "poststart"
+	HookPoststop      = "poststop"
+)
+
+// Hook is a program run at one stage of a container's life
+type Hook struct {
+	Path string `json:"path"`
+
+	// Args is the hook's argv, including argv[0]; empty means just Path
+	Args []string `json:"args,omitempty"`
+	Env  []string `json:"env,omitempty"`
+
+	// Timeout in seconds; empty means defaultHookTimeout
+	Timeout *int `json:"timeout,omitempty"`
+}
+
+// Hooks are a container's hooks by stage, as in the OCI spec
+type Hooks struct {
+	Prestart      []Hook `json:"prestart,omitempty"`
+	CreateRuntime []Hook `json:"createRuntime,omitempty"`
+	Poststart     []Hook `json:"poststart,omitempty"`
+	Poststop      []Hook `json:"poststop,omitempty"`
+}
+
+// stage returns the hooks of a stage, for adding to or running them
+func (h *Hooks) stage(name string) *[]Hook {
+	switch name {
+	case HookPrestart:
+		return &h.Prestart
+	case HookCreateRuntime:
+		return &h.CreateRuntime
+	case HookPoststart:
+		return &h.Poststart
+	case HookPoststop:
+		return &h.Poststop
+	}
+	return nil
+}
+
+// HookDefinition is a drop-in hook definition file
+type HookDefinition struct {
+	Version string   `json:"version"`
+	Hook    Hook     `json:"hook"`
+	When    HookWhen `json:"when"`
+	Stages  []string `json:"stages"`
+}
+
+// HookWhen are the conditions under which a hook applies to a container
+type HookWhen struct {
+	Always *bool `json:"always,omitempty"`
+
+	// Annotations maps key patterns to value patterns
+	Annotations map[string]string `json:"annotations,omitempty"`
+
+	// Commands are patterns matched against the container's command
+	Commands []string `json:"commands,omitempty"`
+
+	HasBindMounts *bool `json:"hasBindMounts,omitempty"`
+}
+
+// matches reports whether any of the conditions holds for the container
+func (w HookWhen) matches(config ContainerConfig) (bool, error) {
+	if w.Always != nil && *w.Always {
+		return true, nil
+	}
+	if w.HasBindMounts != nil && *w.HasBindMounts && hasBindMounts(config.Mounts) {
+		return true, nil
+	}
+
+	for keyPattern, valuePattern := range w.Annotations {
+		keyRegexp, err := regexp.Compile(keyPattern)
+		if err != nil {
+			return false, fmt.Errorf("invalid annotation pattern %q: %v", keyPattern, err)
+		}
+		valueRegexp, err := regexp.Compile(valuePattern)
+		if err != nil {
+			return false, fmt.Errorf("invalid annotation pattern %q: %v", valuePattern, err)
+		}
+		for key, value := range config.Annotations {
+			if keyRegexp.MatchString(key) && valueRegexp.MatchString(value) {
+				return true, nil
+			}
+		}
+	}
+
+	for _, commandPattern := range w.Commands {
+		commandRegexp, err := regexp.Compile(commandPattern)
+		if err != nil {
+			return false, fmt.Errorf("invalid command pattern %q: %v", commandPattern, err)
+		}
+		if commandRegexp.MatchString(config.Command) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// validate checks a definition once it has been read
+func (d HookDefinition) validate() error {
+	if d.Version != hookDefinitionVersion {
+		return fmt.Errorf("unsupported version %q (expected %s)", d.Version, hookDefinitionVersion)
+	}
+	if !filepath.IsAbs(d.Hook.Path) {
+		return fmt.Errorf("hook path %q is not absolute", d.Hook.Path)
+	}
+	if d.Hook.Timeout != nil && *d.Hook.Timeout <= 0 {
+		return fmt.Errorf("hook timeout must be positive")
+	}
+	if len(d.Stages) == 0 {
+		return fmt.Errorf("no stages")
+	}
+	for _, stage := range d.Stages {
+		if (&Hooks{}).stage(stage) == nil {
+			return fmt.Errorf("unsupported stage %q (nsctl runs prestart, createRuntime, poststart and poststop hooks)", stage)
+		}
+	}
+	when := d.When
+	if when.Always == nil && when.HasBindMounts == nil && len(when.Annotations) == 0 && len(when.Commands) == 0 {
+		return fmt.Errorf("no \"when\" conditions")
+	}
+	return nil
+}
+
+// hookDirs returns the directories hook definitions are read from
+func hookDirs() ([]string, error) {
+	runtimeConfig, err := LoadRuntimeConfig()
+	if err != nil {
+		return nil, err
+	}
+	return runtimeConfig.HooksDirs, nil
+}
+
+// loadHookDefinitions reads the definitions from the hooks directories, in
+// the order they apply
+func loadHookDefinitions(dirs []string) ([]HookDefinition, error) {
+	paths := map[string]string{}
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, fmt.Errorf("failed to read hooks directory %s: %v", dir, err)
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".json") {
+				paths[entry.Name()] = filepath.Join(dir, entry.Name())
+			}
+		}
+	}
+
+	names := make([]string, 0, len(paths))
+	for name := range paths {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var definitions []HookDefinition
+	for _, name := range names {
+		data, err := os.ReadFile(paths[name])
+		if err != nil {
+			return nil, fmt.Errorf("failed to read hook %s: %v", paths[name], err)
+		}
+		var definition HookDefinition
+		if err := json.Unmarshal(data, &definition); err != nil {
+			return nil, fmt.Errorf("failed to parse hook %s: %v", paths[name], err)
+		}
+		if err := definition.validate(); err != nil {
+			return nil, fmt.Errorf("invalid hook %s: %v", paths[name], err)
+		}
+		definitions = append(definitions, definition)
+	}
+	return definitions, nil
+}
+
+// matchHooks picks the hooks that apply to a container from the hooks
+// directories; nil if none do
+func matchHooks(config ContainerConfig) (*Hooks, error) {
+	dirs, err := hookDirs()
+	if err != nil {
+		return nil, err
+	}
+	definitions, err := loadHookDefinitions(dirs)
+	if err != nil {
+		return nil, err
+	}
+
+	var hooks *Hooks
+	for _, definition := range definitions {
+		matched, err := definition.When.matches(config)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hook %s: %v", definition.Hook.Path, err)
+		}
+		if !matched {
+			continue
+		}
+		if hooks == nil {
+			hooks = &Hooks{}
+		}
+		for _, stage := range definition.Stages {
+			stageHooks := hooks.stage(stage)
+			*stageHooks = append(*stageHooks, definition.Hook)
+		}
+	}
+	return hooks, nil
+}
+
+// ociState is the container state hooks receive on stdin
+type ociState struct {
+	OCIVersion  string            `json:"ociVersion"`
+	ID          string            `json:"id"`
+	Status      string            `json:"status"`
+	PID         int               `json:"pid,omitempty"`
+	Bundle      string            `json:"bundle"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// OCI state statuses, which name a finished container "stopped"
+const ociStatusStopped = "stopped"
+
+// runHooks runs the hooks of the given stages one after the other, stopping
+// at the first that fails
+func runHooks(config ContainerConfig, status string, pid int, stages ...string) error {
+	if config.Hooks == nil {
+		return nil
+	}
+	state, err := marshalHookState(config, status, pid)
+	if err != nil {
+		return err
+	}
+
+	for _, stage := range stages {
+		for _, hook := range *config.Hooks.stage(stage) {
+			if err := runHook(hook, state); err != nil {
+				return fmt.Errorf("%s hook %s failed: %v", stage, hook.Path, err)
+			}
+			logf("[ns] Ran %s hook %s\n", stage, hook.Path)
+		}
+	}
+	return nil
+}
+
+// marshalHookState returns the container state hooks are given
+func marshalHookState(config ContainerConfig, status string, pid int) ([]byte, error) {
+	state, err := json.Marshal(ociState{
+		OCIVersion:  ociSpecVersion,
+		ID:          config.ID,
+		Status:      status,
+		PID:         pid,
+		Bundle:      config.ContainerDir,
+		Annotations: config.Annotations,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal container state: %v", err)
+	}
+	return state, nil
+}
+
+// runHook runs one hook with the container state on stdin
+func runHook(hook Hook, state []byte) error {
+	timeout := defaultHookTimeout
+	if hook.Timeout != nil {
+		timeout = time.Duration(*hook.Timeout) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, hook.Path)
+	if len(hook.Args) > 0 {
+		cmd.Args = hook.Args
+	}
+	cmd.Env = hook.Env
+	cmd.Stdin = bytes.NewReader(state)
+	output, err := cmd.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("timed out after %v", timeout)
+	}
+	if err != nil {
+		if message := strings.TrimSpace(string(output)); message != "" {
+			return fmt.Errorf("%v: %s", err, message)
+		}
+		return err
+	}
+	return nil
+}
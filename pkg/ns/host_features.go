@@ -0,0 +1,297 @@
+//go:build linux
+
+package ns
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+
+	"nsctl/pkg/cgroup"
+)
+
+// Host feature checks
+//
+// Containers depend on kernel features that are not always there: a kernel
+// built without a namespace type, a cgroup controller that isn't mounted or
+// delegated, or simply missing privileges. Failing deep inside the setup
+// process produces nothing better than "operation not permitted", so
+// RunWithConfig checks for them up front. A missing feature the container
+// needs is an error naming what to fix; one it can do without is a warning.
+
+// featureProblem describes one missing host feature
+type featureProblem struct {
+	// problem says what is missing and fix how to get it
+	problem string
+	fix     string
+
+	// fatal problems prevent the container from running at all
+	fatal bool
+}
+
+func (p featureProblem) String() string {
+	return p.problem + " (" + p.fix + ")"
+}
+
+// requiredNamespaces are the namespace types every container is created
+// with, keyed by their name under /proc/self/ns, with the kernel option
+// providing each
+var requiredNamespaces = []struct {
+	name         string
+	kernelOption string
+}{
+	{name: "pid", kernelOption: "CONFIG_PID_NS"},
+	{name: "uts", kernelOption: "CONFIG_UTS_NS"},
+	{name: "mnt", kernelOption: "CONFIG_NAMESPACES"},
+}
+
+// capSysAdmin is the capability needed to create the namespaces, and
+// capSysChroot the one to chroot without them
+const (
+	capSysAdmin  = 21
+	capSysChroot = 18
+)
+
+// CheckHostFeatures looks for host problems that would break a container
+// with the given config. It returns the problems the container can live
+// with as warnings, and the first one it can't as an error.
+func CheckHostFeatures(config ContainerConfig) ([]string, error) {
+	var warnings []string
+	for _, problem := range findFeatureProblems(config) {
+		if problem.fatal {
+			return warnings, fmt.Errorf("%s", problem)
+		}
+		warnings = append(warnings, problem.String())
+	}
+	return warnings, nil
+}
+
+// findFeatureProblems runs all checks
+func findFeatureProblems(config ContainerConfig) []featureProblem {
+	var problems []featureProblem
+
+	// A chroot container needs no namespaces, only root (see isolation.go)
+	if config.Isolation == IsolationChroot {
+		if os.Geteuid() != 0 || !hasCapability(capSysChroot) {
+			problems = append(problems, featureProblem{
+				problem: "chroot isolation requires CAP_SYS_CHROOT",
+				fix:     "run nsctl with full root privileges",
+				fatal:   true,
+			})
+		}
+	}
+
+	for _, namespace := range requiredNamespaces {
+		if config.Isolation == IsolationChroot {
+			break
+		}
+		if _, err := os.Stat(filepath.Join("/proc/self/ns", namespace.name)); err != nil {
+			problems = append(problems, featureProblem{
+				problem: fmt.Sprintf("the kernel does not support %s namespaces", namespace.name),
+				fix:     fmt.Sprintf("use a kernel built with %s=y", namespace.kernelOption),
+				fatal:   true,
+			})
+		}
+	}
+
+	if config.Isolation != IsolationChroot && os.Geteuid() == 0 && !hasCapability(capSysAdmin) {
+		problems = append(problems, featureProblem{
+			problem: "creating namespaces requires CAP_SYS_ADMIN",
+			fix:     "run nsctl with full root privileges, or as a regular user for a rootless container",
+			fatal:   true,
+		})
+	}
+
+	if hasOwnCgroupNamespace(config) && !kernelHasNamespace("cgroup") {
+		problems = append(problems, featureProblem{
+			problem: "the kernel does not support cgroup namespaces",
+			fix:     fmt.Sprintf("use Linux 4.6 or later, or run the container with --cgroupns=%s", NamespaceHost),
+			fatal:   true,
+		})
+	}
+
+	if hasOwnTimeNamespace(config) && !kernelHasNamespace("time") {
+		problems = append(problems, featureProblem{
+			problem: "the kernel does not support time namespaces, which --time-offset needs",
+			fix:     "use Linux 5.6 or later",
+			fatal:   true,
+		})
+	}
+
+	if os.Geteuid() != 0 {
+		if problem := checkUserNamespaces(); problem != nil {
+			problems = append(problems, *problem)
+		}
+	}
+
+	if hasBindMounts(config.Mounts) && !openTreeSupported() {
+		problems = append(problems, featureProblem{
+			problem: "bind mounts need open_tree(2)",
+			fix:     "use Linux 5.2 or later",
+			fatal:   true,
+		})
+	}
+
+	if problem := checkMemoryCgroup(); problem != nil {
+		// OOM reporting is a nicety, but limits and the device allow list
+		// can't work without cgroups. Rootless, missing delegation is
+		// expected and only costs the limits.
+		hasLimits := config.Memory != "" || config.CPUs > 0
+		restrictsDevices := containerDevices(config) != nil
+		problem.fatal = (hasLimits && os.Geteuid() == 0) || restrictsDevices
+		switch {
+		case hasLimits:
+			problem.problem += "; resource limits are unavailable"
+		case restrictsDevices:
+			problem.problem += "; the container's devices can't be restricted"
+		default:
+			problem.problem += "; OOM kills will not be reported"
+		}
+		problems = append(problems, *problem)
+	} else if containerDevices(config) != nil {
+		if problem := checkDevicesCgroup(); problem != nil {
+			problems = append(problems, *problem)
+		}
+	}
+
+	return problems
+}
+
+// checkUserNamespaces makes sure unprivileged users may create user
+// namespaces, which rootless containers are built on
+func checkUserNamespaces() *featureProblem {
+	if _, err := os.Stat("/proc/self/ns/user"); err != nil {
+		return &featureProblem{
+			problem: "the kernel does not support user namespaces",
+			fix:     "use a kernel built with CONFIG_USER_NS=y, or run nsctl as root",
+			fatal:   true,
+		}
+	}
+
+	if maxNamespaces, err := readSysctlInt("user/max_user_namespaces"); err == nil && maxNamespaces == 0 {
+		return &featureProblem{
+			problem: "user namespaces are disabled",
+			fix:     "sysctl -w user.max_user_namespaces=15000",
+			fatal:   true,
+		}
+	}
+
+	// Debian and older Ubuntu kernels can disallow them for unprivileged users
+	if allowed, err := readSysctlInt("kernel/unprivileged_userns_clone"); err == nil && allowed == 0 {
+		return &featureProblem{
+			problem: "unprivileged user namespaces are disabled",
+			fix:     "sysctl -w kernel.unprivileged_userns_clone=1",
+			fatal:   true,
+		}
+	}
+
+	// Ubuntu 23.10+ restricts them to programs with an AppArmor profile
+	if restricted, err := readSysctlInt("kernel/apparmor_restrict_unprivileged_userns"); err == nil && restricted == 1 {
+		return &featureProblem{
+			problem: "AppArmor restricts unprivileged user namespaces",
+			fix:     "add an AppArmor profile allowing userns for nsctl, or sysctl -w kernel.apparmor_restrict_unprivileged_userns=0",
+			fatal:   true,
+		}
+	}
+	return nil
+}
+
+// readSysctlInt reads a numeric sysctl below /proc/sys
+func readSysctlInt(name string) (int, error) {
+	value, err := os.ReadFile(filepath.Join("/proc/sys", name))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(value)))
+}
+
+// hasCapability reports whether we hold a capability in our effective set
+func hasCapability(capability uint) bool {
+	status, err := os.ReadFile("/proc/self/status")
+	if err != nil {
+		return os.Geteuid() == 0
+	}
+	for _, line := range strings.Split(string(status), "\n") {
+		if value, found := strings.CutPrefix(line, "CapEff:"); found {
+			effective, err := strconv.ParseUint(strings.TrimSpace(value), 16, 64)
+			return err == nil && effective&(1<<capability) != 0
+		}
+	}
+	return os.Geteuid() == 0
+}
+
+// checkDevicesCgroup makes sure nsctl can restrict a rootful container's
+// devices; the unified hierarchy filters them with BPF instead, which only
+// attaching a filter tells
+func checkDevicesCgroup() *featureProblem {
+	if cgroup.IsUnified() {
+		return nil
+	}
+	var stat unix.Statfs_t
+	if err := unix.Statfs("/sys/fs/cgroup/devices", &stat); err != nil || stat.Type != unix.CGROUP_SUPER_MAGIC {
+		return &featureProblem{
+			problem: "the devices cgroup controller is not mounted, so the container's devices can't be restricted",
+			fix:     "mount it with: mkdir -p /sys/fs/cgroup/devices && mount -t cgroup -o devices none /sys/fs/cgroup/devices, or run the container --privileged",
+			fatal:   true,
+		}
+	}
+	return nil
+}
+
+// checkMemoryCgroup makes sure nsctl can create memory cgroups
+func checkMemoryCgroup() *featureProblem {
+	var stat unix.Statfs_t
+	if err := unix.Statfs("/sys/fs/cgroup", &stat); err != nil {
+		return &featureProblem{
+			problem: "no cgroup filesystem is mounted at /sys/fs/cgroup",
+			fix:     "mount one with: mount -t cgroup2 none /sys/fs/cgroup",
+		}
+	}
+
+	if os.Geteuid() != 0 {
+		if err := cgroup.CanDelegate(); err != nil {
+			return &featureProblem{
+				problem: "no cgroup can be delegated to rootless nsctl",
+				fix:     err.Error(),
+			}
+		}
+		return nil
+	}
+
+	if stat.Type == unix.CGROUP2_SUPER_MAGIC {
+		controllers, _ := os.ReadFile("/sys/fs/cgroup/cgroup.controllers")
+		if !strings.Contains(" "+string(controllers)+" ", " memory") {
+			return &featureProblem{
+				problem: "the memory cgroup controller is not available",
+				fix:     "boot with cgroup_enable=memory, or delegate it to this cgroup (Delegate=yes in the systemd unit)",
+			}
+		}
+		if unix.Access("/sys/fs/cgroup", unix.W_OK) != nil {
+			return &featureProblem{
+				problem: "the cgroup hierarchy is not writable",
+				fix:     "run nsctl as root, or from a systemd unit or scope with Delegate=yes",
+			}
+		}
+		return nil
+	}
+
+	// cgroup v1: nsctl only uses the memory hierarchy
+	memoryHierarchy := "/sys/fs/cgroup/memory"
+	if err := unix.Statfs(memoryHierarchy, &stat); err != nil || stat.Type != unix.CGROUP_SUPER_MAGIC {
+		return &featureProblem{
+			problem: "the memory cgroup controller is not mounted",
+			fix:     "mount it with: mkdir -p /sys/fs/cgroup/memory && mount -t cgroup -o memory none /sys/fs/cgroup/memory",
+		}
+	}
+	if unix.Access(memoryHierarchy, unix.W_OK) != nil {
+		return &featureProblem{
+			problem: "the memory cgroup hierarchy is not writable",
+			fix:     "run nsctl as root",
+		}
+	}
+	return nil
+}
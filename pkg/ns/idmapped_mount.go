@@ -0,0 +1,153 @@
+//go:build linux
+
+package ns
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// ID-mapped mounts
+//
+// Inside a user namespace, files on a bind-mounted host directory show up
+// with their host owners translated through the container's mappings, so a
+// directory owned by the invoking user is root's, and everything else is
+// "nobody". Linux 5.12 added ID-mapped mounts: a mount can carry a user
+// namespace of its own through which file ownership is translated, so a
+// host directory can appear with the ownership the container expects
+// without chowning anything on disk.
+//
+// The mount is built in two steps because the two halves need different
+// privileges. The shim (in the host's namespaces) clones the source into a
+// detached mount and attaches the container's user namespace to it, which
+// requires CAP_SYS_ADMIN over the source filesystem, i.e. real root for
+// host filesystems. It hands the mounts to the setup process over a
+// socket (setupMountsFD), which then moves them onto their targets inside
+// the container's mount namespace, where it attaches the plain clones of
+// cloneMounts otherwise.
+//
+// Only a rootful container with --uidmap gets ID-mapped binds: a rootless
+// shim lacks the privileges, and without a user namespace there's nothing
+// to map. A bind whose filesystem can't be ID-mapped is bound unmapped.
+
+// createIDMappedMount clones the directory tree at source into a detached
+// mount whose file ownership is mapped through the user namespace of pid
+func createIDMappedMount(source string, pid int) (*os.File, error) {
+	treeFD, err := unix.OpenTree(unix.AT_FDCWD, source, unix.OPEN_TREE_CLONE|unix.OPEN_TREE_CLOEXEC|unix.AT_RECURSIVE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to clone mount %s: %v", source, err)
+	}
+	tree := os.NewFile(uintptr(treeFD), source)
+
+	userNamespace, err := os.Open(filepath.Join("/proc", strconv.Itoa(pid), "ns", "user"))
+	if err != nil {
+		tree.Close()
+		return nil, fmt.Errorf("failed to open the container's user namespace: %v", err)
+	}
+	defer userNamespace.Close()
+
+	attributes := unix.MountAttr{
+		Attr_set:  unix.MOUNT_ATTR_IDMAP,
+		Userns_fd: uint64(userNamespace.Fd()),
+	}
+	if err := unix.MountSetattr(treeFD, "", unix.AT_EMPTY_PATH|unix.AT_RECURSIVE, &attributes); err != nil {
+		tree.Close()
+		return nil, fmt.Errorf("failed to ID-map mount %s: %v", source, err)
+	}
+	return tree, nil
+}
+
+// attachDetachedMount moves a detached mount, a clone of cloneMounts or
+// one made by createIDMappedMount, onto target
+func attachDetachedMount(mount *os.File, target string) error {
+	started := time.Now()
+	err := unix.MoveMount(int(mount.Fd()), "", unix.AT_FDCWD, target, unix.MOVE_MOUNT_F_EMPTY_PATH)
+	traceSyscall(started, err, "move_mount(%q, \"\", AT_FDCWD, %q, MOVE_MOUNT_F_EMPTY_PATH)", mount.Name(), target)
+	if err != nil {
+		return fmt.Errorf("failed to mount %s: %v", target, err)
+	}
+	return nil
+}
+
+// idmappedMountsSupported reports whether the kernel has mount_setattr(2)
+// Support also depends on the filesystem (ext4, xfs and btrfs have it,
+// for example), which only shows once a mount is actually ID-mapped
+func idmappedMountsSupported() bool {
+	err := unix.MountSetattr(-1, "", 0, &unix.MountAttr{})
+	return !errors.Is(err, unix.ENOSYS)
+}
+
+// idmapBinds reports whether the shim ID-maps a container's bind sources
+func idmapBinds(config ContainerConfig) bool {
+	if config.Rootless || len(config.UIDMappings) == 0 || !hasOwnMountNamespace(config) {
+		return false
+	}
+	for _, mount := range config.Mounts {
+		if mount.isBind() {
+			return idmappedMountsSupported()
+		}
+	}
+	return false
+}
+
+// sendIDMappedMounts sends the setup process of pid one message per bind
+// of the container, carrying the bind's ID-mapped source unless its
+// filesystem can't be ID-mapped
+func sendIDMappedMounts(socket *os.File, mounts []Mount, pid int) error {
+	for _, mount := range mounts {
+		if !mount.isBind() {
+			continue
+		}
+		var rights []byte
+		tree, err := createIDMappedMount(mount.Source, pid)
+		if err != nil {
+			logf("[ns] Warning: binding %s without ID mapping: %v\n", mount.Source, err)
+		} else {
+			rights = unix.UnixRights(int(tree.Fd()))
+		}
+		err = unix.Sendmsg(int(socket.Fd()), []byte{0}, rights, nil, 0)
+		if tree != nil {
+			tree.Close()
+		}
+		if err != nil {
+			return fmt.Errorf("failed to send ID-mapped mount %s: %v", mount.Source, err)
+		}
+	}
+	return nil
+}
+
+// receiveIDMappedMounts receives the bind sources sent by
+// sendIDMappedMounts on setupMountsFD, with a nil entry for other mounts
+// and binds that aren't ID-mapped
+func receiveIDMappedMounts(mounts []Mount) ([]*os.File, error) {
+	socket := os.NewFile(setupMountsFD, "mounts-socket")
+	defer socket.Close()
+
+	var trees []*os.File
+	for _, mount := range mounts {
+		if !mount.isBind() {
+			trees = append(trees, nil)
+			continue
+		}
+		oob := make([]byte, unix.CmsgSpace(4))
+		_, oobn, _, _, err := unix.Recvmsg(int(socket.Fd()), make([]byte, 1), oob, unix.MSG_CMSG_CLOEXEC)
+		if err != nil {
+			closeMounts(trees)
+			return nil, fmt.Errorf("failed to receive ID-mapped mount %s: %v", mount.Source, err)
+		}
+		var tree *os.File
+		if messages, err := unix.ParseSocketControlMessage(oob[:oobn]); err == nil && len(messages) > 0 {
+			if fds, err := unix.ParseUnixRights(&messages[0]); err == nil && len(fds) > 0 {
+				tree = os.NewFile(uintptr(fds[0]), mount.Source)
+			}
+		}
+		trees = append(trees, tree)
+	}
+	return trees, nil
+}
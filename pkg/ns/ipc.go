@@ -0,0 +1,49 @@
+//go:build linux
+
+package ns
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// IPC namespaces (--ipc)
+//
+// SysV shared memory, semaphores and message queues, and POSIX message
+// queues, are found by key or name, not by path: without an IPC namespace
+// of its own a container could attach to the host's shared memory segments
+// or read its message queues. Each container therefore gets a new IPC
+// namespace, and setup mounts a fresh mqueue filesystem on /dev/mqueue so
+// that it lists the container's POSIX queues rather than the host's.
+// --ipc=host shares the host's (see namespaces.go), e.g. for a workload
+// that talks to a host process over shared memory.
+
+// mqueueMountPoint is where POSIX message queues are listed
+const mqueueMountPoint = "/dev/mqueue"
+
+// hasOwnIPCNamespace reports whether a container gets an IPC namespace
+func hasOwnIPCNamespace(config ContainerConfig) bool {
+	return isOwnNamespace(config.IPCNamespace)
+}
+
+// mountMqueue mounts the mqueue filesystem of the container's IPC
+// namespace, its own or one it joined, on /dev/mqueue; the mount point is
+// left alone where the host has none, as creating it would create it in
+// the host's /dev (a --rootfs container's own /dev has one, see dev.go)
+func mountMqueue(config ContainerConfig) error {
+	if config.IPCNamespace == NamespaceHost {
+		return nil
+	}
+	target := filepath.Join(config.Rootfs, mqueueMountPoint)
+	if _, err := os.Stat(target); err != nil {
+		logf("[ns] No %s, skipping the container's message queue filesystem\n", mqueueMountPoint)
+		return nil
+	}
+	if err := mountTraced("mqueue", target, "mqueue", unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, ""); err != nil {
+		return fmt.Errorf("failed to mount %s: %v", mqueueMountPoint, err)
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+//go:build linux
+
+package ns
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Isolation backends (--isolation)
+//
+// Containers normally get PID, UTS and mount namespaces of their own
+// ("namespaces"). Some hosts don't allow creating them, e.g. VPS and LXC
+// guests whose kernel, seccomp profile or capabilities refuse CLONE_NEWPID
+// and CLONE_NEWNS. With --isolation chroot such a host still runs
+// containers, with reduced isolation: the setup process chroots into the
+// container's --rootfs, lowers the resource limits below, drops
+// capabilities and switches to the --user before exec, all without new
+// namespaces. The container sees the host's processes, hostname and
+// mounts, so it gets no /proc, /sys or /etc files of its own and can't
+// have -v mounts; ps and inspect mark it. Nor do the processes it starts
+// die with the workload, so the shim kills what is left in the container's
+// cgroup (see namespaces.go). --isolation auto picks namespaces where the
+// host can create them and chroot where it can't.
+//
+// A chroot container therefore needs a --rootfs, and auto doesn't fall
+// back to chroot without one. --rootfs / opts into running on the host's
+// whole filesystem, with no filesystem confinement at all, and ps and
+// inspect say so. No chroot container may be privileged or keep
+// CAP_SYS_CHROOT, which would let it leave its root.
+
+// Isolation backends
+const (
+	IsolationNamespaces = "namespaces"
+	IsolationChroot     = "chroot"
+	IsolationAuto       = "auto"
+)
+
+// chrootRlimits stand in for some of what the namespaces would contain: no
+// core dumps of the workload land on the host, and it can't take all of the
+// host's processes or file descriptors. Limits that are lower already stay.
+var chrootRlimits = []struct {
+	name     string
+	resource int
+	limit    uint64
+}{
+	{name: "RLIMIT_CORE", resource: unix.RLIMIT_CORE, limit: 0},
+	{name: "RLIMIT_NPROC", resource: unix.RLIMIT_NPROC, limit: 4096},
+	{name: "RLIMIT_NOFILE", resource: unix.RLIMIT_NOFILE, limit: 4096},
+}
+
+// namespaceCloneFlags are the namespaces --isolation auto probes for: those
+// a namespaced container gets by default that hosts are known to refuse
+const namespaceCloneFlags = unix.CLONE_NEWUTS | unix.CLONE_NEWPID | unix.CLONE_NEWNS
+
+// prepareIsolation resolves --isolation auto and checks that the container
+// asks for nothing its backend can't do; it runs before the hostname and
+// the user namespace are filled in
+func prepareIsolation(config *ContainerConfig) error {
+	switch config.Isolation {
+	case "", IsolationNamespaces:
+		config.Isolation = IsolationNamespaces
+		return nil
+	case IsolationAuto:
+		config.Isolation = IsolationNamespaces
+		if os.Geteuid() == 0 && !canCreateNamespaces() {
+			if config.Rootfs == "" {
+				return fmt.Errorf("this host doesn't allow creating namespaces, and --isolation %s only falls back to %s with a --rootfs to confine the container to (--rootfs / runs it on the host's whole filesystem)", IsolationAuto, IsolationChroot)
+			}
+			logf("[ns] Warning: this host doesn't allow creating namespaces, running container with reduced isolation (chroot)\n")
+			config.Isolation = IsolationChroot
+		}
+		if config.Isolation != IsolationChroot {
+			return nil
+		}
+	case IsolationChroot:
+	default:
+		return fmt.Errorf("invalid isolation %q: expected %s, %s or %s", config.Isolation, IsolationNamespaces, IsolationChroot, IsolationAuto)
+	}
+
+	// Without a user namespace, only root may chroot and switch users
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("--isolation %s needs root", IsolationChroot)
+	}
+	switch {
+	case config.Hostname != "":
+		return fmt.Errorf("--isolation %s can't set a hostname: the container has the host's", IsolationChroot)
+	case len(config.UIDMappings) > 0 || config.UserNamespace != "":
+		return fmt.Errorf("--isolation %s can't map IDs: the container has no user namespace", IsolationChroot)
+	case len(config.Mounts) > 0:
+		return fmt.Errorf("--isolation %s can't mount volumes: the container has the host's mounts", IsolationChroot)
+	case config.ProcOptions != "":
+		return fmt.Errorf("--isolation %s can't set proc-opts: the container has the host's /proc", IsolationChroot)
+	case config.Sysfs != "":
+		return fmt.Errorf("--isolation %s can't choose --sysfs: the container has the host's /sys", IsolationChroot)
+	case config.Rootfs == "":
+		return fmt.Errorf("--isolation %s needs a --rootfs to confine the container to (--rootfs / runs it on the host's whole filesystem)", IsolationChroot)
+	case config.Privileged:
+		return fmt.Errorf("--isolation %s can't be privileged: CAP_SYS_CHROOT would let the container leave its root", IsolationChroot)
+	}
+	if capabilities, err := parseCapabilities(config.CapAdd); err != nil {
+		return err
+	} else if capabilities[unix.CAP_SYS_CHROOT] {
+		return fmt.Errorf("--isolation %s can't keep CAP_SYS_CHROOT: it would let the container leave its root", IsolationChroot)
+	}
+	if hasHostRoot(*config) {
+		logf("[ns] Warning: with --rootfs /, the container has no filesystem confinement: it sees and can change the host's whole filesystem\n")
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return fmt.Errorf("failed to get hostname: %v", err)
+	}
+	config.Hostname = hostname
+	return nil
+}
+
+// hasHostRoot reports whether a container's --rootfs is the host's own /
+func hasHostRoot(config ContainerConfig) bool {
+	return config.Rootfs != "" && filepath.Clean(config.Rootfs) == "/"
+}
+
+// canCreateNamespaces reports whether the host lets us create the
+// namespaces of a container, by starting a process in them
+func canCreateNamespaces() bool {
+	probe := exec.Command("/proc/self/exe")
+	probe.SysProcAttr = &syscall.SysProcAttr{Cloneflags: namespaceCloneFlags}
+	if err := probe.Start(); err != nil {
+		return false
+	}
+	probe.Process.Kill()
+	probe.Wait()
+	return true
+}
+
+// setupChrootEnvironment performs the setup of a chroot container, the
+// counterpart of setupNamespaceEnvironment
+func setupChrootEnvironment(config ContainerConfig, targetCmd string) (preparedExec, error) {
+	logf("[ns] Confining container to %s (reduced isolation, no namespaces)\n", config.Rootfs)
+	err := traced("chroot", func() error {
+		if err := unix.Chroot(config.Rootfs); err != nil {
+			return fmt.Errorf("failed to chroot into %s: %v", config.Rootfs, err)
+		}
+		return unix.Chdir("/")
+	})
+	if err != nil {
+		return preparedExec{}, err
+	}
+
+	if err := traced("set resource limits", applyChrootRlimits); err != nil {
+		return preparedExec{}, err
+	}
+	return resolveExec(config, targetCmd)
+}
+
+// applyChrootRlimits lowers the resource limits to chrootRlimits
+func applyChrootRlimits() error {
+	for _, rlimit := range chrootRlimits {
+		var current unix.Rlimit
+		if err := unix.Getrlimit(rlimit.resource, &current); err != nil {
+			return fmt.Errorf("failed to read %s: %v", rlimit.name, err)
+		}
+		lowered := unix.Rlimit{Cur: min(current.Cur, rlimit.limit), Max: min(current.Max, rlimit.limit)}
+		if err := unix.Setrlimit(rlimit.resource, &lowered); err != nil {
+			return fmt.Errorf("failed to set %s: %v", rlimit.name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+//go:build linux
+
+package ns
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Joining another container's namespaces (--pid=container:<id>, ...)
+//
+// Instead of a namespace of its own or the host's, a container can share
+// the UTS, PID, network or IPC namespace of a running container, e.g. to
+// debug a workload with tools its image lacks from a sidecar that sees its
+// processes and its localhost:
+//
+//	nsctl run --pid=container:<id> --net=container:<id> ...
+//
+// The target is looked up by ID or prefix when the container is created.
+// Each time the container starts, the shim enters the namespaces of the
+// target's workload with setns(2) on /proc/<pid>/ns/* and clones the setup
+// process from that thread, so it starts in them; entering a PID namespace
+// only applies to children, which setup is. The thread is thrown away
+// afterwards, leaving the rest of the shim in its own namespaces. The
+// target has to be running then. A container sharing its UTS namespace has
+// its hostname, and one sharing its PID namespace dies with it: when the
+// init of a PID namespace exits the kernel kills everything in it.
+//
+// Mount, cgroup and user namespaces can't be joined, and joining takes
+// root: a Go process can't enter the user namespace of a rootless target,
+// which owns its other namespaces.
+
+// NamespaceContainerPrefix starts a namespace mode joining the namespace of
+// the container whose ID follows
+const NamespaceContainerPrefix = "container:"
+
+// joinableNamespace is a namespace a container can join, with its mode
+type joinableNamespace struct {
+	name    string // under /proc/<pid>/ns
+	ociType string // in an OCI spec
+	flag    int    // for setns(2)
+	mode    *string
+}
+
+// joinableNamespaces lists the namespaces of a container that can be
+// joined, in the order they are entered
+func joinableNamespaces(config *ContainerConfig) []joinableNamespace {
+	return []joinableNamespace{
+		{"uts", "uts", unix.CLONE_NEWUTS, &config.UTSNamespace},
+		{"ipc", "ipc", unix.CLONE_NEWIPC, &config.IPCNamespace},
+		{"net", "network", unix.CLONE_NEWNET, &config.Network},
+		{"pid", "pid", unix.CLONE_NEWPID, &config.PIDNamespace},
+	}
+}
+
+// joinedContainer returns the ID of the container whose namespace a mode
+// joins, if it joins one
+func joinedContainer(mode string) (string, bool) {
+	return strings.CutPrefix(mode, NamespaceContainerPrefix)
+}
+
+// resolveJoinedContainers looks up the containers a container joins the
+// namespaces of and records their full IDs; a container joining a UTS
+// namespace takes its hostname from the container it belongs to
+func resolveJoinedContainers(config *ContainerConfig) error {
+	for _, namespace := range joinableNamespaces(config) {
+		containerID, joined := joinedContainer(*namespace.mode)
+		if !joined {
+			continue
+		}
+		if config.Isolation == IsolationChroot {
+			return fmt.Errorf("--isolation %s can't join another container's namespaces: the container has the host's", IsolationChroot)
+		}
+		if os.Geteuid() != 0 {
+			return fmt.Errorf("joining another container's namespaces needs root")
+		}
+		target, err := LookupContainer(containerID)
+		if err != nil {
+			return fmt.Errorf("can't join the %s namespace of container %s: %v", namespace.name, containerID, err)
+		}
+		if target.Status != StatusRunning {
+			return fmt.Errorf("can't join the %s namespace of container %s: it is %s", namespace.name, ShortID(target.ID), target.Status)
+		}
+		*namespace.mode = NamespaceContainerPrefix + target.ID
+
+		if namespace.name == "uts" {
+			if config.Hostname != "" {
+				return fmt.Errorf("the container can't set a hostname: it shares container %s's UTS namespace", ShortID(target.ID))
+			}
+			config.Hostname = target.Hostname
+		}
+	}
+	return nil
+}
+
+// joinedNamespacePath returns the path of the namespace a mode joins, that
+// of the joined container's workload, if it joins one
+func joinedNamespacePath(mode string, name string) (string, bool, error) {
+	containerID, joined := joinedContainer(mode)
+	if !joined {
+		return "", false, nil
+	}
+	target, err := loadContainerInfo(containerID)
+	if err != nil {
+		return "", true, fmt.Errorf("can't join container %s: %v", ShortID(containerID), err)
+	}
+	if !target.workloadRunning() {
+		return "", true, fmt.Errorf("can't join the %s namespace of container %s: it isn't running", name, ShortID(containerID))
+	}
+	return filepath.Join("/proc", strconv.Itoa(target.PID), "ns", name), true, nil
+}
+
+// startInJoinedNamespaces starts the setup process of a container in the
+// namespaces it joins, and in the shim's others
+func startInJoinedNamespaces(cmd *exec.Cmd, config ContainerConfig) error {
+	var joins []joinableNamespace
+	for _, namespace := range joinableNamespaces(&config) {
+		if _, joined := joinedContainer(*namespace.mode); joined {
+			joins = append(joins, namespace)
+		}
+	}
+	if len(joins) == 0 {
+		return cmd.Start()
+	}
+
+	return startInNamespaces(cmd, func() error {
+		return enterNamespaces(joins)
+	})
+}
+
+// startInNamespaces starts cmd from a thread that enter has moved into
+// other namespaces, which the process starts in
+func startInNamespaces(cmd *exec.Cmd, enter func() error) error {
+	started := make(chan error, 1)
+	go func() {
+		// The thread is never unlocked, so it exits with the goroutine
+		// rather than running other goroutines in the namespaces entered
+		runtime.LockOSThread()
+		if err := enter(); err != nil {
+			started <- err
+			return
+		}
+		started <- cmd.Start()
+	}()
+	return <-started
+}
+
+// enterNamespaces moves the calling thread into the namespaces it joins
+func enterNamespaces(joins []joinableNamespace) error {
+	for _, namespace := range joins {
+		path, _, err := joinedNamespacePath(*namespace.mode, namespace.name)
+		if err != nil {
+			return err
+		}
+		containerID, _ := joinedContainer(*namespace.mode)
+		logf("[ns] Joining the %s namespace of container %s\n", namespace.name, ShortID(containerID))
+		if err := setns(path, namespace.flag); err != nil {
+			return fmt.Errorf("failed to join the %s namespace of container %s: %v", namespace.name, ShortID(containerID), err)
+		}
+	}
+	return nil
+}
+
+// setns moves the calling thread into the namespace at path
+func setns(path string, flag int) error {
+	fd, err := unix.Open(path, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	return unix.Setns(fd, flag)
+}
@@ -0,0 +1,58 @@
+//go:build linux
+
+package ns
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// Session keyrings (--keyring)
+//
+// The kernel keeps keys (Kerberos tickets, ecryptfs and fscrypt keys, what
+// request-key fetched) in keyrings, and a process finds them through its
+// session keyring, which it inherits. Without a keyring of its own the
+// container would share the session keyring of whoever started nsctl, and
+// with it their keys. Setup therefore joins a new, empty session keyring
+// named after the container just before exec; --keyring host keeps the
+// inherited one. A kernel without key management support leaves nothing to
+// share, which is only a warning.
+
+// Keyring modes
+const (
+	KeyringPrivate = "private"
+	KeyringHost    = "host"
+)
+
+// keyringNamePrefix starts the names of containers' session keyrings,
+// which /proc/keys shows
+const keyringNamePrefix = "nsctl-"
+
+// validateKeyring checks the --keyring mode
+func validateKeyring(mode string) error {
+	switch mode {
+	case "", KeyringPrivate, KeyringHost:
+		return nil
+	}
+	return fmt.Errorf("invalid keyring mode %q: expected %s or %s", mode, KeyringPrivate, KeyringHost)
+}
+
+// joinSessionKeyring gives the calling thread a new session keyring, unless
+// the container keeps the host's; the keyring belongs to the thread's
+// credentials, so it runs on the thread that execs
+func joinSessionKeyring(config ContainerConfig) error {
+	if config.Keyring == KeyringHost {
+		return nil
+	}
+	_, err := unix.KeyctlJoinSessionKeyring(keyringNamePrefix + config.ID)
+	if errors.Is(err, unix.ENOSYS) {
+		logf("[ns] Warning: the kernel doesn't support keyrings, container has no session keyring\n")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create session keyring (--keyring %s keeps the host's): %v", KeyringHost, err)
+	}
+	return nil
+}
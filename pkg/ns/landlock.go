@@ -0,0 +1,195 @@
+//go:build linux
+
+package ns
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Landlock (--security-opt landlock=policy.json)
+//
+// Landlock lets an unprivileged process restrict its own filesystem access,
+// so it works for rootless containers where AppArmor or SELinux profiles
+// can't be loaded. A policy lists which paths (and everything beneath them)
+// the workload may read, write or execute; everything else is denied:
+//
+//	{"rules": [
+//	  {"paths": ["/usr", "/lib", "/etc"], "access": ["read", "execute"]},
+//	  {"paths": ["/tmp"], "access": ["read", "write"]}
+//	]}
+//
+// The paths are those seen inside the container, and the command itself must
+// be executable under the policy. The restriction is applied right before
+// the exec and inherited by every process in the container.
+
+// LandlockPolicy is a Landlock filesystem policy
+type LandlockPolicy struct {
+	Rules []LandlockRule `json:"rules"`
+}
+
+// LandlockRule grants access to the given paths and what is beneath them
+type LandlockRule struct {
+	Paths  []string `json:"paths"`
+	Access []string `json:"access"`
+}
+
+// landlockAccess maps policy access names to Landlock filesystem rights
+var landlockAccess = map[string]uint64{
+	"read": unix.LANDLOCK_ACCESS_FS_READ_FILE | unix.LANDLOCK_ACCESS_FS_READ_DIR,
+	"write": unix.LANDLOCK_ACCESS_FS_WRITE_FILE | unix.LANDLOCK_ACCESS_FS_REMOVE_DIR |
+		unix.LANDLOCK_ACCESS_FS_REMOVE_FILE | unix.LANDLOCK_ACCESS_FS_MAKE_CHAR |
+		unix.LANDLOCK_ACCESS_FS_MAKE_DIR | unix.LANDLOCK_ACCESS_FS_MAKE_REG |
+		unix.LANDLOCK_ACCESS_FS_MAKE_SOCK | unix.LANDLOCK_ACCESS_FS_MAKE_FIFO |
+		unix.LANDLOCK_ACCESS_FS_MAKE_BLOCK | unix.LANDLOCK_ACCESS_FS_MAKE_SYM |
+		unix.LANDLOCK_ACCESS_FS_REFER | unix.LANDLOCK_ACCESS_FS_TRUNCATE |
+		unix.LANDLOCK_ACCESS_FS_IOCTL_DEV,
+	"execute": unix.LANDLOCK_ACCESS_FS_EXECUTE,
+}
+
+// landlockFileAccess are the rights that apply to a file rather than to
+// the entries of a directory
+const landlockFileAccess = unix.LANDLOCK_ACCESS_FS_EXECUTE | unix.LANDLOCK_ACCESS_FS_WRITE_FILE |
+	unix.LANDLOCK_ACCESS_FS_READ_FILE | unix.LANDLOCK_ACCESS_FS_TRUNCATE | unix.LANDLOCK_ACCESS_FS_IOCTL_DEV
+
+// landlockABIVersion returns the Landlock ABI the kernel offers, or 0 when
+// Landlock is unavailable (older kernel, or not in the lsm= list)
+func landlockABIVersion() int {
+	version, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, 0, 0, unix.LANDLOCK_CREATE_RULESET_VERSION)
+	if errno != 0 {
+		return 0
+	}
+	return int(version)
+}
+
+// landlockHandledAccess returns the filesystem rights an ABI version knows
+// Rights a kernel doesn't know can't be restricted there, so they are
+// left out rather than failing on older kernels
+func landlockHandledAccess(version int) uint64 {
+	handled := uint64(unix.LANDLOCK_ACCESS_FS_MAKE_SYM<<1 - 1)
+	if version >= 2 {
+		handled |= unix.LANDLOCK_ACCESS_FS_REFER
+	}
+	if version >= 3 {
+		handled |= unix.LANDLOCK_ACCESS_FS_TRUNCATE
+	}
+	if version >= 5 {
+		handled |= unix.LANDLOCK_ACCESS_FS_IOCTL_DEV
+	}
+	return handled
+}
+
+// LoadLandlockPolicy reads and checks a policy file
+func LoadLandlockPolicy(path string) (*LandlockPolicy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Landlock policy: %v", err)
+	}
+
+	var policy LandlockPolicy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return nil, fmt.Errorf("invalid Landlock policy %s: %v", path, err)
+	}
+	for i, rule := range policy.Rules {
+		if len(rule.Paths) == 0 {
+			return nil, fmt.Errorf("invalid Landlock policy %s: rules[%d] has no paths", path, i)
+		}
+		if _, err := rule.accessRights(); err != nil {
+			return nil, fmt.Errorf("invalid Landlock policy %s: rules[%d]: %v", path, i, err)
+		}
+	}
+
+	if landlockABIVersion() == 0 {
+		return nil, fmt.Errorf("the kernel doesn't support Landlock (it needs Linux 5.13 or later with landlock in the lsm= boot parameter)")
+	}
+	return &policy, nil
+}
+
+// accessRights combines the rule's access names into Landlock rights
+func (r LandlockRule) accessRights() (uint64, error) {
+	if len(r.Access) == 0 {
+		return 0, fmt.Errorf("no access given (expected read, write and/or execute)")
+	}
+	var rights uint64
+	for _, name := range r.Access {
+		access, found := landlockAccess[name]
+		if !found {
+			return 0, fmt.Errorf("unknown access %q (expected read, write or execute)", name)
+		}
+		rights |= access
+	}
+	return rights, nil
+}
+
+// applyLandlockPolicy restricts the calling thread, and whatever it execs,
+// to the policy
+func applyLandlockPolicy(policy *LandlockPolicy) error {
+	handled := landlockHandledAccess(landlockABIVersion())
+
+	// Only the first field is set, so only its size is passed: that is
+	// what every Landlock version accepts
+	rulesetAttr := unix.LandlockRulesetAttr{Access_fs: handled}
+	rulesetFD, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET,
+		uintptr(unsafe.Pointer(&rulesetAttr)), unsafe.Sizeof(rulesetAttr.Access_fs), 0)
+	if errno != 0 {
+		return fmt.Errorf("failed to create Landlock ruleset: %v", errno)
+	}
+	defer unix.Close(int(rulesetFD))
+
+	for _, rule := range policy.Rules {
+		rights, err := rule.accessRights()
+		if err != nil {
+			return err
+		}
+		for _, path := range rule.Paths {
+			if err := addLandlockRule(int(rulesetFD), path, rights&handled); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Without CAP_SYS_ADMIN the kernel only lets a process restrict itself
+	// when it can't gain privileges through exec
+	if !hasCapability(capSysAdmin) {
+		if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+			return fmt.Errorf("failed to set no_new_privs: %v", err)
+		}
+	}
+	if _, _, errno := unix.Syscall(unix.SYS_LANDLOCK_RESTRICT_SELF, rulesetFD, 0, 0); errno != 0 {
+		return fmt.Errorf("failed to apply Landlock policy: %v", errno)
+	}
+	logf("[ns] Applied Landlock policy (ABI version %d)\n", landlockABIVersion())
+	return nil
+}
+
+// addLandlockRule allows rights beneath path
+func addLandlockRule(rulesetFD int, path string, rights uint64) error {
+	fd, err := unix.Open(path, unix.O_PATH|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("Landlock policy path %s: %v", path, err)
+	}
+	defer unix.Close(fd)
+
+	// Directory rights on a file are rejected by the kernel
+	var stat unix.Stat_t
+	if err := unix.Fstat(fd, &stat); err != nil {
+		return fmt.Errorf("Landlock policy path %s: %v", path, err)
+	}
+	if stat.Mode&unix.S_IFMT != unix.S_IFDIR {
+		rights &= landlockFileAccess
+	}
+	if rights == 0 {
+		return nil
+	}
+
+	pathBeneath := unix.LandlockPathBeneathAttr{Allowed_access: rights, Parent_fd: int32(fd)}
+	if _, _, errno := unix.Syscall6(unix.SYS_LANDLOCK_ADD_RULE, uintptr(rulesetFD), unix.LANDLOCK_RULE_PATH_BENEATH,
+		uintptr(unsafe.Pointer(&pathBeneath)), 0, 0, 0); errno != 0 {
+		return fmt.Errorf("failed to add Landlock rule for %s: %v", path, errno)
+	}
+	return nil
+}
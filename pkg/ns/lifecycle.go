@@ -0,0 +1,227 @@
+//go:build linux
+
+package ns
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Start synchronization
+//
+// The setup process does all of its preparation (mounts, hostname, ...) and
+// then blocks opening the write end of a FIFO in the container directory.
+// Opening a FIFO for writing blocks until someone opens it for reading, so
+// the workload cannot exec before "start" opens the read end. This splits a
+// container's life into "create" (everything prepared, nothing running yet)
+// and "start" (exec the workload), with no window in which the workload runs
+// before the runtime has finished setting it up.
+
+// Name of the start FIFO inside the container directory
+const execFifoFileName = "exec.fifo"
+
+// createExecFifo makes the start FIFO for a container that is being prepared
+func createExecFifo(containerDir string) error {
+	fifoPath := filepath.Join(containerDir, execFifoFileName)
+	if err := unix.Mkfifo(fifoPath, 0622); err != nil {
+		return fmt.Errorf("failed to create start fifo: %v", err)
+	}
+	return nil
+}
+
+// waitForStartSignal blocks the setup process until the container is started
+// Runs inside the container, after setup and right before exec; the FIFO
+// is opened relative to the container directory opened before setup
+func waitForStartSignal(containerDir *os.File) error {
+	fifoPath := filepath.Join(containerDir.Name(), execFifoFileName)
+	logf("[ns] Waiting for start signal on %s\n", fifoPath)
+
+	// This open blocks until StartContainer opens the other end
+	fd, err := unix.Openat(int(containerDir.Fd()), execFifoFileName, unix.O_WRONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open start fifo: %v", err)
+	}
+	fifo := os.NewFile(uintptr(fd), fifoPath)
+	defer fifo.Close()
+
+	// Write a byte so the starter knows we really got past the open
+	if _, err := fifo.Write([]byte{0}); err != nil {
+		return fmt.Errorf("failed to acknowledge start: %v", err)
+	}
+	return nil
+}
+
+// StartContainer releases a created container so it execs its workload
+func StartContainer(containerID string) error {
+	containerInfo, err := loadContainerInfo(containerID)
+	if err != nil {
+		return err
+	}
+	if refreshStatus(&containerInfo) != StatusCreated {
+		return fmt.Errorf("container %s is %s, not created", ShortID(containerID), containerInfo.Status)
+	}
+
+	// Mark the container running before releasing it: once released it may
+	// exit at any moment, and the shim's exit record must not be overwritten
+	createdInfo := containerInfo
+	containerInfo.Status = StatusRunning
+	containerInfo.StartTime = time.Now()
+	if err := saveContainerInfo(containerInfo); err != nil {
+		return err
+	}
+
+	logf("[ns] Starting container %s\n", ShortID(containerID))
+	if err := releaseExecFifo(getContainerDir(containerID), containerInfo.PID); err != nil {
+		// The workload never started, so put the record back as it was
+		saveContainerInfo(createdInfo)
+		return err
+	}
+	emitEvent(EventStart, containerID, nil)
+
+	// A failing poststart hook can't undo the start, only be reported
+	if config, err := readContainerConfig(containerID); err == nil {
+		if err := runHooks(config, StatusRunning, containerInfo.PID, HookPoststart); err != nil {
+			logf("[ns] Warning: %v\n", err)
+		}
+	}
+	return nil
+}
+
+// DefaultStopTimeout is how long "stop" waits after SIGTERM before SIGKILL
+const DefaultStopTimeout = 10 * time.Second
+
+// StopContainer asks a container to exit with SIGTERM, kills it with
+// SIGKILL if it's still running after timeout, and waits for its shim to
+// record the exit. Stopping an exited container does nothing.
+// The workload is PID 1 of its PID namespace, which only gets the signals
+// it has a handler for, so a workload ignoring SIGTERM runs until the
+// SIGKILL. A created container never ran its workload and is killed, and
+// a restarting one just isn't restarted.
+func StopContainer(containerID string, timeout time.Duration) error {
+	containerInfo, err := loadContainerInfo(containerID)
+	if err != nil {
+		return err
+	}
+
+	status := refreshStatus(&containerInfo)
+	if status == StatusExited {
+		return nil
+	}
+	if err := requestStop(&containerInfo); err != nil {
+		return err
+	}
+
+	switch status {
+	case StatusRestarting:
+		waitForShimExit(containerInfo)
+		return nil
+	case StatusRunning:
+		logf("[ns] Stopping container %s (PID %d)\n", ShortID(containerID), containerInfo.PID)
+		if err := signalContainer(containerInfo, syscall.SIGTERM); err != nil {
+			return err
+		}
+		deadline := time.Now().Add(timeout)
+		for time.Now().Before(deadline) && containerInfo.workloadRunning() {
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	if containerInfo.workloadRunning() {
+		logf("[ns] Killing container %s (PID %d)\n", ShortID(containerID), containerInfo.PID)
+		if err := signalContainer(containerInfo, syscall.SIGKILL); err != nil {
+			return err
+		}
+	}
+	waitForShimExit(containerInfo)
+	return nil
+}
+
+// KillContainer sends a signal to a running or created container
+func KillContainer(containerID string, signal syscall.Signal) error {
+	containerInfo, err := loadContainerInfo(containerID)
+	if err != nil {
+		return err
+	}
+	if refreshStatus(&containerInfo) == StatusExited {
+		return fmt.Errorf("container %s is not running", ShortID(containerID))
+	}
+	return signalContainer(containerInfo, signal)
+}
+
+// signalContainer sends a signal to a container's workload and records a
+// kill event
+func signalContainer(containerInfo ContainerInfo, signal syscall.Signal) error {
+	if err := signalProcess(containerInfo.PID, containerInfo.PIDStartTime, signal); err != nil && err != syscall.ESRCH {
+		return fmt.Errorf("failed to signal container %s: %v", ShortID(containerInfo.ID), err)
+	}
+	emitEvent(EventKill, containerInfo.ID, map[string]string{"signal": unix.SignalName(signal)})
+	return nil
+}
+
+// ParseSignal parses a signal given by name (TERM, SIGTERM) or number
+func ParseSignal(value string) (syscall.Signal, error) {
+	if number, err := strconv.Atoi(value); err == nil && number > 0 {
+		return syscall.Signal(number), nil
+	}
+	name := strings.ToUpper(value)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	if signal := unix.SignalNum(name); signal != 0 {
+		return signal, nil
+	}
+	return 0, fmt.Errorf("unknown signal %q", value)
+}
+
+// releaseExecFifo opens and drains the start FIFO, then removes it so the
+// container cannot be started twice
+func releaseExecFifo(containerDir string, containerPID int) error {
+	fifoPath := filepath.Join(containerDir, execFifoFileName)
+
+	// Opening the read end blocks until the setup process opens the write
+	// end. If the setup process died before getting there it never will, so
+	// open in the background and keep an eye on the process meanwhile.
+	type openResult struct {
+		fifo *os.File
+		err  error
+	}
+	opened := make(chan openResult, 1)
+	go func() {
+		fifo, err := os.OpenFile(fifoPath, os.O_RDONLY, 0)
+		opened <- openResult{fifo: fifo, err: err}
+	}()
+
+	var result openResult
+	for waiting := true; waiting; {
+		select {
+		case result = <-opened:
+			waiting = false
+		case <-time.After(100 * time.Millisecond):
+			if !isProcessRunning(containerPID) {
+				return fmt.Errorf("container process exited before it could be started")
+			}
+		}
+	}
+	if result.err != nil {
+		return fmt.Errorf("failed to open start fifo: %v", result.err)
+	}
+	defer result.fifo.Close()
+
+	// A zero-length read means the setup process died before acknowledging
+	acknowledgement := make([]byte, 1)
+	if count, _ := result.fifo.Read(acknowledgement); count != 1 {
+		return fmt.Errorf("container process exited before it could be started")
+	}
+
+	if err := os.Remove(fifoPath); err != nil {
+		logf("[ns] Warning: failed to remove start fifo: %v\n", err)
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+//go:build linux
+
+package ns
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// Container limits
+//
+// The "limits" of the runtime config cap what containers may take of the
+// host, so that a runaway script can't create namespaces until the host
+// falls over:
+//
+//	"limits": {
+//	  "max_containers": 200,
+//	  "max_containers_per_user": 20,
+//	  "max_writable_size": "50g"
+//	}
+//
+// The container counts are of containers that are created, running or
+// restarting, i.e. hold namespaces and processes; exited ones don't count.
+// A container belongs to the user who ran nsctl, the one behind sudo for
+// "sudo nsctl". Containers have no image layers, so what they write to disk
+// is their container directory (with their logs) and their volumes:
+// max_writable_size caps the total of those that "nsctl system df" shows.
+// All limits apply to the containers of one state directory, so rootless
+// users, who have state directories of their own, are limited separately.
+//
+// Creating a container that would go over a limit fails before anything is
+// created. A lock in the state directory is held from the check until the
+// container's directory holds its config, so concurrent creations can't
+// both take the last slot; directories of containers whose shim hasn't
+// registered them yet count too.
+
+// limitsLockFileName is the lock taken while checking the limits, in the
+// state directory
+const limitsLockFileName = "limits.lock"
+
+// ContainerLimits are the limits of the runtime config; zero values mean no
+// limit
+type ContainerLimits struct {
+	MaxContainers        int    `json:"max_containers"`
+	MaxContainersPerUser int    `json:"max_containers_per_user"`
+	MaxWritableSize      string `json:"max_writable_size"`
+}
+
+// validate checks the limits once they have been read
+func (limits ContainerLimits) validate() error {
+	if limits.MaxContainers < 0 || limits.MaxContainersPerUser < 0 {
+		return fmt.Errorf("container limits must not be negative")
+	}
+	if _, err := ParseSize(limits.MaxWritableSize); err != nil {
+		return fmt.Errorf("invalid max_writable_size: %v", err)
+	}
+	return nil
+}
+
+// invokingUID returns the user a new container belongs to: the user behind
+// sudo when root was reached through it
+func invokingUID() int {
+	if os.Geteuid() == 0 {
+		if sudoUID, err := strconv.Atoi(os.Getenv("SUDO_UID")); err == nil {
+			return sudoUID
+		}
+	}
+	return os.Getuid()
+}
+
+// reserveContainerSlot checks that one more container of config's owner
+// stays within the limits, and returns with the limits lock held; release
+// it once the container's config is written
+func reserveContainerSlot(config ContainerConfig) (release func(), err error) {
+	runtimeConfig, err := LoadRuntimeConfig()
+	if err != nil {
+		return nil, err
+	}
+	limits := runtimeConfig.Limits
+	if limits == (ContainerLimits{}) {
+		return func() {}, nil
+	}
+	if err := ensureStateDir(); err != nil {
+		return nil, err
+	}
+
+	lockPath := filepath.Join(currentStateDir, limitsLockFileName)
+	lock, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %v", lockPath, err)
+	}
+	if err := unix.Flock(int(lock.Fd()), unix.LOCK_EX); err != nil {
+		lock.Close()
+		return nil, fmt.Errorf("failed to lock %s: %v", lockPath, err)
+	}
+	release = func() {
+		unix.Flock(int(lock.Fd()), unix.LOCK_UN)
+		lock.Close()
+	}
+
+	if err := checkContainerLimits(limits, config.OwnerUID); err != nil {
+		release()
+		return nil, err
+	}
+	return release, nil
+}
+
+// checkContainerLimits checks that a new container of owner stays within
+// the limits
+func checkContainerLimits(limits ContainerLimits, owner int) error {
+	if limits.MaxContainers > 0 || limits.MaxContainersPerUser > 0 {
+		total, owned, err := countLiveContainers(owner)
+		if err != nil {
+			return err
+		}
+		if limits.MaxContainers > 0 && total >= limits.MaxContainers {
+			return fmt.Errorf("container limit reached: %d containers are created or running, the most limits.max_containers in %s allows; stop or remove some first",
+				total, runtimeConfigPath())
+		}
+		if limits.MaxContainersPerUser > 0 && owned >= limits.MaxContainersPerUser {
+			return fmt.Errorf("per-user container limit reached: UID %d has %d containers created or running, the most limits.max_containers_per_user in %s allows; stop or remove some first",
+				owner, owned, runtimeConfigPath())
+		}
+	}
+
+	maxWritableSize, _ := ParseSize(limits.MaxWritableSize)
+	if maxWritableSize > 0 {
+		usage, err := GetDiskUsage()
+		if err != nil {
+			return err
+		}
+		var total int64
+		for _, category := range usage {
+			total += category.Size
+		}
+		if total >= maxWritableSize {
+			return fmt.Errorf("disk limit reached: containers and volumes take %s, limits.max_writable_size in %s is %s; free some with \"nsctl system prune --volumes\"",
+				FormatSize(total), runtimeConfigPath(), FormatSize(maxWritableSize))
+		}
+	}
+	return nil
+}
+
+// countLiveContainers counts the containers that are created, running or
+// restarting, all of them and those of owner, including containers whose
+// shim is still starting
+func countLiveContainers(owner int) (int, int, error) {
+	containers, err := ListContainers()
+	if err != nil {
+		return 0, 0, err
+	}
+	total, owned := 0, 0
+	registered := map[string]bool{}
+	for _, container := range containers {
+		registered[container.ID] = true
+		if container.Status == StatusExited {
+			continue
+		}
+		total++
+		if container.OwnerUID == owner {
+			owned++
+		}
+	}
+
+	// A container's config is written before its shim starts and registers
+	// it; directories without one are left over from failed creations
+	entries, err := os.ReadDir(currentStateDir)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read state directory: %v", err)
+	}
+	for _, entry := range entries {
+		containerID := entry.Name()
+		if !entry.IsDir() || !containerIDPattern.MatchString(containerID) || registered[containerID] || isLeftOver(entry) {
+			continue
+		}
+		config, err := readContainerConfig(containerID)
+		if err != nil {
+			continue
+		}
+		total++
+		if config.OwnerUID == owner {
+			owned++
+		}
+	}
+	return total, owned, nil
+}
@@ -0,0 +1,19 @@
+//go:build linux
+
+package ns
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// LogOutput is where the runtime writes its "[ns] ..." diagnostics.
+// It defaults to stderr so that stdout stays free for machine-readable
+// output (container IDs, ps -q, ...) and for the container's own output.
+var LogOutput io.Writer = os.Stderr
+
+// logf prints a diagnostic line to LogOutput
+func logf(format string, args ...interface{}) {
+	fmt.Fprintf(LogOutput, format, args...)
+}
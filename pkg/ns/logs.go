@@ -0,0 +1,456 @@
+//go:build linux
+
+package ns
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Container logs
+//
+// A container's log is a file of records the shim appends, one per line
+// of output, in the CRI log format:
+//
+//	2024-05-01T12:00:01.123456789Z stdout F a complete line
+//	2024-05-01T12:00:02.5Z stdout P the start of a line, whose
+//	2024-05-01T12:00:02.6Z stdout F  end was written later
+//
+// Each record carries the time the shim read it, its stream, and whether it
+// ends the line (F) or the rest of the line follows (P). "logs" turns the
+// records back into the output, picking them by time (--since, --until)
+// and, with --tail, from the end; it can prefix each line with its time
+// (--timestamps). Records of both streams are interleaved in the order the
+// shim read them, and go to the matching writer; --stdout or --stderr picks
+// one stream. The logs of several containers are merged by time, each line
+// starting with its container's ID. With --follow it keeps polling the log
+// for new records until the containers have exited; a shim has copied
+// everything by the time it records the exit, so one last read after that
+// gets the rest.
+//
+// Logs written before records were introduced are plain output; lines that
+// aren't records are printed as they are.
+
+// Log streams, as recorded in container logs
+const (
+	LogStreamStdout = "stdout"
+	LogStreamStderr = "stderr"
+)
+
+const (
+	// logPollInterval is how often a followed log is checked for new output
+	logPollInterval = 200 * time.Millisecond
+
+	// logChunkSize is how much of a log is read at a time when searching
+	// it backwards or by time
+	logChunkSize = 64 << 10
+)
+
+// logRecord is one record of a container log
+type logRecord struct {
+	Time    time.Time
+	Stream  string
+	Partial bool
+	Content []byte
+}
+
+// formatLogRecord encodes a log record as a line of the log
+func formatLogRecord(t time.Time, stream string, partial bool, content []byte) []byte {
+	tag := "F"
+	if partial {
+		tag = "P"
+	}
+	line := make([]byte, 0, len(content)+64)
+	line = t.UTC().AppendFormat(line, time.RFC3339Nano)
+	line = append(line, ' ')
+	line = append(line, stream...)
+	line = append(line, ' ')
+	line = append(line, tag...)
+	line = append(line, ' ')
+	line = append(line, content...)
+	return append(line, '\n')
+}
+
+// parseLogRecord decodes a line of the log, without its newline
+func parseLogRecord(line []byte) (logRecord, bool) {
+	fields := bytes.SplitN(line, []byte{' '}, 4)
+	if len(fields) != 4 {
+		return logRecord{}, false
+	}
+	recordTime, err := time.Parse(time.RFC3339Nano, string(fields[0]))
+	if err != nil {
+		return logRecord{}, false
+	}
+	stream := string(fields[1])
+	if stream != LogStreamStdout && stream != LogStreamStderr {
+		return logRecord{}, false
+	}
+	tag := string(fields[2])
+	if tag != "F" && tag != "P" {
+		return logRecord{}, false
+	}
+	return logRecord{Time: recordTime, Stream: stream, Partial: tag == "P", Content: fields[3]}, true
+}
+
+// LogOptions say which part of a container's log to print, and how
+type LogOptions struct {
+	// Tail prints only the last Tail lines; negative means the whole log
+	Tail int
+
+	// Since and Until print only output written in that time range; zero
+	// means no bound
+	Since time.Time
+	Until time.Time
+
+	// Timestamps prefixes each line with the time it was written
+	Timestamps bool
+
+	// Stream prints only the output of one stream, "stdout" or "stderr";
+	// empty means both
+	Stream string
+
+	// Follow keeps printing new output until the container exits
+	Follow bool
+}
+
+// logPrinter writes the output log records hold to the writer of their
+// stream
+type logPrinter struct {
+	stdout  io.Writer
+	stderr  io.Writer
+	options LogOptions
+
+	// prefix starts every line, naming the container when several are shown
+	prefix string
+
+	// midLine is set for a stream after a partial record, whose line isn't
+	// finished
+	midLine map[string]bool
+}
+
+// print writes one line of the log, and reports whether Until has passed
+func (p *logPrinter) print(line []byte) (bool, error) {
+	record, isRecord := parseLogRecord(line)
+	if !isRecord {
+		output := append([]byte(p.prefix), line...)
+		_, err := p.stdout.Write(append(output, '\n'))
+		return false, err
+	}
+	if !p.options.Until.IsZero() && record.Time.After(p.options.Until) {
+		return true, nil
+	}
+	if record.Time.Before(p.options.Since) || !p.wants(record.Stream) {
+		return false, nil
+	}
+
+	output := make([]byte, 0, len(p.prefix)+len(record.Content)+40)
+	if !p.midLine[record.Stream] {
+		output = append(output, p.prefix...)
+		if p.options.Timestamps {
+			output = record.Time.AppendFormat(output, time.RFC3339Nano)
+			output = append(output, ' ')
+		}
+	}
+	output = append(output, record.Content...)
+	if !record.Partial {
+		output = append(output, '\n')
+	}
+	p.midLine[record.Stream] = record.Partial
+	w := p.stdout
+	if record.Stream == LogStreamStderr {
+		w = p.stderr
+	}
+	_, err := w.Write(output)
+	return false, err
+}
+
+// wants reports whether the output of a stream is printed
+func (p *logPrinter) wants(stream string) bool {
+	return p.options.Stream == "" || p.options.Stream == stream
+}
+
+// logSource is the log of one of the containers being shown
+type logSource struct {
+	container *ContainerInfo
+	file      *os.File
+	reader    *bufio.Reader
+	printer   *logPrinter
+
+	// partial is the start of a line the shim hasn't finished writing
+	partial []byte
+
+	// line is the next complete line, read but not printed yet, and
+	// lineTime the time of its record
+	line     []byte
+	lineTime time.Time
+	ready    bool
+
+	// exited is set once the container has exited, so the log is complete
+	exited bool
+
+	// done is set once the log has passed Until
+	done bool
+}
+
+// openLogSource opens a container's log at the first line to print
+func openLogSource(container *ContainerInfo, options LogOptions) (*logSource, error) {
+	// Adopted containers write wherever their runtime sent their output
+	if container.Adopted != nil {
+		return nil, fmt.Errorf("container %s was adopted from %s, which kept no log nsctl can read", ShortID(container.ID), container.Adopted.Runtime)
+	}
+	// Interactive containers wrote straight to the terminal, nothing was kept
+	if container.LogPath == "" {
+		return nil, fmt.Errorf("container %s ran interactively, on the terminal, and has no log", ShortID(container.ID))
+	}
+
+	logFile, err := os.Open(container.LogPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open log of %s: %v", ShortID(container.ID), err)
+	}
+
+	// Start at whichever is later: the first record since Since, or the
+	// first of the last Tail lines
+	var offset int64
+	if !options.Since.IsZero() {
+		offset, err = sinceOffset(logFile, options.Since)
+	}
+	if err == nil && options.Tail >= 0 {
+		var tail int64
+		tail, err = tailOffset(logFile, options.Tail, options.Stream)
+		offset = max(offset, tail)
+	}
+	if err == nil {
+		_, err = logFile.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		logFile.Close()
+		return nil, fmt.Errorf("failed to read log of %s: %v", ShortID(container.ID), err)
+	}
+
+	return &logSource{container: container, file: logFile, reader: bufio.NewReader(logFile)}, nil
+}
+
+// readLine reads the next complete line of the log, if it has one yet
+func (s *logSource) readLine() error {
+	if s.ready || s.done {
+		return nil
+	}
+	line, err := s.reader.ReadBytes('\n')
+	s.partial = append(s.partial, line...)
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read log of %s: %v", ShortID(s.container.ID), err)
+	}
+
+	s.line = bytes.Clone(bytes.TrimSuffix(s.partial, []byte{'\n'}))
+	s.partial = s.partial[:0]
+	// Lines that aren't records have no time and come first
+	record, _ := parseLogRecord(s.line)
+	s.lineTime = record.Time
+	s.ready = true
+	return nil
+}
+
+// WriteContainerLog writes a container's output, as recorded in its log, to
+// stdout and stderr; they may be the same writer
+func WriteContainerLog(container *ContainerInfo, options LogOptions, stdout io.Writer, stderr io.Writer) error {
+	return WriteContainerLogs([]*ContainerInfo{container}, options, stdout, stderr)
+}
+
+// WriteContainerLogs writes the output of several containers, merging their
+// logs in time order; with more than one, each line starts with the ID of
+// its container
+func WriteContainerLogs(containers []*ContainerInfo, options LogOptions, stdout io.Writer, stderr io.Writer) error {
+	var sources []*logSource
+	defer func() {
+		for _, source := range sources {
+			source.file.Close()
+		}
+	}()
+	for _, container := range containers {
+		source, err := openLogSource(container, options)
+		if err != nil {
+			return err
+		}
+		source.printer = &logPrinter{stdout: stdout, stderr: stderr, options: options, midLine: map[string]bool{}}
+		if len(containers) > 1 {
+			source.printer.prefix = ShortID(container.ID) + " | "
+		}
+		sources = append(sources, source)
+	}
+
+	for {
+		// Print the earliest of the next lines of the logs
+		var next *logSource
+		for _, source := range sources {
+			if err := source.readLine(); err != nil {
+				return err
+			}
+			if source.ready && (next == nil || source.lineTime.Before(next.lineTime)) {
+				next = source
+			}
+		}
+		if next != nil {
+			next.ready = false
+			done, err := next.printer.print(next.line)
+			if err != nil {
+				return err
+			}
+			next.done = done
+			continue
+		}
+
+		// At the end of every log. Without --follow, or once the containers
+		// have exited and their shims have written the last records, we're
+		// done.
+		if !options.Follow || allLogsComplete(sources) {
+			for _, source := range sources {
+				if len(source.partial) > 0 && !source.done {
+					if _, err := source.printer.print(source.partial); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		}
+		if !options.Until.IsZero() && time.Now().After(options.Until) {
+			return nil
+		}
+		exited := false
+		for _, source := range sources {
+			if source.exited || source.done {
+				continue
+			}
+			current, err := LookupContainer(source.container.ID)
+			if err != nil || current.Status == StatusExited {
+				source.exited = true
+				exited = true
+			}
+		}
+		// A container that just exited may have had its last output logged
+		// since the read, so read once more before waiting
+		if !exited {
+			time.Sleep(logPollInterval)
+		}
+	}
+}
+
+// allLogsComplete reports whether no more output will be shown from any of
+// the logs
+func allLogsComplete(sources []*logSource) bool {
+	for _, source := range sources {
+		if !source.exited && !source.done {
+			return false
+		}
+	}
+	return true
+}
+
+// tailOffset returns where the last lines of a log start, reading it
+// backwards in chunks; a line ends with a complete (F) record, or with a
+// newline in logs that aren't made of records. With a stream, only the
+// lines of that stream count.
+func tailOffset(file *os.File, lines int, stream string) (int64, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	end := info.Size()
+
+	// carry is the start of the earliest line seen so far, whose beginning
+	// is in the part of the file not read yet
+	var carry []byte
+	chunk := make([]byte, logChunkSize)
+	position := end
+	count := 0
+	last := true
+	for position > 0 {
+		readSize := min(int64(logChunkSize), position)
+		position -= readSize
+		if _, err := file.ReadAt(chunk[:readSize], position); err != nil {
+			return 0, err
+		}
+		data := append(chunk[:readSize:readSize], carry...)
+
+		for {
+			index := bytes.LastIndexByte(data, '\n')
+			if index < 0 {
+				break
+			}
+			// The newline at index ends a line; if that line finishes a
+			// line of output and enough lines follow it, the tail starts
+			// right after it
+			lineStart := bytes.LastIndexByte(data[:index], '\n') + 1
+			if lineStart == 0 && position > 0 {
+				// The line starts in an earlier chunk
+				break
+			}
+			record, isRecord := parseLogRecord(data[lineStart:index])
+			if !isRecord || stream == "" || record.Stream == stream {
+				// A partial record at the very end is the unfinished last line
+				if last || !isRecord || !record.Partial {
+					count++
+					if count > lines {
+						return position + int64(index) + 1, nil
+					}
+				}
+				last = false
+			}
+			data = data[:index]
+		}
+		carry = bytes.Clone(data)
+	}
+	return 0, nil
+}
+
+// sinceOffset returns an offset in a log before which all records are older
+// than since, searching it by time; records are appended in time order
+func sinceOffset(file *os.File, since time.Time) (int64, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	low, high := int64(0), info.Size()
+	for high-low > logChunkSize {
+		middle := low + (high-low)/2
+		record, recordEnd, found, err := recordAfter(file, middle)
+		if err != nil {
+			return 0, err
+		}
+		if found && recordEnd <= high && record.Time.Before(since) {
+			low = recordEnd
+		} else {
+			high = middle
+		}
+	}
+	return low, nil
+}
+
+// recordAfter reads the first record that starts after offset, and returns
+// it with the offset it ends at
+func recordAfter(file *os.File, offset int64) (logRecord, int64, bool, error) {
+	chunk := make([]byte, logChunkSize)
+	count, err := file.ReadAt(chunk, offset)
+	if err != nil && err != io.EOF {
+		return logRecord{}, 0, false, err
+	}
+	data := chunk[:count]
+
+	start := bytes.IndexByte(data, '\n') + 1
+	if start == 0 {
+		return logRecord{}, 0, false, nil
+	}
+	length := bytes.IndexByte(data[start:], '\n')
+	if length < 0 {
+		return logRecord{}, 0, false, nil
+	}
+	record, isRecord := parseLogRecord(data[start : start+length])
+	return record, offset + int64(start+length+1), isRecord, nil
+}
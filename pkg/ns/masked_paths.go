@@ -0,0 +1,139 @@
+//go:build linux
+
+package ns
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"golang.org/x/sys/unix"
+)
+
+// Masked and read-only paths (--security-opt mask=..., unmask=...)
+//
+// The container's /proc and /sys are its own, but parts of them still
+// describe or control the whole host: /proc/kcore is the host's memory,
+// /proc/sysrq-trigger reboots it and /proc/sys holds the kernel's
+// settings. Once /proc and /sys are mounted, setup therefore hides the
+// masked paths, a directory behind an empty read-only tmpfs and a file
+// behind /dev/null, and binds the read-only paths read-only onto
+// themselves. The defaults are those of other OCI runtimes, plus the /sys
+// subtrees sysfs.go describes; a privileged container gets none.
+//
+// --security-opt mask=/path:/path masks more paths, and unmask=/path:/path
+// takes paths off both lists, e.g. /proc/sys for a workload that tunes
+// its network namespace's sysctls; unmask=ALL takes off all of them.
+// Paths missing from the container are skipped.
+//
+// A rootful container can't undo any of this without CAP_SYS_ADMIN. In a
+// rootless container the masks are a convenience rather than a barrier:
+// its root could unmount them, but the kernel gives it no more access to
+// what they hide than any other unprivileged user of the host.
+
+// defaultMaskedPaths are hidden from a container
+var defaultMaskedPaths = append([]string{
+	"/proc/acpi",
+	"/proc/asound",
+	"/proc/kcore",
+	"/proc/keys",
+	"/proc/latency_stats",
+	"/proc/timer_list",
+	"/proc/timer_stats",
+	"/proc/sched_debug",
+	"/proc/scsi",
+}, maskedSysPaths...)
+
+// defaultReadonlyPaths are read-only in a container
+var defaultReadonlyPaths = []string{
+	"/proc/bus",
+	"/proc/fs",
+	"/proc/irq",
+	"/proc/sys",
+	"/proc/sysrq-trigger",
+}
+
+// prepareMaskedPaths fills in a container's masked and read-only paths
+// from the defaults and its mask and unmask security options
+func prepareMaskedPaths(config *ContainerConfig, masks []string, unmasks []string) error {
+	config.MaskedPaths, config.ReadonlyPaths = nil, nil
+	if !config.Privileged {
+		config.MaskedPaths = slices.Clone(defaultMaskedPaths)
+		config.ReadonlyPaths = slices.Clone(defaultReadonlyPaths)
+	}
+
+	for _, path := range unmasks {
+		if path == "ALL" {
+			config.MaskedPaths, config.ReadonlyPaths = nil, nil
+			continue
+		}
+		path = filepath.Clean(path)
+		masked := slices.Contains(config.MaskedPaths, path)
+		readonly := slices.Contains(config.ReadonlyPaths, path)
+		if !masked && !readonly {
+			return fmt.Errorf("invalid --security-opt unmask: %s isn't masked or read-only (see nsctl run --dry-run)", path)
+		}
+		config.MaskedPaths = slices.DeleteFunc(config.MaskedPaths, func(masked string) bool { return masked == path })
+		config.ReadonlyPaths = slices.DeleteFunc(config.ReadonlyPaths, func(readonly string) bool { return readonly == path })
+	}
+
+	for _, path := range masks {
+		if !filepath.IsAbs(path) {
+			return fmt.Errorf("invalid --security-opt mask: %s is not an absolute path", path)
+		}
+		path = filepath.Clean(path)
+		if !slices.Contains(config.MaskedPaths, path) {
+			config.MaskedPaths = append(config.MaskedPaths, path)
+		}
+	}
+	return nil
+}
+
+// applyMaskedPaths masks and write-protects the container's masked and
+// read-only paths, in the root filesystem at config.Rootfs
+func applyMaskedPaths(config ContainerConfig) error {
+	for _, path := range config.ReadonlyPaths {
+		if err := readonlyPath(filepath.Join(config.Rootfs, path)); err != nil {
+			return err
+		}
+	}
+	for _, path := range config.MaskedPaths {
+		if err := maskPath(filepath.Join(config.Rootfs, path)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// maskPath hides a path from the container: a directory gets an empty
+// read-only tmpfs mounted over it, a file /dev/null; missing paths are
+// skipped
+func maskPath(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil
+	}
+
+	if info.IsDir() {
+		err = mountTraced("tmpfs", path, "tmpfs", unix.MS_RDONLY|unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, "size=0")
+	} else {
+		err = mountTraced("/dev/null", path, "", unix.MS_BIND, "")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to mask %s: %v", path, err)
+	}
+	return nil
+}
+
+// readonlyPath binds a path read-only onto itself; missing paths are
+// skipped
+func readonlyPath(path string) error {
+	if _, err := os.Stat(path); err != nil {
+		return nil
+	}
+	if err := mountTraced(path, path, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+		return fmt.Errorf("failed to bind %s read-only: %v", path, err)
+	}
+	return restrictMount(path, unix.MOUNT_ATTR_RDONLY|unix.MOUNT_ATTR_NOSUID|unix.MOUNT_ATTR_NODEV|unix.MOUNT_ATTR_NOEXEC, true)
+}
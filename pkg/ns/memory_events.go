@@ -0,0 +1,183 @@
+//go:build linux
+
+package ns
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"nsctl/pkg/cgroup"
+)
+
+// Memory event actions (--on-memory-event)
+//
+// The shim watches the container's memory event counters (see
+// cgroup/memory_events.go) and reacts to each increase of one as the
+// container's --on-memory-event actions say:
+//
+//	oom_kill=event                emit a "memory" event
+//	max=hook:/usr/local/bin/page  run a program, given the container's OCI
+//	                              state on stdin like a hook
+//	oom=restart                   kill the workload, which the restart
+//	                              policy then starts again
+//
+// The events are high, max, oom and oom_kill, counted for the container's
+// cgroup and the groups it creates below; "local:" in front counts the
+// container's own group only. A restart counts against on-failure's maximum
+// and happens even with --restart no; "nsctl stop" still prevents it.
+
+// Memory event action kinds
+const (
+	MemoryActionEvent   = "event"
+	MemoryActionHook    = "hook"
+	MemoryActionRestart = "restart"
+
+	// FinishReasonMemoryEvent marks workloads a restart action killed
+	FinishReasonMemoryEvent = "memory event"
+)
+
+// memoryEventNames are the events actions can be given for
+var memoryEventNames = []string{cgroup.MemoryEventHigh, cgroup.MemoryEventMax, cgroup.MemoryEventOOM, cgroup.MemoryEventOOMKill}
+
+// MemoryEventAction is the reaction to one memory event
+type MemoryEventAction struct {
+	// Event is high, max, oom or oom_kill
+	Event string `json:"event"`
+
+	// Local counts only the events of the container's own cgroup
+	Local bool `json:"local,omitempty"`
+
+	// Action is one of the MemoryAction* kinds; HookPath is the program a
+	// hook action runs
+	Action   string `json:"action"`
+	HookPath string `json:"hook_path,omitempty"`
+}
+
+// ParseMemoryEventAction parses an --on-memory-event value,
+// [local:]<event>=event|restart|hook:<path>
+func ParseMemoryEventAction(value string) (MemoryEventAction, error) {
+	var action MemoryEventAction
+	event, kind, found := strings.Cut(value, "=")
+	if !found {
+		return action, fmt.Errorf("invalid memory event action %q: expected [local:]<event>=event|restart|hook:<path>", value)
+	}
+	event, action.Local = strings.CutPrefix(event, "local:")
+	if !slices.Contains(memoryEventNames, event) {
+		return action, fmt.Errorf("invalid memory event action %q: the event must be one of %s", value, strings.Join(memoryEventNames, ", "))
+	}
+	action.Event = event
+
+	switch path, isHook := strings.CutPrefix(kind, MemoryActionHook+":"); {
+	case isHook:
+		if !filepath.IsAbs(path) {
+			return action, fmt.Errorf("invalid memory event action %q: the hook must be an absolute path", value)
+		}
+		action.Action, action.HookPath = MemoryActionHook, path
+	case kind == MemoryActionEvent || kind == MemoryActionRestart:
+		action.Action = kind
+	default:
+		return action, fmt.Errorf("invalid memory event action %q: expected event, restart or hook:<path>, not %q", value, kind)
+	}
+	return action, nil
+}
+
+// String formats the action as --on-memory-event takes it
+func (a MemoryEventAction) String() string {
+	event := a.Event
+	if a.Local {
+		event = "local:" + event
+	}
+	if a.Action == MemoryActionHook {
+		return event + "=" + MemoryActionHook + ":" + a.HookPath
+	}
+	return event + "=" + a.Action
+}
+
+// watchMemoryEvents starts a watcher of the container's memory events for
+// each kind of counter its actions are given for, and returns their stop
+// functions
+func watchMemoryEvents(config ContainerConfig, process *os.Process, containerCgroup *cgroup.Cgroup, watch *cgroupWatch) []func() {
+	if len(config.MemoryEventActions) == 0 || containerCgroup == nil {
+		return nil
+	}
+
+	var stops []func()
+	for _, local := range []bool{false, true} {
+		var actions []MemoryEventAction
+		for _, action := range config.MemoryEventActions {
+			if action.Local != local {
+				continue
+			}
+			if !containerCgroup.HasMemoryEvent(action.Event, action.Local) {
+				logf("[shim] Warning: memory event action %s disabled: cgroup v1 doesn't count the event\n", action)
+				continue
+			}
+			actions = append(actions, action)
+		}
+		if len(actions) == 0 {
+			continue
+		}
+
+		watcher, err := containerCgroup.WatchMemoryEvents(local)
+		if err != nil {
+			logf("[shim] Warning: memory event actions disabled: %v\n", err)
+			continue
+		}
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for counters := range watcher.Events {
+				for _, action := range actions {
+					if count, increased := counters[action.Event]; increased {
+						runMemoryEventAction(config, process, action, count, watch)
+					}
+				}
+			}
+		}()
+		stops = append(stops, func() {
+			watcher.Close()
+			<-done
+		})
+	}
+	return stops
+}
+
+// runMemoryEventAction reacts to an event whose counter reached count
+func runMemoryEventAction(config ContainerConfig, process *os.Process, action MemoryEventAction, count uint64, watch *cgroupWatch) {
+	logf("[shim] Memory event %s in container %s (%d so far), running action %s\n", action.Event, ShortID(config.ID), count, action.Action)
+	switch action.Action {
+	case MemoryActionEvent:
+		attributes := map[string]string{"event": action.Event, "count": strconv.FormatUint(count, 10)}
+		if action.Local {
+			attributes["local"] = "true"
+		}
+		emitEvent(EventMemory, config.ID, attributes)
+
+	case MemoryActionHook:
+		state, err := marshalHookState(config, StatusRunning, process.Pid)
+		if err == nil {
+			err = runHook(Hook{
+				Path: action.HookPath,
+				Args: []string{action.HookPath, action.Event},
+				Env: append(os.Environ(),
+					"NSCTL_MEMORY_EVENT="+action.Event,
+					"NSCTL_MEMORY_EVENT_COUNT="+strconv.FormatUint(count, 10)),
+			}, state)
+		}
+		if err != nil {
+			logf("[shim] Warning: memory event hook %s failed: %v\n", action.HookPath, err)
+		}
+
+	case MemoryActionRestart:
+		// The restart loop takes over once the workload has exited
+		watch.requestRestart(func() {
+			logf("[shim] Killing container %s to restart it\n", ShortID(config.ID))
+			process.Signal(syscall.SIGKILL)
+		})
+	}
+}
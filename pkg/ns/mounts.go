@@ -0,0 +1,734 @@
+//go:build linux
+
+package ns
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Bind and tmpfs mounts (-v /host/path:/container/path[:options], --mount)
+//
+// Each bind is a recursive one, cloned from the host's mount tree with
+// open_tree(2) before setup makes the container's mounts private, and
+// attached at its target later on. Cloning first is what lets a bind keep
+// its connection to the host: the clone of a shared host mount joins the
+// host mount's peer group, while the rest of the container's mount tree is
+// cut off from the host, so container mounts never leak back to the host.
+//
+// What a bind then shares with the host is its propagation:
+//
+//	rprivate  nothing (the default)
+//	rslave    mounts made on the host below the source show up in the
+//	          container, but not the other way round
+//	rshared   mounts propagate both ways (rootful containers only: a
+//	          rootless container's copy of the host mounts is never shared
+//	          with the host)
+//
+// private, slave and shared do the same for the bind itself, leaving its
+// submounts as they are on the host. Anything but private requires the
+// source to be on a shared mount on the host, as it is by default with
+// systemd.
+//
+// --mount takes the comma-separated key=value form other runtimes use,
+// which can also describe tmpfs mounts and paths containing colons:
+//
+//	--mount type=bind,src=/a,dst=/b,ro,bind-propagation=rslave
+//	--mount type=tmpfs,dst=/scratch,tmpfs-size=1g,tmpfs-mode=1770
+//	--mount type=volume,src=cache,dst=/var/cache/app (see volumes.go)
+//
+// --tmpfs is the short form of a tmpfs, for scratch directories like /tmp
+// and /run, e.g. --tmpfs /run:size=64m,mode=755,noexec.
+//
+// Both forms take ro, noexec, nosuid and nodev, so a host data directory can
+// be shared without letting the container run programs or gain privileges
+// from it. They apply to the bind's submounts too.
+//
+// A bind's source must exist: a typo shouldn't quietly leave the container
+// with an empty directory. --mount takes create=true to make a missing
+// source directory instead. The destination must exist too, unless the
+// container has a --rootfs, in which setup creates it (see rootfs.go); on
+// the host's / it would be created on the host. Mounts over /, /proc, /sys
+// and /dev, or below /proc and /sys, are refused unless the container is
+// --privileged; they would hide the container's view of the system or
+// undo the masking and read-only protection of the kernel interfaces.
+
+// Mount types
+const (
+	MountTypeBind   = "bind"
+	MountTypeTmpfs  = "tmpfs"
+	MountTypeVolume = "volume"
+)
+
+// Mount is a host path or managed volume bind-mounted into the
+// container, or a tmpfs
+type Mount struct {
+	// Type is MountTypeBind, MountTypeVolume or MountTypeTmpfs; empty means
+	// a bind
+	Type        string `json:"type,omitempty"`
+	Source      string `json:"source,omitempty"`
+	Destination string `json:"destination"`
+
+	// VolumeName is the volume a MountTypeVolume mount refers to; Source
+	// is then its data directory (both filled in by RunWithConfig) and,
+	// until then, the volume's name or empty for an anonymous volume
+	VolumeName string `json:"volume_name,omitempty"`
+
+	// ReadOnly, NoExec, NoSuid and NoDev make the mount (a bind,
+	// recursively) read-only, forbid executing files on it, ignore setuid
+	// and setgid bits and file capabilities on it, and block device files
+	// on it
+	ReadOnly bool `json:"read_only,omitempty"`
+	NoExec   bool `json:"noexec,omitempty"`
+	NoSuid   bool `json:"nosuid,omitempty"`
+	NoDev    bool `json:"nodev,omitempty"`
+
+	// Propagation is one of mountPropagations; empty means rprivate
+	Propagation string `json:"propagation,omitempty"`
+
+	// TmpfsSize limits a tmpfs, in bytes; zero means the kernel's default
+	// of half the RAM
+	TmpfsSize int64 `json:"tmpfs_size,omitempty"`
+
+	// TmpfsMode is the permissions of a tmpfs's root; zero means 1777
+	TmpfsMode os.FileMode `json:"tmpfs_mode,omitempty"`
+
+	// Relabel is RelabelShared or RelabelPrivate to relabel the source for
+	// SELinux (the z and Z options, see selinux.go); empty leaves it alone
+	Relabel string `json:"relabel,omitempty"`
+
+	// CreateSource makes a bind's missing source directory instead of
+	// refusing it (--mount create=true)
+	CreateSource bool `json:"create_source,omitempty"`
+}
+
+// isBind reports whether the mount is a bind mount, which volumes are too
+func (m Mount) isBind() bool {
+	return m.Type == "" || m.Type == MountTypeBind || m.Type == MountTypeVolume
+}
+
+// attributes returns the mount's restrictions as MOUNT_ATTR_* attributes
+func (m Mount) attributes() uint64 {
+	var attributes uint64
+	if m.ReadOnly {
+		attributes |= unix.MOUNT_ATTR_RDONLY
+	}
+	if m.NoExec {
+		attributes |= unix.MOUNT_ATTR_NOEXEC
+	}
+	if m.NoSuid {
+		attributes |= unix.MOUNT_ATTR_NOSUID
+	}
+	if m.NoDev {
+		attributes |= unix.MOUNT_ATTR_NODEV
+	}
+	return attributes
+}
+
+// options returns the mount's restrictions as mount(8) options
+func (m Mount) options() []string {
+	var options []string
+	for _, option := range []struct {
+		set  bool
+		name string
+	}{{m.ReadOnly, "ro"}, {m.NoExec, "noexec"}, {m.NoSuid, "nosuid"}, {m.NoDev, "nodev"}} {
+		if option.set {
+			options = append(options, option.name)
+		}
+	}
+	return options
+}
+
+// setFlagOption sets the restriction an option like "ro" or "noexec"
+// names, reporting whether it is one
+func (m *Mount) setFlagOption(name string, value bool) bool {
+	switch name {
+	case "ro", "readonly":
+		m.ReadOnly = value
+	case "rw":
+		m.ReadOnly = !value
+	case "noexec":
+		m.NoExec = value
+	case "nosuid":
+		m.NoSuid = value
+	case "nodev":
+		m.NoDev = value
+	default:
+		return false
+	}
+	return true
+}
+
+// hasBindMounts reports whether any of mounts is a bind mount
+func hasBindMounts(mounts []Mount) bool {
+	for _, mount := range mounts {
+		if mount.isBind() {
+			return true
+		}
+	}
+	return false
+}
+
+// mountPropagations maps the propagation options to their mount flags
+var mountPropagations = map[string]uintptr{
+	"private":  unix.MS_PRIVATE,
+	"rprivate": unix.MS_PRIVATE | unix.MS_REC,
+	"slave":    unix.MS_SLAVE,
+	"rslave":   unix.MS_SLAVE | unix.MS_REC,
+	"shared":   unix.MS_SHARED,
+	"rshared":  unix.MS_SHARED | unix.MS_REC,
+}
+
+// defaultPropagation is the propagation of binds that don't name one
+const defaultPropagation = "rprivate"
+
+// ParseVolume parses a -v value, /host/path:/container/path[:options],
+// where options is a comma-separated list of ro|rw, noexec, nosuid, nodev,
+// z|Z and a propagation. Instead of a host path, the source can name a managed
+// volume; a lone /container/path gets an anonymous volume.
+func ParseVolume(spec string) (Mount, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) == 1 && filepath.IsAbs(spec) {
+		return Mount{Type: MountTypeVolume, Destination: spec}, nil
+	}
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return Mount{}, fmt.Errorf("invalid volume %q: expected /host/path:/container/path[:options]", spec)
+	}
+
+	mount := Mount{Source: parts[0], Destination: parts[1]}
+	if isVolumeName(mount.Source) {
+		mount.Type = MountTypeVolume
+	}
+	if len(parts) == 3 {
+		for _, option := range strings.Split(parts[2], ",") {
+			if mount.setFlagOption(option, true) {
+				continue
+			}
+			if option == "z" || option == "Z" {
+				if mount.Relabel != "" {
+					return Mount{}, fmt.Errorf("invalid volume %q: more than one of z and Z", spec)
+				}
+				mount.Relabel = map[string]string{"z": RelabelShared, "Z": RelabelPrivate}[option]
+				continue
+			}
+			if _, found := mountPropagations[option]; !found {
+				return Mount{}, fmt.Errorf("invalid volume %q: unknown option %q", spec, option)
+			}
+			if mount.Propagation != "" {
+				return Mount{}, fmt.Errorf("invalid volume %q: more than one propagation", spec)
+			}
+			mount.Propagation = option
+		}
+	}
+	return mount, nil
+}
+
+// ParseMount parses a --mount value, e.g. type=bind,src=/a,dst=/b,ro
+// Fields are CSV, so a value containing a comma can be quoted.
+func ParseMount(spec string) (Mount, error) {
+	fields, err := csv.NewReader(strings.NewReader(spec)).Read()
+	if err != nil {
+		return Mount{}, fmt.Errorf("invalid mount %q: %v", spec, err)
+	}
+
+	mount := Mount{Type: MountTypeBind}
+	var tmpfsOption, bindOption string
+	for _, field := range fields {
+		key, value, hasValue := strings.Cut(field, "=")
+		switch key {
+		case "type":
+			if value != MountTypeBind && value != MountTypeTmpfs && value != MountTypeVolume {
+				return Mount{}, fmt.Errorf("invalid mount %q: unsupported type %q (expected bind, volume or tmpfs)", spec, value)
+			}
+			mount.Type = value
+		case "src", "source":
+			mount.Source = value
+		case "dst", "destination", "target":
+			mount.Destination = value
+		case "ro", "readonly", "noexec", "nosuid", "nodev":
+			enabled, err := parseMountBool(key, value, hasValue)
+			if err != nil {
+				return Mount{}, fmt.Errorf("invalid mount %q: %v", spec, err)
+			}
+			mount.setFlagOption(key, enabled)
+		case "relabel":
+			if value != RelabelShared && value != RelabelPrivate {
+				return Mount{}, fmt.Errorf("invalid mount %q: relabel must be shared or private", spec)
+			}
+			mount.Relabel = value
+			bindOption = key
+		case "create":
+			if mount.CreateSource, err = parseMountBool(key, value, hasValue); err != nil {
+				return Mount{}, fmt.Errorf("invalid mount %q: %v", spec, err)
+			}
+			bindOption = key
+		case "bind-propagation":
+			if _, found := mountPropagations[value]; !found {
+				return Mount{}, fmt.Errorf("invalid mount %q: unknown propagation %q", spec, value)
+			}
+			mount.Propagation = value
+			bindOption = key
+		case "tmpfs-size":
+			if mount.TmpfsSize, err = ParseSize(value); err != nil {
+				return Mount{}, fmt.Errorf("invalid mount %q: %v", spec, err)
+			}
+			tmpfsOption = key
+		case "tmpfs-mode":
+			mode, err := strconv.ParseUint(value, 8, 32)
+			if err != nil || mode > 07777 {
+				return Mount{}, fmt.Errorf("invalid mount %q: tmpfs-mode must be octal permissions, e.g. 1777", spec)
+			}
+			mount.TmpfsMode = os.FileMode(mode)
+			tmpfsOption = key
+		default:
+			return Mount{}, fmt.Errorf("invalid mount %q: unknown option %q", spec, key)
+		}
+	}
+
+	if mount.Destination == "" {
+		return Mount{}, fmt.Errorf("invalid mount %q: missing dst", spec)
+	}
+	if mount.Type == MountTypeTmpfs && (mount.Source != "" || bindOption != "") {
+		return Mount{}, fmt.Errorf("invalid mount %q: a tmpfs has no src, bind-propagation, relabel or create", spec)
+	}
+	if mount.Type == MountTypeVolume && mount.CreateSource {
+		return Mount{}, fmt.Errorf("invalid mount %q: create only applies to type=bind; volumes are always created", spec)
+	}
+	if mount.Type == MountTypeBind && mount.Source == "" {
+		return Mount{}, fmt.Errorf("invalid mount %q: missing src", spec)
+	}
+	if mount.Type == MountTypeVolume && mount.Source != "" && !isVolumeName(mount.Source) {
+		return Mount{}, fmt.Errorf("invalid mount %q: invalid volume name %q", spec, mount.Source)
+	}
+	if mount.Type != MountTypeTmpfs && tmpfsOption != "" {
+		return Mount{}, fmt.Errorf("invalid mount %q: %s only applies to type=tmpfs", spec, tmpfsOption)
+	}
+	return mount, nil
+}
+
+// ParseTmpfs parses a --tmpfs value, /container/path[:options], where
+// options is a comma-separated list of size=<size>, mode=<octal>, ro|rw,
+// noexec, nosuid and nodev
+func ParseTmpfs(spec string) (Mount, error) {
+	destination, options, _ := strings.Cut(spec, ":")
+	if destination == "" {
+		return Mount{}, fmt.Errorf("invalid tmpfs %q: expected /container/path[:options]", spec)
+	}
+
+	mount := Mount{Type: MountTypeTmpfs, Destination: destination}
+	if options == "" {
+		return mount, nil
+	}
+	for _, option := range strings.Split(options, ",") {
+		if mount.setFlagOption(option, true) {
+			continue
+		}
+		key, value, _ := strings.Cut(option, "=")
+		switch key {
+		case "size":
+			size, err := ParseSize(value)
+			if err != nil || size <= 0 {
+				return Mount{}, fmt.Errorf("invalid tmpfs %q: size must be a size, e.g. 64m", spec)
+			}
+			mount.TmpfsSize = size
+		case "mode":
+			mode, err := strconv.ParseUint(value, 8, 32)
+			if err != nil || mode > 07777 {
+				return Mount{}, fmt.Errorf("invalid tmpfs %q: mode must be octal permissions, e.g. 1777", spec)
+			}
+			mount.TmpfsMode = os.FileMode(mode)
+		default:
+			return Mount{}, fmt.Errorf("invalid tmpfs %q: unknown option %q", spec, option)
+		}
+	}
+	return mount, nil
+}
+
+// parseMountBool parses the value of a --mount flag like ro or create,
+// which may be given without one
+func parseMountBool(key string, value string, hasValue bool) (bool, error) {
+	switch {
+	case !hasValue, value == "true", value == "1":
+		return true, nil
+	case value == "false", value == "0":
+		return false, nil
+	}
+	return false, fmt.Errorf("%s must be true or false", key)
+}
+
+// protectedMountTargets are the paths mounts may not cover, and
+// protectedMountTrees those nothing may be mounted below either, unless
+// the container is privileged
+var (
+	protectedMountTargets = []string{"/", "/dev"}
+	protectedMountTrees   = []string{"/proc", "/sys"}
+)
+
+// checkMountDestination refuses mounts over the container's view of the
+// kernel and its devices
+func checkMountDestination(destination string, privileged bool) error {
+	if privileged {
+		return nil
+	}
+	protected := slices.Contains(protectedMountTargets, destination)
+	for _, tree := range protectedMountTrees {
+		if destination == tree || strings.HasPrefix(destination, tree+"/") {
+			protected = true
+		}
+	}
+	if protected {
+		return fmt.Errorf("refusing to mount over %s, which would expose or hide the kernel's interfaces to the container (use --privileged if you mean it)", destination)
+	}
+	return nil
+}
+
+// prepareMounts checks the container's binds before anything is created,
+// and makes their sources absolute, as the setup process resolves them in
+// another working directory. Volumes are only created later, by
+// prepareVolumes.
+func prepareMounts(config *ContainerConfig) error {
+	for i := range config.Mounts {
+		mount := &config.Mounts[i]
+
+		if !filepath.IsAbs(mount.Destination) {
+			return fmt.Errorf("mount destination %s is not an absolute path", mount.Destination)
+		}
+		mount.Destination = filepath.Clean(mount.Destination)
+		if err := checkMountDestination(mount.Destination, config.Privileged); err != nil {
+			return err
+		}
+		if mount.Type == MountTypeVolume {
+			if mount.Propagation != "" && mount.Propagation != defaultPropagation {
+				return fmt.Errorf("%s propagation for %s only applies to host paths, not volumes", mount.Propagation, mount.Destination)
+			}
+			mount.Propagation = defaultPropagation
+			continue
+		}
+		if !mount.isBind() {
+			continue
+		}
+
+		source, err := filepath.Abs(mount.Source)
+		if err != nil {
+			return fmt.Errorf("invalid mount source %s: %v", mount.Source, err)
+		}
+		mount.Source = source
+
+		if _, err := os.Stat(source); os.IsNotExist(err) {
+			if !mount.CreateSource {
+				return fmt.Errorf("bind source %s doesn't exist (create it, or use --mount type=bind,src=%s,dst=%s,create=true)", source, source, mount.Destination)
+			}
+		} else if err != nil {
+			return fmt.Errorf("invalid mount source %s: %v", source, err)
+		}
+
+		if mount.Propagation == "" {
+			mount.Propagation = defaultPropagation
+		}
+		if _, found := mountPropagations[mount.Propagation]; !found {
+			return fmt.Errorf("unknown propagation %q for %s", mount.Propagation, mount.Destination)
+		}
+		if strings.HasSuffix(mount.Propagation, "private") {
+			continue
+		}
+
+		if strings.HasSuffix(mount.Propagation, "shared") && config.Rootless {
+			return fmt.Errorf("%s propagation for %s needs a rootful container: a rootless container's mounts are never shared with the host", mount.Propagation, mount.Destination)
+		}
+		shared, mountPoint, err := isOnSharedMount(source)
+		if err != nil {
+			return err
+		}
+		if !shared {
+			return fmt.Errorf("%s propagation for %s needs %s to be a shared mount (mount --make-rshared %s)", mount.Propagation, mount.Destination, mountPoint, mountPoint)
+		}
+	}
+	return nil
+}
+
+// createBindSources makes the missing source directories of binds with
+// create=true
+func createBindSources(mounts []Mount) error {
+	for _, mount := range mounts {
+		if !mount.CreateSource {
+			continue
+		}
+		if _, err := os.Stat(mount.Source); !os.IsNotExist(err) {
+			continue
+		}
+		if err := os.MkdirAll(mount.Source, 0755); err != nil {
+			return fmt.Errorf("failed to create bind source %s: %v", mount.Source, err)
+		}
+		logf("[ns] Created bind source %s\n", mount.Source)
+	}
+	return nil
+}
+
+// isOnSharedMount reports whether the mount path is on is shared, and
+// which mount that is
+// A source that is yet to be created is on its closest existing parent's.
+func isOnSharedMount(path string) (bool, string, error) {
+	resolvedPath, err := filepath.EvalSymlinks(path)
+	for os.IsNotExist(err) && path != "/" {
+		path = filepath.Dir(path)
+		resolvedPath, err = filepath.EvalSymlinks(path)
+	}
+	if err != nil {
+		return false, "", fmt.Errorf("invalid mount source: %v", err)
+	}
+
+	mountInfo, err := os.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return false, "", fmt.Errorf("failed to read mountinfo: %v", err)
+	}
+
+	// The last matching line is the one on top
+	var mountPoint string
+	var shared bool
+	for _, line := range strings.Split(string(mountInfo), "\n") {
+		// Format: ID parentID major:minor root mountPoint options
+		// [optional fields...] - type source superOptions
+		fields := strings.Fields(line)
+		if len(fields) < 7 {
+			continue
+		}
+		candidate := fields[4]
+		if candidate != "/" && resolvedPath != candidate && !strings.HasPrefix(resolvedPath, candidate+"/") {
+			continue
+		}
+		if len(candidate) < len(mountPoint) {
+			continue
+		}
+		mountPoint = candidate
+		shared = false
+		for _, field := range fields[6:] {
+			if field == "-" {
+				break
+			}
+			if strings.HasPrefix(field, "shared:") {
+				shared = true
+			}
+		}
+	}
+	return shared, mountPoint, nil
+}
+
+// cloneMounts clones the sources of the container's binds, which must
+// happen while the container's mount tree is still connected to the host's
+// Binds with an ID-mapped source in idmapped (see idmapped_mount.go) take
+// that instead; other mounts get a nil entry.
+func cloneMounts(mounts []Mount, idmapped []*os.File) ([]*os.File, error) {
+	var clones []*os.File
+	for i, mount := range mounts {
+		if !mount.isBind() {
+			clones = append(clones, nil)
+			continue
+		}
+		if idmapped != nil && idmapped[i] != nil {
+			clones = append(clones, idmapped[i])
+			continue
+		}
+		started := time.Now()
+		treeFD, err := unix.OpenTree(unix.AT_FDCWD, mount.Source, unix.OPEN_TREE_CLONE|unix.OPEN_TREE_CLOEXEC|unix.AT_RECURSIVE)
+		traceSyscall(started, err, "open_tree(AT_FDCWD, %q, OPEN_TREE_CLONE|OPEN_TREE_CLOEXEC|AT_RECURSIVE)", mount.Source)
+		if err != nil {
+			closeMounts(clones)
+			return nil, fmt.Errorf("failed to clone mount %s: %v", mount.Source, err)
+		}
+		clones = append(clones, os.NewFile(uintptr(treeFD), mount.Source))
+	}
+	return clones, nil
+}
+
+// attachMounts mounts the clones made by cloneMounts at their targets in
+// the root filesystem at rootfs (the host's for ""), with their
+// propagation, and the container's tmpfs mounts
+func attachMounts(rootfs string, mounts []Mount, clones []*os.File) error {
+	defer closeMounts(clones)
+
+	for i, mount := range mounts {
+		target := filepath.Join(rootfs, mount.Destination)
+		if _, err := os.Lstat(target); os.IsNotExist(err) && rootfs != "" {
+			if err := createMountDestination(rootfs, mount.Destination, isFileMount(mount, clones[i])); err != nil {
+				return err
+			}
+			logf("[ns] Created mount destination %s in the rootfs\n", mount.Destination)
+		}
+		if _, err := os.Stat(target); err != nil {
+			return fmt.Errorf("mount destination %s doesn't exist", mount.Destination)
+		}
+		if !mount.isBind() {
+			if err := mountTmpfs(mount, target); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := attachDetachedMount(clones[i], target); err != nil {
+			return err
+		}
+		if err := mountTraced("", target, "", mountPropagations[mount.Propagation], ""); err != nil {
+			return fmt.Errorf("failed to make %s %s: %v", mount.Destination, mount.Propagation, err)
+		}
+		if attributes := mount.attributes(); attributes != 0 {
+			if err := restrictMount(target, attributes, true); err != nil {
+				return err
+			}
+		}
+		source := mount.Source
+		if mount.VolumeName != "" {
+			source = "volume " + mount.VolumeName
+		}
+		logf("[ns] Mounted %s at %s (%s)\n", source, mount.Destination, strings.Join(append(mount.options(), mount.Propagation), ","))
+	}
+	return nil
+}
+
+// isFileMount reports whether a mount, by its clone for a bind, is of a
+// file rather than a directory
+func isFileMount(mount Mount, clone *os.File) bool {
+	if !mount.isBind() || clone == nil {
+		return false
+	}
+	info, err := clone.Stat()
+	return err == nil && !info.IsDir()
+}
+
+// mountTmpfs mounts a tmpfs described by --mount type=tmpfs at target, its
+// destination in the root filesystem
+func mountTmpfs(mount Mount, target string) error {
+	flags := uintptr(unix.MS_NOSUID | unix.MS_NODEV)
+	for _, attribute := range mountAttributeFlags {
+		if mount.attributes()&attribute.attribute != 0 {
+			flags |= attribute.mountFlag
+		}
+	}
+	mode := mount.TmpfsMode
+	if mode == 0 {
+		mode = 01777
+	}
+	options := fmt.Sprintf("mode=%o", mode)
+	if mount.TmpfsSize > 0 {
+		options += fmt.Sprintf(",size=%d", mount.TmpfsSize)
+	}
+
+	if err := mountTraced("tmpfs", target, "tmpfs", flags, options); err != nil {
+		return fmt.Errorf("failed to mount tmpfs at %s: %v", mount.Destination, err)
+	}
+	logf("[ns] Mounted tmpfs at %s (%s)\n", mount.Destination, options)
+	return nil
+}
+
+func closeMounts(clones []*os.File) {
+	for _, clone := range clones {
+		if clone != nil {
+			clone.Close()
+		}
+	}
+}
+
+// mountAttributeFlags pairs the mount_setattr(2) attributes with the
+// flags older kernels set them with, and the statfs(2) flags reporting them
+var mountAttributeFlags = []struct {
+	attribute uint64
+	mountFlag uintptr
+	statFlag  uintptr
+}{
+	{unix.MOUNT_ATTR_RDONLY, unix.MS_RDONLY, unix.ST_RDONLY},
+	{unix.MOUNT_ATTR_NOSUID, unix.MS_NOSUID, unix.ST_NOSUID},
+	{unix.MOUNT_ATTR_NODEV, unix.MS_NODEV, unix.ST_NODEV},
+	{unix.MOUNT_ATTR_NOEXEC, unix.MS_NOEXEC, unix.ST_NOEXEC},
+	{unix.MOUNT_ATTR_NOATIME, unix.MS_NOATIME, unix.ST_NOATIME},
+	{unix.MOUNT_ATTR_NODIRATIME, unix.MS_NODIRATIME, unix.ST_NODIRATIME},
+	{unix.MOUNT_ATTR_RELATIME, unix.MS_RELATIME, unix.ST_RELATIME},
+}
+
+// restrictMount adds MOUNT_ATTR_* attributes to the mount at path and,
+// with recursive, to every mount below it
+func restrictMount(path string, attributes uint64, recursive bool) error {
+	// mount_setattr (Linux 5.12) does it in one go
+	var setattrFlags uint
+	setattrFlagNames := "0"
+	if recursive {
+		setattrFlags = unix.AT_RECURSIVE
+		setattrFlagNames = "AT_RECURSIVE"
+	}
+	started := time.Now()
+	err := unix.MountSetattr(-1, path, setattrFlags, &unix.MountAttr{Attr_set: attributes})
+	traceSyscall(started, err, "mount_setattr(-1, %q, %s, {attr_set: %#x})", path, setattrFlagNames, attributes)
+	if err == nil {
+		return nil
+	}
+
+	// Older kernels: each mount has to be remounted
+	mountPoints := []string{path}
+	if recursive {
+		var err error
+		if mountPoints, err = mountPointsBelow(path); err != nil {
+			return err
+		}
+	}
+	for _, mountPoint := range mountPoints {
+		if err := remountBind(mountPoint, attributes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remountBind adds attributes to one mount by remounting it
+// Flags the user namespace locked have to be repeated, or the remount
+// fails, so the mount's current flags are kept
+func remountBind(path string, attributes uint64) error {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(path, &stat); err != nil {
+		return fmt.Errorf("failed to stat %s: %v", path, err)
+	}
+
+	flags := uintptr(unix.MS_BIND | unix.MS_REMOUNT)
+	for _, attribute := range mountAttributeFlags {
+		if attributes&attribute.attribute != 0 || uintptr(stat.Flags)&attribute.statFlag != 0 {
+			flags |= attribute.mountFlag
+		}
+	}
+	if err := mountTraced("", path, "", flags, ""); err != nil {
+		return fmt.Errorf("failed to remount %s: %v", path, err)
+	}
+	return nil
+}
+
+// mountPointsBelow lists path and the mount points beneath it, parents first
+func mountPointsBelow(path string) ([]string, error) {
+	mountInfo, err := os.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mountinfo: %v", err)
+	}
+
+	var mountPoints []string
+	for _, line := range strings.Split(string(mountInfo), "\n") {
+		// Format: ID parentID major:minor root mountPoint options ...
+		fields := strings.Fields(line)
+		if len(fields) < 5 {
+			continue
+		}
+		if fields[4] == path || strings.HasPrefix(fields[4], path+"/") {
+			mountPoints = append(mountPoints, fields[4])
+		}
+	}
+	return mountPoints, nil
+}
+
+// openTreeSupported reports whether the kernel has open_tree(2), which
+// bind mounts are made with
+func openTreeSupported() bool {
+	_, err := unix.OpenTree(-1, "", 0)
+	return err != unix.ENOSYS
+}
@@ -0,0 +1,179 @@
+//go:build linux
+
+package ns
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseVolume(t *testing.T) {
+	tests := []struct {
+		spec string
+		want Mount
+	}{
+		{"/data", Mount{Type: MountTypeVolume, Destination: "/data"}},
+		{"/srv/data:/data", Mount{Source: "/srv/data", Destination: "/data"}},
+		{"cache:/var/cache", Mount{Type: MountTypeVolume, Source: "cache", Destination: "/var/cache"}},
+		{"./data:/data:ro", Mount{Source: "./data", Destination: "/data", ReadOnly: true}},
+		{"/srv/data:/data:ro,noexec,nosuid,nodev", Mount{Source: "/srv/data", Destination: "/data", ReadOnly: true, NoExec: true, NoSuid: true, NoDev: true}},
+		{"/srv/data:/data:rw,rslave", Mount{Source: "/srv/data", Destination: "/data", Propagation: "rslave"}},
+		{"/srv/data:/data:Z", Mount{Source: "/srv/data", Destination: "/data", Relabel: RelabelPrivate}},
+		{"/srv/data:/data:z,ro", Mount{Source: "/srv/data", Destination: "/data", Relabel: RelabelShared, ReadOnly: true}},
+	}
+	for _, test := range tests {
+		got, err := ParseVolume(test.spec)
+		if err != nil {
+			t.Errorf("ParseVolume(%q): %v", test.spec, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ParseVolume(%q) = %+v, want %+v", test.spec, got, test.want)
+		}
+	}
+}
+
+func TestParseVolumeErrors(t *testing.T) {
+	tests := []struct {
+		spec string
+		want string
+	}{
+		{"data", "expected /host/path:/container/path"},
+		{":/data", "expected /host/path:/container/path"},
+		{"/srv/data:", "expected /host/path:/container/path"},
+		{"/a:/b:ro:extra", "expected /host/path:/container/path"},
+		{"/a:/b:exec", `unknown option "exec"`},
+		{"/a:/b:z,Z", "more than one of z and Z"},
+		{"/a:/b:rslave,shared", "more than one propagation"},
+	}
+	for _, test := range tests {
+		if _, err := ParseVolume(test.spec); err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("ParseVolume(%q) error = %v, want one containing %q", test.spec, err, test.want)
+		}
+	}
+}
+
+func TestParseMount(t *testing.T) {
+	tests := []struct {
+		spec string
+		want Mount
+	}{
+		{"type=bind,src=/a,dst=/b", Mount{Type: MountTypeBind, Source: "/a", Destination: "/b"}},
+		{"src=/a,target=/b,readonly", Mount{Type: MountTypeBind, Source: "/a", Destination: "/b", ReadOnly: true}},
+		{"source=/a,destination=/b,ro=false,noexec=1,nosuid=true,nodev", Mount{Type: MountTypeBind, Source: "/a", Destination: "/b", NoExec: true, NoSuid: true, NoDev: true}},
+		{"type=bind,src=/a,dst=/b,bind-propagation=rshared,relabel=private,create", Mount{Type: MountTypeBind, Source: "/a", Destination: "/b", Propagation: "rshared", Relabel: RelabelPrivate, CreateSource: true}},
+		{`type=bind,"src=/a,b",dst=/b`, Mount{Type: MountTypeBind, Source: "/a,b", Destination: "/b"}},
+		{"type=volume,src=cache,dst=/var/cache", Mount{Type: MountTypeVolume, Source: "cache", Destination: "/var/cache"}},
+		{"type=volume,dst=/var/cache", Mount{Type: MountTypeVolume, Destination: "/var/cache"}},
+		{"type=tmpfs,dst=/scratch,tmpfs-size=1g,tmpfs-mode=1770", Mount{Type: MountTypeTmpfs, Destination: "/scratch", TmpfsSize: 1 << 30, TmpfsMode: 01770}},
+	}
+	for _, test := range tests {
+		got, err := ParseMount(test.spec)
+		if err != nil {
+			t.Errorf("ParseMount(%q): %v", test.spec, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ParseMount(%q) = %+v, want %+v", test.spec, got, test.want)
+		}
+	}
+}
+
+func TestParseMountErrors(t *testing.T) {
+	tests := []struct {
+		spec string
+		want string
+	}{
+		{"type=overlay,dst=/b", `unsupported type "overlay"`},
+		{"src=/a", "missing dst"},
+		{"dst=/b", "missing src"},
+		{"src=/a,dst=/b,ro=maybe", "ro must be true or false"},
+		{"src=/a,dst=/b,relabel=yes", "relabel must be shared or private"},
+		{"src=/a,dst=/b,bind-propagation=sideways", `unknown propagation "sideways"`},
+		{"src=/a,dst=/b,tmpfs-size=1g", "tmpfs-size only applies to type=tmpfs"},
+		{"src=/a,dst=/b,uid=0", `unknown option "uid"`},
+		{"type=tmpfs,src=/a,dst=/b", "a tmpfs has no src"},
+		{"type=tmpfs,dst=/b,bind-propagation=rslave", "a tmpfs has no src"},
+		{"type=tmpfs,dst=/b,tmpfs-mode=999", "tmpfs-mode must be octal permissions"},
+		{"type=tmpfs,dst=/b,tmpfs-mode=17777", "tmpfs-mode must be octal permissions"},
+		{"type=tmpfs,dst=/b,tmpfs-size=lots", "invalid size"},
+		{"type=volume,src=../etc,dst=/b", `invalid volume name "../etc"`},
+		{"type=volume,src=cache,dst=/b,create", "create only applies to type=bind"},
+		{`src="/a,dst=/b`, "invalid mount"},
+	}
+	for _, test := range tests {
+		if _, err := ParseMount(test.spec); err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("ParseMount(%q) error = %v, want one containing %q", test.spec, err, test.want)
+		}
+	}
+}
+
+func TestParseTmpfs(t *testing.T) {
+	tests := []struct {
+		spec string
+		want Mount
+	}{
+		{"/tmp", Mount{Type: MountTypeTmpfs, Destination: "/tmp"}},
+		{"/run:size=64m,mode=755,noexec", Mount{Type: MountTypeTmpfs, Destination: "/run", TmpfsSize: 64 << 20, TmpfsMode: 0755, NoExec: true}},
+		{"/cache:ro,nosuid,nodev", Mount{Type: MountTypeTmpfs, Destination: "/cache", ReadOnly: true, NoSuid: true, NoDev: true}},
+	}
+	for _, test := range tests {
+		got, err := ParseTmpfs(test.spec)
+		if err != nil {
+			t.Errorf("ParseTmpfs(%q): %v", test.spec, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ParseTmpfs(%q) = %+v, want %+v", test.spec, got, test.want)
+		}
+	}
+}
+
+func TestParseTmpfsErrors(t *testing.T) {
+	tests := []struct {
+		spec string
+		want string
+	}{
+		{"", "expected /container/path[:options]"},
+		{":size=1m", "expected /container/path[:options]"},
+		{"/tmp:size=0", "size must be a size"},
+		{"/tmp:size=big", "size must be a size"},
+		{"/tmp:mode=rwx", "mode must be octal permissions"},
+		{"/tmp:mode=20000", "mode must be octal permissions"},
+		{"/tmp:uid=0", `unknown option "uid=0"`},
+	}
+	for _, test := range tests {
+		if _, err := ParseTmpfs(test.spec); err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("ParseTmpfs(%q) error = %v, want one containing %q", test.spec, err, test.want)
+		}
+	}
+}
+
+func TestCheckMountDestination(t *testing.T) {
+	tests := []struct {
+		destination string
+		refused     bool
+	}{
+		{"/data", false},
+		{"/devices", false},
+		{"/process", false},
+		{"/system", false},
+		{"/dev/shm", false},
+		{"/", true},
+		{"/dev", true},
+		{"/proc", true},
+		{"/proc/sys", true},
+		{"/sys", true},
+		{"/sys/fs/cgroup", true},
+	}
+	for _, test := range tests {
+		err := checkMountDestination(test.destination, false)
+		if refused := err != nil; refused != test.refused {
+			t.Errorf("checkMountDestination(%q) = %v, want refused %t", test.destination, err, test.refused)
+		}
+		if err := checkMountDestination(test.destination, true); err != nil {
+			t.Errorf("checkMountDestination(%q) refuses a privileged container: %v", test.destination, err)
+		}
+	}
+}
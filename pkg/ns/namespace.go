@@ -3,121 +3,950 @@
 package ns
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	"golang.org/x/sys/unix"
+
+	"nsctl/pkg/cgroup"
 )
 
+// ContainerConfig describes a container to be started by RunWithConfig
+type ContainerConfig struct {
+	// ID identifies the container; RunWithConfig generates one when empty
+	ID string
+
+	// Command and Args are executed inside the new namespaces
+	Command string
+	Args    []string
+
+	// Detach starts the container in the background instead of waiting for it
+	Detach bool
+
+	// CreateOnly prepares the container in the background but leaves it
+	// waiting for StartContainer instead of starting the workload
+	CreateOnly bool
+
+	// AutoRemove deletes the container's record once it exits (--rm)
+	AutoRemove bool
+
+	// Timeout is the maximum wall-clock run time; zero means no limit
+	Timeout time.Duration
+
+	// Restart says when the shim starts the workload again after it exits
+	// (--restart)
+	Restart RestartPolicy
+
+	// PreserveEnv passes the whole host environment into the container
+	// instead of the minimal default one
+	PreserveEnv bool
+
+	// User is the --user spec ("name", "uid", "name:group", "uid:gid") the
+	// command runs as; empty means root
+	User string
+
+	// GroupAdd lists extra groups (names from the container's /etc/group or
+	// GIDs) the command runs with (--group-add)
+	GroupAdd []string
+
+	// Hostname is set in the UTS namespace; defaults to the short container ID
+	Hostname string
+
+	// Timezone is the zone of the container's TZ and /etc/localtime, e.g.
+	// "Europe/Berlin" (--tz); empty means the host's /etc/localtime
+	Timezone string
+
+	// LogMaxSize caps the log of a detached container, e.g. "10m"; empty
+	// means the runtime config's log_max_size and "0" means no limit
+	LogMaxSize string
+
+	// Memory limits the container's memory use, e.g. "512m"; empty means
+	// no limit
+	Memory string
+
+	// CPUs limits the container to this many CPUs' worth of time, e.g. 1.5;
+	// zero means no limit
+	CPUs float64
+
+	// PressureAlerts are the pressure thresholds the shim emits pressure
+	// events at (--pressure-alert)
+	PressureAlerts []cgroup.PressureTrigger
+
+	// MemoryEventActions are the shim's reactions to the memory events of
+	// the container's cgroup (--on-memory-event)
+	MemoryEventActions []MemoryEventAction
+
+	// HealthCheck is the probe the shim checks the container's health with
+	// (--health-type and friends)
+	HealthCheck HealthCheck
+
+	// ContainerDir is the per-container directory under the state dir
+	// It is filled in by RunWithConfig
+	ContainerDir string
+
+	// CgroupPath is the container's cgroup, filled in by the shim
+	CgroupPath string
+
+	// CgroupPaths are the container's cgroup directories by hierarchy (see
+	// cgroup.Cgroup.Paths), which setup mounts at /sys/fs/cgroup; filled
+	// in by the shim
+	CgroupPaths map[string]string
+
+	// UIDMappings and GIDMappings map IDs in the container's user namespace
+	// to host IDs (--uidmap/--gidmap); when set, the container gets a user
+	// namespace
+	UIDMappings []IDMap
+	GIDMappings []IDMap
+
+	// IDMappedMounts makes the setup process receive its bind sources
+	// ID-mapped from the shim; it is filled in by startContainerProcess
+	IDMappedMounts bool
+
+	// Rootless is set for containers started by an unprivileged user; it is
+	// filled in by RunWithConfig
+	Rootless bool
+
+	// OwnerUID is the user the container counts against in the per-user
+	// limit (see limits.go); it is filled in by RunWithConfig
+	OwnerUID int
+
+	// CapAdd lists the capabilities a rootful container keeps (--cap-add),
+	// e.g. "NET_ADMIN" or "ALL"; by default it keeps none
+	CapAdd []string
+
+	// SecurityOpt holds the --security-opt key=value settings
+	SecurityOpt []string
+
+	// Seccomp is the syscall filter loaded from --security-opt seccomp=...;
+	// it is filled in by RunWithConfig
+	Seccomp *SeccompProfile
+
+	// ProcOptions are the procfs mount options of the container's /proc,
+	// e.g. "hidepid=2,subset=pid" (--security-opt proc-opts=...)
+	ProcOptions string
+
+	// MountLabel is the SELinux label of the sources of Z mounts, with the
+	// container's own MCS level, which the workload runs with too; it is
+	// filled in by RunWithConfig
+	MountLabel string
+
+	// TraceSetup makes the setup process log its steps and syscalls with
+	// their durations (--trace-setup, see trace.go)
+	TraceSetup bool
+
+	// Privileged gives the container every capability, all host devices
+	// and a writable, unmasked /sys and cgroup (--privileged, see
+	// privileged.go)
+	Privileged bool
+
+	// Landlock is the filesystem policy loaded from --security-opt
+	// landlock=...; it is filled in by RunWithConfig
+	Landlock *LandlockPolicy
+
+	// Rootfs is the host directory the container gets as its root
+	// filesystem (--rootfs, see rootfs.go); empty means the host's /
+	Rootfs string
+
+	// ReadOnly makes the container's root mount read-only, with tmpfs
+	// mounts on /tmp and /run (--read-only, see rootfs.go)
+	ReadOnly bool
+
+	// MaskedPaths are hidden from the container and ReadonlyPaths made
+	// read-only in it (see masked_paths.go); they are filled in by
+	// RunWithConfig
+	MaskedPaths   []string
+	ReadonlyPaths []string
+
+	// Mounts are the host paths, volumes and tmpfs mounts of the container
+	// (-v, --mount)
+	Mounts []Mount
+
+	// Volumes names the managed volumes the container uses; it is filled in
+	// by RunWithConfig
+	Volumes []string
+
+	// Annotations are arbitrary key=value metadata (--annotation) for tools
+	// built on nsctl; they end up in the container's record, its OCI spec
+	// and the state hooks are given
+	Annotations map[string]string
+
+	// Hooks are the hooks from the hooks directories that apply to the
+	// container; they are filled in by RunWithConfig
+	Hooks *Hooks
+
+	// Platform is the os/arch the container's binaries are built for
+	// (--platform); RunWithConfig defaults it to the host's
+	Platform Platform
+
+	// NoProxy keeps the proxy settings of the runtime config out of the
+	// container, and with PreserveEnv those of the host too (--no-proxy)
+	NoProxy bool
+
+	// ProxyEnv holds the proxy variables passed into the container; it is
+	// filled in by RunWithConfig
+	ProxyEnv []string
+
+	// UserNamespace is the --userns mode of a rootless container: empty
+	// maps the user to root, "keep-id" to their own IDs
+	UserNamespace string
+
+	// Isolation is the --isolation backend: namespaces, or chroot for hosts
+	// that forbid creating them (see isolation.go); RunWithConfig resolves
+	// auto to one of them
+	Isolation string
+
+	// Keyring is the --keyring mode: private (the default) gives the
+	// container a session keyring of its own, host keeps the inherited one
+	// (see keyring.go)
+	Keyring string
+
+	// Sysfs is the --sysfs mode: mount (the default) gives the container a
+	// sysfs of its own, bind the host's /sys read-only, none no /sys at all
+	// (see sysfs.go)
+	Sysfs string
+
+	// Network is the --network mode: bridge, host, none (see network.go)
+	// or container:<id> (see join.go); RunWithConfig picks the default
+	Network string
+
+	// IPAddress is a bridge container's address with its prefix, e.g.
+	// "10.87.0.2/16"; it is filled in by the shim
+	IPAddress string
+
+	// Modes of the container's UTS, PID, mount, IPC and cgroup namespaces:
+	// private (the default) or host (see namespaces.go), or for UTS, PID
+	// and IPC container:<id> (see join.go); the cgroup namespace is the
+	// host's where the kernel has no cgroup namespaces
+	UTSNamespace    string
+	PIDNamespace    string
+	MountNamespace  string
+	IPCNamespace    string
+	CgroupNamespace string
+
+	// TimeOffsets shift the container's monotonic and boot-time clocks; a
+	// container only gets a time namespace with them (see timens.go)
+	TimeOffsets []TimeOffset
+
+	// PodID is the pod the container runs in, whose UTS, IPC and network
+	// namespaces it joins (--pod, see pod.go); PodInfra is set for the
+	// pod's infra container, which holds them
+	PodID    string
+	PodInfra bool
+}
+
+// File descriptors passed to the setup process (ExtraFiles[i] becomes fd 3+i)
+const (
+	// setupConfigFD is where the setup process receives its ContainerConfig
+	setupConfigFD = 3
+
+	// setupLogFD is where the setup process writes its diagnostics
+	setupLogFD = 4
+
+	// setupSyncFD is where the setup process reports that setup finished
+	setupSyncFD = 5
+
+	// setupMountsFD is where the setup process receives ID-mapped bind
+	// sources, if IDMappedMounts is set (see idmapped_mount.go)
+	setupMountsFD = 6
+)
+
+// setupReadyMessage is sent on setupSyncFD when setup succeeded; anything
+// else is an error message
+const setupReadyMessage = "ready"
+
 // RunWithSetup creates a process with isolated namespaces and sets up the environment
 // This is the main entry point for creating containers
 func RunWithSetup(execPath string, command string, args []string) error {
-	fmt.Printf("[ns] Creating isolated namespaces (PID, UTS, Mount)\n")
-	fmt.Printf("[ns] Using executable: %s\n", execPath)
+	_, err := RunWithConfig(execPath, ContainerConfig{Command: command, Args: args})
+	return err
+}
+
+// RunWithConfig starts a container described by config and returns its ID
+// The container is started and waited for by a per-container shim process
+// (see shim.go). In the foreground this waits for the container to exit; with
+// config.Detach it returns as soon as the container has been started, and with
+// config.CreateOnly as soon as it is ready for StartContainer
+func RunWithConfig(execPath string, config ContainerConfig) (string, error) {
+	if err := prepareContainerConfig(&config); err != nil {
+		return "", err
+	}
+	if err := createBindSources(config.Mounts); err != nil {
+		return "", err
+	}
+
+	// Catch missing kernel features and privileges here, with a message
+	// saying how to fix them, rather than as EPERM from the setup process
+	warnings, err := CheckHostFeatures(config)
+	for _, warning := range warnings {
+		logf("[ns] Warning: %s\n", warning)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// The container is counted from when its directory holds its config
+	config.OwnerUID = invokingUID()
+	release, err := reserveContainerSlot(config)
+	if err != nil {
+		return "", err
+	}
+	err = createContainerFiles(&config)
+	release()
+	if err != nil {
+		return "", err
+	}
+
+	return config.ID, startShim(execPath, config)
+}
+
+// createContainerFiles creates the container directory with everything the
+// shim needs in it, and the container's volumes
+func createContainerFiles(config *ContainerConfig) error {
+	containerDir, err := createContainerDir(config.ID)
+	if err != nil {
+		return err
+	}
+	config.ContainerDir = containerDir
+
+	// A container sharing another container's network can't reach the
+	// host's loopback any more than one with a network of its own
+	if err := writeEtcFiles(containerDir, config.Hostname, config.Timezone, config.Network != NetworkHost); err != nil {
+		os.RemoveAll(containerDir)
+		return err
+	}
+
+	// The workload stays blocked on this FIFO until the container is started
+	if err := createExecFifo(containerDir); err != nil {
+		os.RemoveAll(containerDir)
+		return err
+	}
+
+	// Volumes are created last, so a container that fails to be created
+	// doesn't leave anonymous ones behind
+	if err := prepareVolumes(config); err != nil {
+		removeAnonymousVolumes(config.Volumes)
+		os.RemoveAll(containerDir)
+		return err
+	}
+
+	if err := relabelMounts(config); err != nil {
+		removeAnonymousVolumes(config.Volumes)
+		os.RemoveAll(containerDir)
+		return err
+	}
+
+	// The shim reads everything it needs from the container directory
+	if err := writeContainerConfig(*config); err != nil {
+		removeAnonymousVolumes(config.Volumes)
+		os.RemoveAll(containerDir)
+		return err
+	}
+	return nil
+}
+
+// prepareContainerConfig fills in and checks everything about a container
+// that can be known before anything is created for it, for a run or a
+// plan of one (see plan.go)
+func prepareContainerConfig(config *ContainerConfig) error {
+	// The ID is needed before the container starts: it names the container
+	// directory and provides the default hostname
+	if config.ID == "" {
+		containerID, err := generateContainerID()
+		if err != nil {
+			return err
+		}
+		config.ID = containerID
+	}
+	if err := prepareIsolation(config); err != nil {
+		return err
+	}
+	if err := preparePod(config); err != nil {
+		return err
+	}
+	if err := prepareNamespaces(config); err != nil {
+		return err
+	}
+	if config.Hostname == "" {
+		config.Hostname = ShortID(config.ID)
+	}
+
+	// Unprivileged users get a user namespace in which they are root (or,
+	// with --userns=keep-id, themselves); anyone may ask for explicit mappings
+	if err := prepareUserNamespace(config); err != nil {
+		return err
+	}
+	if err := prepareNetwork(config); err != nil {
+		return err
+	}
+	if err := validateTimeOffsets(*config); err != nil {
+		return err
+	}
+
+	if err := preparePlatform(config); err != nil {
+		return err
+	}
+	if err := validateAnnotations(config.Annotations); err != nil {
+		return err
+	}
+	if err := validateTimezone(config.Timezone); err != nil {
+		return err
+	}
+	if err := validateKeyring(config.Keyring); err != nil {
+		return err
+	}
+	if err := validateSysfs(config.Sysfs); err != nil {
+		return err
+	}
+	if err := prepareHealthCheck(&config.HealthCheck); err != nil {
+		return err
+	}
+	if config.AutoRemove && config.Restart.Name != "" && config.Restart.Name != RestartNo {
+		return fmt.Errorf("--rm and --restart %s cannot be used together", config.Restart)
+	}
+	if err := resolveProxyEnv(config); err != nil {
+		return err
+	}
+
+	if err := prepareMounts(config); err != nil {
+		return err
+	}
+	if err := prepareReadOnly(config); err != nil {
+		return err
+	}
+	hooks, err := matchHooks(*config)
+	if err != nil {
+		return err
+	}
+	config.Hooks = hooks
+
+	if _, err := parseCapabilities(config.CapAdd); err != nil {
+		return err
+	}
+	if err := checkPrivileged(*config); err != nil {
+		return err
+	}
+	if err := applySecurityOpts(config); err != nil {
+		return err
+	}
+	if err := prepareRootfs(config); err != nil {
+		return err
+	}
+	return nil
+}
+
+// startContainerProcess creates the namespaced setup process for a container
+// The caller (the shim) owns the returned command and must Wait for it.
+// beforeSetup, if set, runs once the process exists but before it gets its
+// config and starts setting up, and may still change that config.
+func startContainerProcess(execPath string, config ContainerConfig, stdio containerStdio, beforeSetup func(pid int, config *ContainerConfig) error) (*exec.Cmd, error) {
+	if config.Isolation == IsolationChroot {
+		logf("[ns] Creating container without namespaces (chroot isolation)\n")
+	} else if namespaces := ownNamespaces(config); len(namespaces) > 0 {
+		logf("[ns] Creating isolated namespaces (%s)\n", strings.Join(namespaces, ", "))
+	} else {
+		logf("[ns] Creating container in the host's namespaces\n")
+	}
+	logf("[ns] Using executable: %s\n", execPath)
 
 	// Re-execute ourselves with special arguments to run setup inside the namespace
 	// This two-step process is necessary because namespace setup must happen inside the namespace
-	setupArgs := []string{"setup-and-exec", command}
-	setupArgs = append(setupArgs, args...)
+	setupArgs := []string{"setup-and-exec", config.Command}
+	setupArgs = append(setupArgs, config.Args...)
 
 	cmd := exec.Command(execPath, setupArgs...)
 
-	// Configure namespace isolation using clone flags
-	cmd.SysProcAttr = &syscall.SysProcAttr{
-		Cloneflags: unix.CLONE_NEWUTS | // Isolate hostname/domainname
-			unix.CLONE_NEWPID | // Isolate process IDs (new PID namespace)
-			unix.CLONE_NEWNS, // Isolate filesystem mounts
+	// Configure namespace isolation using clone flags: hostname/domainname,
+	// process IDs, filesystem mounts, the network and IPC, each unless the
+	// container uses the host's; a chroot container gets none
+	cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: cloneFlags(config)}
+	if len(config.UIDMappings) > 0 {
+		// Rootless: the namespaces above are owned by the new user namespace,
+		// in which the setup process needs to keep its capabilities
+		cmd.SysProcAttr.AmbientCaps = setupCapabilities()
 	}
 
-	// Connect container I/O to parent terminal
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	// The setup process hands its own environment to the target command on
+	// exec, so this is the environment the container ends up with
+	cmd.Env = buildContainerEnv(config)
 
-	// Start the namespaced process
-	if err := cmd.Start(); err != nil {
-		return fmt.Errorf("failed to start namespace process: %v", err)
+	// Settings such as --user have to be applied from inside the namespaces,
+	// so the config is streamed to the setup process over a pipe
+	configReader, configWriter, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create config pipe: %v", err)
 	}
+	defer configWriter.Close()
 
-	containerPID := cmd.Process.Pid
-	fmt.Printf("[ns] Container started with PID %d\n", containerPID)
-
-	// Register the container for tracking
-	containerID, err := RegisterContainer(containerPID, command, args)
+	// The setup process reports back once it is blocked on the start FIFO
+	syncReader, syncWriter, err := os.Pipe()
 	if err != nil {
-		fmt.Printf("[ns] Warning: failed to register container: %v\n", err)
+		configReader.Close()
+		return nil, fmt.Errorf("failed to create sync pipe: %v", err)
 	}
+	defer syncReader.Close()
 
-	// Wait for container to finish and return its exit status
-	err = cmd.Wait()
+	// fd 3 carries the config, fd 4 receives the setup diagnostics so they
+	// don't end up mixed into the container's own stderr, fd 5 is the sync pipe
+	cmd.ExtraFiles = []*os.File{configReader, stdio.setupLog, syncWriter}
 
-	// Unregister the container when it finishes
-	if containerID != "" {
-		if unregErr := UnregisterContainer(containerID); unregErr != nil {
-			fmt.Printf("[ns] Warning: failed to unregister container: %v\n", unregErr)
+	// fd 6 receives the ID-mapped bind sources, which the shim can only
+	// make once the process and its user namespace exist
+	var mountsSender *os.File
+	config.IDMappedMounts = idmapBinds(config)
+	if config.IDMappedMounts {
+		fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_SEQPACKET|unix.SOCK_CLOEXEC, 0)
+		if err != nil {
+			configReader.Close()
+			syncWriter.Close()
+			return nil, fmt.Errorf("failed to create mounts socket: %v", err)
 		}
+		mountsSender = os.NewFile(uintptr(fds[0]), "mounts-socket")
+		mountsReceiver := os.NewFile(uintptr(fds[1]), "mounts-socket")
+		defer mountsSender.Close()
+		defer mountsReceiver.Close()
+		cmd.ExtraFiles = append(cmd.ExtraFiles, mountsReceiver)
 	}
 
-	return err
+	cmd.Stdin = stdio.stdin
+	cmd.Stdout = stdio.stdout
+	cmd.Stderr = stdio.stderr
+
+	// Start the namespaced process, in the namespaces it joins
+	started := time.Now()
+	if err := startInJoinedNamespaces(cmd, config); err != nil {
+		configReader.Close()
+		syncWriter.Close()
+		return nil, fmt.Errorf("failed to start namespace process: %v", err)
+	}
+	configReader.Close()
+	syncWriter.Close()
+
+	// The setup process waits for its config, so its user namespace can be
+	// mapped before it does anything
+	if len(config.UIDMappings) > 0 {
+		if err := writeIDMappings(cmd.Process.Pid, config); err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			return nil, err
+		}
+	}
+
+	if mountsSender != nil {
+		if err := sendIDMappedMounts(mountsSender, config.Mounts, cmd.Process.Pid); err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			return nil, err
+		}
+	}
+
+	if beforeSetup != nil {
+		if err := beforeSetup(cmd.Process.Pid, &config); err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			return nil, err
+		}
+	}
+
+	// Hand the config over; closing our end lets the child see EOF
+	if err := json.NewEncoder(configWriter).Encode(config); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, fmt.Errorf("failed to send config to container: %v", err)
+	}
+	configWriter.Close()
+
+	// Wait until setup inside the namespaces has finished (or failed)
+	syncMessage, _ := io.ReadAll(syncReader)
+	if message := strings.TrimSpace(string(syncMessage)); message != setupReadyMessage {
+		cmd.Process.Kill()
+		cmd.Wait()
+		if message == "" {
+			message = "setup process exited unexpectedly"
+		}
+		return nil, fmt.Errorf("container setup failed: %s", message)
+	}
+
+	if config.TraceSetup {
+		logf("%s setup of container %s took %s\n", tracePrefix, ShortID(config.ID), time.Since(started).Round(time.Microsecond))
+	}
+	logf("[ns] Container started with PID %d\n", cmd.Process.Pid)
+	return cmd, nil
 }
 
 // HandleSetupAndExec runs inside the new namespace to set up the environment
 // and then execute the target command
 func HandleSetupAndExec(targetCmd string, targetArgs []string) error {
-	fmt.Printf("[ns] Setting up isolated environment...\n")
+	// Send our diagnostics to the log descriptor provided by the shim
+	// It is marked close-on-exec so the workload never inherits it
+	unix.CloseOnExec(setupLogFD)
+	LogOutput = os.NewFile(setupLogFD, "setup-log")
+
+	// The sync pipe tells the shim whether setup succeeded
+	unix.CloseOnExec(setupSyncFD)
+	syncPipe := os.NewFile(setupSyncFD, "sync-pipe")
 
-	// Step 1: Set custom hostname in the UTS namespace
-	newHostname := "container"
-	fmt.Printf("[ns] Setting hostname to '%s'\n", newHostname)
-	if err := unix.Sethostname([]byte(newHostname)); err != nil {
-		return fmt.Errorf("failed to set hostname: %v", err)
+	logf("[ns] Setting up isolated environment...\n")
+
+	config, err := readSetupConfig()
+	if err != nil {
+		fmt.Fprintln(syncPipe, err)
+		return err
 	}
+	setupTracing = config.TraceSetup
 
-	// Step 2: Mount /proc for the new PID namespace
-	// This gives us the isolated view of processes (ps, top, etc. will work correctly)
-	fmt.Printf("[ns] Mounting /proc filesystem for isolated process view\n")
-	if err := unix.Mount("proc", "/proc", "proc", 0, ""); err != nil {
-		return fmt.Errorf("failed to mount /proc: %v", err)
+	// The cgroup and time namespaces, session keyring, SELinux exec label,
+	// capability sets, Landlock domain and seccomp filter below are per
+	// thread, so all of it has to happen on the thread that execs
+	runtime.LockOSThread()
+
+	// The shim has moved us into the container's cgroup by the time the
+	// config arrives, which is where the namespace is rooted
+	if err := traced("unshare cgroup namespace", func() error { return unshareCgroupNamespace(config) }); err != nil {
+		fmt.Fprintln(syncPipe, err)
+		return err
+	}
+	if err := traced("unshare time namespace", func() error { return unshareTimeNamespace(config) }); err != nil {
+		fmt.Fprintln(syncPipe, err)
+		return err
+	}
+
+	// A seccomp agent needs our PID as it sees it, which only the host's
+	// /proc can tell, before setup mounts the container's own
+	hostPID := os.Getpid()
+	if config.Seccomp != nil {
+		if self, err := os.Readlink("/proc/self"); err == nil {
+			hostPID, _ = strconv.Atoi(self)
+		}
 	}
 
-	// Step 3: Execute the target command
-	fmt.Printf("[ns] Executing target command: %s %v\n", targetCmd, targetArgs)
+	// The start FIFO is opened by the container directory, which the
+	// container can't reach any more once it is in its --rootfs
+	containerDir, err := os.OpenFile(config.ContainerDir, unix.O_PATH|unix.O_DIRECTORY, 0)
+	if err != nil {
+		err = fmt.Errorf("failed to open container directory: %v", err)
+		fmt.Fprintln(syncPipe, err)
+		return err
+	}
+	defer containerDir.Close()
 
-	// Find the full path to the command
-	targetPath, err := exec.LookPath(targetCmd)
+	setup := setupNamespaceEnvironment
+	if config.Isolation == IsolationChroot {
+		setup = setupChrootEnvironment
+	}
+	prepared, err := setup(config, targetCmd)
 	if err != nil {
-		return fmt.Errorf("command not found: %s (%v)", targetCmd, err)
+		fmt.Fprintln(syncPipe, err)
+		return err
+	}
+
+	// Setup is complete: let the shim know, then wait until the container is started
+	fmt.Fprintln(syncPipe, setupReadyMessage)
+	syncPipe.Close()
+	if err := traced("wait for start", func() error { return waitForStartSignal(containerDir) }); err != nil {
+		return err
+	}
+
+	if err := traced("join session keyring", func() error { return joinSessionKeyring(config) }); err != nil {
+		return err
+	}
+
+	// A workload with Z mounts runs with their MCS level; the label is set
+	// before Landlock could deny writing it
+	if err := traced("set SELinux label", func() error { return setExecLabel(config.MountLabel) }); err != nil {
+		return err
+	}
+
+	// A rootful workload must not run as root with every capability
+	if !config.Rootless {
+		keep, err := containerCapabilities(config)
+		if err != nil {
+			return err
+		}
+		if err := traced("drop capabilities", func() error { return dropCapabilities(keep) }); err != nil {
+			return err
+		}
+	} else if config.ProcOptions != "" {
+		if err := traced("drop CAP_SYS_ADMIN", dropProcRemount); err != nil {
+			return err
+		}
+	}
+
+	// Landlock goes first, in case the seccomp profile doesn't allow it
+	if config.Landlock != nil {
+		if err := traced("apply Landlock policy", func() error { return applyLandlockPolicy(config.Landlock) }); err != nil {
+			return err
+		}
+	}
+
+	// Filter syscalls from here on; this still has CAP_SYS_ADMIN, so the
+	// filter doesn't require no_new_privs, and it covers the user switch
+	if config.Seccomp != nil {
+		if err := traced("install seccomp filter", func() error { return installSeccompFilter(config, hostPID) }); err != nil {
+			return err
+		}
+	}
+
+	// Switch to the container user
+	// This happens last so the privileged steps above still run as root. In
+	// a user namespace even root needs switching to: the host IDs we run as
+	// need not be mapped, e.g. with --uidmap 0:100000:65536 as root
+	if config.User != "" || len(config.GroupAdd) > 0 || len(config.UIDMappings) > 0 {
+		if err := traced("switch user", func() error { return switchUser(prepared.user) }); err != nil {
+			return err
+		}
+	}
+	if len(config.UIDMappings) > 0 {
+		if err := traced("drop setup capabilities", dropSetupCapabilities); err != nil {
+			return err
+		}
 	}
 
+	// Execute the target command
+	logf("[ns] Executing target command: %s %v\n", targetCmd, targetArgs)
+
 	// Replace the current process with the target command
 	// This makes the target command PID 1 in the new namespace
 	execArgs := append([]string{targetCmd}, targetArgs...)
 
-	fmt.Printf("[ns] Replacing process with target command...\n")
-	return syscall.Exec(targetPath, execArgs, os.Environ())
+	logf("[ns] Replacing process with target command...\n")
+	if setupTracing {
+		tracef("  execve(%q, %q, %d variables)", prepared.commandPath, execArgs, len(prepared.env))
+	}
+	return syscall.Exec(prepared.commandPath, execArgs, prepared.env)
 }
 
-// Legacy function kept for compatibility - prefer RunWithSetup
-func Run(command string, args []string) error {
-	fmt.Printf("[ns] Using legacy Run function - consider using RunWithSetup\n")
+// preparedExec is what setupNamespaceEnvironment resolved for the final exec
+type preparedExec struct {
+	commandPath string
+	env         []string
+	user        containerUser
+}
 
-	cmd := exec.Command(command, args...)
-	cmd.SysProcAttr = &syscall.SysProcAttr{
-		Cloneflags: syscall.CLONE_NEWUTS | syscall.CLONE_NEWPID | syscall.CLONE_NEWNS,
+// setupNamespaceEnvironment performs all setup inside the new namespaces
+// that has to happen before the workload may start
+func setupNamespaceEnvironment(config ContainerConfig, targetCmd string) (preparedExec, error) {
+	// Step 1: Stop our mounts from propagating back to the host
+	// CLONE_NEWNS copies the mount table, including "shared" propagation, so
+	// without this the /proc and bind mounts below would appear on the host too.
+	// Binds are cloned before, so they can keep the propagation asked for.
+	// In the host's mount namespace nothing may be mounted at all.
+	ownMounts := hasOwnMountNamespace(config)
+	var clones []*os.File
+	err := traced("clone bind sources", func() error {
+		var idmapped []*os.File
+		if config.IDMappedMounts {
+			var err error
+			if idmapped, err = receiveIDMappedMounts(config.Mounts); err != nil {
+				return err
+			}
+		}
+		var err error
+		clones, err = cloneMounts(config.Mounts, idmapped)
+		if err != nil {
+			closeMounts(idmapped)
+		}
+		return err
+	})
+	if err != nil {
+		return preparedExec{}, err
+	}
+	if ownMounts {
+		logf("[ns] Making mount tree private\n")
+		err = traced("make mounts private", func() error {
+			if err := mountTraced("", "/", "", unix.MS_REC|unix.MS_PRIVATE, ""); err != nil {
+				return fmt.Errorf("failed to make mounts private: %v", err)
+			}
+			return nil
+		})
+		if err != nil {
+			closeMounts(clones)
+			return preparedExec{}, err
+		}
+	}
+
+	// Step 1a: Make the --rootfs a mount point, to mount everything below
+	// in and pivot into at the end
+	if config.Rootfs != "" {
+		logf("[ns] Using root filesystem %s\n", config.Rootfs)
+		if err := traced("bind rootfs", func() error { return bindRootfs(config.Rootfs) }); err != nil {
+			closeMounts(clones)
+			return preparedExec{}, err
+		}
+	}
+
+	// Step 1b: Bring up the interfaces of the container's network namespace
+	if err := traced("configure network", func() error { return setUpContainerNetwork(config) }); err != nil {
+		closeMounts(clones)
+		return preparedExec{}, err
+	}
+
+	// Step 2: Set the container's hostname and mount the managed /etc files
+	// (hostname, hosts, resolv.conf) from the container directory
+	if hasOwnUTSNamespace(config) {
+		logf("[ns] Setting hostname to '%s'\n", config.Hostname)
+		err = traced("set hostname", func() error {
+			started := time.Now()
+			err := unix.Sethostname([]byte(config.Hostname))
+			traceSyscall(started, err, "sethostname(%q)", config.Hostname)
+			if err != nil {
+				return fmt.Errorf("failed to set hostname: %v", err)
+			}
+			return nil
+		})
+		if err != nil {
+			closeMounts(clones)
+			return preparedExec{}, err
+		}
+	}
+	if !ownMounts {
+		logf("[ns] Sharing the host's mounts: no /proc, /sys or /etc files of the container's own\n")
+		return resolveExec(config, targetCmd)
+	}
+	if err := traced("mount /etc files", func() error { return mountEtcFiles(config.Rootfs, config.ContainerDir) }); err != nil {
+		closeMounts(clones)
+		return preparedExec{}, err
+	}
+
+	// Step 3: Mount /proc for the new PID namespace
+	// This gives us the isolated view of processes (ps, top, etc. will work correctly)
+	logf("[ns] Mounting /proc filesystem for isolated process view\n")
+	if err := traced("mount /proc", func() error { return mountProc(config.Rootfs, config.ProcOptions) }); err != nil {
+		closeMounts(clones)
+		return preparedExec{}, err
+	}
+
+	// Step 3b: Cover the host's /sys with a read-only one (--sysfs)
+	logf("[ns] Mounting read-only /sys\n")
+	if err := traced("mount /sys", func() error { return mountSysfs(config) }); err != nil {
+		closeMounts(clones)
+		return preparedExec{}, err
+	}
+
+	// Step 3c: Mask and write-protect the sensitive parts of /proc and /sys
+	logf("[ns] Masking sensitive paths in /proc and /sys\n")
+	if err := traced("mask paths", func() error { return applyMaskedPaths(config) }); err != nil {
+		closeMounts(clones)
+		return preparedExec{}, err
+	}
+
+	// Step 3d: Give a --rootfs a /dev of its own, and list the IPC
+	// namespace's own message queues
+	if config.Rootfs != "" {
+		logf("[ns] Populating /dev\n")
+		if err := traced("mount /dev", func() error { return mountDev(config) }); err != nil {
+			closeMounts(clones)
+			return preparedExec{}, err
+		}
+	}
+	if err := traced("mount /dev/mqueue", func() error { return mountMqueue(config) }); err != nil {
+		closeMounts(clones)
+		return preparedExec{}, err
 	}
 
+	// Step 3e: Attach the binds (-v)
+	if err := traced("attach mounts", func() error { return attachMounts(config.Rootfs, config.Mounts, clones) }); err != nil {
+		return preparedExec{}, err
+	}
+
+	// Step 3f: Make the root read-only (--read-only), now that everything
+	// is mounted in it
+	if config.ReadOnly {
+		logf("[ns] Making the root filesystem read-only\n")
+		if err := traced("make root read-only", func() error { return makeRootReadOnly(config.Rootfs) }); err != nil {
+			return preparedExec{}, err
+		}
+	}
+
+	// Step 3g: Leave the host's root for the --rootfs
+	if config.Rootfs != "" {
+		logf("[ns] Pivoting into %s\n", config.Rootfs)
+		if err := traced("pivot root", func() error { return pivotRoot(config.Rootfs) }); err != nil {
+			return preparedExec{}, err
+		}
+	}
+
+	// Step 4: Resolve the user and the command
+	return resolveExec(config, targetCmd)
+}
+
+// resolveExec resolves the user from the container's passwd file and finds
+// the command, so that mistakes in either fail "create" rather than "start"
+func resolveExec(config ContainerConfig, targetCmd string) (preparedExec, error) {
+	var prepared preparedExec
+	err := traced("resolve user and command", func() error {
+		resolvedUser, err := resolveUser(config.User)
+		if err != nil {
+			return err
+		}
+		if resolvedUser.Groups, err = resolveGroups(config.GroupAdd); err != nil {
+			return err
+		}
+
+		targetPath, err := exec.LookPath(targetCmd)
+		if err != nil {
+			return fmt.Errorf("command not found: %s (%v)", targetCmd, err)
+		}
+		if config.Platform.Architecture != "" {
+			if err := checkCommandPlatform(targetPath, config.Platform); err != nil {
+				return err
+			}
+		}
+
+		prepared = preparedExec{
+			commandPath: targetPath,
+			env:         withDefaultHome(os.Environ(), resolvedUser.Home),
+			user:        resolvedUser,
+		}
+		return nil
+	})
+	return prepared, err
+}
+
+// readSetupConfig reads the ContainerConfig sent by RunWithConfig on setupConfigFD
+func readSetupConfig() (ContainerConfig, error) {
+	var config ContainerConfig
+
+	configPipe := os.NewFile(setupConfigFD, "config-pipe")
+	defer configPipe.Close()
+
+	if err := json.NewDecoder(configPipe).Decode(&config); err != nil {
+		return config, fmt.Errorf("failed to read container config: %v", err)
+	}
+	return config, nil
+}
+
+// Run starts a command in the namespaces modes picks, without the setup
+// of RunWithSetup: no /proc, hostname, cgroup or network configuration of
+// its own. Prefer RunWithSetup
+func Run(command string, args []string, modes NamespaceModes) error {
+	logf("[ns] Using legacy Run function - consider using RunWithSetup\n")
+
+	config, err := modes.containerConfig()
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(command, args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: cloneFlags(config)}
+
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 
-	if err := cmd.Start(); err != nil {
+	if err := startInJoinedNamespaces(cmd, config); err != nil {
 		return fmt.Errorf("failed to start command in namespace: %v", err)
 	}
 
 	containerPID := cmd.Process.Pid
-	fmt.Printf("[ns] Started process with PID %d\n", containerPID)
+	logf("[ns] Started process with PID %d\n", containerPID)
 
 	return cmd.Wait()
 }
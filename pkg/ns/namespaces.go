@@ -0,0 +1,252 @@
+//go:build linux
+
+package ns
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+
+	"nsctl/pkg/cgroup"
+)
+
+// Choosing a container's namespaces (--uts, --pid, --mnt, --net, --ipc,
+// --cgroupns)
+//
+// A container gets new UTS, PID, mount, IPC and cgroup namespaces, a
+// network namespace of its own unless it is rootless (see network.go), a
+// user namespace when it is rootless or has ID mappings (see userns.go)
+// and a time namespace with --time-offset (see timens.go). Any of the
+// first six can be left the host's instead, e.g. to isolate a workload's
+// processes while it keeps the host's network:
+//
+//	nsctl run --net=false --pid ...
+//
+// The flags take true or false, or private or host, after "=", and --uts,
+// --pid, --net and --ipc also container:<id> to share the namespace of
+// another container (see join.go). --net gives the container the default
+// network of its own: bridge, or none when it is rootless. The user
+// namespace has no such flag, because --user names the workload's user.
+// --userns and --uidmap decide it instead.
+//
+// What a container sharing a namespace with the host can't have is
+// refused. With the host's UTS namespace it can't have --hostname and its
+// /etc/hostname names the host. With the host's mount namespace setup
+// mounts nothing, so there are no -v mounts or proc-opts and the container
+// sees the host's /proc, /sys and /etc files; with a PID namespace of its
+// own, that /proc shows the host's processes. With the host's PID
+// namespace the processes the workload starts don't die with it, so the
+// shim kills what is left in its cgroup. A chroot container shares all of
+// them.
+//
+// Run, which starts a bare process without any of this setup, takes the
+// same modes as NamespaceModes, its clone flags following from them.
+
+// Namespace modes
+const (
+	NamespacePrivate = "private"
+	NamespaceHost    = "host"
+)
+
+// NamespaceModes picks the namespaces of a process started by Run, each
+// private (the default), host or, except Mount, container:<id>; a private
+// network namespace only has a loopback interface
+type NamespaceModes struct {
+	UTS     string
+	PID     string
+	Mount   string
+	Network string
+	IPC     string
+}
+
+// containerConfig checks the modes and returns them as the namespace modes
+// of a ContainerConfig, with the host's cgroup namespace
+func (modes NamespaceModes) containerConfig() (ContainerConfig, error) {
+	config := ContainerConfig{
+		UTSNamespace:    modes.UTS,
+		PIDNamespace:    modes.PID,
+		MountNamespace:  modes.Mount,
+		IPCNamespace:    modes.IPC,
+		CgroupNamespace: NamespaceHost,
+		Network:         modes.Network,
+	}
+	switch config.Network {
+	case "", NamespacePrivate:
+		config.Network = NetworkNone
+	case NamespaceHost:
+		config.Network = NetworkHost
+	default:
+		if _, joined := joinedContainer(config.Network); !joined {
+			return config, fmt.Errorf("invalid network namespace mode %q: expected %s, %s or %s<id>", config.Network, NamespacePrivate, NamespaceHost, NamespaceContainerPrefix)
+		}
+	}
+	for _, namespace := range namespaceModes(&config) {
+		if err := prepareNamespaceMode(namespace.mode, namespace.name, namespace.joinable, IsolationNamespaces); err != nil {
+			return config, err
+		}
+	}
+	return config, resolveJoinedContainers(&config)
+}
+
+// prepareNamespaces checks the namespace modes of a container and picks
+// the defaults, except the network's and the user namespace's; it runs
+// before the hostname is filled in
+func prepareNamespaces(config *ContainerConfig) error {
+	// Kernels before 4.6 have no cgroup namespaces
+	if config.CgroupNamespace == "" && !kernelHasNamespace("cgroup") {
+		config.CgroupNamespace = NamespaceHost
+	}
+	for _, namespace := range namespaceModes(config) {
+		if err := prepareNamespaceMode(namespace.mode, namespace.name, namespace.joinable, config.Isolation); err != nil {
+			return err
+		}
+	}
+	if err := resolveJoinedContainers(config); err != nil {
+		return err
+	}
+
+	if config.UTSNamespace == NamespaceHost && config.Isolation != IsolationChroot {
+		if config.Hostname != "" {
+			return fmt.Errorf("the container can't set a hostname: it has the host's UTS namespace")
+		}
+		hostname, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("failed to get hostname: %v", err)
+		}
+		config.Hostname = hostname
+	}
+	if !hasOwnMountNamespace(*config) && config.Isolation != IsolationChroot {
+		switch {
+		case len(config.Mounts) > 0:
+			return fmt.Errorf("the container can't mount volumes: it has the host's mount namespace")
+		case config.ProcOptions != "":
+			return fmt.Errorf("the container can't set proc-opts: it has the host's mount namespace, and /proc")
+		}
+	}
+	return nil
+}
+
+// namespaceMode is the mode of one of a container's namespaces
+type namespaceMode struct {
+	mode     *string
+	name     string
+	joinable bool
+}
+
+// namespaceModes lists the namespace modes of a container but the
+// network's, which prepareNetwork checks
+func namespaceModes(config *ContainerConfig) []namespaceMode {
+	return []namespaceMode{
+		{&config.UTSNamespace, "UTS", true},
+		{&config.PIDNamespace, "PID", true},
+		{&config.MountNamespace, "mount", false},
+		{&config.IPCNamespace, "IPC", true},
+		{&config.CgroupNamespace, "cgroup", false},
+	}
+}
+
+// prepareNamespaceMode checks the mode of one namespace and defaults it to
+// private, or for a chroot container, which has no namespaces, to host;
+// the containers joinable namespaces join are looked up later
+func prepareNamespaceMode(mode *string, name string, joinable bool, isolation string) error {
+	_, joined := joinedContainer(*mode)
+	switch {
+	case *mode == "":
+		*mode = NamespacePrivate
+		if isolation == IsolationChroot {
+			*mode = NamespaceHost
+		}
+		return nil
+	case *mode == NamespacePrivate, *mode == NamespaceHost:
+	case joined && joinable:
+		return nil
+	case joinable:
+		return fmt.Errorf("invalid %s namespace mode %q: expected %s, %s or %s<id>", name, *mode, NamespacePrivate, NamespaceHost, NamespaceContainerPrefix)
+	default:
+		return fmt.Errorf("invalid %s namespace mode %q: expected %s or %s", name, *mode, NamespacePrivate, NamespaceHost)
+	}
+	if isolation == IsolationChroot && *mode != NamespaceHost {
+		return fmt.Errorf("--isolation %s can't have a %s namespace of its own: the container has the host's", IsolationChroot, name)
+	}
+	return nil
+}
+
+// isOwnNamespace reports whether a namespace mode gives the container a
+// namespace of its own rather than the host's or another container's
+func isOwnNamespace(mode string) bool {
+	_, joined := joinedContainer(mode)
+	return mode != NamespaceHost && !joined
+}
+
+// hasOwnUTSNamespace reports whether a container gets a UTS namespace
+func hasOwnUTSNamespace(config ContainerConfig) bool {
+	return isOwnNamespace(config.UTSNamespace)
+}
+
+// hasOwnPIDNamespace reports whether a container gets a PID namespace
+func hasOwnPIDNamespace(config ContainerConfig) bool {
+	return isOwnNamespace(config.PIDNamespace)
+}
+
+// hasOwnMountNamespace reports whether a container gets a mount namespace
+func hasOwnMountNamespace(config ContainerConfig) bool {
+	return isOwnNamespace(config.MountNamespace)
+}
+
+// ownNamespaces names the namespaces a container gets, for the log
+func ownNamespaces(config ContainerConfig) []string {
+	var names []string
+	for _, namespace := range []struct {
+		name string
+		own  bool
+	}{
+		{"PID", hasOwnPIDNamespace(config)},
+		{"UTS", hasOwnUTSNamespace(config)},
+		{"Mount", hasOwnMountNamespace(config)},
+		{"Network", hasOwnNetworkNamespace(config)},
+		{"IPC", hasOwnIPCNamespace(config)},
+		{"Cgroup", hasOwnCgroupNamespace(config)},
+		{"Time", hasOwnTimeNamespace(config)},
+		{"User", len(config.UIDMappings) > 0},
+	} {
+		if namespace.own {
+			names = append(names, namespace.name)
+		}
+	}
+	return names
+}
+
+// cloneFlags are the namespaces the setup process of a container is
+// cloned into; setup unshares the cgroup and time namespaces itself
+func cloneFlags(config ContainerConfig) uintptr {
+	var flags uintptr
+	for _, namespace := range []struct {
+		flag uintptr
+		own  bool
+	}{
+		{unix.CLONE_NEWUTS, hasOwnUTSNamespace(config)},
+		{unix.CLONE_NEWPID, hasOwnPIDNamespace(config)},
+		{unix.CLONE_NEWNS, hasOwnMountNamespace(config)},
+		{unix.CLONE_NEWNET, hasOwnNetworkNamespace(config)},
+		{unix.CLONE_NEWIPC, hasOwnIPCNamespace(config)},
+		{unix.CLONE_NEWUSER, len(config.UIDMappings) > 0},
+	} {
+		if namespace.own {
+			flags |= namespace.flag
+		}
+	}
+	return flags
+}
+
+// killLeftovers kills what the workload of a container without a PID
+// namespace of its own left running: its processes don't die with it
+func killLeftovers(config ContainerConfig, containerCgroup *cgroup.Cgroup) {
+	if containerCgroup == nil {
+		logf("[shim] Warning: container %s has no cgroup, processes it started may still be running\n", ShortID(config.ID))
+		return
+	}
+	if err := containerCgroup.Kill(); err != nil {
+		logf("[shim] Warning: %v\n", err)
+	}
+}
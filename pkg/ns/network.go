@@ -0,0 +1,272 @@
+//go:build linux
+
+package ns
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+
+	"nsctl/pkg/network"
+)
+
+// Container networks (--network)
+//
+//	bridge   a network namespace of its own, with an eth0 on the host's
+//	         nsctl0 bridge and an address from 10.87.0.0/16; the default
+//	         for root
+//	host     the host's network namespace, interfaces and ports; the
+//	         default for rootless and chroot containers
+//	none     a network namespace with only a loopback interface
+//	container:<id>
+//	         the network namespace of another container (see join.go)
+//
+// For a bridge container the shim creates the nsctl0 bridge (gateway
+// 10.87.0.1) where it doesn't exist yet, switches on IPv4 forwarding,
+// adds iptables rules that masquerade the subnet, allocates the container
+// an address and creates a veth pair: veth<id> on the bridge, eth0 in the
+// container's namespace. Setup then brings up lo and eth0 and routes
+// through the gateway. The pair disappears with the namespace; the address
+// stays the container's across restarts and is released when its shim
+// exits. Addresses are allocated as files named after them in the state
+// directory's network directory, holding the ID of the container using
+// them; a file whose container's shim is gone is free again. Without
+// iptables the container can only reach the host.
+//
+// Creating veths on the host takes root: a rootless container can't have
+// --network bridge, but does get a namespace of its own with --network
+// none. --net (see namespaces.go) asks for a namespace of the container's
+// own without naming the mode: bridge, or none when rootless.
+
+// Network modes; NetworkPrivate is resolved to bridge or none
+const (
+	NetworkBridge  = "bridge"
+	NetworkHost    = "host"
+	NetworkNone    = "none"
+	NetworkPrivate = "private"
+)
+
+const (
+	// bridgeName is the host's bridge for containers, bridgeSubnet its
+	// subnet and bridgeGateway its address, the containers' default route
+	bridgeName    = "nsctl0"
+	bridgeSubnet  = "10.87.0.0/16"
+	bridgeGateway = "10.87.0.1/16"
+
+	// containerInterfaceName is the container's end of its veth pair;
+	// hostInterfacePrefix starts the host's end, followed by the ID
+	containerInterfaceName = "eth0"
+	hostInterfacePrefix    = "veth"
+
+	// networkDirName holds the address allocations, in the state directory
+	networkDirName = "network"
+
+	// addressLockFileName is locked while an address is allocated
+	addressLockFileName = "addresses.lock"
+)
+
+// prepareNetwork checks a container's --network mode and picks the default;
+// it runs once its isolation and user namespace are known
+func prepareNetwork(config *ContainerConfig) error {
+	if _, joined := joinedContainer(config.Network); joined {
+		// Checked with the other joined namespaces, see join.go
+		return nil
+	}
+	switch config.Network {
+	case "":
+		config.Network = NetworkHost
+		if !config.Rootless && config.Isolation != IsolationChroot {
+			config.Network = NetworkBridge
+		}
+		return nil
+	case NetworkPrivate:
+		config.Network = NetworkBridge
+		if config.Rootless {
+			config.Network = NetworkNone
+		}
+	case NetworkBridge:
+		if config.Rootless {
+			return fmt.Errorf("--network %s needs root to create the container's interfaces; rootless containers can use --network %s or %s", NetworkBridge, NetworkHost, NetworkNone)
+		}
+	case NetworkHost, NetworkNone:
+	default:
+		return fmt.Errorf("invalid network %q: expected %s, %s, %s or %s<id>", config.Network, NetworkBridge, NetworkHost, NetworkNone, NamespaceContainerPrefix)
+	}
+	if config.Isolation == IsolationChroot && config.Network != NetworkHost {
+		return fmt.Errorf("--isolation %s can't have a network of its own: the container has the host's", IsolationChroot)
+	}
+	return nil
+}
+
+// hasOwnNetworkNamespace reports whether a container gets a network
+// namespace
+func hasOwnNetworkNamespace(config ContainerConfig) bool {
+	return config.Network == NetworkBridge || config.Network == NetworkNone
+}
+
+// hostInterfaceName names the host's end of a container's veth pair
+func hostInterfaceName(containerID string) string {
+	return hostInterfacePrefix + containerID[:unix.IFNAMSIZ-1-len(hostInterfacePrefix)]
+}
+
+// connectContainer plugs the network namespace of the container's setup
+// process pid into the bridge, allocating the container's address the
+// first time; it runs in the shim before setup gets the config
+func connectContainer(config *ContainerConfig, pid int) error {
+	if config.Network != NetworkBridge {
+		return nil
+	}
+	if err := prepareBridge(); err != nil {
+		return err
+	}
+
+	if config.IPAddress == "" {
+		address, err := allocateAddress(config.ID)
+		if err != nil {
+			return err
+		}
+		config.IPAddress = address.String()
+		if err := writeHostsFile(config.ContainerDir, config.Hostname, address.IP.String()); err != nil {
+			return err
+		}
+	}
+
+	hostInterface := hostInterfaceName(config.ID)
+	if err := network.CreateVeth(hostInterface, containerInterfaceName, pid, bridgeName); err != nil {
+		return err
+	}
+	logf("[shim] Container %s is on bridge %s as %s (%s)\n", ShortID(config.ID), bridgeName, config.IPAddress, hostInterface)
+	return nil
+}
+
+// prepareBridge makes sure of the bridge and the host's forwarding and NAT
+func prepareBridge() error {
+	gateway, subnet, _ := net.ParseCIDR(bridgeGateway)
+	subnet.IP = gateway
+	if err := network.EnsureBridge(bridgeName, subnet); err != nil {
+		return err
+	}
+
+	enabled, err := network.EnableForwarding()
+	if err != nil {
+		return err
+	}
+	if enabled {
+		logf("[shim] Enabled IPv4 forwarding for containers on %s\n", bridgeName)
+	}
+	if err := network.EnsureMasquerade(bridgeSubnet, bridgeName); err != nil {
+		if !errors.Is(err, network.ErrNoIptables) {
+			return err
+		}
+		logf("[shim] Warning: %v, containers on %s can only reach the host\n", err, bridgeName)
+	}
+	return nil
+}
+
+// setUpContainerNetwork configures the interfaces of the container's
+// network namespace, from inside it
+func setUpContainerNetwork(config ContainerConfig) error {
+	if !hasOwnNetworkNamespace(config) {
+		return nil
+	}
+	if err := network.SetUp("lo"); err != nil {
+		return err
+	}
+	if config.Network != NetworkBridge {
+		return nil
+	}
+
+	ip, subnet, err := net.ParseCIDR(config.IPAddress)
+	if err != nil {
+		return fmt.Errorf("invalid container address %q: %v", config.IPAddress, err)
+	}
+	subnet.IP = ip
+	gateway, _, _ := net.ParseCIDR(bridgeGateway)
+	logf("[ns] Configuring %s with %s, via %s\n", containerInterfaceName, config.IPAddress, gateway)
+	if err := network.AddAddress(containerInterfaceName, subnet); err != nil {
+		return fmt.Errorf("failed to configure %s: %v", containerInterfaceName, err)
+	}
+	if err := network.SetUp(containerInterfaceName); err != nil {
+		return err
+	}
+	return network.AddDefaultRoute(containerInterfaceName, gateway)
+}
+
+// allocateAddress picks the first address of the bridge's subnet no other
+// container holds, and records it for containerID
+func allocateAddress(containerID string) (*net.IPNet, error) {
+	networkDir := filepath.Join(currentStateDir, networkDirName)
+	if err := os.MkdirAll(networkDir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %v", networkDir, err)
+	}
+
+	lockPath := filepath.Join(networkDir, addressLockFileName)
+	lock, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %v", lockPath, err)
+	}
+	defer lock.Close()
+	if err := unix.Flock(int(lock.Fd()), unix.LOCK_EX); err != nil {
+		return nil, fmt.Errorf("failed to lock %s: %v", lockPath, err)
+	}
+
+	gateway, subnet, _ := net.ParseCIDR(bridgeGateway)
+	for ip := nextIP(subnet.IP); subnet.Contains(ip); ip = nextIP(ip) {
+		if ip.Equal(gateway) || !subnet.Contains(nextIP(ip)) {
+			// The broadcast address is the last one
+			continue
+		}
+		path := filepath.Join(networkDir, ip.String())
+		if owner, err := os.ReadFile(path); err == nil && addressHeld(string(owner)) {
+			continue
+		}
+		if err := os.WriteFile(path, []byte(containerID), 0600); err != nil {
+			return nil, fmt.Errorf("failed to record address %s: %v", ip, err)
+		}
+		return &net.IPNet{IP: ip, Mask: subnet.Mask}, nil
+	}
+	return nil, fmt.Errorf("no free address left in %s", bridgeSubnet)
+}
+
+// addressHeld reports whether the container owner still holds an address:
+// its shim is running, or it is being created and has none yet
+func addressHeld(owner string) bool {
+	containerInfo, err := loadContainerInfo(owner)
+	if err == nil {
+		return containerInfo.shimRunning()
+	}
+	_, err = readContainerConfig(owner)
+	return err == nil
+}
+
+// releaseAddress frees the container's address, if it still holds it
+func releaseAddress(config ContainerConfig) {
+	if config.IPAddress == "" {
+		return
+	}
+	ip, _, err := net.ParseCIDR(config.IPAddress)
+	if err != nil {
+		return
+	}
+	path := filepath.Join(currentStateDir, networkDirName, ip.String())
+	if owner, err := os.ReadFile(path); err == nil && string(owner) == config.ID {
+		os.Remove(path)
+	}
+}
+
+// nextIP returns the IPv4 address after ip
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, net.IPv4len)
+	copy(next, ip.To4())
+	for index := len(next) - 1; index >= 0; index-- {
+		next[index]++
+		if next[index] != 0 {
+			break
+		}
+	}
+	return next
+}
@@ -0,0 +1,548 @@
+//go:build linux
+
+package ns
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"nsctl/pkg/cgroup"
+)
+
+// OCI runtime spec generation ("nsctl spec")
+//
+// The types below are the subset of the OCI runtime specification
+// (https://github.com/opencontainers/runtime-spec/blob/main/config.md) that
+// describes what nsctl actually does, so the generated config.json can be
+// compared with nsctl's behaviour or handed to runc. Settings the spec has
+// no field for (--timeout, --rm, log limits) are recorded as annotations.
+
+// ociSpecVersion is the runtime-spec version the generated configs follow
+const ociSpecVersion = "1.0.2"
+
+// Annotation keys for nsctl settings outside the OCI spec
+const (
+	annotationTimeout    = "io.nsctl.timeout"
+	annotationAutoRemove = "io.nsctl.auto-remove"
+	annotationLogMaxSize = "io.nsctl.log-max-size"
+)
+
+// reservedAnnotationPrefix is the namespace of nsctl's own annotations,
+// which --annotation may not set
+const reservedAnnotationPrefix = "io.nsctl."
+
+// validateAnnotations checks the --annotation keys of a container
+func validateAnnotations(annotations map[string]string) error {
+	for key := range annotations {
+		if key == "" || strings.ContainsAny(key, " \t\n=") {
+			return fmt.Errorf("invalid annotation key %q", key)
+		}
+		if strings.HasPrefix(key, reservedAnnotationPrefix) {
+			return fmt.Errorf("annotation %s: keys starting with %s are reserved for nsctl", key, reservedAnnotationPrefix)
+		}
+	}
+	return nil
+}
+
+// OCISpec is an OCI runtime config.json
+type OCISpec struct {
+	OCIVersion  string            `json:"ociVersion"`
+	Process     OCIProcess        `json:"process"`
+	Root        OCIRoot           `json:"root"`
+	Hostname    string            `json:"hostname,omitempty"`
+	Mounts      []OCIMount        `json:"mounts,omitempty"`
+	Hooks       *Hooks            `json:"hooks,omitempty"`
+	Linux       OCILinux          `json:"linux"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// OCIProcess describes the container's workload
+type OCIProcess struct {
+	Terminal     bool             `json:"terminal,omitempty"`
+	User         OCIUser          `json:"user"`
+	Args         []string         `json:"args"`
+	Env          []string         `json:"env,omitempty"`
+	Cwd          string           `json:"cwd"`
+	Capabilities *OCICapabilities `json:"capabilities,omitempty"`
+}
+
+// OCICapabilities are the capability sets of the workload
+type OCICapabilities struct {
+	Bounding  []string `json:"bounding"`
+	Effective []string `json:"effective"`
+	Permitted []string `json:"permitted"`
+}
+
+// OCIUser is the numeric identity the workload runs as
+type OCIUser struct {
+	UID            uint32   `json:"uid"`
+	GID            uint32   `json:"gid"`
+	AdditionalGids []uint32 `json:"additionalGids,omitempty"`
+}
+
+// OCIRoot is the container's root filesystem
+type OCIRoot struct {
+	Path     string `json:"path"`
+	Readonly bool   `json:"readonly,omitempty"`
+}
+
+// OCIMount is one entry of the container's mount list
+type OCIMount struct {
+	Destination string   `json:"destination"`
+	Type        string   `json:"type,omitempty"`
+	Source      string   `json:"source,omitempty"`
+	Options     []string `json:"options,omitempty"`
+}
+
+// OCILinux holds the Linux-specific part of the spec
+type OCILinux struct {
+	Namespaces        []OCINamespace  `json:"namespaces"`
+	UIDMappings       []OCIIDMapping  `json:"uidMappings,omitempty"`
+	GIDMappings       []OCIIDMapping  `json:"gidMappings,omitempty"`
+	Resources         *OCIResources   `json:"resources,omitempty"`
+	Seccomp           *SeccompProfile `json:"seccomp,omitempty"`
+	RootfsPropagation string          `json:"rootfsPropagation,omitempty"`
+	MaskedPaths       []string        `json:"maskedPaths,omitempty"`
+	ReadonlyPaths     []string        `json:"readonlyPaths,omitempty"`
+
+	// TimeOffsets are keyed by clock, monotonic or boottime
+	TimeOffsets map[string]OCITimeOffset `json:"timeOffsets,omitempty"`
+}
+
+// OCITimeOffset shifts a clock of the container's time namespace
+type OCITimeOffset struct {
+	Secs     int64  `json:"secs"`
+	Nanosecs uint32 `json:"nanosecs"`
+}
+
+// OCIIDMapping maps container IDs to host IDs in a user namespace
+type OCIIDMapping struct {
+	ContainerID uint32 `json:"containerID"`
+	HostID      uint32 `json:"hostID"`
+	Size        uint32 `json:"size"`
+}
+
+// OCIResources are the container's cgroup limits
+type OCIResources struct {
+	Memory  *OCIMemory        `json:"memory,omitempty"`
+	CPU     *OCICPU           `json:"cpu,omitempty"`
+	Devices []OCIDeviceCgroup `json:"devices,omitempty"`
+}
+
+// OCIDeviceCgroup allows or denies access to devices; nil numbers match
+// any
+type OCIDeviceCgroup struct {
+	Allow  bool   `json:"allow"`
+	Type   string `json:"type,omitempty"`
+	Major  *int64 `json:"major,omitempty"`
+	Minor  *int64 `json:"minor,omitempty"`
+	Access string `json:"access,omitempty"`
+}
+
+// OCICPU holds the cpu controller's CFS bandwidth limit
+type OCICPU struct {
+	Quota  int64  `json:"quota,omitempty"`
+	Period uint64 `json:"period,omitempty"`
+}
+
+// OCIMemory holds the memory controller's limits
+type OCIMemory struct {
+	Limit int64 `json:"limit,omitempty"`
+}
+
+// OCINamespace is a namespace the container gets (or joins, with Path)
+type OCINamespace struct {
+	Type string `json:"type"`
+	Path string `json:"path,omitempty"`
+}
+
+// GenerateSpec describes the container "run" would create for config
+// The managed /etc files are bind-mounted from paths relative to the bundle
+// directory, where WriteBundle puts them.
+func GenerateSpec(config ContainerConfig) (*OCISpec, error) {
+	if err := prepareNamespaces(&config); err != nil {
+		return nil, err
+	}
+	if config.Hostname == "" {
+		// "run" defaults the hostname to the short ID of the new container
+		containerID, err := generateContainerID()
+		if err != nil {
+			return nil, err
+		}
+		config.Hostname = ShortID(containerID)
+	}
+
+	// Like "run", an unprivileged user gets a user namespace; with keep-id
+	// this also picks the default user
+	if err := prepareUserNamespace(&config); err != nil {
+		return nil, err
+	}
+	if err := prepareNetwork(&config); err != nil {
+		return nil, err
+	}
+	if err := validateTimeOffsets(config); err != nil {
+		return nil, err
+	}
+
+	if err := resolveProxyEnv(&config); err != nil {
+		return nil, err
+	}
+	if err := validateTimezone(config.Timezone); err != nil {
+		return nil, err
+	}
+	if err := validateKeyring(config.Keyring); err != nil {
+		return nil, err
+	}
+	if err := validateSysfs(config.Sysfs); err != nil {
+		return nil, err
+	}
+	if config.Isolation == IsolationChroot {
+		return nil, fmt.Errorf("an OCI spec can't describe --isolation %s", IsolationChroot)
+	}
+	// Runtimes give every container a session keyring of its own
+	if config.Keyring == KeyringHost {
+		return nil, fmt.Errorf("an OCI spec can't describe --keyring %s", KeyringHost)
+	}
+	// Without a mount namespace, the runtime would mount /proc and the /etc
+	// files on the host
+	if !hasOwnMountNamespace(config) {
+		return nil, fmt.Errorf("an OCI spec can't describe a container with the host's mount namespace")
+	}
+	if err := prepareRootfs(&config); err != nil {
+		return nil, err
+	}
+
+	// nsctl resolves the user inside the container, but without a --rootfs
+	// the container sees the host's passwd and group files anyway
+	if config.Rootfs != "" && (config.User != "" || len(config.GroupAdd) > 0) {
+		return nil, fmt.Errorf("an OCI spec can't describe --user or --group-add with a --rootfs: they are resolved in the container's passwd and group files")
+	}
+	resolvedUser, err := resolveUser(config.User)
+	if err != nil {
+		return nil, err
+	}
+	if resolvedUser.Groups, err = resolveGroups(config.GroupAdd); err != nil {
+		return nil, err
+	}
+	var additionalGIDs []uint32
+	for _, gid := range resolvedUser.Groups {
+		additionalGIDs = append(additionalGIDs, uint32(gid))
+	}
+
+	spec := &OCISpec{
+		OCIVersion: ociSpecVersion,
+		Process: OCIProcess{
+			Terminal: hasTerminal(config) && !config.CreateOnly,
+			User:     OCIUser{UID: uint32(resolvedUser.UID), GID: uint32(resolvedUser.GID), AdditionalGids: additionalGIDs},
+			Args:     append([]string{config.Command}, config.Args...),
+			Env:      withDefaultHome(buildContainerEnv(config), resolvedUser.Home),
+			Cwd:      "/",
+		},
+		// Containers share the host's root filesystem, unless they have a
+		// --rootfs (below)
+		Root:     OCIRoot{Path: "/"},
+		Hostname: config.Hostname,
+		Mounts: []OCIMount{
+			{Destination: "/proc", Type: "proc", Source: "proc"},
+		},
+		Linux: OCILinux{
+			Namespaces:        []OCINamespace{},
+			RootfsPropagation: "private",
+		},
+	}
+	if hasOwnPIDNamespace(config) {
+		spec.Linux.Namespaces = append(spec.Linux.Namespaces, OCINamespace{Type: "pid"})
+	}
+	// Runtimes only set the hostname in a UTS namespace of the container's
+	// own; the bundle's /etc/hostname still names the host
+	if hasOwnUTSNamespace(config) {
+		spec.Linux.Namespaces = append(spec.Linux.Namespaces, OCINamespace{Type: "uts"})
+	} else {
+		spec.Hostname = ""
+	}
+	spec.Linux.Namespaces = append(spec.Linux.Namespaces, OCINamespace{Type: "mount"})
+
+	// A rootful workload keeps only the --cap-add capabilities, unless it is
+	// privileged; rootless ones keep all of theirs, which only apply in
+	// their user namespace
+	if !config.Rootless {
+		keep, err := containerCapabilities(config)
+		if err != nil {
+			return nil, err
+		}
+		capabilities := capabilityList(keep)
+		spec.Process.Capabilities = &OCICapabilities{
+			Bounding:  capabilities,
+			Effective: capabilities,
+			Permitted: capabilities,
+		}
+	}
+
+	// The profile format is the spec's own
+	if err := checkPrivileged(config); err != nil {
+		return nil, err
+	}
+	if err := applySecurityOpts(&config); err != nil {
+		return nil, err
+	}
+	spec.Linux.Seccomp = config.Seccomp
+	spec.Linux.MaskedPaths = config.MaskedPaths
+	spec.Linux.ReadonlyPaths = config.ReadonlyPaths
+	if config.ProcOptions != "" {
+		spec.Mounts[0].Options = append([]string{"nosuid", "nodev", "noexec"}, strings.Split(config.ProcOptions, ",")...)
+	}
+
+	memoryLimit, err := ParseSize(config.Memory)
+	if err != nil {
+		return nil, fmt.Errorf("invalid memory limit: %v", err)
+	}
+	devices := containerDevices(config)
+	if memoryLimit > 0 || config.CPUs > 0 || devices != nil {
+		spec.Linux.Resources = &OCIResources{}
+	}
+	if memoryLimit > 0 {
+		spec.Linux.Resources.Memory = &OCIMemory{Limit: memoryLimit}
+	}
+	if config.CPUs > 0 {
+		// The same 100ms period nsctl's cgroups use
+		spec.Linux.Resources.CPU = &OCICPU{Quota: int64(config.CPUs * 100000), Period: 100000}
+	}
+	if devices != nil {
+		spec.Linux.Resources.Devices = ociDeviceRules(devices)
+	}
+
+	// A bridge container's interfaces are the business of whatever sets up
+	// the namespace's network for the runtime, e.g. a CNI plugin
+	if hasOwnNetworkNamespace(config) {
+		spec.Linux.Namespaces = append(spec.Linux.Namespaces, OCINamespace{Type: "network"})
+	}
+	if hasOwnIPCNamespace(config) {
+		spec.Linux.Namespaces = append(spec.Linux.Namespaces, OCINamespace{Type: "ipc"})
+	}
+	// /sys as nsctl mounts it, where rootless runtimes can't mount sysfs
+	// either: in the host's network namespace. Runtimes mount the
+	// container's own cgroup on /sys/fs/cgroup.
+	sysfsAccess := "ro"
+	if config.Privileged {
+		sysfsAccess = "rw"
+	}
+	sysfsOptions := []string{"nosuid", "noexec", "nodev", sysfsAccess}
+	switch {
+	case config.Sysfs == SysfsNone:
+		spec.Linux.MaskedPaths = append([]string{"/sys"}, spec.Linux.MaskedPaths...)
+	case config.Sysfs == SysfsBind || (config.Rootless && !hasOwnNetworkNamespace(config)):
+		spec.Mounts = append(spec.Mounts, OCIMount{Destination: "/sys", Type: "bind", Source: "/sys", Options: append([]string{"rbind"}, sysfsOptions...)})
+	default:
+		spec.Mounts = append(spec.Mounts, OCIMount{Destination: "/sys", Type: "sysfs", Source: "sysfs", Options: sysfsOptions})
+	}
+	if config.Sysfs != SysfsNone {
+		spec.Mounts = append(spec.Mounts, OCIMount{Destination: "/sys/fs/cgroup", Type: "cgroup", Source: "cgroup", Options: append([]string{"relatime"}, sysfsOptions...)})
+	}
+	// A --rootfs gets a /dev of its own, as in nsctl; runtimes create the
+	// standard nodes and the ptmx link in it themselves. A privileged one
+	// has the host's /dev bound into it.
+	if config.Rootfs != "" {
+		spec.Root.Path = config.Rootfs
+		if config.Privileged {
+			spec.Mounts = append(spec.Mounts, OCIMount{Destination: "/dev", Type: "bind", Source: "/dev", Options: []string{"rbind"}})
+		} else {
+			ptsOptions := devPtsRootfulOptions
+			if config.Rootless {
+				ptsOptions = devPtsOptions
+			}
+			spec.Mounts = append(spec.Mounts,
+				OCIMount{Destination: "/dev", Type: "tmpfs", Source: "tmpfs", Options: append([]string{"nosuid", "strictatime"}, strings.Split(devTmpfsOptions, ",")...)},
+				OCIMount{Destination: "/dev/pts", Type: "devpts", Source: "devpts", Options: append([]string{"nosuid", "noexec"}, strings.Split(ptsOptions, ",")...)},
+				OCIMount{Destination: "/dev/shm", Type: "tmpfs", Source: "shm", Options: append([]string{"nosuid", "nodev", "noexec"}, strings.Split(shmTmpfsOptions, ",")...)},
+			)
+		}
+	}
+	if config.IPCNamespace != NamespaceHost {
+		spec.Mounts = append(spec.Mounts, OCIMount{
+			Destination: mqueueMountPoint,
+			Type:        "mqueue",
+			Source:      "mqueue",
+			Options:     []string{"nosuid", "noexec", "nodev"},
+		})
+	}
+	// Namespaces joined from another container are given by the path of its
+	// workload's, so the spec only works while that container runs
+	for _, namespace := range joinableNamespaces(&config) {
+		path, joined, err := joinedNamespacePath(*namespace.mode, namespace.name)
+		if err != nil {
+			return nil, err
+		}
+		if joined {
+			spec.Linux.Namespaces = append(spec.Linux.Namespaces, OCINamespace{Type: namespace.ociType, Path: path})
+		}
+	}
+	if hasOwnCgroupNamespace(config) {
+		spec.Linux.Namespaces = append(spec.Linux.Namespaces, OCINamespace{Type: "cgroup"})
+	}
+	if hasOwnTimeNamespace(config) {
+		spec.Linux.Namespaces = append(spec.Linux.Namespaces, OCINamespace{Type: "time"})
+		spec.Linux.TimeOffsets = map[string]OCITimeOffset{}
+		for _, offset := range config.TimeOffsets {
+			seconds, nanoseconds := splitTimeOffset(offset.Offset)
+			spec.Linux.TimeOffsets[offset.Clock] = OCITimeOffset{Secs: seconds, Nanosecs: uint32(nanoseconds)}
+		}
+	}
+	if len(config.UIDMappings) > 0 {
+		spec.Linux.Namespaces = append(spec.Linux.Namespaces, OCINamespace{Type: "user"})
+		spec.Linux.UIDMappings = ociIDMappings(config.UIDMappings)
+		spec.Linux.GIDMappings = ociIDMappings(config.GIDMappings)
+	}
+
+	if err := prepareMounts(&config); err != nil {
+		return nil, err
+	}
+	if err := prepareReadOnly(&config); err != nil {
+		return nil, err
+	}
+	spec.Root.Readonly = config.ReadOnly
+	if err := describeVolumes(config.Mounts); err != nil {
+		return nil, err
+	}
+	for _, mount := range config.Mounts {
+		spec.Mounts = append(spec.Mounts, ociMount(mount))
+	}
+
+	if spec.Hooks, err = matchHooks(config); err != nil {
+		return nil, err
+	}
+
+	for _, managedFile := range managedEtcFiles {
+		spec.Mounts = append(spec.Mounts, OCIMount{
+			Destination: managedFile.containerPath,
+			Type:        "bind",
+			Source:      managedFile.fileName,
+			Options:     []string{"bind"},
+		})
+	}
+
+	if err := validateAnnotations(config.Annotations); err != nil {
+		return nil, err
+	}
+	annotations := map[string]string{}
+	for key, value := range config.Annotations {
+		annotations[key] = value
+	}
+	if config.Timeout > 0 {
+		annotations[annotationTimeout] = config.Timeout.String()
+	}
+	if config.AutoRemove {
+		annotations[annotationAutoRemove] = "true"
+	}
+	if config.LogMaxSize != "" {
+		annotations[annotationLogMaxSize] = config.LogMaxSize
+	}
+	if len(annotations) > 0 {
+		spec.Annotations = annotations
+	}
+
+	return spec, nil
+}
+
+// ociMount describes a -v or --mount mount in the spec
+func ociMount(mount Mount) OCIMount {
+	options := mount.options()
+	if mount.isBind() {
+		return OCIMount{
+			Destination: mount.Destination,
+			Type:        "bind",
+			Source:      mount.Source,
+			Options:     append([]string{"rbind", mount.Propagation}, options...),
+		}
+	}
+
+	mode := mount.TmpfsMode
+	if mode == 0 {
+		mode = 01777
+	}
+	if !mount.NoSuid {
+		options = append(options, "nosuid")
+	}
+	if !mount.NoDev {
+		options = append(options, "nodev")
+	}
+	options = append(options, fmt.Sprintf("mode=%o", mode))
+	if mount.TmpfsSize > 0 {
+		options = append(options, fmt.Sprintf("size=%d", mount.TmpfsSize))
+	}
+	return OCIMount{Destination: mount.Destination, Type: "tmpfs", Source: "tmpfs", Options: options}
+}
+
+// ociDeviceRules describes a device allow list in the spec: everything is
+// denied, then each rule allowed
+func ociDeviceRules(rules []cgroup.DeviceRule) []OCIDeviceCgroup {
+	converted := []OCIDeviceCgroup{{Allow: false, Access: "rwm"}}
+	for _, rule := range rules {
+		device := OCIDeviceCgroup{Allow: true, Type: string(rule.Type), Access: rule.Access}
+		if rule.Major >= 0 {
+			device.Major = &rule.Major
+		}
+		if rule.Minor >= 0 {
+			device.Minor = &rule.Minor
+		}
+		converted = append(converted, device)
+	}
+	return converted
+}
+
+// ociIDMappings converts ID mappings to their OCI form
+func ociIDMappings(mappings []IDMap) []OCIIDMapping {
+	var converted []OCIIDMapping
+	for _, mapping := range mappings {
+		converted = append(converted, OCIIDMapping{
+			ContainerID: uint32(mapping.ContainerID),
+			HostID:      uint32(mapping.HostID),
+			Size:        uint32(mapping.Size),
+		})
+	}
+	return converted
+}
+
+// MarshalSpec renders a spec as indented JSON, the way config.json is written
+func MarshalSpec(spec *OCISpec) ([]byte, error) {
+	data, err := json.MarshalIndent(spec, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal OCI spec: %v", err)
+	}
+	return append(data, '\n'), nil
+}
+
+// WriteBundle writes an OCI bundle directory: config.json plus the managed
+// /etc files its bind mounts refer to
+func WriteBundle(bundleDir string, spec *OCISpec) error {
+	if err := os.MkdirAll(bundleDir, 0755); err != nil {
+		return fmt.Errorf("failed to create bundle directory: %v", err)
+	}
+
+	ownNetwork := false
+	for _, namespace := range spec.Linux.Namespaces {
+		ownNetwork = ownNetwork || namespace.Type == "network"
+	}
+	hostname := spec.Hostname
+	if hostname == "" {
+		var err error
+		if hostname, err = os.Hostname(); err != nil {
+			return fmt.Errorf("failed to get hostname: %v", err)
+		}
+	}
+	if err := writeEtcFiles(bundleDir, hostname, timezoneFromEnv(spec.Process.Env), ownNetwork); err != nil {
+		return err
+	}
+
+	data, err := MarshalSpec(spec)
+	if err != nil {
+		return err
+	}
+	configPath := filepath.Join(bundleDir, containerConfigFileName)
+	if err := os.WriteFile(configPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", configPath, err)
+	}
+	return nil
+}
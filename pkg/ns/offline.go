@@ -0,0 +1,45 @@
+//go:build linux
+
+package ns
+
+import (
+	"fmt"
+	"os"
+)
+
+// Offline mode (nsctl --offline, or "offline": true in the runtime config)
+//
+// For air-gapped hosts: in offline mode nsctl itself never opens a network
+// connection. Anything that would, like pulling an image or calling a
+// webhook, fails straight away with an error saying so instead of waiting
+// for a timeout. The containers' own networking is not affected.
+
+// offlineEnvVar carries --offline to the shims and other processes nsctl
+// starts, and can be set directly as well
+const offlineEnvVar = "NSCTL_OFFLINE"
+
+// SetOffline puts this process, and those it starts, in offline mode
+func SetOffline() {
+	os.Setenv(offlineEnvVar, "1")
+}
+
+// IsOffline reports whether nsctl runs in offline mode
+func IsOffline() bool {
+	switch os.Getenv(offlineEnvVar) {
+	case "1", "true":
+		return true
+	case "0", "false":
+		return false
+	}
+	runtimeConfig, err := LoadRuntimeConfig()
+	return err == nil && runtimeConfig.Offline
+}
+
+// CheckOnline fails in offline mode; code about to use the network calls
+// it first, naming what it was going to do
+func CheckOnline(action string) error {
+	if IsOffline() {
+		return fmt.Errorf("%s needs network access, but nsctl is running offline (--offline, %s or the runtime config's \"offline\")", action, offlineEnvVar)
+	}
+	return nil
+}
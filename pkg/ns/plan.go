@@ -0,0 +1,343 @@
+//go:build linux
+
+package ns
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"nsctl/pkg/cgroup"
+)
+
+// Dry runs ("run --dry-run")
+//
+// A dry run makes the same checks as "run" (flags, mounts, hooks, security
+// options, host features) and then describes what the run would do instead
+// of doing it: the namespaces, the mounts in the order setup makes them,
+// the cgroup values, networking, the environment and the final argv.
+// Nothing is created: no container directory, record, volume, bind source
+// or cgroup. The ID (and default hostname) in the plan is made up for it;
+// the real run gets another.
+
+// PlanContainer describes the container a run with config would create
+func PlanContainer(config ContainerConfig) (string, error) {
+	if err := prepareContainerConfig(&config); err != nil {
+		return "", err
+	}
+	// For the paths in the plan; the state directory is shared by all
+	// containers anyway
+	if err := ensureStateDir(); err != nil {
+		return "", err
+	}
+	warnings, err := CheckHostFeatures(config)
+	if err != nil {
+		return "", err
+	}
+
+	resolvedUser, err := resolveUser(config.User)
+	if err != nil {
+		return "", err
+	}
+	if resolvedUser.Groups, err = resolveGroups(config.GroupAdd); err != nil {
+		return "", err
+	}
+
+	var plan strings.Builder
+	section := func(title string) {
+		if plan.Len() > 0 {
+			plan.WriteString("\n")
+		}
+		plan.WriteString(title + ":\n")
+	}
+	item := func(format string, args ...any) {
+		fmt.Fprintf(&plan, "  "+format+"\n", args...)
+	}
+
+	section("Container")
+	item("ID        %s (a real run gets a new one)", config.ID)
+	item("Hostname  %s", config.Hostname)
+	if config.Timezone != "" {
+		item("Timezone  %s", config.Timezone)
+	} else {
+		item("Timezone  the host's")
+	}
+	item("Platform  %s", config.Platform)
+	item("Mode      %s", planMode(config))
+	if logsOutput(config) {
+		item("Output    logged to %s", filepath.Join(getContainerDir(config.ID), containerLogFileName))
+	} else {
+		item("Output    the terminal (no log)")
+	}
+
+	if config.Isolation == IsolationChroot {
+		section("Isolation")
+		if hasHostRoot(config) {
+			item("chroot into /, no namespaces: the host's whole filesystem, processes, hostname, mounts, network, IPC and cgroups (reduced isolation, no filesystem confinement)")
+		} else {
+			item("chroot into %s, no namespaces: the host's processes, hostname, mounts, network, IPC and cgroups (reduced isolation)", config.Rootfs)
+		}
+		for _, rlimit := range chrootRlimits {
+			item("%-13s at most %d", rlimit.name, rlimit.limit)
+		}
+	} else {
+		section("Namespaces")
+		namespace := func(name string, own bool, mode string) {
+			if containerID, joined := joinedContainer(mode); joined {
+				item("%-16s container %s's", name, ShortID(containerID))
+			} else if own {
+				item("%-16s new", name)
+			} else {
+				item("%-16s the host's", name)
+			}
+		}
+		namespace("pid", hasOwnPIDNamespace(config), config.PIDNamespace)
+		namespace("uts", hasOwnUTSNamespace(config), config.UTSNamespace)
+		namespace("mount", hasOwnMountNamespace(config), config.MountNamespace)
+		if len(config.UIDMappings) > 0 {
+			item("user             new, uid map %s, gid map %s", formatIDMaps(config.UIDMappings), formatIDMaps(config.GIDMappings))
+		} else {
+			item("user             the host's")
+		}
+		namespace("network", hasOwnNetworkNamespace(config), config.Network)
+		namespace("ipc", hasOwnIPCNamespace(config), config.IPCNamespace)
+		if hasOwnCgroupNamespace(config) {
+			item("cgroup           new, rooted at the container's cgroup")
+		} else {
+			item("cgroup           the host's")
+		}
+		if hasOwnTimeNamespace(config) {
+			offsets := make([]string, len(config.TimeOffsets))
+			for index, offset := range config.TimeOffsets {
+				offsets[index] = offset.String()
+			}
+			item("time             new, %s", strings.Join(offsets, ", "))
+		} else {
+			item("time             the host's")
+		}
+
+	}
+	if config.Isolation != IsolationChroot && !hasOwnMountNamespace(config) {
+		section("Mounts")
+		item("none: the container has the host's mounts, /proc, /sys and /etc files")
+	} else if config.Isolation != IsolationChroot {
+		section("Mounts, in order")
+		item("/                 made rprivate, so nothing propagates back to the host")
+		if config.Rootfs != "" {
+			item("%-17s bound onto itself, everything below mounted in it", config.Rootfs)
+		}
+		for _, managedFile := range managedEtcFiles {
+			item("%-17s bind of %s", managedFile.containerPath, filepath.Join(getContainerDir(config.ID), managedFile.fileName))
+		}
+		if config.ProcOptions != "" {
+			item("/proc             proc (nosuid,nodev,noexec,%s)", config.ProcOptions)
+		} else {
+			item("/proc             proc")
+		}
+		access := "ro"
+		if config.Privileged {
+			access = "rw"
+		}
+		switch {
+		case config.Sysfs == SysfsNone:
+			item("/sys              empty read-only tmpfs (--sysfs %s)", SysfsNone)
+		case config.Sysfs == SysfsBind:
+			item("/sys              rbind of the host's /sys (%s,nosuid,nodev,noexec)", access)
+		default:
+			item("/sys              sysfs (%s,nosuid,nodev,noexec), the host's /sys bound if sysfs can't be mounted", access)
+		}
+		if config.Sysfs != SysfsNone && config.Privileged {
+			item("/sys/fs/cgroup    the container's cgroup, read-write (privileged)")
+		} else if config.Sysfs != SysfsNone {
+			item("/sys/fs/cgroup    the container's cgroup, read-only")
+		}
+		if len(config.ReadonlyPaths) > 0 {
+			item("read-only         %s", strings.Join(config.ReadonlyPaths, ", "))
+		}
+		if len(config.MaskedPaths) > 0 {
+			item("masked            %s", strings.Join(config.MaskedPaths, ", "))
+		}
+		if config.Rootfs != "" && config.Privileged {
+			item("/dev              rbind of the host's /dev, if the rootfs has the directory (privileged)")
+		} else if config.Rootfs != "" {
+			ptsOptions := devPtsRootfulOptions
+			if config.Rootless {
+				ptsOptions = devPtsOptions
+			}
+			item("/dev              tmpfs (nosuid,strictatime,%s) with null, zero, full, random, urandom, tty and console, if the rootfs has the directory", devTmpfsOptions)
+			item("/dev/pts          devpts (nosuid,noexec,%s), /dev/ptmx linked to its ptmx", ptsOptions)
+			item("/dev/shm          tmpfs (nosuid,nodev,noexec,%s)", shmTmpfsOptions)
+		}
+		if hasOwnIPCNamespace(config) && config.Rootfs != "" && !config.Privileged {
+			item("%-17s mqueue (nosuid,nodev,noexec)", mqueueMountPoint)
+		} else if hasOwnIPCNamespace(config) {
+			item("%-17s mqueue (nosuid,nodev,noexec), if the host has the directory", mqueueMountPoint)
+		}
+		for _, mount := range config.Mounts {
+			item("%-17s %s", mount.Destination, planMount(mount))
+		}
+		if config.ReadOnly {
+			item("/                 made read-only (the root mount only)")
+		}
+		if config.Rootfs != "" {
+			item("/                 pivot_root into %s, the host's root detached", config.Rootfs)
+		}
+	}
+
+	section("Cgroup")
+	memoryLimit, err := ParseSize(config.Memory)
+	if err != nil {
+		return "", fmt.Errorf("invalid memory limit: %v", err)
+	}
+	if config.Rootless {
+		item("%-22s a group in the systemd scope %s%s.scope, if systemd delegates one", "path", cgroup.ScopePrefix, config.ID)
+	} else {
+		item("%-22s %s", "path", cgroup.GroupPath(config.ID))
+	}
+	devices := containerDevices(config)
+	settings := cgroup.Settings(cgroup.Resources{MemoryLimit: memoryLimit, CPUs: config.CPUs, Devices: devices}, cgroup.IsUnified())
+	for _, setting := range settings {
+		item("%-22s %s", setting.File, setting.Value)
+	}
+	if devices != nil && cgroup.IsUnified() {
+		rules := make([]string, len(devices))
+		for index, rule := range devices {
+			rules[index] = rule.String()
+		}
+		item("%-22s allows only %s", "device filter", strings.Join(rules, ", "))
+	}
+	switch {
+	case config.Privileged:
+		item("%-22s all of the host's (privileged)", "devices")
+	case devices == nil:
+		item("%-22s those the user may open on the host (rootless)", "devices")
+	}
+	if len(settings) == 0 && devices == nil {
+		item("no limits (the cgroup only reports OOM kills)")
+	}
+
+	section("Network")
+	switch config.Network {
+	case NetworkBridge:
+		item("%-10s %s on bridge %s (gateway %s), an address from %s", "eth0", hostInterfaceName(config.ID), bridgeName, strings.Split(bridgeGateway, "/")[0], bridgeSubnet)
+		item("%-10s lo, and eth0 routing via the gateway", "up")
+		item("%-10s IPv4 forwarding on, iptables MASQUERADE for %s, if iptables is installed", "host", bridgeSubnet)
+	case NetworkNone:
+		item("only lo: the container has a network namespace of its own with no way out")
+	case NetworkHost:
+		item("the host's network namespace, interfaces and ports")
+	default:
+		containerID, _ := joinedContainer(config.Network)
+		item("container %s's network namespace, interfaces and ports", ShortID(containerID))
+	}
+
+	section("Process")
+	groups := make([]string, 0, len(resolvedUser.Groups))
+	for _, gid := range resolvedUser.Groups {
+		groups = append(groups, fmt.Sprint(gid))
+	}
+	item("user          uid %d, gid %d, groups [%s]", resolvedUser.UID, resolvedUser.GID, strings.Join(groups, " "))
+	if config.Rootless {
+		item("capabilities  all, within the user namespace")
+	} else {
+		keep, err := containerCapabilities(config)
+		if err != nil {
+			return "", err
+		}
+		item("capabilities  [%s]", strings.Join(capabilityList(keep), " "))
+	}
+	if config.Seccomp != nil {
+		item("seccomp       %d syscall rules, default action %s", len(config.Seccomp.Syscalls), config.Seccomp.DefaultAction)
+	}
+	if config.Landlock != nil {
+		item("landlock      enabled")
+	}
+	if config.Keyring == KeyringHost {
+		item("keyring       the host's session keyring")
+	} else {
+		item("keyring       a new session keyring, %s%s", keyringNamePrefix, config.ID)
+	}
+	if config.Hooks != nil {
+		item("hooks         %d prestart, %d createRuntime, %d poststart, %d poststop",
+			len(config.Hooks.Prestart), len(config.Hooks.CreateRuntime), len(config.Hooks.Poststart), len(config.Hooks.Poststop))
+	}
+
+	section("Environment")
+	for _, variable := range withDefaultHome(buildContainerEnv(config), resolvedUser.Home) {
+		item("%s", variable)
+	}
+
+	section("Command")
+	commandPath, err := exec.LookPath(config.Command)
+	if err != nil {
+		commandPath = fmt.Sprintf("%s (not found: %v)", config.Command, err)
+	}
+	item("path  %s", commandPath)
+	argv := append([]string{config.Command}, config.Args...)
+	quoted := make([]string, len(argv))
+	for index, argument := range argv {
+		quoted[index] = fmt.Sprintf("%q", argument)
+	}
+	item("argv  [%s]", strings.Join(quoted, " "))
+
+	if len(warnings) > 0 {
+		section("Warnings")
+		for _, warning := range warnings {
+			item("%s", warning)
+		}
+	}
+	return plan.String(), nil
+}
+
+// planMode describes how a run with config is started and ends
+func planMode(config ContainerConfig) string {
+	mode := "foreground"
+	switch {
+	case config.CreateOnly:
+		mode = "created, waiting for start"
+	case config.Detach:
+		mode = "detached"
+	}
+	if config.AutoRemove {
+		mode += ", removed on exit"
+	}
+	if config.Restart.Name != "" && config.Restart.Name != RestartNo {
+		mode += ", restart " + config.Restart.String()
+	}
+	if config.Timeout > 0 {
+		mode += fmt.Sprintf(", stopped after %s", config.Timeout)
+	}
+	return mode
+}
+
+// planMount describes a -v or --mount mount
+func planMount(mount Mount) string {
+	described := ociMount(mount)
+	source := described.Source
+	if mount.Type == MountTypeVolume {
+		if mount.Source == "" {
+			source = "a new anonymous volume"
+		} else {
+			source = fmt.Sprintf("volume %s (created if missing)", mount.Source)
+		}
+	} else if mount.CreateSource {
+		if _, err := os.Stat(mount.Source); os.IsNotExist(err) {
+			source += " (created)"
+		}
+	}
+	if described.Type == "tmpfs" {
+		return fmt.Sprintf("tmpfs (%s)", strings.Join(described.Options, ","))
+	}
+	return fmt.Sprintf("bind of %s (%s)", source, strings.Join(described.Options, ","))
+}
+
+// formatIDMaps formats ID mappings as --uidmap takes them
+func formatIDMaps(mappings []IDMap) string {
+	formatted := make([]string, len(mappings))
+	for index, mapping := range mappings {
+		formatted[index] = fmt.Sprintf("%d:%d:%d", mapping.ContainerID, mapping.HostID, mapping.Size)
+	}
+	return strings.Join(formatted, ",")
+}
@@ -0,0 +1,184 @@
+//go:build linux
+
+package ns
+
+import (
+	"debug/elf"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"slices"
+	"strings"
+)
+
+// Container platforms (--platform linux/arm64)
+//
+// A container's platform is the OS/architecture its binaries are built for,
+// in the os/arch[/variant] form of OCI image indexes. It defaults to the
+// host's. Setup checks the command against it before exec: an ELF binary
+// built for another architecture is refused rather than failing with
+// "exec format error", unless --platform names that architecture, in which
+// case it runs emulated through the kernel's binfmt_misc handlers. The
+// 32-bit architectures a host runs itself, 386 on amd64 and arm on arm64,
+// count as the host's.
+//
+// Without image support the platform can't pick an image variant yet; it
+// is recorded with the container, and is what the command must match.
+
+// Platform is an os/arch[/variant] platform
+type Platform struct {
+	OS           string `json:"os"`
+	Architecture string `json:"architecture"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// String formats the platform as os/arch[/variant]
+func (p Platform) String() string {
+	if p.Variant != "" {
+		return p.OS + "/" + p.Architecture + "/" + p.Variant
+	}
+	return p.OS + "/" + p.Architecture
+}
+
+// elfArchitectures maps ELF machine types to GOARCH-style architecture
+// names; the byte order tells the little-endian ppc64 and mips variants apart
+var elfArchitectures = map[elf.Machine][2]string{
+	elf.EM_X86_64:    {"amd64", "amd64"},
+	elf.EM_386:       {"386", "386"},
+	elf.EM_AARCH64:   {"arm64", "arm64"},
+	elf.EM_ARM:       {"arm", "arm"},
+	elf.EM_PPC64:     {"ppc64le", "ppc64"},
+	elf.EM_S390:      {"s390x", "s390x"},
+	elf.EM_RISCV:     {"riscv64", "riscv64"},
+	elf.EM_MIPS:      {"mipsle", "mips"},
+	elf.EM_LOONGARCH: {"loong64", "loong64"},
+}
+
+// nativeArchitectures are the 32-bit architectures whose binaries hosts of
+// a 64-bit one run without emulation, by host architecture
+var nativeArchitectures = map[string][]string{
+	"amd64": {"386"},
+	"arm64": {"arm"},
+}
+
+// HostPlatform returns the platform of the host nsctl runs on
+func HostPlatform() Platform {
+	return Platform{OS: "linux", Architecture: runtime.GOARCH}
+}
+
+// runsNatively reports whether the host runs binaries of an architecture
+// itself, without emulation
+func runsNatively(architecture string) bool {
+	host := HostPlatform().Architecture
+	return architecture == host || slices.Contains(nativeArchitectures[host], architecture)
+}
+
+// ParsePlatform parses an os/arch[/variant] platform such as linux/arm64
+// or linux/arm/v7; the OS may be left out
+func ParsePlatform(text string) (Platform, error) {
+	parts := strings.Split(strings.ToLower(text), "/")
+	if len(parts) == 1 {
+		parts = append([]string{"linux"}, parts...)
+	}
+	if len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return Platform{}, fmt.Errorf("invalid platform %q: expected os/arch[/variant], e.g. linux/arm64", text)
+	}
+	if parts[0] != "linux" {
+		return Platform{}, fmt.Errorf("unsupported platform %q: containers run on linux", text)
+	}
+
+	platform := Platform{OS: parts[0], Architecture: normalizeArchitecture(parts[1])}
+	if len(parts) == 3 {
+		platform.Variant = parts[2]
+	}
+	known := false
+	for _, architectures := range elfArchitectures {
+		known = known || platform.Architecture == architectures[0] || platform.Architecture == architectures[1]
+	}
+	if !known {
+		return Platform{}, fmt.Errorf("unsupported platform %q: unknown architecture %s", text, platform.Architecture)
+	}
+	return platform, nil
+}
+
+// normalizeArchitecture maps the architecture names of uname and other
+// tools to the GOARCH-style ones OCI uses
+func normalizeArchitecture(architecture string) string {
+	switch architecture {
+	case "x86_64", "x86-64":
+		return "amd64"
+	case "aarch64":
+		return "arm64"
+	case "i386", "i686":
+		return "386"
+	case "armhf", "armel":
+		return "arm"
+	}
+	return architecture
+}
+
+// binaryArchitecture returns the architecture an executable was built for,
+// or "" for scripts and other non-ELF files
+func binaryArchitecture(path string) (string, error) {
+	file, err := elf.Open(path)
+	if err != nil {
+		var formatErr *elf.FormatError
+		if errors.As(err, &formatErr) {
+			return "", nil
+		}
+		return "", err
+	}
+	defer file.Close()
+
+	architectures, found := elfArchitectures[file.Machine]
+	if !found {
+		return strings.ToLower(strings.TrimPrefix(file.Machine.String(), "EM_")), nil
+	}
+	if file.ByteOrder.String() == "LittleEndian" {
+		return architectures[0], nil
+	}
+	return architectures[1], nil
+}
+
+// checkCommandPlatform refuses a command built for another architecture
+// than the container's platform; the host's platform takes the binaries
+// the host runs natively
+func checkCommandPlatform(commandPath string, platform Platform) error {
+	architecture, err := binaryArchitecture(commandPath)
+	if err != nil {
+		if os.IsPermission(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to read %s: %v", commandPath, err)
+	}
+	if architecture == "" || architecture == platform.Architecture {
+		return nil
+	}
+	if platform.Architecture == HostPlatform().Architecture && runsNatively(architecture) {
+		return nil
+	}
+	hint := "run it with --platform linux/" + architecture
+	if !runsNatively(architecture) {
+		hint += ", emulated"
+	}
+	return fmt.Errorf("%s is a linux/%s binary, but the container's platform is %s (%s)", commandPath, architecture, platform, hint)
+}
+
+// preparePlatform defaults the container's platform to the host's, and
+// makes sure a foreign one can be emulated
+func preparePlatform(config *ContainerConfig) error {
+	host := HostPlatform()
+	if config.Platform.Architecture == "" {
+		config.Platform = host
+		return nil
+	}
+	if runsNatively(config.Platform.Architecture) {
+		return nil
+	}
+	if err := checkEmulation(config.Platform); err != nil {
+		return err
+	}
+	logf("[ns] Warning: platform %s doesn't match the host (%s); the container runs emulated, which is much slower\n", config.Platform, host)
+	return nil
+}
@@ -0,0 +1,76 @@
+//go:build linux
+
+package ns
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestParsePlatform(t *testing.T) {
+	tests := []struct {
+		text string
+		want Platform
+	}{
+		{"linux/amd64", Platform{OS: "linux", Architecture: "amd64"}},
+		{"arm64", Platform{OS: "linux", Architecture: "arm64"}},
+		{"linux/arm/v7", Platform{OS: "linux", Architecture: "arm", Variant: "v7"}},
+		{"Linux/ARM64/V8", Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}},
+		{"linux/x86_64", Platform{OS: "linux", Architecture: "amd64"}},
+		{"aarch64", Platform{OS: "linux", Architecture: "arm64"}},
+		{"linux/i686", Platform{OS: "linux", Architecture: "386"}},
+		{"linux/armhf", Platform{OS: "linux", Architecture: "arm"}},
+		{"linux/ppc64le", Platform{OS: "linux", Architecture: "ppc64le"}},
+		{"linux/mips", Platform{OS: "linux", Architecture: "mips"}},
+	}
+	for _, test := range tests {
+		got, err := ParsePlatform(test.text)
+		if err != nil {
+			t.Errorf("ParsePlatform(%q): %v", test.text, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("ParsePlatform(%q) = %+v, want %+v", test.text, got, test.want)
+		}
+	}
+}
+
+func TestParsePlatformErrors(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"", "expected os/arch[/variant]"},
+		{"linux/", "expected os/arch[/variant]"},
+		{"/amd64", "expected os/arch[/variant]"},
+		{"linux/arm/v7/extra", "expected os/arch[/variant]"},
+		{"windows/amd64", "containers run on linux"},
+		{"linux/sparc64", "unknown architecture sparc64"},
+	}
+	for _, test := range tests {
+		if _, err := ParsePlatform(test.text); err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("ParsePlatform(%q) error = %v, want one containing %q", test.text, err, test.want)
+		}
+	}
+}
+
+func TestBinaryArchitecture(t *testing.T) {
+	executable, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := binaryArchitecture(executable); err != nil || got != runtime.GOARCH {
+		t.Errorf("binaryArchitecture of the test binary = %q, %v, want %q", got, err, runtime.GOARCH)
+	}
+
+	script := filepath.Join(t.TempDir(), "script")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := binaryArchitecture(script); err != nil || got != "" {
+		t.Errorf("binaryArchitecture of a script = %q, %v, want no architecture", got, err)
+	}
+}
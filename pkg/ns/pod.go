@@ -0,0 +1,311 @@
+//go:build linux
+
+package ns
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Pods (nsctl pod)
+//
+// A pod is a group of containers sharing UTS, IPC and network namespaces:
+// one hostname, SysV IPC and localhost, like the containers of a
+// Kubernetes pod. The namespaces are those of the pod's infra container,
+// which "pod create" starts running nsctl's hidden pod-infra command, a
+// process that only waits to be stopped. Containers run in the pod join
+// them (see join.go), each keeping a PID and mount namespace of its own:
+//
+//	POD=$(nsctl pod create)
+//	nsctl pod run $POD -d ./server
+//	nsctl pod run $POD curl localhost:8080
+//
+// Pod records live in the state directory's pods directory, named after
+// the pod's ID, and the records of its containers name it. "pod rm" removes
+// a pod with all its containers, the running ones only with --force.
+// Joining namespaces takes root, so rootless users can't create pods.
+
+// PodInfraCommand is the hidden command a pod's infra container runs
+const PodInfraCommand = "pod-infra"
+
+// podsDirName holds the pod records, in the state directory
+const podsDirName = "pods"
+
+// Pod is a pod's record
+type Pod struct {
+	// SchemaVersion is the version of the record's format (see
+	// state_schema.go)
+	SchemaVersion int `json:"schema_version"`
+
+	ID       string    `json:"id"`
+	Created  time.Time `json:"created"`
+	Hostname string    `json:"hostname"`
+
+	// InfraID is the container holding the pod's namespaces
+	InfraID string `json:"infra_id"`
+}
+
+// PodConfig describes a pod to be created by CreatePod
+type PodConfig struct {
+	// Hostname is shared by the pod's containers; defaults to the short pod
+	// ID
+	Hostname string
+
+	// Network is the --network mode of the pod's network namespace
+	Network string
+}
+
+// PodSummary is a pod with its status and the number of its containers,
+// for pod ps
+type PodSummary struct {
+	Pod
+	Status     string
+	Containers int
+}
+
+// RunPodInfra is the infra container's workload: it holds the pod's
+// namespaces until it is stopped
+func RunPodInfra() int {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	<-signals
+	return 0
+}
+
+// CreatePod starts a pod's infra container and returns the pod's ID
+func CreatePod(execPath string, podConfig PodConfig) (string, error) {
+	if os.Geteuid() != 0 {
+		return "", fmt.Errorf("pods need root: their containers join the namespaces of the pod's infra container")
+	}
+	absoluteExecPath, err := os.Executable()
+	if err != nil {
+		return "", fmt.Errorf("failed to find the nsctl executable: %v", err)
+	}
+	podID, err := generateContainerID()
+	if err != nil {
+		return "", err
+	}
+	pod := Pod{ID: podID, Created: time.Now(), Hostname: podConfig.Hostname}
+	if pod.Hostname == "" {
+		pod.Hostname = ShortID(podID)
+	}
+	if err := savePod(pod); err != nil {
+		return "", err
+	}
+
+	infraID, err := RunWithConfig(execPath, ContainerConfig{
+		Command:  absoluteExecPath,
+		Args:     []string{PodInfraCommand},
+		Detach:   true,
+		Hostname: pod.Hostname,
+		Network:  podConfig.Network,
+		PodID:    podID,
+		PodInfra: true,
+	})
+	if err != nil {
+		os.Remove(podFilePath(podID))
+		return "", err
+	}
+	pod.InfraID = infraID
+	if err := savePod(pod); err != nil {
+		RemoveContainer(infraID, true, false)
+		os.Remove(podFilePath(podID))
+		return "", err
+	}
+	logf("[ns] Created pod %s with infra container %s\n", ShortID(podID), ShortID(infraID))
+	return podID, nil
+}
+
+// preparePod points the namespaces of a container run in a pod at those of
+// the pod's infra container
+func preparePod(config *ContainerConfig) error {
+	if config.PodID == "" || config.PodInfra {
+		return nil
+	}
+	pod, err := LookupPod(config.PodID)
+	if err != nil {
+		return err
+	}
+	config.PodID = pod.ID
+	for _, mode := range []*string{&config.UTSNamespace, &config.IPCNamespace, &config.Network} {
+		if *mode != "" {
+			return fmt.Errorf("a container in a pod has the pod's UTS, IPC and network namespaces: --uts, --ipc, --net and --network don't apply")
+		}
+		*mode = NamespaceContainerPrefix + pod.InfraID
+	}
+	return nil
+}
+
+// podFilePath returns the path of a pod's record
+func podFilePath(podID string) string {
+	return filepath.Join(currentStateDir, podsDirName, podID+containerFileExt)
+}
+
+// savePod writes a pod's record, in the current schema version
+func savePod(pod Pod) error {
+	if err := os.MkdirAll(filepath.Join(currentStateDir, podsDirName), 0700); err != nil {
+		return fmt.Errorf("failed to create pods directory: %v", err)
+	}
+	pod.SchemaVersion = podSchemaVersion
+	data, err := json.MarshalIndent(pod, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal pod: %v", err)
+	}
+	podPath := podFilePath(pod.ID)
+	tempPath := podPath + ".tmp"
+	if err := os.WriteFile(tempPath, data, 0600); err != nil {
+		return fmt.Errorf("failed to write pod %s: %v", ShortID(pod.ID), err)
+	}
+	if err := os.Rename(tempPath, podPath); err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("failed to write pod %s: %v", ShortID(pod.ID), err)
+	}
+	return nil
+}
+
+// loadPod reads a pod's record by its full ID
+func loadPod(podID string) (Pod, error) {
+	var pod Pod
+	data, err := os.ReadFile(podFilePath(podID))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return pod, fmt.Errorf("no such pod: %s", podID)
+		}
+		return pod, fmt.Errorf("failed to read pod %s: %v", ShortID(podID), err)
+	}
+	migrated, err := decodeRecord("pod", podID, data, podMigrations, &pod)
+	if err != nil {
+		if _, newer := err.(*NewerSchemaError); newer {
+			return pod, err
+		}
+		return pod, fmt.Errorf("failed to parse pod %s: %v", ShortID(podID), err)
+	}
+	if migrated {
+		if err := savePod(pod); err != nil {
+			logf("[ns] Warning: failed to save migrated pod %s: %v\n", ShortID(podID), err)
+		}
+	}
+	return pod, nil
+}
+
+// ListPods returns all pods with their status, newest first
+func ListPods() ([]PodSummary, error) {
+	entries, err := os.ReadDir(filepath.Join(currentStateDir, podsDirName))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read pods: %v", err)
+	}
+	containers, err := ListContainers()
+	if err != nil {
+		return nil, err
+	}
+
+	var pods []PodSummary
+	for _, entry := range entries {
+		podID, isRecord := strings.CutSuffix(entry.Name(), containerFileExt)
+		if !isRecord {
+			continue
+		}
+		pod, err := loadPod(podID)
+		if err != nil {
+			if _, newer := err.(*NewerSchemaError); newer {
+				return nil, err
+			}
+			logf("[ns] Warning: %v\n", err)
+			continue
+		}
+
+		summary := PodSummary{Pod: pod, Status: StatusExited}
+		for _, container := range containers {
+			switch {
+			case container.ID == pod.InfraID:
+				summary.Status = container.Status
+			case container.PodID == pod.ID:
+				summary.Containers++
+			}
+		}
+		pods = append(pods, summary)
+	}
+	sort.Slice(pods, func(i, j int) bool { return pods[i].Created.After(pods[j].Created) })
+	return pods, nil
+}
+
+// LookupPod finds a pod by its full ID or a unique ID prefix
+func LookupPod(idOrPrefix string) (Pod, error) {
+	if idOrPrefix == "" {
+		return Pod{}, fmt.Errorf("empty pod ID")
+	}
+	pods, err := ListPods()
+	if err != nil {
+		return Pod{}, err
+	}
+
+	var matches []Pod
+	for _, pod := range pods {
+		if pod.ID == idOrPrefix {
+			return pod.Pod, nil
+		}
+		if strings.HasPrefix(pod.ID, idOrPrefix) {
+			matches = append(matches, pod.Pod)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return Pod{}, fmt.Errorf("no such pod: %s", idOrPrefix)
+	case 1:
+		return matches[0], nil
+	default:
+		return Pod{}, fmt.Errorf("pod ID prefix %s is ambiguous (%d matches)", idOrPrefix, len(matches))
+	}
+}
+
+// RemovePod deletes a pod with its containers and returns its ID; running
+// containers other than the infra container are refused unless force is
+// set, in which case they are killed first
+func RemovePod(idOrPrefix string, force bool) (string, error) {
+	pod, err := LookupPod(idOrPrefix)
+	if err != nil {
+		return "", err
+	}
+	containers, err := ListContainers()
+	if err != nil {
+		return "", err
+	}
+
+	var members []ContainerInfo
+	infraFound := false
+	for _, container := range containers {
+		if container.ID == pod.InfraID {
+			infraFound = true
+			continue
+		}
+		if container.PodID != pod.ID {
+			continue
+		}
+		if container.Status != StatusExited && !force {
+			return "", fmt.Errorf("pod %s has running container %s: stop it first or use --force", ShortID(pod.ID), ShortID(container.ID))
+		}
+		members = append(members, container)
+	}
+	for _, container := range members {
+		if err := RemoveContainer(container.ID, force, false); err != nil {
+			return "", err
+		}
+	}
+	if infraFound {
+		if err := RemoveContainer(pod.InfraID, true, false); err != nil {
+			return "", err
+		}
+	}
+	if err := os.Remove(podFilePath(pod.ID)); err != nil {
+		return "", fmt.Errorf("failed to remove pod %s: %v", ShortID(pod.ID), err)
+	}
+	logf("[ns] Removed pod %s\n", ShortID(pod.ID))
+	return pod.ID, nil
+}
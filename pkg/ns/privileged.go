@@ -0,0 +1,68 @@
+//go:build linux
+
+package ns
+
+import (
+	"fmt"
+	"strings"
+
+	"nsctl/pkg/cgroup"
+)
+
+// Privileged containers (--privileged)
+//
+// By default a container gets no more of the host than it needs: a rootful
+// one keeps only the --cap-add capabilities, /sys and its cgroup are
+// read-only with the kernel's firmware and debugging interfaces masked, -v
+// can't cover /, /dev, /proc or /sys, and although it sees the host's /dev
+// (without --rootfs, see dev.go) it may only use the devices in
+// cgroup.DefaultDeviceRules (null, zero, full, random, urandom, tty,
+// console and pseudo terminals). Anything more is denied, also when the
+// device cgroup can't be set up: a rootful container then fails to start.
+//
+// Some workloads genuinely need full access, e.g. container builds that run
+// containers themselves or tools that talk to hardware. --privileged gives
+// it to them explicitly: the container keeps every capability, gets /sys
+// and its own cgroup read-write and unmasked, may use all of the host's
+// devices and mount anywhere. It runs without a seccomp filter, Landlock
+// policy or /proc options, which --privileged therefore refuses.
+
+// privilegedSecurityOpts are the --security-opt keys that would confine a
+// privileged container
+var privilegedSecurityOpts = []string{"seccomp", "seccomp-listener", "landlock", "proc-opts"}
+
+// checkPrivileged refuses options that contradict --privileged
+func checkPrivileged(config ContainerConfig) error {
+	if !config.Privileged {
+		return nil
+	}
+	for _, option := range config.SecurityOpt {
+		key, _, _ := strings.Cut(option, "=")
+		for _, confining := range privilegedSecurityOpts {
+			if key == confining {
+				return fmt.Errorf("--privileged can't be combined with --security-opt %s: a privileged container runs unconfined", key)
+			}
+		}
+	}
+	return nil
+}
+
+// containerCapabilities returns the capabilities a rootful container
+// keeps: those of --cap-add, or all of them when it is privileged
+func containerCapabilities(config ContainerConfig) (map[int]bool, error) {
+	if config.Privileged {
+		return parseCapabilities([]string{capabilityAll})
+	}
+	return parseCapabilities(config.CapAdd)
+}
+
+// containerDevices returns the devices a container may use, nil for all of
+// the host's
+// A rootless container can't open more devices than its user anyway, and
+// can't have a device filter attached to its cgroup.
+func containerDevices(config ContainerConfig) []cgroup.DeviceRule {
+	if config.Privileged || config.Rootless {
+		return nil
+	}
+	return cgroup.DefaultDeviceRules
+}
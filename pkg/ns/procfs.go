@@ -0,0 +1,82 @@
+//go:build linux
+
+package ns
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Hardened /proc (--security-opt proc-opts=hidepid=2,subset=pid)
+//
+// Every container gets its own /proc, for its PID namespace. On hosts shared
+// by several tenants it can also be mounted with procfs's own restrictions:
+// hidepid hides other users' processes from a container user, and subset=pid
+// (Linux 5.8) leaves out everything but the process directories, such as
+// /proc/sys, /proc/kcore and the host-wide statistics.
+//
+// Those restrictions are only worth something if the container can't mount
+// /proc again without them, or unmount what masks its entries. Doing either
+// takes CAP_SYS_ADMIN, which a rootful container doesn't keep unless it is
+// added with --cap-add, and a rootless one loses when proc-opts are set.
+
+// procOptionValues lists the accepted proc-opts and, where they are
+// limited to a few, their values; gid takes a number
+var procOptionValues = map[string][]string{
+	"hidepid": {"0", "1", "2", "4", "off", "noaccess", "invisible", "ptraceable"},
+	"subset":  {"pid"},
+	"gid":     nil,
+}
+
+// parseProcOptions checks a proc-opts value, e.g. "hidepid=2,subset=pid"
+func parseProcOptions(options string) error {
+	for _, option := range strings.Split(options, ",") {
+		key, value, _ := strings.Cut(option, "=")
+		allowed, found := procOptionValues[key]
+		if !found {
+			return fmt.Errorf("unknown proc option %q (expected hidepid, subset or gid)", key)
+		}
+		if key == "gid" {
+			if _, err := strconv.ParseUint(value, 10, 32); err != nil {
+				return fmt.Errorf("invalid proc option %q: expected a GID", option)
+			}
+			continue
+		}
+		if !slices.Contains(allowed, value) {
+			return fmt.Errorf("invalid proc option %q: expected %s=%s", option, key, strings.Join(allowed, "|"))
+		}
+	}
+	return nil
+}
+
+// mountProc mounts the container's /proc, in the root filesystem at rootfs
+// (the host's for ""), with the given proc-opts
+func mountProc(rootfs string, options string) error {
+	target := filepath.Join(rootfs, "/proc")
+	if options == "" {
+		if err := mountTraced("proc", target, "proc", 0, ""); err != nil {
+			return fmt.Errorf("failed to mount /proc: %v", err)
+		}
+		return nil
+	}
+
+	if err := mountTraced("proc", target, "proc", unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, options); err != nil {
+		return fmt.Errorf("failed to mount /proc with %s: %v (hidepid names and subset need Linux 5.8 or later)", options, err)
+	}
+	logf("[ns] Mounted /proc with %s\n", options)
+	return nil
+}
+
+// dropProcRemount takes CAP_SYS_ADMIN out of a rootless container's
+// bounding set, so the workload can't undo its hardened /proc
+func dropProcRemount() error {
+	if err := unix.Prctl(unix.PR_CAPBSET_DROP, capSysAdmin, 0, 0, 0); err != nil {
+		return fmt.Errorf("failed to drop CAP_SYS_ADMIN: %v", err)
+	}
+	return nil
+}
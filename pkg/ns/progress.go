@@ -0,0 +1,90 @@
+//go:build linux
+
+package ns
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Progress of long transfers
+//
+// nsctl has no images to pull, push or load yet; the long transfers it has
+// are volume exports and imports. They report their progress on stderr so a
+// big volume doesn't look hung: on a terminal a line that is redrawn with
+// the bytes moved, the percentage when the total is known, and the speed;
+// otherwise (e.g. in a log) a single line once the transfer is over.
+
+// progressRedrawInterval is how often the progress line is redrawn
+const progressRedrawInterval = 100 * time.Millisecond
+
+// Progress counts the bytes of a transfer, as the io.Writer the data is
+// copied to as well
+type Progress struct {
+	mu sync.Mutex
+
+	label string
+	total int64 // 0 if unknown
+	done  int64
+
+	output   io.Writer
+	terminal bool
+	started  time.Time
+	drawn    time.Time
+}
+
+// NewProgress starts reporting a transfer of total bytes (0 if unknown) on
+// stderr
+func NewProgress(label string, total int64) *Progress {
+	return &Progress{
+		label:    label,
+		total:    total,
+		output:   os.Stderr,
+		terminal: IsTerminal(os.Stderr),
+		started:  time.Now(),
+	}
+}
+
+// Write counts p as transferred
+func (p *Progress) Write(data []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.done += int64(len(data))
+	if p.terminal && time.Since(p.drawn) >= progressRedrawInterval {
+		p.drawn = time.Now()
+		fmt.Fprintf(p.output, "\r%s\x1b[K", p.describe())
+	}
+	return len(data), nil
+}
+
+// Finish prints the final state of a transfer that succeeded
+func (p *Progress) Finish() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// A reader may stop short of the end, e.g. before a tarball's padding
+	p.done = max(p.done, p.total)
+	if p.terminal {
+		fmt.Fprintf(p.output, "\r%s\x1b[K\n", p.describe())
+		return
+	}
+	fmt.Fprintf(p.output, "%s in %s\n", p.describe(), time.Since(p.started).Round(time.Millisecond))
+}
+
+// describe formats the progress so far, e.g.
+// "Importing data: 12.0MB / 40.0MB  30%  5.1MB/s"
+func (p *Progress) describe() string {
+	description := fmt.Sprintf("%s: %s", p.label, FormatSize(p.done))
+	if p.total > 0 {
+		percent := min(100, p.done*100/p.total)
+		description += fmt.Sprintf(" / %s  %d%%", FormatSize(p.total), percent)
+	}
+	if elapsed := time.Since(p.started).Seconds(); elapsed > 0 {
+		description += fmt.Sprintf("  %s/s", FormatSize(int64(float64(p.done)/elapsed)))
+	}
+	return description
+}
@@ -0,0 +1,210 @@
+//go:build linux
+
+package ns
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Restart policies
+//
+// A container's shim can start the workload again when it exits, as
+// --restart says:
+//
+//	no                never (the default)
+//	on-failure[:max]  when it exits with a non-zero code, at most max times
+//	always            whatever the exit code
+//
+// A restart action of --on-memory-event (see memory_events.go) restarts
+// the workload whatever the policy. A container stopped with "nsctl stop"
+// or removed with "rm -f" isn't restarted. Between restarts the container
+// is "restarting"; the delay starts at restartMinDelay and doubles up to
+// restartMaxDelay, so a crash loop doesn't hog the host, and starts over
+// after a run that lasted restartResetAfter. Since the shim does the
+// restarting, nothing restarts containers after the host reboots.
+//
+// The record counts the restarts and keeps the exits that caused the last
+// maxPreviousExits of them, for "inspect" and the RESTARTS column of "ps".
+
+// Restart policy names
+const (
+	RestartNo        = "no"
+	RestartOnFailure = "on-failure"
+	RestartAlways    = "always"
+)
+
+const (
+	restartMinDelay   = 100 * time.Millisecond
+	restartMaxDelay   = time.Minute
+	restartResetAfter = 10 * time.Second
+
+	// maxPreviousExits is how many earlier exits a record keeps
+	maxPreviousExits = 10
+)
+
+// RestartPolicy says when a container's workload is started again
+type RestartPolicy struct {
+	// Name is one of the Restart* policies; empty means RestartNo
+	Name string `json:"name,omitempty"`
+
+	// MaxRetries limits the restarts of on-failure; 0 means no limit
+	MaxRetries int `json:"max_retries,omitempty"`
+}
+
+// ParseRestartPolicy parses a --restart value: no, always or
+// on-failure[:max]
+func ParseRestartPolicy(value string) (RestartPolicy, error) {
+	name, maxText, hasMax := strings.Cut(value, ":")
+	policy := RestartPolicy{Name: name}
+	switch name {
+	case RestartNo, RestartAlways:
+		if hasMax {
+			return policy, fmt.Errorf("restart policy %s takes no maximum", name)
+		}
+	case RestartOnFailure:
+		if hasMax {
+			maxRetries, err := strconv.Atoi(maxText)
+			if err != nil || maxRetries < 0 {
+				return policy, fmt.Errorf("invalid maximum restarts %q", maxText)
+			}
+			policy.MaxRetries = maxRetries
+		}
+	default:
+		return policy, fmt.Errorf("unknown restart policy %q (expected no, on-failure[:max] or always)", name)
+	}
+	return policy, nil
+}
+
+// String formats the policy as --restart takes it
+func (p RestartPolicy) String() string {
+	switch {
+	case p.Name == "":
+		return RestartNo
+	case p.Name == RestartOnFailure && p.MaxRetries > 0:
+		return fmt.Sprintf("%s:%d", p.Name, p.MaxRetries)
+	}
+	return p.Name
+}
+
+// wantsRestart reports whether the policy restarts a workload that ended
+// with exit, after restarts earlier restarts
+func (p RestartPolicy) wantsRestart(exit containerExit, restarts int) bool {
+	// A memory event action asked for it, whatever the policy
+	if exit.FinishReason == FinishReasonMemoryEvent {
+		return p.MaxRetries == 0 || restarts < p.MaxRetries
+	}
+	switch p.Name {
+	case RestartAlways:
+		return true
+	case RestartOnFailure:
+		return exit.ExitCode != 0 && (p.MaxRetries == 0 || restarts < p.MaxRetries)
+	}
+	return false
+}
+
+// PreviousExit is how an earlier run of a restarted container ended
+type PreviousExit struct {
+	ExitCode     int       `json:"exit_code"`
+	OOMKilled    bool      `json:"oom_killed,omitempty"`
+	FinishReason string    `json:"finish_reason,omitempty"`
+	StartedAt    time.Time `json:"started_at"`
+	FinishedAt   time.Time `json:"finished_at"`
+}
+
+// shouldRestart decides, once the workload has exited, whether the shim
+// starts it again
+func shouldRestart(config ContainerConfig, exit containerExit) bool {
+	requested := exit.FinishReason == FinishReasonMemoryEvent
+	if !requested && (config.Restart.Name == "" || config.Restart.Name == RestartNo) {
+		return false
+	}
+	containerInfo, err := loadContainerInfo(config.ID)
+	if err != nil || containerInfo.ManuallyStopped {
+		return false
+	}
+	return config.Restart.wantsRestart(exit, containerInfo.RestartCount)
+}
+
+// recordContainerRestart notes in the record that the workload exited and
+// is going to be restarted, and returns the run that ended
+func recordContainerRestart(config ContainerConfig, exit containerExit) (PreviousExit, error) {
+	containerInfo, err := loadContainerInfo(config.ID)
+	if err != nil {
+		return PreviousExit{}, err
+	}
+
+	previous := PreviousExit{
+		ExitCode:     exit.ExitCode,
+		OOMKilled:    exit.OOMKilled,
+		FinishReason: exit.FinishReason,
+		StartedAt:    containerInfo.StartTime,
+		FinishedAt:   exit.FinishedAt,
+	}
+	containerInfo.PreviousExits = append(containerInfo.PreviousExits, previous)
+	if len(containerInfo.PreviousExits) > maxPreviousExits {
+		containerInfo.PreviousExits = containerInfo.PreviousExits[len(containerInfo.PreviousExits)-maxPreviousExits:]
+	}
+	containerInfo.RestartCount++
+	containerInfo.Status = StatusRestarting
+	containerInfo.ExitCode = exit.ExitCode
+	containerInfo.FinishedAt = exit.FinishedAt
+	if err := saveContainerInfo(containerInfo); err != nil {
+		return previous, err
+	}
+
+	attributes := map[string]string{
+		"exit_code": strconv.Itoa(exit.ExitCode),
+		"restart":   strconv.Itoa(containerInfo.RestartCount),
+	}
+	if exit.FinishReason != "" {
+		attributes["reason"] = exit.FinishReason
+	}
+	emitEvent(EventDie, config.ID, attributes)
+	return previous, nil
+}
+
+// waitToRestart waits out the delay before a restart; it returns false if
+// the container was stopped in the meantime
+func waitToRestart(containerID string, delay time.Duration) bool {
+	deadline := time.Now().Add(delay)
+	for {
+		containerInfo, err := loadContainerInfo(containerID)
+		if err != nil || containerInfo.ManuallyStopped {
+			return false
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return true
+		}
+		time.Sleep(min(remaining, 100*time.Millisecond))
+	}
+}
+
+// markContainerRestarted puts a restarted container's new workload into its
+// record, ready for StartContainer
+func markContainerRestarted(containerID string, pid int) error {
+	containerInfo, err := loadContainerInfo(containerID)
+	if err != nil {
+		return err
+	}
+	if containerInfo.ManuallyStopped {
+		return fmt.Errorf("it was stopped")
+	}
+	containerInfo.PID = pid
+	containerInfo.PIDStartTime, _ = processStartTime(pid)
+	containerInfo.Status = StatusCreated
+	return saveContainerInfo(containerInfo)
+}
+
+// requestStop marks a container as stopped on purpose, so that its shim
+// doesn't restart it
+func requestStop(containerInfo *ContainerInfo) error {
+	if containerInfo.ManuallyStopped {
+		return nil
+	}
+	containerInfo.ManuallyStopped = true
+	return saveContainerInfo(*containerInfo)
+}
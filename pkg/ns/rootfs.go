@@ -0,0 +1,185 @@
+//go:build linux
+
+package ns
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Root filesystems (--rootfs)
+//
+// By default a container sees the host's filesystem, with /proc, /sys and
+// the /etc files of its own mounted over the host's. With --rootfs it gets
+// a directory of the host as its root instead, e.g. an unpacked image or a
+// debootstrap tree:
+//
+//	nsctl run --rootfs /srv/alpine /bin/sh
+//
+// Setup bind-mounts the directory onto itself, so it is a mount point,
+// and mounts /proc, /sys, a /dev of its own (see dev.go), the /etc files,
+// /dev/mqueue and the binds at their paths inside it while the host's
+// paths, such as the container directory and the cgroup, are still
+// reachable. Only then does setup pivot_root(2) into it and detach the
+// host's root, so that the workload can't get back to the host's files
+// even as root, unlike with chroot(2).
+// The user and the command are looked up in the new root, as are the paths
+// of a Landlock policy.
+//
+// The only things created in the directory are missing destinations of -v
+// and --mount: a directory, or an empty file for the bind of a file, made
+// through existing directories only, never symlinks, which could lead out
+// of it. Other mount points missing from it are skipped, except /proc,
+// which it must have. A chroot container (see isolation.go) is chrooted
+// into the directory instead, without /proc, /sys or /etc files of its
+// own.
+//
+// --read-only makes the container's root mount read-only at the end of
+// setup, for containers that shouldn't change their files: the --rootfs,
+// or the host's / itself (but not host filesystems mounted below it, such
+// as a separate /home). The container's own mounts stay as they are, and
+// it gets writable tmpfs mounts on /tmp and /run, unless it mounts
+// something else there.
+
+// prepareRootfs checks a container's --rootfs and makes it absolute
+func prepareRootfs(config *ContainerConfig) error {
+	if config.Rootfs == "" {
+		return nil
+	}
+	rootfs, err := filepath.Abs(config.Rootfs)
+	if err != nil {
+		return fmt.Errorf("invalid rootfs %s: %v", config.Rootfs, err)
+	}
+	if rootfs, err = filepath.EvalSymlinks(rootfs); err != nil {
+		return fmt.Errorf("invalid rootfs: %v", err)
+	}
+	if info, err := os.Stat(rootfs); err != nil {
+		return fmt.Errorf("invalid rootfs: %v", err)
+	} else if !info.IsDir() {
+		return fmt.Errorf("rootfs %s is not a directory", rootfs)
+	}
+	config.Rootfs = rootfs
+
+	if config.Isolation == IsolationChroot {
+		return nil
+	}
+	if !hasOwnMountNamespace(*config) {
+		return fmt.Errorf("--rootfs needs a mount namespace of the container's own: with --mnt=false it would replace the host's root")
+	}
+	if info, err := os.Stat(filepath.Join(rootfs, "proc")); err != nil || !info.IsDir() {
+		return fmt.Errorf("rootfs %s has no /proc directory to mount the container's /proc on", rootfs)
+	}
+	// The agent's socket is a host path, which setup connects to only after
+	// leaving the host's root
+	if config.Seccomp != nil && config.Seccomp.usesNotify() {
+		return fmt.Errorf("--rootfs can't be combined with a seccomp listener: its socket isn't reachable from the container's root")
+	}
+	return nil
+}
+
+// readOnlyScratchDirs get a tmpfs in a --read-only container
+var readOnlyScratchDirs = []string{"/tmp", "/run"}
+
+// prepareReadOnly checks a --read-only container and adds its tmpfs
+// mounts; it runs after prepareMounts
+func prepareReadOnly(config *ContainerConfig) error {
+	if !config.ReadOnly {
+		return nil
+	}
+	if config.Isolation == IsolationChroot {
+		return fmt.Errorf("--isolation %s can't have a --read-only root: the container has the host's mounts", IsolationChroot)
+	}
+	if !hasOwnMountNamespace(*config) {
+		return fmt.Errorf("--read-only needs a mount namespace of the container's own: with --mnt=false it would make the host's root read-only")
+	}
+	for _, dir := range readOnlyScratchDirs {
+		mounted := slices.ContainsFunc(config.Mounts, func(mount Mount) bool { return mount.Destination == dir })
+		if !mounted {
+			config.Mounts = append(config.Mounts, Mount{Type: MountTypeTmpfs, Destination: dir})
+		}
+	}
+	return nil
+}
+
+// makeRootReadOnly makes the container's root mount, in the root
+// filesystem at rootfs (the host's for ""), read-only
+func makeRootReadOnly(rootfs string) error {
+	root := filepath.Join("/", rootfs)
+	if err := restrictMount(root, unix.MOUNT_ATTR_RDONLY, false); err != nil {
+		return fmt.Errorf("failed to make the root filesystem read-only: %v", err)
+	}
+	return nil
+}
+
+// bindRootfs bind-mounts the container's root filesystem onto itself,
+// which pivot_root(2) needs it to be a mount point
+func bindRootfs(rootfs string) error {
+	if err := mountTraced(rootfs, rootfs, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+		return fmt.Errorf("failed to bind rootfs %s: %v", rootfs, err)
+	}
+	return nil
+}
+
+// createMountDestination creates the missing destination of a mount in the
+// root filesystem at rootfs: a directory, or with file an empty file
+// Each existing part of the path has to be a directory; a symlink could
+// lead out of rootfs, e.g. into the host's /etc.
+func createMountDestination(rootfs string, destination string, file bool) error {
+	dirFD, err := unix.Open(rootfs, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open rootfs %s: %v", rootfs, err)
+	}
+	defer func() { unix.Close(dirFD) }()
+
+	parts := strings.Split(strings.Trim(destination, "/"), "/")
+	for index, part := range parts {
+		if index == len(parts)-1 && file {
+			fileFD, err := unix.Openat(dirFD, part, unix.O_CREAT|unix.O_EXCL|unix.O_WRONLY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0644)
+			if err != nil {
+				return fmt.Errorf("failed to create mount destination %s: %v", destination, err)
+			}
+			return unix.Close(fileFD)
+		}
+		if err := unix.Mkdirat(dirFD, part, 0755); err != nil && err != unix.EEXIST {
+			return fmt.Errorf("failed to create mount destination %s: %v", destination, err)
+		}
+		nextFD, err := unix.Openat(dirFD, part, unix.O_PATH|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return fmt.Errorf("can't create mount destination %s: %s isn't a directory in the rootfs (%v)", destination, "/"+strings.Join(parts[:index+1], "/"), err)
+		}
+		unix.Close(dirFD)
+		dirFD = nextFD
+	}
+	return nil
+}
+
+// pivotRoot makes rootfs the root of the container's mount namespace and
+// detaches the host's root from it
+// pivot_root(".", ".") stacks the old root on top of the new one, without
+// a directory in rootfs to put it in; unmounting it from there uncovers
+// the new root.
+func pivotRoot(rootfs string) error {
+	if err := unix.Chdir(rootfs); err != nil {
+		return fmt.Errorf("failed to enter rootfs %s: %v", rootfs, err)
+	}
+	started := time.Now()
+	err := unix.PivotRoot(".", ".")
+	traceSyscall(started, err, "pivot_root(%q, %q)", ".", ".")
+	if err != nil {
+		return fmt.Errorf("failed to pivot_root into %s: %v", rootfs, err)
+	}
+
+	started = time.Now()
+	err = unix.Unmount(".", unix.MNT_DETACH)
+	traceSyscall(started, err, "umount2(%q, MNT_DETACH)", ".")
+	if err != nil {
+		return fmt.Errorf("failed to detach the host's root: %v", err)
+	}
+	return unix.Chdir("/")
+}
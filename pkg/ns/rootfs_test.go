@@ -0,0 +1,70 @@
+//go:build linux
+
+package ns
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCreateMountDestination(t *testing.T) {
+	rootfs := t.TempDir()
+	outside := t.TempDir()
+	if err := os.Mkdir(filepath.Join(rootfs, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(rootfs, "etc", "hostname"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(rootfs, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/etc", filepath.Join(rootfs, "abs")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		destination string
+		file        bool
+		want        string // empty for success, else part of the error
+	}{
+		{destination: "/data", file: false},
+		{destination: "/srv/app/data", file: false},
+		{destination: "/etc", file: false},
+		{destination: "/etc/app.conf", file: true},
+		{destination: "/etc/hostname/data", file: false, want: "/etc/hostname isn't a directory in the rootfs"},
+		{destination: "/etc/hostname", file: true, want: "failed to create mount destination"},
+		{destination: "/escape/data", file: false, want: "/escape isn't a directory in the rootfs"},
+		{destination: "/escape/secret", file: true, want: "/escape isn't a directory in the rootfs"},
+		{destination: "/abs/data", file: false, want: "/abs isn't a directory in the rootfs"},
+	}
+	for _, test := range tests {
+		err := createMountDestination(rootfs, test.destination, test.file)
+		if test.want == "" {
+			if err != nil {
+				t.Errorf("createMountDestination(%q): %v", test.destination, err)
+				continue
+			}
+			info, err := os.Lstat(filepath.Join(rootfs, test.destination))
+			if err != nil {
+				t.Errorf("createMountDestination(%q) created nothing: %v", test.destination, err)
+			} else if info.IsDir() == test.file {
+				t.Errorf("createMountDestination(%q) created a %v, want file %t", test.destination, info.Mode().Type(), test.file)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("createMountDestination(%q) error = %v, want one containing %q", test.destination, err, test.want)
+		}
+	}
+
+	entries, err := os.ReadDir(outside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) > 0 {
+		t.Errorf("createMountDestination created %s outside the rootfs", entries[0].Name())
+	}
+}
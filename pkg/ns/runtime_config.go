@@ -0,0 +1,182 @@
+//go:build linux
+
+package ns
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// RuntimeConfig holds host-wide settings that apply to every container
+// It is read from /etc/nsctl/config.json (or the file named by $NSCTL_CONFIG).
+// The file is optional and every field has a sensible default, e.g.:
+//
+//	{
+//	  "log_max_size": "100m",
+//	  "log_max_total_size": "1g",
+//	  "proxy": {
+//	    "http_proxy": "http://proxy.example.com:3128",
+//	    "https_proxy": "http://proxy.example.com:3128",
+//	    "no_proxy": "localhost,127.0.0.1,.internal"
+//	  },
+//	  "limits": {"max_containers": 200, "max_containers_per_user": 20}
+//	}
+type RuntimeConfig struct {
+	// LogMaxSize caps each container's log unless --log-max-size is given;
+	// "0" means no limit
+	LogMaxSize string `json:"log_max_size"`
+
+	// LogMaxTotalSize caps the combined size of all container logs; "0"
+	// means no limit
+	LogMaxTotalSize string `json:"log_max_total_size"`
+
+	// Proxy is passed into every container unless --no-proxy is given
+	Proxy ProxyConfig `json:"proxy"`
+
+	// Offline keeps nsctl itself off the network, as --offline does
+	Offline bool `json:"offline"`
+
+	// HooksDirs are the directories drop-in hook definitions are read from
+	// (see hooks.go)
+	HooksDirs []string `json:"hooks_dirs"`
+
+	// Webhooks are sent container events (see webhooks.go)
+	Webhooks []WebhookConfig `json:"webhooks"`
+
+	// Limits cap the containers and the disk space they take (see
+	// limits.go)
+	Limits ContainerLimits `json:"limits"`
+}
+
+// ProxyConfig holds the proxy settings passed into containers' environment;
+// empty fields are left unset. nsctl's own requests, such as webhooks,
+// don't use them.
+type ProxyConfig struct {
+	HTTPProxy  string `json:"http_proxy,omitempty"`
+	HTTPSProxy string `json:"https_proxy,omitempty"`
+	FTPProxy   string `json:"ftp_proxy,omitempty"`
+	AllProxy   string `json:"all_proxy,omitempty"`
+	NoProxy    string `json:"no_proxy,omitempty"`
+}
+
+// proxyVariables are the names of the proxy environment variables, in
+// lowercase; tools disagree on the case, so both forms are set
+var proxyVariables = []string{"http_proxy", "https_proxy", "ftp_proxy", "all_proxy", "no_proxy"}
+
+// Environment returns the settings as environment variables, each in
+// lowercase and uppercase
+func (p ProxyConfig) Environment() []string {
+	var env []string
+	values := []string{p.HTTPProxy, p.HTTPSProxy, p.FTPProxy, p.AllProxy, p.NoProxy}
+	for i, name := range proxyVariables {
+		if values[i] == "" {
+			continue
+		}
+		env = append(env, name+"="+values[i], strings.ToUpper(name)+"="+values[i])
+	}
+	return env
+}
+
+// isProxyVariable reports whether an environment entry sets a proxy
+func isProxyVariable(variable string) bool {
+	name, _, _ := strings.Cut(variable, "=")
+	for _, proxyVariable := range proxyVariables {
+		if strings.EqualFold(name, proxyVariable) {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	defaultRuntimeConfigPath = "/etc/nsctl/config.json"
+	runtimeConfigEnvVar      = "NSCTL_CONFIG"
+
+	defaultLogMaxSize      = "100m"
+	defaultLogMaxTotalSize = "1g"
+	defaultHooksDir        = "/etc/nsctl/hooks.d"
+)
+
+// LoadRuntimeConfig reads the runtime config file, filling in defaults
+// A missing file is not an error; a malformed one is
+func LoadRuntimeConfig() (RuntimeConfig, error) {
+	config := RuntimeConfig{
+		LogMaxSize:      defaultLogMaxSize,
+		LogMaxTotalSize: defaultLogMaxTotalSize,
+		HooksDirs:       []string{defaultHooksDir},
+	}
+
+	configPath := runtimeConfigPath()
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return config, nil
+		}
+		return config, fmt.Errorf("failed to read %s: %v", configPath, err)
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("failed to parse %s: %v", configPath, err)
+	}
+
+	// Validate sizes up front so a typo is reported where it was made
+	for _, size := range []string{config.LogMaxSize, config.LogMaxTotalSize} {
+		if _, err := ParseSize(size); err != nil {
+			return config, fmt.Errorf("invalid size in %s: %v", configPath, err)
+		}
+	}
+	for _, webhook := range config.Webhooks {
+		if err := webhook.validate(); err != nil {
+			return config, fmt.Errorf("invalid webhook in %s: %v", configPath, err)
+		}
+	}
+	if err := config.Limits.validate(); err != nil {
+		return config, fmt.Errorf("invalid limits in %s: %v", configPath, err)
+	}
+	return config, nil
+}
+
+// runtimeConfigPath returns where the runtime config is read from
+func runtimeConfigPath() string {
+	if configPath := os.Getenv(runtimeConfigEnvVar); configPath != "" {
+		return configPath
+	}
+	return defaultRuntimeConfigPath
+}
+
+// ParseSize parses a human-friendly size such as "512k", "100m" or "1g"
+// Suffixes are binary (k = 1024) and may be followed by "b"; a plain number
+// is bytes. An empty string parses as 0.
+func ParseSize(size string) (int64, error) {
+	text := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(size)), "b")
+	if text == "" {
+		return 0, nil
+	}
+
+	multiplier := int64(1)
+	switch text[len(text)-1] {
+	case 'k':
+		multiplier = 1 << 10
+	case 'm':
+		multiplier = 1 << 20
+	case 'g':
+		multiplier = 1 << 30
+	case 't':
+		multiplier = 1 << 40
+	}
+	if multiplier != 1 {
+		text = text[:len(text)-1]
+	}
+
+	value, err := strconv.ParseInt(text, 10, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size %q (expected e.g. 512k, 100m, 1g)", size)
+	}
+	if value > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("invalid size %q: too large", size)
+	}
+	return value * multiplier, nil
+}
@@ -0,0 +1,41 @@
+//go:build linux
+
+package ns
+
+import "testing"
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		size string
+		want int64
+	}{
+		{"", 0},
+		{"0", 0},
+		{"4096", 4096},
+		{"512k", 512 << 10},
+		{"512K", 512 << 10},
+		{"512kb", 512 << 10},
+		{"100m", 100 << 20},
+		{"100MB", 100 << 20},
+		{" 1g ", 1 << 30},
+		{"2t", 2 << 40},
+		{"8388607t", 8388607 << 40},
+		{"10b", 10},
+	}
+	for _, test := range tests {
+		got, err := ParseSize(test.size)
+		if err != nil {
+			t.Errorf("ParseSize(%q): %v", test.size, err)
+		} else if got != test.want {
+			t.Errorf("ParseSize(%q) = %d, want %d", test.size, got, test.want)
+		}
+	}
+}
+
+func TestParseSizeErrors(t *testing.T) {
+	for _, size := range []string{"k", "-1", "-1m", "1.5g", "1p", "ten", "1 g", "8388608t", "9223372036854775808"} {
+		if got, err := ParseSize(size); err == nil {
+			t.Errorf("ParseSize(%q) = %d, want an error", size, got)
+		}
+	}
+}
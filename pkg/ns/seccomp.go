@@ -0,0 +1,275 @@
+//go:build linux
+
+package ns
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Seccomp profiles (--security-opt seccomp=profile.json)
+//
+// Profiles use the JSON format of Docker and the OCI spec: a default action
+// plus per-syscall actions. nsctl compiles them into a plain BPF filter that
+// checks the architecture and then compares the syscall number against each
+// rule; argument conditions are not supported, which rules out Docker's
+// and Podman's default profiles. Rules giving one syscall different
+// actions are refused, as libseccomp does. Syscall names this architecture
+// doesn't have are skipped, as libseccomp does too, so the usual
+// multi-arch profiles load.
+//
+// SCMP_ACT_NOTIFY suspends the syscall and hands it to a user-space agent.
+// The filter is then installed with SECCOMP_FILTER_FLAG_NEW_LISTENER, and the
+// resulting notification fd is passed to the agent listening on the
+// profile's listenerPath (or --security-opt seccomp-listener=<socket>), in
+// an SCM_RIGHTS message next to the container's state, like OCI runtimes do.
+// The agent can then emulate e.g. mount or mknod for the container.
+
+// SeccompProfile is a seccomp profile in the Docker/OCI JSON format
+type SeccompProfile struct {
+	DefaultAction    string        `json:"defaultAction"`
+	DefaultErrnoRet  *uint         `json:"defaultErrnoRet,omitempty"`
+	ListenerPath     string        `json:"listenerPath,omitempty"`
+	ListenerMetadata string        `json:"listenerMetadata,omitempty"`
+	Syscalls         []SeccompRule `json:"syscalls,omitempty"`
+}
+
+// SeccompRule applies an action to a set of syscalls
+type SeccompRule struct {
+	Names    []string `json:"names"`
+	Action   string   `json:"action"`
+	ErrnoRet *uint    `json:"errnoRet,omitempty"`
+
+	// Args are argument conditions, which nsctl rejects
+	Args json.RawMessage `json:"args,omitempty"`
+}
+
+// seccompActNotify is the action that forwards a syscall to the agent
+const seccompActNotify = "SCMP_ACT_NOTIFY"
+
+// seccompActions maps profile actions to seccomp return values; ERRNO
+// actions additionally carry an errno in the low bits
+var seccompActions = map[string]uint32{
+	"SCMP_ACT_ALLOW":        unix.SECCOMP_RET_ALLOW,
+	"SCMP_ACT_ERRNO":        unix.SECCOMP_RET_ERRNO,
+	"SCMP_ACT_KILL":         unix.SECCOMP_RET_KILL_THREAD,
+	"SCMP_ACT_KILL_THREAD":  unix.SECCOMP_RET_KILL_THREAD,
+	"SCMP_ACT_KILL_PROCESS": unix.SECCOMP_RET_KILL_PROCESS,
+	"SCMP_ACT_TRAP":         unix.SECCOMP_RET_TRAP,
+	"SCMP_ACT_LOG":          unix.SECCOMP_RET_LOG,
+	seccompActNotify:        unix.SECCOMP_RET_USER_NOTIF,
+}
+
+// LoadSeccompProfile reads and checks a profile file
+func LoadSeccompProfile(path string) (*SeccompProfile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read seccomp profile: %v", err)
+	}
+
+	var profile SeccompProfile
+	if err := json.Unmarshal(data, &profile); err != nil {
+		return nil, fmt.Errorf("invalid seccomp profile %s: %v", path, err)
+	}
+	if _, err := compileSeccompProfile(&profile); err != nil {
+		return nil, fmt.Errorf("invalid seccomp profile %s: %v", path, err)
+	}
+	return &profile, nil
+}
+
+// usesNotify reports whether any syscall is forwarded to an agent
+func (p *SeccompProfile) usesNotify() bool {
+	if p.DefaultAction == seccompActNotify {
+		return true
+	}
+	for _, rule := range p.Syscalls {
+		if rule.Action == seccompActNotify {
+			return true
+		}
+	}
+	return false
+}
+
+// seccompReturn converts a profile action to the filter's return value
+func seccompReturn(action string, errnoRet *uint) (uint32, error) {
+	value, found := seccompActions[action]
+	if !found {
+		return 0, fmt.Errorf("unsupported action %q", action)
+	}
+	if value == unix.SECCOMP_RET_ERRNO {
+		errno := uint(unix.EPERM)
+		if errnoRet != nil {
+			errno = *errnoRet
+		}
+		value |= uint32(errno) & unix.SECCOMP_RET_DATA
+	}
+	return value, nil
+}
+
+// compileSeccompProfile turns a profile into a BPF program
+func compileSeccompProfile(profile *SeccompProfile) ([]unix.SockFilter, error) {
+	if seccompAuditArch == 0 {
+		return nil, fmt.Errorf("seccomp profiles are not supported on this architecture")
+	}
+
+	defaultReturn, err := seccompReturn(profile.DefaultAction, profile.DefaultErrnoRet)
+	if err != nil {
+		return nil, fmt.Errorf("defaultAction: %v", err)
+	}
+
+	// Offsets into struct seccomp_data
+	const (
+		dataNR   = 0
+		dataArch = 4
+	)
+
+	filter := []unix.SockFilter{
+		// A syscall made through another ABI has other numbers: kill it
+		bpfStatement(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, dataArch),
+		bpfJump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, seccompAuditArch, 1, 0),
+		bpfStatement(unix.BPF_RET|unix.BPF_K, unix.SECCOMP_RET_KILL_PROCESS),
+		bpfStatement(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, dataNR),
+	}
+	// x32 syscalls pass the architecture check but would match no rule,
+	// getting the default action even in a deny list: kill them too
+	if seccompX32SyscallBit != 0 {
+		filter = append(filter,
+			bpfJump(unix.BPF_JMP|unix.BPF_JGE|unix.BPF_K, seccompX32SyscallBit, 0, 1),
+			bpfStatement(unix.BPF_RET|unix.BPF_K, unix.SECCOMP_RET_KILL_PROCESS),
+		)
+	}
+
+	// A syscall may be named again with the same action, but rules giving
+	// it different actions are refused rather than picked between
+	type seenRule struct {
+		index      int
+		ruleReturn uint32
+	}
+	seen := map[uintptr]seenRule{}
+	for i, rule := range profile.Syscalls {
+		if len(rule.Args) > 0 && string(rule.Args) != "null" && string(rule.Args) != "[]" {
+			return nil, fmt.Errorf("syscalls[%d]: argument conditions are not supported", i)
+		}
+		ruleReturn, err := seccompReturn(rule.Action, rule.ErrnoRet)
+		if err != nil {
+			return nil, fmt.Errorf("syscalls[%d]: %v", i, err)
+		}
+		for _, name := range rule.Names {
+			number, found := syscallNumbers[strings.ToLower(name)]
+			if !found {
+				continue
+			}
+			if earlier, named := seen[number]; named {
+				if earlier.ruleReturn != ruleReturn {
+					return nil, fmt.Errorf("syscalls[%d]: %s already has another action in syscalls[%d]", i, name, earlier.index)
+				}
+				continue
+			}
+			seen[number] = seenRule{index: i, ruleReturn: ruleReturn}
+			filter = append(filter,
+				bpfJump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, uint32(number), 0, 1),
+				bpfStatement(unix.BPF_RET|unix.BPF_K, ruleReturn),
+			)
+		}
+	}
+	filter = append(filter, bpfStatement(unix.BPF_RET|unix.BPF_K, defaultReturn))
+
+	if len(filter) > unix.BPF_MAXINSNS {
+		return nil, fmt.Errorf("profile compiles to %d instructions, more than the kernel's limit of %d", len(filter), unix.BPF_MAXINSNS)
+	}
+	return filter, nil
+}
+
+func bpfStatement(code uint16, k uint32) unix.SockFilter {
+	return unix.SockFilter{Code: code, K: k}
+}
+
+func bpfJump(code uint16, k uint32, jumpTrue uint8, jumpFalse uint8) unix.SockFilter {
+	return unix.SockFilter{Code: code, Jt: jumpTrue, Jf: jumpFalse, K: k}
+}
+
+// seccompListenerState is sent to the agent along with the notification
+// fd, following the OCI runtime's "container process state"
+type seccompListenerState struct {
+	OCIVersion string   `json:"ociVersion"`
+	FDs        []string `json:"fds"`
+	PID        int      `json:"pid"`
+	Metadata   string   `json:"metadata,omitempty"`
+	State      struct {
+		OCIVersion string `json:"ociVersion"`
+		ID         string `json:"id"`
+		Status     string `json:"status"`
+		PID        int    `json:"pid"`
+	} `json:"state"`
+}
+
+// installSeccompFilter loads the container's profile into the calling
+// thread, which must be the one that execs the workload
+// hostPID is the setup process's PID as the agent sees it.
+func installSeccompFilter(config ContainerConfig, hostPID int) error {
+	profile := config.Seccomp
+	filter, err := compileSeccompProfile(profile)
+	if err != nil {
+		return err
+	}
+
+	// Connect first: once the filter is in place, connect(2) itself may
+	// be one of the syscalls the agent is supposed to handle
+	var agent *net.UnixConn
+	if profile.usesNotify() {
+		agent, err = net.DialUnix("unix", nil, &net.UnixAddr{Name: profile.ListenerPath, Net: "unix"})
+		if err != nil {
+			return fmt.Errorf("failed to connect to seccomp agent: %v", err)
+		}
+		defer agent.Close()
+	}
+
+	// Without CAP_SYS_ADMIN the kernel only accepts a filter from a process
+	// that can't gain privileges through exec
+	if !hasCapability(capSysAdmin) {
+		if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+			return fmt.Errorf("failed to set no_new_privs: %v", err)
+		}
+	}
+
+	program := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	var flags uintptr
+	if agent != nil {
+		flags |= unix.SECCOMP_FILTER_FLAG_NEW_LISTENER
+	}
+	listenerFD, _, errno := unix.Syscall(unix.SYS_SECCOMP, unix.SECCOMP_SET_MODE_FILTER, flags, uintptr(unsafe.Pointer(&program)))
+	if errno != 0 {
+		return fmt.Errorf("failed to install seccomp filter: %v", errno)
+	}
+	if agent == nil {
+		return nil
+	}
+	defer unix.Close(int(listenerFD))
+
+	state := seccompListenerState{
+		OCIVersion: ociSpecVersion,
+		FDs:        []string{"seccompFd"},
+		PID:        hostPID,
+		Metadata:   profile.ListenerMetadata,
+	}
+	state.State.OCIVersion = ociSpecVersion
+	state.State.ID = config.ID
+	state.State.Status = StatusCreated
+	state.State.PID = hostPID
+
+	payload, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to marshal seccomp agent message: %v", err)
+	}
+	if _, _, err := agent.WriteMsgUnix(payload, unix.UnixRights(int(listenerFD)), nil); err != nil {
+		return fmt.Errorf("failed to pass seccomp listener to agent: %v", err)
+	}
+	logf("[ns] Passed seccomp notifications to agent at %s\n", profile.ListenerPath)
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build linux && !amd64 && !arm64
+
+package ns
+
+// Seccomp profiles are only supported on amd64 and arm64; elsewhere every
+// profile is rejected when it is loaded
+const seccompAuditArch = 0
+
+// seccompX32SyscallBit is 0: there is no filter to compile
+const seccompX32SyscallBit = 0
+
+// syscallNumbers has no entries on architectures without a syscall table
+var syscallNumbers = map[string]uintptr{}
@@ -0,0 +1,186 @@
+//go:build linux
+
+package ns
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// runSeccompFilter evaluates a compiled filter for one syscall, covering
+// the instructions compileSeccompProfile emits
+func runSeccompFilter(t *testing.T, filter []unix.SockFilter, arch uint32, nr uint32) uint32 {
+	t.Helper()
+	var accumulator uint32
+	for pc := 0; pc < len(filter); pc++ {
+		instruction := filter[pc]
+		switch instruction.Code {
+		case unix.BPF_LD | unix.BPF_W | unix.BPF_ABS:
+			switch instruction.K {
+			case 0:
+				accumulator = nr
+			case 4:
+				accumulator = arch
+			default:
+				t.Fatalf("load of unexpected offset %d", instruction.K)
+			}
+		case unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K:
+			if accumulator == instruction.K {
+				pc += int(instruction.Jt)
+			} else {
+				pc += int(instruction.Jf)
+			}
+		case unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K:
+			if accumulator >= instruction.K {
+				pc += int(instruction.Jt)
+			} else {
+				pc += int(instruction.Jf)
+			}
+		case unix.BPF_RET | unix.BPF_K:
+			return instruction.K
+		default:
+			t.Fatalf("unexpected instruction %#x", instruction.Code)
+		}
+	}
+	t.Fatalf("filter ends without returning")
+	return 0
+}
+
+func TestCompileSeccompProfile(t *testing.T) {
+	if seccompAuditArch == 0 {
+		t.Skip("no seccomp support on this architecture")
+	}
+	errnoRet := uint(unix.EACCES)
+
+	tests := []struct {
+		name    string
+		profile string
+		// want maps syscall names to the filter's return for them
+		want map[string]uint32
+	}{
+		{
+			name:    "deny list",
+			profile: `{"defaultAction": "SCMP_ACT_ALLOW", "syscalls": [{"names": ["mkdirat"], "action": "SCMP_ACT_ERRNO"}]}`,
+			want: map[string]uint32{
+				"mkdirat": unix.SECCOMP_RET_ERRNO | uint32(unix.EPERM),
+				"getpid":  unix.SECCOMP_RET_ALLOW,
+			},
+		},
+		{
+			name:    "allow list",
+			profile: `{"defaultAction": "SCMP_ACT_KILL_PROCESS", "syscalls": [{"names": ["getpid", "openat"], "action": "SCMP_ACT_ALLOW"}]}`,
+			want: map[string]uint32{
+				"getpid":  unix.SECCOMP_RET_ALLOW,
+				"openat":  unix.SECCOMP_RET_ALLOW,
+				"mkdirat": unix.SECCOMP_RET_KILL_PROCESS,
+			},
+		},
+		{
+			name:    "errno value",
+			profile: `{"defaultAction": "SCMP_ACT_ALLOW", "syscalls": [{"names": ["mkdirat"], "action": "SCMP_ACT_ERRNO", "errnoRet": 13}]}`,
+			want: map[string]uint32{
+				"mkdirat": unix.SECCOMP_RET_ERRNO | uint32(errnoRet),
+			},
+		},
+		{
+			name:    "names unknown to this architecture are skipped",
+			profile: `{"defaultAction": "SCMP_ACT_ALLOW", "syscalls": [{"names": ["no_such_syscall", "mkdirat"], "action": "SCMP_ACT_LOG"}]}`,
+			want: map[string]uint32{
+				"mkdirat": unix.SECCOMP_RET_LOG,
+			},
+		},
+		{
+			name:    "the same action twice",
+			profile: `{"defaultAction": "SCMP_ACT_ALLOW", "syscalls": [{"names": ["mkdirat"], "action": "SCMP_ACT_TRAP"}, {"names": ["MKDIRAT"], "action": "SCMP_ACT_TRAP"}]}`,
+			want: map[string]uint32{
+				"mkdirat": unix.SECCOMP_RET_TRAP,
+			},
+		},
+		{
+			name:    "notify",
+			profile: `{"defaultAction": "SCMP_ACT_ALLOW", "listenerPath": "/run/agent.sock", "syscalls": [{"names": ["mkdirat"], "action": "SCMP_ACT_NOTIFY"}]}`,
+			want: map[string]uint32{
+				"mkdirat": unix.SECCOMP_RET_USER_NOTIF,
+				"getpid":  unix.SECCOMP_RET_ALLOW,
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var profile SeccompProfile
+			if err := json.Unmarshal([]byte(test.profile), &profile); err != nil {
+				t.Fatal(err)
+			}
+			filter, err := compileSeccompProfile(&profile)
+			if err != nil {
+				t.Fatalf("compileSeccompProfile: %v", err)
+			}
+			for name, want := range test.want {
+				if got := runSeccompFilter(t, filter, seccompAuditArch, uint32(syscallNumbers[name])); got != want {
+					t.Errorf("%s returns %#x, want %#x", name, got, want)
+				}
+			}
+			if got := runSeccompFilter(t, filter, seccompAuditArch+1, uint32(syscallNumbers["getpid"])); got != unix.SECCOMP_RET_KILL_PROCESS {
+				t.Errorf("a syscall of another architecture returns %#x, want SECCOMP_RET_KILL_PROCESS", got)
+			}
+			if seccompX32SyscallBit != 0 {
+				if got := runSeccompFilter(t, filter, seccompAuditArch, seccompX32SyscallBit|uint32(syscallNumbers["getpid"])); got != unix.SECCOMP_RET_KILL_PROCESS {
+					t.Errorf("an x32 syscall returns %#x, want SECCOMP_RET_KILL_PROCESS", got)
+				}
+			}
+		})
+	}
+}
+
+func TestCompileSeccompProfileErrors(t *testing.T) {
+	if seccompAuditArch == 0 {
+		t.Skip("no seccomp support on this architecture")
+	}
+
+	tests := []struct {
+		name    string
+		profile string
+		want    string
+	}{
+		{
+			name:    "unknown default action",
+			profile: `{"defaultAction": "SCMP_ACT_MAYBE"}`,
+			want:    "defaultAction",
+		},
+		{
+			name:    "unknown rule action",
+			profile: `{"defaultAction": "SCMP_ACT_ALLOW", "syscalls": [{"names": ["mkdirat"], "action": "SCMP_ACT_MAYBE"}]}`,
+			want:    "syscalls[0]: unsupported action",
+		},
+		{
+			name:    "argument conditions",
+			profile: `{"defaultAction": "SCMP_ACT_ALLOW", "syscalls": [{"names": ["personality"], "action": "SCMP_ACT_ALLOW", "args": [{"index": 0, "value": 0, "op": "SCMP_CMP_EQ"}]}]}`,
+			want:    "syscalls[0]: argument conditions are not supported",
+		},
+		{
+			name:    "conflicting actions",
+			profile: `{"defaultAction": "SCMP_ACT_ALLOW", "syscalls": [{"names": ["mkdirat"], "action": "SCMP_ACT_ERRNO"}, {"names": ["getpid", "mkdirat"], "action": "SCMP_ACT_ALLOW"}]}`,
+			want:    "syscalls[1]: mkdirat already has another action in syscalls[0]",
+		},
+		{
+			name:    "conflicting errno values",
+			profile: `{"defaultAction": "SCMP_ACT_ALLOW", "syscalls": [{"names": ["mkdirat"], "action": "SCMP_ACT_ERRNO"}, {"names": ["mkdirat"], "action": "SCMP_ACT_ERRNO", "errnoRet": 13}]}`,
+			want:    "already has another action",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var profile SeccompProfile
+			if err := json.Unmarshal([]byte(test.profile), &profile); err != nil {
+				t.Fatal(err)
+			}
+			_, err := compileSeccompProfile(&profile)
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("compileSeccompProfile error = %v, want one containing %q", err, test.want)
+			}
+		})
+	}
+}
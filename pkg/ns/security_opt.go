@@ -0,0 +1,101 @@
+//go:build linux
+
+package ns
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// applySecurityOpts loads what the --security-opt key=value settings refer
+// to, so the setup process gets everything it needs in its config:
+//
+//	seccomp=<profile.json>      filter syscalls ("unconfined" for none)
+//	seccomp-listener=<socket>   agent for SCMP_ACT_NOTIFY, overriding the
+//	                            profile's listenerPath
+//	landlock=<policy.json>      restrict filesystem access with Landlock
+//	proc-opts=<options>         mount /proc with e.g. hidepid=2,subset=pid
+//	mask=<path>[:<path>...]     mask more paths (see masked_paths.go)
+//	unmask=<path>[:<path>...]   unmask default masked or read-only paths,
+//	                            ALL for all of them
+func applySecurityOpts(config *ContainerConfig) error {
+	var listenerPath string
+	var masks, unmasks []string
+	for _, option := range config.SecurityOpt {
+		key, value, found := strings.Cut(option, "=")
+		if !found || value == "" {
+			return fmt.Errorf("invalid --security-opt %q: expected key=value", option)
+		}
+
+		switch key {
+		case "seccomp":
+			if value == "unconfined" {
+				config.Seccomp = nil
+				continue
+			}
+			profile, err := LoadSeccompProfile(value)
+			if err != nil {
+				return err
+			}
+			config.Seccomp = profile
+		case "seccomp-listener":
+			listenerPath = value
+		case "landlock":
+			policy, err := LoadLandlockPolicy(value)
+			if err != nil {
+				return err
+			}
+			config.Landlock = policy
+		case "proc-opts":
+			if err := parseProcOptions(value); err != nil {
+				return err
+			}
+			config.ProcOptions = value
+		case "mask":
+			masks = append(masks, strings.Split(value, ":")...)
+		case "unmask":
+			unmasks = append(unmasks, strings.Split(value, ":")...)
+		default:
+			return fmt.Errorf("unknown --security-opt %q", key)
+		}
+	}
+
+	if err := prepareMaskedPaths(config, masks, unmasks); err != nil {
+		return err
+	}
+
+	// A rootful container holding CAP_SYS_ADMIN could simply mount /proc
+	// again without the options
+	if config.ProcOptions != "" && !config.Rootless {
+		keep, err := parseCapabilities(config.CapAdd)
+		if err != nil {
+			return err
+		}
+		if keep[capSysAdmin] {
+			return fmt.Errorf("--security-opt proc-opts can't be enforced with --cap-add SYS_ADMIN")
+		}
+	}
+
+	if config.Seccomp == nil {
+		if listenerPath != "" {
+			return fmt.Errorf("--security-opt seccomp-listener needs a seccomp profile")
+		}
+		return nil
+	}
+	if listenerPath != "" {
+		config.Seccomp.ListenerPath = listenerPath
+	}
+	if config.Seccomp.usesNotify() {
+		if config.Seccomp.ListenerPath == "" {
+			return fmt.Errorf("seccomp profile uses %s but names no agent: set its listenerPath or --security-opt seccomp-listener=<socket>", seccompActNotify)
+		}
+		// The setup process doesn't necessarily share our working directory
+		absolutePath, err := filepath.Abs(config.Seccomp.ListenerPath)
+		if err != nil {
+			return fmt.Errorf("invalid seccomp listener path: %v", err)
+		}
+		config.Seccomp.ListenerPath = absolutePath
+	}
+	return nil
+}
@@ -0,0 +1,296 @@
+//go:build linux
+
+package ns
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"nsctl/pkg/cgroup"
+)
+
+// End-to-end self-test (nsctl selftest)
+//
+// "nsctl check" looks at the host; the self-test runs a real container and
+// looks at it from the inside. The test binary is nsctl itself, run in the
+// container as "nsctl selftest-probe <dir>": it prints what it sees (its
+// PID, hostname, namespaces, cgroup limits) as JSON, writes a marker into a
+// tmpfs the container has mounted over <dir>, and exits with
+// selftestExitCode. The container runs detached, so its output ends up in
+// its log, and is removed afterwards.
+
+// SelftestProbeCommand is the hidden command the test container runs
+const SelftestProbeCommand = "selftest-probe"
+
+const (
+	// selftestExitCode is what the probe exits with, to check that exit
+	// codes make it out of the container
+	selftestExitCode = 42
+
+	// selftestHostname, selftestMemory and selftestCPUs are the settings
+	// the test container is given
+	selftestHostname = "nsctl-selftest"
+	selftestMemory   = 64 << 20 // 64m
+	selftestCPUs     = 0.5
+
+	// selftestMarker is the file the probe writes into its tmpfs
+	selftestMarker = "selftest-marker"
+
+	// selftestTimeout bounds the whole container run
+	selftestTimeout = 30 * time.Second
+)
+
+// selftestReport is what the probe saw inside the container
+type selftestReport struct {
+	PID        int               `json:"pid"`
+	Hostname   string            `json:"hostname"`
+	Namespaces map[string]string `json:"namespaces"`
+
+	// TmpfsMounted is set if the probe's directory was the container's
+	// tmpfs, and MarkerError says why the marker couldn't be written
+	TmpfsMounted bool   `json:"tmpfs_mounted"`
+	MarkerError  string `json:"marker_error,omitempty"`
+
+	// MemoryLimit and CPUQuota are the limits the cgroup mounted at
+	// /sys/fs/cgroup shows; empty without one
+	MemoryLimit string `json:"memory_limit,omitempty"`
+	CPUQuota    string `json:"cpu_quota,omitempty"`
+}
+
+// selftestNamespaces are the namespace types whose isolation is tested
+var selftestNamespaces = []string{"pid", "uts", "mnt", "net"}
+
+// RunSelftestProbe is the body of "nsctl selftest-probe <dir>" and returns
+// the exit code
+func RunSelftestProbe(dir string) int {
+	report := selftestReport{PID: os.Getpid(), Namespaces: readNamespaces("self")}
+	report.Hostname, _ = os.Hostname()
+
+	var stat unix.Statfs_t
+	report.TmpfsMounted = unix.Statfs(dir, &stat) == nil && stat.Type == unix.TMPFS_MAGIC
+	if err := os.WriteFile(filepath.Join(dir, selftestMarker), nil, 0644); err != nil {
+		report.MarkerError = err.Error()
+	}
+
+	report.MemoryLimit = readFirstLine("/sys/fs/cgroup/memory.max", "/sys/fs/cgroup/memory/memory.limit_in_bytes")
+	report.CPUQuota = readFirstLine("/sys/fs/cgroup/cpu.max", "/sys/fs/cgroup/cpu/cpu.cfs_quota_us")
+
+	data, _ := json.Marshal(report)
+	fmt.Println(string(data))
+	return selftestExitCode
+}
+
+// readNamespaces returns the namespace identities of a process, like
+// "pid:[4026531836]"
+func readNamespaces(pid string) map[string]string {
+	namespaces := map[string]string{}
+	for _, name := range selftestNamespaces {
+		if link, err := os.Readlink(filepath.Join("/proc", pid, "ns", name)); err == nil {
+			namespaces[name] = link
+		}
+	}
+	return namespaces
+}
+
+// readFirstLine returns the first line of the first of the files that exists
+func readFirstLine(paths ...string) string {
+	for _, path := range paths {
+		if data, err := os.ReadFile(path); err == nil {
+			line, _, _ := strings.Cut(string(data), "\n")
+			return line
+		}
+	}
+	return ""
+}
+
+// RunSelftest runs a container with the probe and checks what it saw;
+// execPath is the nsctl executable, which is also the test binary
+func RunSelftest(execPath string) []CheckResult {
+	run := CheckResult{Name: "Container run", Status: CheckPass}
+	outcome, err := runSelftestContainer(execPath)
+	if err != nil {
+		run.Status = CheckFail
+		run.Detail = err.Error()
+		run.Fix = "run \"nsctl check\" to find out what the host lacks"
+		return []CheckResult{run}
+	}
+	report, info := outcome.report, outcome.info
+	run.Detail = fmt.Sprintf("container %s ran the probe", ShortID(info.ID))
+
+	hostNamespaces := readNamespaces("self")
+	isolated := func(name string) bool {
+		return report.Namespaces[name] != "" && report.Namespaces[name] != hostNamespaces[name]
+	}
+	results := []CheckResult{run}
+
+	pid := CheckResult{Name: "PID isolation", Status: CheckPass, Detail: "the probe ran as PID 1 of its own namespace"}
+	if !isolated("pid") || report.PID != 1 {
+		pid.Status = CheckFail
+		pid.Detail = fmt.Sprintf("the probe ran as PID %d in %s (the host's is %s)", report.PID, report.Namespaces["pid"], hostNamespaces["pid"])
+	}
+	results = append(results, pid)
+
+	uts := CheckResult{Name: "UTS isolation", Status: CheckPass, Detail: "the container has its own hostname"}
+	hostHostname, _ := os.Hostname()
+	if !isolated("uts") || report.Hostname != selftestHostname || hostHostname == selftestHostname {
+		uts.Status = CheckFail
+		uts.Detail = fmt.Sprintf("the probe saw hostname %q, expected %q", report.Hostname, selftestHostname)
+	}
+	results = append(results, uts)
+
+	results = append(results, checkSelftestMounts(report, isolated("mnt"), outcome.markerOnHost))
+
+	network := CheckResult{Name: "Network isolation", Status: CheckPass, Detail: "the container has its own network namespace"}
+	if !isolated("net") {
+		network.Status = CheckSkip
+		network.Detail = "containers share the host's network"
+	}
+	results = append(results, network)
+
+	results = append(results, checkSelftestLimits(report))
+
+	exit := CheckResult{Name: "Exit code", Status: CheckPass, Detail: fmt.Sprintf("%d made it out of the container", selftestExitCode)}
+	if info.ExitCode != selftestExitCode {
+		exit.Status = CheckFail
+		exit.Detail = fmt.Sprintf("the container exited with %d, the probe with %d", info.ExitCode, selftestExitCode)
+	}
+	return append(results, exit)
+}
+
+// checkSelftestMounts checks that the container's tmpfs was there for the
+// probe, and not for the host
+func checkSelftestMounts(report selftestReport, isolated bool, markerOnHost bool) CheckResult {
+	result := CheckResult{Name: "Mount isolation", Status: CheckPass, Detail: "the container's mounts stay in the container"}
+	switch {
+	case !isolated:
+		result.Status = CheckFail
+		result.Detail = "the container shares the host's mount namespace"
+	case !report.TmpfsMounted:
+		result.Status = CheckFail
+		result.Detail = "the container's tmpfs mount was missing"
+	case report.MarkerError != "":
+		result.Status = CheckFail
+		result.Detail = "writing to the container's tmpfs failed: " + report.MarkerError
+	case markerOnHost:
+		result.Status = CheckFail
+		result.Detail = "a file written to the container's tmpfs showed up on the host"
+	}
+	return result
+}
+
+// checkSelftestLimits checks that the container saw the limits it was given
+func checkSelftestLimits(report selftestReport) CheckResult {
+	result := CheckResult{Name: "Cgroup limits", Status: CheckPass, Detail: "the container saw its memory and CPU limits"}
+	if os.Geteuid() != 0 {
+		if err := cgroup.CanDelegate(); err != nil {
+			result.Status = CheckSkip
+			result.Detail = "rootless containers get no cgroup here: " + err.Error()
+			return result
+		}
+	}
+
+	expectedQuota := strconv.Itoa(int(selftestCPUs * 100000))
+	quota, _, _ := strings.Cut(report.CPUQuota, " ")
+	switch {
+	case report.MemoryLimit == "" && report.CPUQuota == "":
+		result.Status = CheckFail
+		result.Detail = "the container's cgroup wasn't mounted at /sys/fs/cgroup"
+	case report.MemoryLimit != strconv.Itoa(selftestMemory):
+		result.Status = CheckFail
+		result.Detail = fmt.Sprintf("memory limit %q, expected %d", report.MemoryLimit, selftestMemory)
+	case quota != expectedQuota:
+		result.Status = CheckFail
+		result.Detail = fmt.Sprintf("CPU quota %q, expected %s", report.CPUQuota, expectedQuota)
+	}
+	return result
+}
+
+// selftestRun is the outcome of running the test container
+type selftestRun struct {
+	report selftestReport
+	info   *ContainerInfo
+
+	// markerOnHost is set if the marker the probe wrote to its tmpfs
+	// showed up in the host's directory
+	markerOnHost bool
+}
+
+// runSelftestContainer runs the probe in a detached container and waits for
+// it; the container is removed again
+func runSelftestContainer(execPath string) (selftestRun, error) {
+	var run selftestRun
+	absoluteExecPath, err := os.Executable()
+	if err != nil {
+		return run, fmt.Errorf("failed to find the nsctl executable: %v", err)
+	}
+
+	markerDir, err := os.MkdirTemp("", "nsctl-selftest-")
+	if err != nil {
+		return run, fmt.Errorf("failed to create test directory: %v", err)
+	}
+	defer os.RemoveAll(markerDir)
+
+	config := ContainerConfig{
+		Command:  absoluteExecPath,
+		Args:     []string{SelftestProbeCommand, markerDir},
+		Detach:   true,
+		Hostname: selftestHostname,
+		Memory:   "64m",
+		CPUs:     selftestCPUs,
+		Mounts:   []Mount{{Type: MountTypeTmpfs, Destination: markerDir}},
+	}
+	containerID, err := RunWithConfig(execPath, config)
+	if err != nil {
+		return run, err
+	}
+	defer RemoveContainer(containerID, true, true)
+
+	run.info, err = waitForExit(containerID, selftestTimeout)
+	if err != nil {
+		return run, err
+	}
+	_, err = os.Stat(filepath.Join(markerDir, selftestMarker))
+	run.markerOnHost = err == nil
+
+	var output bytes.Buffer
+	if err := WriteContainerLog(run.info, LogOptions{Tail: -1}, &output, &output); err != nil {
+		return run, fmt.Errorf("failed to read the container's log: %v", err)
+	}
+	scanner := bufio.NewScanner(&output)
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "{") {
+			if err := json.Unmarshal(scanner.Bytes(), &run.report); err != nil {
+				return run, fmt.Errorf("failed to parse the probe's report: %v", err)
+			}
+			return run, nil
+		}
+	}
+	return run, fmt.Errorf("the probe printed no report (exit code %d)", run.info.ExitCode)
+}
+
+// waitForExit polls a container's record until it has exited
+func waitForExit(containerID string, timeout time.Duration) (*ContainerInfo, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		info, err := LookupContainer(containerID)
+		if err != nil {
+			return nil, err
+		}
+		if info.Status == StatusExited {
+			return info, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("container %s didn't exit within %v", ShortID(containerID), timeout)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,181 @@
+//go:build linux
+
+package ns
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io/fs"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// SELinux relabeling of mount sources (-v src:dst:z, -v src:dst:Z)
+//
+// Under an enforcing policy, a confined container process may only touch
+// files labeled for containers; anything else from the host, like a home
+// directory, fails with EACCES. The z and Z options relabel a bind's
+// source (or a volume) before the container starts:
+//
+//	z  container_file_t:s0, which every container may use
+//	Z  container_file_t with an MCS level of this container's own, e.g.
+//	   s0:c12,c345, which other containers can't use
+//
+// With Z the workload itself runs as container_t with the same level
+// (setExecLabel), so its Z mounts are the only private ones it can use;
+// without Z it keeps the label nsctl runs with.
+//
+// Relabeling system directories would break the host, so / and the
+// directories of the OS (/usr, /etc, ...) are skipped with a warning. On
+// hosts without SELinux the options do nothing.
+
+// Relabel modes of Mount.Relabel
+const (
+	RelabelShared  = "shared"
+	RelabelPrivate = "private"
+)
+
+const (
+	// selinuxXattr holds a file's SELinux label
+	selinuxXattr = "security.selinux"
+
+	// containerProcessType is the SELinux type of a container with Z
+	// mounts, given their MCS level
+	containerProcessType = "system_u:system_r:container_t"
+
+	// containerFileLabel is the label of files any container may use
+	containerFileLabel = "system_u:object_r:container_file_t:s0"
+
+	// mcsCategories is the number of MCS categories levels are drawn from
+	mcsCategories = 1024
+)
+
+// selinuxSystemPaths are directories never relabeled, along with what is
+// below them
+var selinuxSystemPaths = []string{
+	"/bin", "/boot", "/dev", "/etc", "/lib", "/lib32", "/lib64", "/proc",
+	"/sbin", "/sys", "/usr",
+}
+
+// selinuxSkippedPaths are directories never relabeled themselves, though
+// directories below them may be
+var selinuxSkippedPaths = []string{"/", "/home", "/mnt", "/opt", "/root", "/run", "/srv", "/tmp", "/var"}
+
+// newMCSLevel picks a random MCS level with two distinct categories
+func newMCSLevel() (string, error) {
+	var categories [2]int64
+	for categories[0] == categories[1] {
+		for i := range categories {
+			category, err := rand.Int(rand.Reader, big.NewInt(mcsCategories))
+			if err != nil {
+				return "", fmt.Errorf("failed to pick an MCS level: %v", err)
+			}
+			categories[i] = category.Int64()
+		}
+	}
+	low, high := min(categories[0], categories[1]), max(categories[0], categories[1])
+	return fmt.Sprintf("s0:c%d,c%d", low, high), nil
+}
+
+// isSELinuxSystemPath reports whether relabeling path would relabel part
+// of the OS or a directory users share
+func isSELinuxSystemPath(path string) bool {
+	for _, systemPath := range selinuxSystemPaths {
+		if path == systemPath || strings.HasPrefix(path, systemPath+"/") {
+			return true
+		}
+	}
+	for _, skippedPath := range selinuxSkippedPaths {
+		if path == skippedPath {
+			return true
+		}
+	}
+	return false
+}
+
+// relabelMounts relabels the sources of the container's mounts with z or
+// Z, picking the container's MCS level for Z
+func relabelMounts(config *ContainerConfig) error {
+	var relabeled []Mount
+	for _, mount := range config.Mounts {
+		if mount.Relabel != "" {
+			relabeled = append(relabeled, mount)
+		}
+	}
+	if len(relabeled) == 0 || !detectSELinux() {
+		return nil
+	}
+
+	for _, mount := range relabeled {
+		label := containerFileLabel
+		if mount.Relabel == RelabelPrivate {
+			if config.MountLabel == "" {
+				level, err := newMCSLevel()
+				if err != nil {
+					return err
+				}
+				config.MountLabel = "system_u:object_r:container_file_t:" + level
+			}
+			label = config.MountLabel
+		}
+
+		source, err := filepath.EvalSymlinks(mount.Source)
+		if err != nil {
+			return fmt.Errorf("failed to relabel %s: %v", mount.Source, err)
+		}
+		if isSELinuxSystemPath(source) {
+			logf("[ns] Warning: not relabeling system path %s for %s\n", source, mount.Destination)
+			continue
+		}
+		if err := relabelTree(source, label); err != nil {
+			return err
+		}
+		logf("[ns] Relabeled %s as %s\n", source, label)
+	}
+	return nil
+}
+
+// setExecLabel makes the calling thread's next exec run as a container
+// process with the MCS level of mountLabel, the label of the container's Z
+// mounts; without any, nothing changes
+func setExecLabel(mountLabel string) error {
+	if mountLabel == "" {
+		return nil
+	}
+	parts := strings.SplitN(mountLabel, ":", 4)
+	if len(parts) != 4 {
+		return fmt.Errorf("invalid mount label %q", mountLabel)
+	}
+	label := containerProcessType + ":" + parts[3]
+
+	attr, err := os.OpenFile("/proc/thread-self/attr/exec", os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("failed to set the SELinux label %s: %v", label, err)
+	}
+	defer attr.Close()
+	if _, err := attr.Write([]byte(label)); err != nil {
+		return fmt.Errorf("failed to set the SELinux label %s: %v", label, err)
+	}
+	return nil
+}
+
+// relabelTree sets the SELinux label of path and everything below it
+func relabelTree(path string, label string) error {
+	err := filepath.WalkDir(path, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := unix.Lsetxattr(filePath, selinuxXattr, []byte(label), 0); err != nil {
+			return &os.PathError{Op: "relabel", Path: filePath, Err: err}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to relabel %s: %v", path, err)
+	}
+	return nil
+}
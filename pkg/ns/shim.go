@@ -0,0 +1,616 @@
+//go:build linux
+
+package ns
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"nsctl/pkg/cgroup"
+)
+
+// The shim
+//
+// Every container gets a small "shim" process: nsctl re-executed as
+// "nsctl shim <id>". The shim, not the CLI, is the parent of the container.
+// It starts the namespaced process, registers it, waits for it, and records
+// how it exited. Because the shim runs independently of the CLI, the
+// container's lifetime is no longer tied to the command that started it:
+//
+//   nsctl run -d ... --> shim (own session) --> setup-and-exec --> workload
+//        |                 |
+//        exits once        stays until the workload exits, then writes
+//        started           <container dir>/exit and updates the record
+//
+// There is no daemon: a detached shim is "daemonized" with the classic double
+// fork. The CLI starts an intermediate "shim --daemonize" process in a new
+// session, which starts the real shim and exits immediately. The orphaned
+// shim is re-parented to init (or the nearest subreaper) and is no longer
+// related to the invoking shell in any way, so closing the terminal, killing
+// the shell or logging out leaves it running. Everything later commands need
+// (config, record, exit file, logs) lives in the state directory.
+
+const (
+	// Files kept in the per-container directory
+	containerConfigFileName = "config.json"
+	containerExitFileName   = "exit"
+	containerLogFileName    = "container.log"
+	shimLogFileName         = "shim.log"
+
+	// shimReadyFD is where a detached shim reports that the container started
+	shimReadyFD = 3
+
+	// shimFailureExitCode is the shim's exit code when it fails by itself,
+	// as opposed to passing on the container's exit code
+	shimFailureExitCode = 125
+)
+
+// ContainerExitError reports that a foreground container exited non-zero
+type ContainerExitError struct {
+	ExitCode int
+}
+
+func (e *ContainerExitError) Error() string {
+	return fmt.Sprintf("container exited with code %d", e.ExitCode)
+}
+
+// containerStdio describes where a container's standard streams go
+type containerStdio struct {
+	stdin    *os.File
+	stdout   *os.File
+	stderr   *os.File
+	setupLog *os.File // receives the "[ns]" lines of the setup process
+
+	// logPipes are the write ends of the stdout and stderr pipes the shim
+	// copies into the container log, and logCopied is closed once that
+	// copy has finished
+	logPipes  []*os.File
+	logCopied <-chan struct{}
+}
+
+// closeLogPipes drops the shim's copies of the log pipes' write ends
+// Called once the container has been started with them, so that the pipes
+// reach EOF as soon as the container's processes are gone
+func (stdio *containerStdio) closeLogPipes() {
+	for _, pipe := range stdio.logPipes {
+		pipe.Close()
+	}
+	stdio.logPipes = nil
+}
+
+// waitForLog waits until the container's output has been fully logged
+func (stdio *containerStdio) waitForLog() {
+	if stdio.logCopied != nil {
+		<-stdio.logCopied
+	}
+}
+
+// writeContainerConfig stores the config in the container directory for the shim
+func writeContainerConfig(config ContainerConfig) error {
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal container config: %v", err)
+	}
+
+	configPath := filepath.Join(config.ContainerDir, containerConfigFileName)
+	if err := os.WriteFile(configPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write container config: %v", err)
+	}
+	return nil
+}
+
+// readContainerConfig loads the config written by writeContainerConfig
+func readContainerConfig(containerID string) (ContainerConfig, error) {
+	var config ContainerConfig
+
+	configPath := filepath.Join(getContainerDir(containerID), containerConfigFileName)
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return config, fmt.Errorf("failed to read container config: %v", err)
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("failed to parse container config: %v", err)
+	}
+	return config, nil
+}
+
+// startShim launches the shim for a prepared container
+// In the foreground the shim shares our terminal and we wait for it; its exit
+// code is the container's. Detached, the shim gets its own session and we
+// only wait until it reports that the container is up.
+func startShim(execPath string, config ContainerConfig) error {
+	logf("[ns] Starting shim for container %s\n", ShortID(config.ID))
+
+	// The shim outlives us and runs from "/", so it needs an absolute path
+	absoluteExecPath, err := exec.LookPath(execPath)
+	if err == nil {
+		absoluteExecPath, err = filepath.Abs(absoluteExecPath)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to resolve nsctl executable %s: %v", execPath, err)
+	}
+
+	if !config.Detach && !config.CreateOnly {
+		shim := shimCommand(absoluteExecPath, config.ID)
+		shim.Stdin = os.Stdin
+		shim.Stdout = os.Stdout
+		shim.Stderr = os.Stderr
+		if err := shim.Run(); err != nil {
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) && exitErr.ExitCode() > 0 {
+				return &ContainerExitError{ExitCode: exitErr.ExitCode()}
+			}
+			return fmt.Errorf("shim failed: %v", err)
+		}
+		return nil
+	}
+
+	// Detached: the shim's own diagnostics go to a log file in the container
+	// directory since there is no terminal to print them to
+	shimLogPath := filepath.Join(config.ContainerDir, shimLogFileName)
+	shimLog, err := os.OpenFile(shimLogPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open shim log: %v", err)
+	}
+	defer shimLog.Close()
+
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("failed to create shim ready pipe: %v", err)
+	}
+	defer readyReader.Close()
+
+	// Start the intermediate process of the double fork
+	launcher := exec.Command(absoluteExecPath, "shim", "--daemonize", config.ID)
+	launcher.Stderr = shimLog
+	launcher.ExtraFiles = []*os.File{readyWriter}
+
+	// A new session detaches the shim from our terminal, so closing the
+	// terminal or pressing Ctrl-C no longer reaches it
+	launcher.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+
+	if err := launcher.Run(); err != nil {
+		readyWriter.Close()
+		return fmt.Errorf("failed to launch shim: %v", err)
+	}
+	readyWriter.Close()
+
+	// The shim writes "ok" once the container runs, or an error message;
+	// EOF without either means it died early
+	readyMessage, _ := io.ReadAll(readyReader)
+	if config.TraceSetup {
+		printSetupTrace(shimLogPath)
+	}
+
+	switch message := strings.TrimSpace(string(readyMessage)); {
+	case message == "ok":
+		return nil
+	case message != "":
+		return errors.New(message)
+	default:
+		return fmt.Errorf("shim exited before the container started (see %s)", shimLogPath)
+	}
+}
+
+// printSetupTrace copies the --trace-setup lines of a detached shim's log
+// to stderr, where a foreground container's go straight away
+func printSetupTrace(shimLogPath string) {
+	data, err := os.ReadFile(shimLogPath)
+	if err != nil {
+		return
+	}
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		if strings.HasPrefix(line, tracePrefix) {
+			fmt.Fprint(os.Stderr, line)
+		}
+	}
+}
+
+// shimCommand prepares "nsctl shim <id>"
+// Rootless, the shim is started in a transient systemd scope delegated to
+// the user, so that it can create the container's cgroup there; without
+// systemd it runs as is and the container goes without limits (which
+// CheckHostFeatures has already warned about).
+func shimCommand(execPath string, containerID string) *exec.Cmd {
+	argv := []string{execPath, "shim", containerID}
+	if os.Geteuid() != 0 && cgroup.CanDelegate() == nil {
+		argv = cgroup.DelegatedScopeCommand(containerID, argv)
+	}
+	return exec.Command(argv[0], argv[1:]...)
+}
+
+// DaemonizeShim is the intermediate "nsctl shim --daemonize <id>" process
+// It starts the real shim and exits straight away, leaving the shim orphaned
+// so that init adopts it. The ready pipe and log are passed straight through.
+func DaemonizeShim(execPath string, containerID string) error {
+	shim := shimCommand(execPath, containerID)
+	shim.Stderr = os.Stderr
+	shim.ExtraFiles = []*os.File{os.NewFile(shimReadyFD, "ready-pipe")}
+
+	// Don't keep whatever directory the user ran nsctl from busy (or its
+	// filesystem from being unmounted) for the lifetime of the container
+	shim.Dir = "/"
+
+	if err := shim.Start(); err != nil {
+		return fmt.Errorf("failed to start shim: %v", err)
+	}
+	logf("[shim] Daemonized shim for container %s with PID %d\n", ShortID(containerID), shim.Process.Pid)
+	return shim.Process.Release()
+}
+
+// RunShim is the body of the "nsctl shim <id>" process
+// It returns the exit code the shim process should exit with: the
+// container's own exit code, or shimFailureExitCode if the shim failed.
+func RunShim(execPath string, containerID string) int {
+	// Resolve the state directory the same way the CLI did (it falls back
+	// to one under $HOME for unprivileged users)
+	if err := ensureStateDir(); err != nil {
+		logf("[shim] %v\n", err)
+		return shimFailureExitCode
+	}
+
+	config, err := readContainerConfig(containerID)
+	if err != nil {
+		logf("[shim] %v\n", err)
+		return shimFailureExitCode
+	}
+
+	// Detached shims report readiness to the CLI over a pipe
+	var readyPipe *os.File
+	if config.Detach || config.CreateOnly {
+		readyPipe = os.NewFile(shimReadyFD, "ready-pipe")
+	}
+	reportReady := func(message string) {
+		if readyPipe != nil {
+			fmt.Fprintln(readyPipe, message)
+			readyPipe.Close()
+			readyPipe = nil
+		}
+	}
+
+	// The container's address is its own for as long as its shim runs
+	defer func() { releaseAddress(config) }()
+
+	// The shim must outlive terminal hangups and Ctrl-C aimed at the
+	// foreground job; otherwise nobody would be left to record the exit
+	signal.Ignore(syscall.SIGINT, syscall.SIGHUP, syscall.SIGQUIT)
+
+	// Until the container is registered, a failure leaves nothing behind
+	failBeforeRegistration := func(err error) int {
+		logf("[shim] %v\n", err)
+		reportReady(err.Error())
+		os.RemoveAll(config.ContainerDir)
+		return shimFailureExitCode
+	}
+
+	container, containerCgroup, stdio, err := launchContainer(execPath, &config)
+	if err != nil {
+		return failBeforeRegistration(err)
+	}
+
+	if err := RegisterContainer(config, container.Process.Pid); err != nil {
+		killLaunchedContainer(container, containerCgroup)
+		return failBeforeRegistration(err)
+	}
+
+	cgroupWatch := watchCgroupEvents(config, container.Process, containerCgroup)
+
+	// "run" starts the workload straight away; "create" leaves that to "start"
+	if !config.CreateOnly {
+		if err := StartContainer(containerID); err != nil {
+			logf("[shim] %v\n", err)
+			reportReady(err.Error())
+			cgroupWatch.stop()
+			killLaunchedContainer(container, containerCgroup)
+			recordContainerExit(config, containerExit{ExitCode: shimFailureExitCode})
+			return shimFailureExitCode
+		}
+	}
+	reportReady("ok")
+
+	delay := restartMinDelay
+	for {
+		exit := waitForWorkload(config, container, containerCgroup, stdio, cgroupWatch)
+		if !shouldRestart(config, exit) {
+			recordContainerExit(config, exit)
+			return exit.ExitCode
+		}
+
+		// Back off between quick failures, starting over after a long run
+		previous, err := recordContainerRestart(config, exit)
+		if err == nil && previous.FinishedAt.Sub(previous.StartedAt) >= restartResetAfter {
+			delay = restartMinDelay
+		}
+		if err == nil {
+			logf("[shim] Restarting container %s in %s\n", ShortID(containerID), delay)
+			container, containerCgroup, stdio, err = restartContainer(execPath, &config, delay)
+		}
+		if err != nil {
+			logf("[shim] Not restarting container %s: %v\n", ShortID(containerID), err)
+			recordContainerExit(config, exit)
+			return exit.ExitCode
+		}
+		delay = min(delay*2, restartMaxDelay)
+		cgroupWatch = watchCgroupEvents(config, container.Process, containerCgroup)
+	}
+}
+
+// launchContainer starts the setup process of a container in its cgroup
+// and runs the prestart hooks; the workload then waits for StartContainer
+func launchContainer(execPath string, config *ContainerConfig) (*exec.Cmd, *cgroup.Cgroup, containerStdio, error) {
+	stdio, err := openContainerStdio(*config)
+	if err != nil {
+		return nil, nil, stdio, err
+	}
+
+	// The container goes into its cgroup before setup starts, so that setup
+	// is accounted for too and can mount the cgroup into the container, and
+	// its network namespace is plugged into the bridge for setup to configure
+	var containerCgroup *cgroup.Cgroup
+	container, err := startContainerProcess(execPath, *config, stdio, func(pid int, setupConfig *ContainerConfig) error {
+		var err error
+		containerCgroup, err = setUpCgroup(*config, pid)
+		if err != nil {
+			return err
+		}
+		if containerCgroup != nil {
+			config.CgroupPath = containerCgroup.Path
+			setupConfig.CgroupPath = containerCgroup.Path
+			setupConfig.CgroupPaths = containerCgroup.Paths()
+		}
+
+		if err := connectContainer(config, pid); err != nil {
+			return err
+		}
+		setupConfig.IPAddress = config.IPAddress
+		return nil
+	})
+	stdio.closeLogPipes()
+	if err != nil {
+		if containerCgroup != nil {
+			releaseCgroup(containerCgroup, &containerExit{})
+		}
+		return nil, nil, stdio, err
+	}
+
+	// The namespaces exist, the workload hasn't started: prestart hooks
+	if err := runHooks(*config, StatusCreated, container.Process.Pid, HookPrestart, HookCreateRuntime); err != nil {
+		killLaunchedContainer(container, containerCgroup)
+		return nil, nil, stdio, err
+	}
+	return container, containerCgroup, stdio, nil
+}
+
+// killLaunchedContainer gets rid of a container whose workload won't run
+func killLaunchedContainer(container *exec.Cmd, containerCgroup *cgroup.Cgroup) {
+	container.Process.Kill()
+	container.Wait()
+	releaseCgroup(containerCgroup, &containerExit{})
+}
+
+// restartContainer launches and starts a container's workload again once
+// delay has passed
+func restartContainer(execPath string, config *ContainerConfig, delay time.Duration) (*exec.Cmd, *cgroup.Cgroup, containerStdio, error) {
+	if !waitToRestart(config.ID, delay) {
+		return nil, nil, containerStdio{}, fmt.Errorf("it was stopped")
+	}
+
+	// The workload waits on the start FIFO again, which the last start removed
+	if err := createExecFifo(config.ContainerDir); err != nil {
+		return nil, nil, containerStdio{}, err
+	}
+	container, containerCgroup, stdio, err := launchContainer(execPath, config)
+	if err != nil {
+		return nil, nil, stdio, err
+	}
+	if err := markContainerRestarted(config.ID, container.Process.Pid); err != nil {
+		killLaunchedContainer(container, containerCgroup)
+		return nil, nil, stdio, err
+	}
+	if err := StartContainer(config.ID); err != nil {
+		killLaunchedContainer(container, containerCgroup)
+		return nil, nil, stdio, err
+	}
+	return container, containerCgroup, stdio, nil
+}
+
+// waitForWorkload waits for a started container's workload to exit, with
+// its --timeout and health check, and works out how it ended
+func waitForWorkload(config ContainerConfig, container *exec.Cmd, containerCgroup *cgroup.Cgroup, stdio containerStdio, cgroupWatch *cgroupWatch) containerExit {
+	exited := make(chan struct{})
+	timedOut := make(chan bool, 1)
+	if config.Timeout > 0 {
+		go func() {
+			timedOut <- enforceTimeout(config.ID, container.Process, config.Timeout, exited)
+		}()
+	} else {
+		timedOut <- false
+	}
+
+	healthChecked := make(chan struct{})
+	go func() {
+		defer close(healthChecked)
+		runHealthCheck(config, container.Process, exited)
+	}()
+
+	container.Wait()
+	close(exited)
+	// Leftovers outside a PID namespace would keep the log pipes open
+	if !hasOwnPIDNamespace(config) {
+		killLeftovers(config, containerCgroup)
+	}
+	<-healthChecked
+	stdio.waitForLog()
+	exit := containerExitFromState(container.ProcessState)
+	cgroupWatch.stop()
+	releaseCgroup(containerCgroup, &exit)
+	logf("[shim] Container %s exited with code %d\n", ShortID(config.ID), exit.ExitCode)
+
+	if cgroupWatch.restartRequested {
+		exit.FinishReason = FinishReasonMemoryEvent
+	}
+	if <-timedOut {
+		exit.FinishReason = FinishReasonTimedOut
+	}
+	return exit
+}
+
+// openContainerStdio picks the container's streams
+// Containers write stdout and stderr into two pipes that the shim copies to
+// the container log, within the log quotas, keeping track of which stream
+// each line came from. Detached and created ones read from /dev/null;
+// foreground ones use the shim's stdin, and the shim also copies their
+// output to its own (i.e. the user's terminal). Interactive containers,
+// whose stdin is a terminal, get it as stdout and stderr too, so programs
+// that need a terminal work; their output isn't logged.
+func openContainerStdio(config ContainerConfig) (containerStdio, error) {
+	if !logsOutput(config) {
+		return containerStdio{stdin: os.Stdin, stdout: os.Stdout, stderr: os.Stderr, setupLog: os.Stderr}, nil
+	}
+
+	maxSize, maxTotalSize, err := containerLogLimits(config)
+	if err != nil {
+		return containerStdio{}, err
+	}
+	logWriter, err := newLogQuotaWriter(config.ContainerDir, maxSize, maxTotalSize)
+	if err != nil {
+		return containerStdio{}, err
+	}
+
+	stdoutReader, stdoutWriter, err := os.Pipe()
+	if err != nil {
+		logWriter.Close()
+		return containerStdio{}, fmt.Errorf("failed to create log pipe: %v", err)
+	}
+	stderrReader, stderrWriter, err := os.Pipe()
+	if err != nil {
+		stdoutReader.Close()
+		stdoutWriter.Close()
+		logWriter.Close()
+		return containerStdio{}, fmt.Errorf("failed to create log pipe: %v", err)
+	}
+
+	stdio := containerStdio{
+		stdout:   stdoutWriter,
+		stderr:   stderrWriter,
+		setupLog: os.Stderr,
+		logPipes: []*os.File{stdoutWriter, stderrWriter},
+	}
+	if config.Detach || config.CreateOnly {
+		stdio.logCopied = copyContainerOutput(stdoutReader, stderrReader, logWriter, nil, nil)
+	} else {
+		stdio.stdin = os.Stdin
+		stdio.logCopied = copyContainerOutput(stdoutReader, stderrReader, logWriter, os.Stdout, os.Stderr)
+	}
+	return stdio, nil
+}
+
+// containerExit is the content of a container's exit file
+// The shim writes it once the workload has been reaped, like conmon's exit
+// files; the state layer falls back to it if the record wasn't updated
+type containerExit struct {
+	// ExitCode is shell-style: a container killed by signal N reports 128+N
+	ExitCode int `json:"exit_code"`
+
+	// Signal that killed the workload, if any, and whether it dumped core
+	Signal     int  `json:"signal,omitempty"`
+	CoreDumped bool `json:"core_dumped,omitempty"`
+
+	// OOMKilled is set when the kernel's OOM killer ended the workload
+	OOMKilled bool `json:"oom_killed,omitempty"`
+
+	// FinishReason explains an exit nsctl caused itself, e.g. a --timeout
+	FinishReason string `json:"finish_reason,omitempty"`
+
+	FinishedAt time.Time `json:"finished_at"`
+}
+
+// containerExitFromState converts a wait status into a containerExit
+func containerExitFromState(state *os.ProcessState) containerExit {
+	exit := containerExit{ExitCode: shimFailureExitCode, FinishedAt: time.Now()}
+	if state == nil {
+		return exit
+	}
+
+	exit.ExitCode = state.ExitCode()
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		exit.ExitCode = 128 + int(status.Signal())
+		exit.Signal = int(status.Signal())
+		exit.CoreDumped = status.CoreDump()
+	}
+	return exit
+}
+
+// writeExitFile stores a container's exit in its container directory
+func writeExitFile(containerDir string, exit containerExit) error {
+	data, err := json.MarshalIndent(exit, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal exit status: %v", err)
+	}
+
+	exitPath := filepath.Join(containerDir, containerExitFileName)
+	tempPath := exitPath + ".tmp"
+	if err := os.WriteFile(tempPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write exit file: %v", err)
+	}
+	return os.Rename(tempPath, exitPath)
+}
+
+// readExitFile loads the exit written by writeExitFile
+func readExitFile(containerDir string) (containerExit, error) {
+	var exit containerExit
+
+	data, err := os.ReadFile(filepath.Join(containerDir, containerExitFileName))
+	if err != nil {
+		return exit, err
+	}
+	if err := json.Unmarshal(data, &exit); err != nil {
+		return exit, fmt.Errorf("failed to parse exit file: %v", err)
+	}
+	return exit, nil
+}
+
+// recordContainerExit writes the exit file and updates the container record
+func recordContainerExit(config ContainerConfig, exit containerExit) {
+	if exit.FinishedAt.IsZero() {
+		exit.FinishedAt = time.Now()
+	}
+	if err := writeExitFile(config.ContainerDir, exit); err != nil {
+		logf("[shim] Warning: %v\n", err)
+	}
+
+	attributes := map[string]string{"exit_code": strconv.Itoa(exit.ExitCode)}
+	if exit.OOMKilled {
+		attributes["oom_killed"] = "true"
+	}
+	if exit.FinishReason != "" {
+		attributes["reason"] = exit.FinishReason
+	}
+	emitEvent(EventDie, config.ID, attributes)
+
+	if err := runHooks(config, ociStatusStopped, 0, HookPoststop); err != nil {
+		logf("[shim] Warning: %v\n", err)
+	}
+
+	if config.AutoRemove {
+		if err := UnregisterContainer(config.ID); err != nil {
+			logf("[shim] Warning: failed to remove container: %v\n", err)
+		}
+		removeAnonymousVolumes(config.Volumes)
+		return
+	}
+
+	if err := markContainerExited(config.ID, exit); err != nil {
+		logf("[shim] Warning: failed to update container record: %v\n", err)
+	}
+}
@@ -0,0 +1,322 @@
+//go:build linux
+
+package ns
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"nsctl/pkg/cgroup"
+)
+
+// Checking the state directory ("nsctl state fsck")
+//
+// A shim killed at the wrong moment, a full disk or a crash can leave the
+// state directory out of step with the host. CheckState compares it with
+// reality and reports what doesn't match:
+//
+//   - records that can't be parsed, or name another container than their
+//     file; --repair moves them to the quarantine directory, where they can
+//     be looked at, instead of ListContainers skipping them forever
+//   - records in an older schema version, which --repair rewrites
+//   - records of running containers whose process is gone, and exited --rm
+//     containers whose shim died before removing them
+//   - container directories without a record, and leftover temporary files
+//   - cgroups of exited or unknown containers
+//   - mounts under the state directory, which only leak from a container
+//     setup that went wrong
+//   - bridge addresses still allocated to containers whose shim is gone
+//     (see network.go)
+//
+// A container's veth pair goes away with its network namespace, so there
+// are no links to check. Problems nsctl can't repair, like records of a
+// newer nsctl, are reported with what to do instead.
+
+const (
+	// quarantineDirName is where --repair moves broken records, inside the
+	// state directory
+	quarantineDirName = "quarantine"
+
+	// stateCheckGracePeriod is how old a file without a record has to be
+	// to count as left over; younger ones may belong to a container that is
+	// being set up
+	stateCheckGracePeriod = time.Minute
+)
+
+// containerIDPattern matches full container IDs
+var containerIDPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// StateProblem is an inconsistency between the state directory and the host
+type StateProblem struct {
+	// Subject is the record, directory, cgroup or mount concerned
+	Subject string `json:"subject"`
+	Problem string `json:"problem"`
+
+	// Repair describes what --repair does about it; empty when it can't
+	// help, in which case Fix says what to do
+	Repair string `json:"repair,omitempty"`
+	Fix    string `json:"fix,omitempty"`
+
+	// Repaired is set once the repair has been made
+	Repaired    bool   `json:"repaired"`
+	RepairError string `json:"repair_error,omitempty"`
+}
+
+// stateCheck collects the problems found, repairing them on the way if
+// asked to
+type stateCheck struct {
+	repair   bool
+	problems []StateProblem
+}
+
+// report records a problem, and with repair set makes its repair
+func (check *stateCheck) report(problem StateProblem, repair func() error) {
+	if check.repair && repair != nil {
+		if err := repair(); err != nil {
+			problem.RepairError = err.Error()
+		} else {
+			problem.Repaired = true
+			logf("[ns] Repaired %s: %s\n", problem.Subject, problem.Repair)
+		}
+	}
+	check.problems = append(check.problems, problem)
+}
+
+// CheckState checks the state directory against the host and returns the
+// problems found; with repair set, it also repairs what it can
+func CheckState(repair bool) ([]StateProblem, error) {
+	if err := ensureStateDir(); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(currentStateDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state directory: %v", err)
+	}
+
+	check := &stateCheck{repair: repair, problems: []StateProblem{}}
+	records := map[string]ContainerInfo{}
+	for _, entry := range entries {
+		name := entry.Name()
+		path := filepath.Join(currentStateDir, name)
+		switch {
+		case strings.HasSuffix(name, containerFileExt):
+			if containerInfo, ok := check.checkRecord(path, strings.TrimSuffix(name, containerFileExt)); ok {
+				records[containerInfo.ID] = containerInfo
+			}
+		case strings.HasSuffix(name, ".tmp") && isLeftOver(entry):
+			check.report(StateProblem{
+				Subject: path,
+				Problem: "temporary file of an interrupted write",
+				Repair:  "remove it",
+			}, func() error { return os.Remove(path) })
+		}
+	}
+
+	// With the records known, what's left over can be told apart
+	for _, entry := range entries {
+		containerID := entry.Name()
+		if !entry.IsDir() || !containerIDPattern.MatchString(containerID) || !isLeftOver(entry) {
+			continue
+		}
+		if _, found := records[containerID]; !found {
+			path := filepath.Join(currentStateDir, containerID)
+			check.report(StateProblem{
+				Subject: path,
+				Problem: "container directory without a record",
+				Repair:  "remove it",
+			}, func() error { return os.RemoveAll(path) })
+		}
+	}
+	check.checkCgroups(records)
+	check.checkMounts(records)
+	check.checkAddresses()
+	return check.problems, nil
+}
+
+// checkRecord checks one container record file, returning the record if
+// it is usable
+func (check *stateCheck) checkRecord(path string, containerID string) (ContainerInfo, bool) {
+	quarantine := func() error { return quarantineRecord(path) }
+
+	var containerInfo ContainerInfo
+	data, err := os.ReadFile(path)
+	if err != nil {
+		check.report(StateProblem{Subject: path, Problem: fmt.Sprintf("unreadable: %v", err), Fix: "check the file's permissions"}, nil)
+		return containerInfo, false
+	}
+	migrated, err := decodeRecord("container", ShortID(containerID), data, containerMigrations, &containerInfo)
+	if err != nil {
+		if _, newer := err.(*NewerSchemaError); newer {
+			check.report(StateProblem{Subject: path, Problem: err.Error(), Fix: "upgrade nsctl"}, nil)
+			return containerInfo, false
+		}
+		check.report(StateProblem{
+			Subject: path,
+			Problem: fmt.Sprintf("unparsable record: %v", err),
+			Repair:  "move it to " + filepath.Join(currentStateDir, quarantineDirName),
+		}, quarantine)
+		return containerInfo, false
+	}
+	if containerInfo.ID != containerID {
+		check.report(StateProblem{
+			Subject: path,
+			Problem: fmt.Sprintf("record of container %q in the file of %s", containerInfo.ID, ShortID(containerID)),
+			Repair:  "move it to " + filepath.Join(currentStateDir, quarantineDirName),
+		}, quarantine)
+		return containerInfo, false
+	}
+
+	subject := "container " + ShortID(containerID)
+	if migrated {
+		check.report(StateProblem{
+			Subject: subject,
+			Problem: fmt.Sprintf("record in an older schema version than %d", containerSchemaVersion),
+			Repair:  "rewrite it in the current version",
+		}, func() error { return saveContainerInfo(containerInfo) })
+	}
+
+	refreshed := containerInfo
+	if status := refreshStatus(&refreshed); status != containerInfo.Status {
+		check.report(StateProblem{
+			Subject: subject,
+			Problem: fmt.Sprintf("record says %s, but its process is gone", containerInfo.Status),
+			Repair:  "record it as exited",
+		}, func() error { return saveContainerInfo(refreshed) })
+		containerInfo = refreshed
+	}
+	// The shim of a --rm container removes it on exit
+	if containerInfo.AutoRemove && containerInfo.Status == StatusExited && !containerInfo.shimRunning() {
+		check.report(StateProblem{
+			Subject: subject,
+			Problem: "exited --rm container its shim didn't remove",
+			Repair:  "remove it",
+		}, func() error { return RemoveContainer(containerID, false, true) })
+	}
+
+	if containerInfo.Status != StatusExited && containerInfo.Adopted == nil {
+		if _, err := os.Stat(getContainerDir(containerID)); os.IsNotExist(err) {
+			check.report(StateProblem{
+				Subject: subject,
+				Problem: "container directory is missing, so its logs, exit file and /etc files are gone",
+				Fix:     fmt.Sprintf("nsctl rm -f %s", ShortID(containerID)),
+			}, nil)
+		}
+	}
+	return containerInfo, true
+}
+
+// checkCgroups looks for cgroups of exited containers and of containers
+// without a record
+func (check *stateCheck) checkCgroups(records map[string]ContainerInfo) {
+	for _, containerInfo := range records {
+		if containerInfo.Status != StatusExited || containerInfo.CgroupPath == "" || containerInfo.Adopted != nil {
+			continue
+		}
+		if _, err := os.Stat(containerInfo.CgroupPath); err == nil {
+			check.checkLeftoverCgroup(containerInfo.CgroupPath, "cgroup of exited container "+ShortID(containerInfo.ID))
+		}
+	}
+
+	groups, err := cgroup.ContainerGroups()
+	if err != nil {
+		check.report(StateProblem{Subject: "cgroups", Problem: err.Error()}, nil)
+		return
+	}
+	for containerID, path := range groups {
+		if _, found := records[containerID]; !found {
+			check.checkLeftoverCgroup(path, "cgroup without a container record")
+		}
+	}
+}
+
+// checkLeftoverCgroup reports a cgroup that should be gone; only an empty
+// one can be removed
+func (check *stateCheck) checkLeftoverCgroup(path string, problem string) {
+	group := cgroup.Load(path)
+	if empty, err := group.Empty(); err != nil || !empty {
+		check.report(StateProblem{
+			Subject: path,
+			Problem: problem + ", with processes still in it",
+			Fix:     fmt.Sprintf("kill the processes in %s", filepath.Join(path, "cgroup.procs")),
+		}, nil)
+		return
+	}
+	check.report(StateProblem{Subject: path, Problem: problem, Repair: "remove it"}, group.Delete)
+}
+
+// checkMounts looks for mounts under the state directory on the host; a
+// container's mounts are made in its own mount namespace
+func (check *stateCheck) checkMounts(records map[string]ContainerInfo) {
+	mountPoints, err := mountPointsBelow(currentStateDir)
+	if err != nil {
+		check.report(StateProblem{Subject: "mounts", Problem: err.Error()}, nil)
+		return
+	}
+	// Children first, so their parents can be unmounted after them
+	for index := len(mountPoints) - 1; index >= 0; index-- {
+		mountPoint := mountPoints[index]
+		if mountPoint == currentStateDir {
+			continue
+		}
+		containerID, _, _ := strings.Cut(strings.TrimPrefix(mountPoint, currentStateDir+"/"), "/")
+		if containerInfo, found := records[containerID]; found && containerInfo.Status != StatusExited {
+			continue
+		}
+		check.report(StateProblem{
+			Subject: mountPoint,
+			Problem: "mount leaked to the host",
+			Repair:  "unmount it",
+		}, func() error { return unix.Unmount(mountPoint, unix.MNT_DETACH) })
+	}
+}
+
+// checkAddresses looks for bridge addresses whose container no longer
+// holds them; they are free already, but their files are clutter
+func (check *stateCheck) checkAddresses() {
+	networkDir := filepath.Join(currentStateDir, networkDirName)
+	entries, err := os.ReadDir(networkDir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if net.ParseIP(entry.Name()) == nil || !isLeftOver(entry) {
+			continue
+		}
+		path := filepath.Join(networkDir, entry.Name())
+		owner, err := os.ReadFile(path)
+		if err != nil || addressHeld(string(owner)) {
+			continue
+		}
+		check.report(StateProblem{
+			Subject: path,
+			Problem: fmt.Sprintf("address of container %s, which is no longer running", ShortID(string(owner))),
+			Repair:  "release it",
+		}, func() error { return os.Remove(path) })
+	}
+}
+
+// quarantineRecord moves a broken record out of the way of ListContainers
+func quarantineRecord(path string) error {
+	quarantineDir := filepath.Join(currentStateDir, quarantineDirName)
+	if err := os.MkdirAll(quarantineDir, 0700); err != nil {
+		return fmt.Errorf("failed to create quarantine directory: %v", err)
+	}
+	if err := os.Rename(path, filepath.Join(quarantineDir, filepath.Base(path))); err != nil {
+		return fmt.Errorf("failed to quarantine %s: %v", path, err)
+	}
+	return nil
+}
+
+// isLeftOver reports whether a state directory entry is older than a
+// container setup takes
+func isLeftOver(entry os.DirEntry) bool {
+	info, err := entry.Info()
+	return err == nil && time.Since(info.ModTime()) > stateCheckGracePeriod
+}
@@ -0,0 +1,110 @@
+//go:build linux
+
+package ns
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// State schema versions
+//
+// Container, volume and pod records carry a schema_version, so a new nsctl can
+// read what an older one left behind: a record with an older version is
+// migrated step by step when it is first read, and written back in the
+// current format. Records from before versions existed count as version 0.
+// A record with a newer version than this nsctl knows is refused, rather
+// than misread or overwritten without the fields it doesn't know about; the
+// fix is to upgrade nsctl (or to remove the container with the newer one).
+//
+// Migrations work on the record's JSON fields, so they don't depend on the
+// Go types of either version. Adding one means appending a function to the
+// kind's list; the list's length is the current version.
+
+// recordMigration upgrades a record's fields by one schema version
+type recordMigration func(fields map[string]json.RawMessage) error
+
+// containerMigrations upgrade container records; containerMigrations[n]
+// goes from version n to n+1
+var containerMigrations = []recordMigration{
+	// 0 to 1: records from before Created was kept only have StartTime,
+	// which later moves on to when the container was last started
+	func(fields map[string]json.RawMessage) error {
+		if _, found := fields["created"]; !found {
+			if startTime, found := fields["start_time"]; found {
+				fields["created"] = startTime
+			}
+		}
+		return nil
+	},
+}
+
+// volumeMigrations upgrade volume records, like containerMigrations
+var volumeMigrations = []recordMigration{
+	// 0 to 1: the unversioned format is the first versioned one
+	func(fields map[string]json.RawMessage) error { return nil },
+}
+
+// podMigrations upgrade pod records, like containerMigrations; pods were
+// versioned from the start, at version 0
+var podMigrations = []recordMigration{}
+
+var (
+	// containerSchemaVersion is the version of container records this
+	// nsctl writes
+	containerSchemaVersion = len(containerMigrations)
+
+	// volumeSchemaVersion is the version of volume records this nsctl
+	// writes
+	volumeSchemaVersion = len(volumeMigrations)
+
+	// podSchemaVersion is the version of pod records this nsctl writes
+	podSchemaVersion = len(podMigrations)
+)
+
+// NewerSchemaError is returned for a record written by a newer nsctl
+type NewerSchemaError struct {
+	Kind      string
+	Name      string
+	Version   int
+	Supported int
+}
+
+func (e *NewerSchemaError) Error() string {
+	return fmt.Sprintf("%s %s has schema version %d, but this nsctl supports only up to %d: upgrade nsctl",
+		e.Kind, e.Name, e.Version, e.Supported)
+}
+
+// decodeRecord unmarshals a record of a kind into record, migrating it from
+// an older schema version first
+// It reports whether the record was migrated, and so should be written back.
+func decodeRecord(kind string, name string, data []byte, migrations []recordMigration, record any) (bool, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return false, err
+	}
+	version := 0
+	if raw, found := fields["schema_version"]; found {
+		if err := json.Unmarshal(raw, &version); err != nil {
+			return false, fmt.Errorf("invalid schema_version: %v", err)
+		}
+	}
+	if version > len(migrations) {
+		return false, &NewerSchemaError{Kind: kind, Name: name, Version: version, Supported: len(migrations)}
+	}
+	if version == len(migrations) {
+		return false, json.Unmarshal(data, record)
+	}
+
+	for ; version < len(migrations); version++ {
+		if err := migrations[version](fields); err != nil {
+			return false, fmt.Errorf("failed to migrate %s %s from schema version %d: %v", kind, name, version, err)
+		}
+	}
+	fields["schema_version"] = json.RawMessage(fmt.Sprint(version))
+	migrated, err := json.Marshal(fields)
+	if err != nil {
+		return false, err
+	}
+	return true, json.Unmarshal(migrated, record)
+}
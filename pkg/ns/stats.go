@@ -0,0 +1,142 @@
+//go:build linux
+
+package ns
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"nsctl/pkg/cgroup"
+)
+
+// Container statistics
+//
+// CollectStats is the one place container usage is measured: "nsctl stats"
+// prints it, and programs embedding nsctl can call it themselves. CPU,
+// memory, block I/O, process counts and pressure come from the container's
+// cgroup; network counters from the container's network namespace, so there are
+// none for containers sharing the host's.
+
+// Metrics are a container's resource usage counters at one moment
+type Metrics struct {
+	ContainerID string    `json:"id"`
+	Read        time.Time `json:"read"`
+
+	CPU    cgroup.CPUStats    `json:"cpu"`
+	Memory cgroup.MemoryStats `json:"memory"`
+
+	// IO and PIDs are nil where the host doesn't account them
+	IO   *cgroup.IOStats  `json:"io,omitempty"`
+	PIDs *cgroup.PIDStats `json:"pids,omitempty"`
+
+	// Pressure is the stall information of the container's cgroup; nil
+	// where the host has none (see cgroup/pressure.go)
+	Pressure *cgroup.PressureStats `json:"pressure,omitempty"`
+
+	// Network holds the counters of each interface of the container's own
+	// network namespace; nil if it uses the host's
+	Network map[string]InterfaceStats `json:"network,omitempty"`
+}
+
+// InterfaceStats are a network interface's traffic counters
+type InterfaceStats struct {
+	RxBytes   uint64 `json:"rx_bytes"`
+	RxPackets uint64 `json:"rx_packets"`
+	RxErrors  uint64 `json:"rx_errors"`
+	RxDropped uint64 `json:"rx_dropped"`
+	TxBytes   uint64 `json:"tx_bytes"`
+	TxPackets uint64 `json:"tx_packets"`
+	TxErrors  uint64 `json:"tx_errors"`
+	TxDropped uint64 `json:"tx_dropped"`
+}
+
+// CollectStats measures a running container's resource usage; id may be a
+// unique ID prefix
+func CollectStats(id string) (*Metrics, error) {
+	containerInfo, err := LookupContainer(id)
+	if err != nil {
+		return nil, err
+	}
+	if refreshStatus(containerInfo) != StatusRunning {
+		return nil, fmt.Errorf("container %s is %s, not running", ShortID(containerInfo.ID), containerInfo.Status)
+	}
+	if containerInfo.CgroupPath == "" {
+		return nil, fmt.Errorf("container %s has no cgroup to measure", ShortID(containerInfo.ID))
+	}
+
+	stats, err := cgroup.Load(containerInfo.CgroupPath).Stats()
+	if err != nil {
+		return nil, err
+	}
+	metrics := &Metrics{
+		ContainerID: containerInfo.ID,
+		Read:        time.Now(),
+		CPU:         stats.CPU,
+		Memory:      stats.Memory,
+		IO:          stats.IO,
+		PIDs:        stats.PIDs,
+		Pressure:    stats.Pressure,
+	}
+	if hasOwnNetwork(containerInfo.PID) {
+		if metrics.Network, err = readInterfaceStats(containerInfo.PID); err != nil {
+			return nil, err
+		}
+	}
+	return metrics, nil
+}
+
+// CPUPercent returns the share of one CPU the container used between an
+// earlier measurement and this one, where 200 means two CPUs' worth
+func (m *Metrics) CPUPercent(earlier *Metrics) float64 {
+	elapsed := m.Read.Sub(earlier.Read)
+	if elapsed <= 0 || m.CPU.UsageNanos < earlier.CPU.UsageNanos {
+		return 0
+	}
+	return float64(m.CPU.UsageNanos-earlier.CPU.UsageNanos) / float64(elapsed.Nanoseconds()) * 100
+}
+
+// hasOwnNetwork reports whether a process has another network namespace
+// than ours
+func hasOwnNetwork(pid int) bool {
+	own, err := os.Readlink("/proc/self/ns/net")
+	if err != nil {
+		return false
+	}
+	theirs, err := os.Readlink(filepath.Join("/proc", strconv.Itoa(pid), "ns", "net"))
+	return err == nil && theirs != own
+}
+
+// readInterfaceStats reads the interface counters of a process's network
+// namespace from /proc/<pid>/net/dev
+func readInterfaceStats(pid int) (map[string]InterfaceStats, error) {
+	data, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "net", "dev"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read network counters: %v", err)
+	}
+
+	interfaces := map[string]InterfaceStats{}
+	// After two header lines: "name: 8 receive counters 8 transmit counters"
+	for _, line := range strings.Split(string(data), "\n") {
+		name, counters, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		fields := strings.Fields(counters)
+		if len(fields) < 16 {
+			continue
+		}
+		values := make([]uint64, 16)
+		for index := range values {
+			values[index], _ = strconv.ParseUint(fields[index], 10, 64)
+		}
+		interfaces[strings.TrimSpace(name)] = InterfaceStats{
+			RxBytes: values[0], RxPackets: values[1], RxErrors: values[2], RxDropped: values[3],
+			TxBytes: values[8], TxPackets: values[9], TxErrors: values[10], TxDropped: values[11],
+		}
+	}
+	return interfaces, nil
+}
@@ -0,0 +1,126 @@
+//go:build linux
+
+package ns
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// Stores
+//
+// Each user's containers, volumes, schedules and events are kept in a store
+// of their own, a state directory and a data directory picked by the
+// effective UID:
+//
+//	root           the rootful store, /var/run/nsctl and /var/lib/nsctl
+//	anyone else    their rootless store, ~/.nsctl/run and ~/.nsctl/lib,
+//	               in the home directory of the UID's passwd entry
+//
+// There is no falling back from one to the other, so "nsctl ps" shows the
+// same containers whatever the permissions of the other stores, and "sudo
+// nsctl" always means the rootful store. The home directory comes from the
+// passwd entry rather than $HOME, which sudo may carry over from another
+// user.
+//
+// A store's directories belong to its user and are created with mode 0711:
+// other users can't list them to learn container IDs or volume names, but
+// user-namespaced containers can still reach the files bind-mounted into
+// them. Files with fixed names in them (the event journal, the container
+// index, schedules) are only readable by the store's user. nsctl refuses a
+// store directory owned by someone else, and tightens one created by an
+// older nsctl that other users could list.
+
+const (
+	// storeDirMode lets other users pass through store directories, but not
+	// list them
+	storeDirMode = 0711
+
+	// rootlessStoreDirName holds a rootless store, in the user's home
+	rootlessStoreDirName = ".nsctl"
+)
+
+// Store describes where a user's containers are kept
+type Store struct {
+	// Rootless is set for the store of a user other than root
+	Rootless bool `json:"rootless"`
+
+	// UID is the user the store belongs to
+	UID int `json:"uid"`
+
+	StateDir string `json:"state_dir"`
+	DataDir  string `json:"data_dir"`
+}
+
+// defaultStore is the store of the effective user
+var defaultStore = userStore(os.Geteuid())
+
+// userStore returns the store of a user; its directories are empty if the
+// user has no home directory to keep a rootless store in
+func userStore(uid int) Store {
+	if uid == 0 {
+		return Store{UID: 0, StateDir: defaultStateDir, DataDir: defaultDataDir}
+	}
+
+	store := Store{Rootless: true, UID: uid}
+	home := os.Getenv("HOME")
+	if entry, err := user.LookupId(strconv.Itoa(uid)); err == nil && entry.HomeDir != "" {
+		home = entry.HomeDir
+	}
+	if filepath.IsAbs(home) {
+		store.StateDir = filepath.Join(home, rootlessStoreDirName, "run")
+		store.DataDir = filepath.Join(home, rootlessStoreDirName, "lib")
+	}
+	return store
+}
+
+// CurrentStore returns the store nsctl is using
+func CurrentStore() Store {
+	store := defaultStore
+	store.StateDir = currentStateDir
+	store.DataDir = currentDataDir
+	return store
+}
+
+// String describes the store for humans, e.g. "rootless store of UID 1000
+// (/home/alice/.nsctl/run)"
+func (s Store) String() string {
+	if !s.Rootless {
+		return fmt.Sprintf("rootful store (%s)", s.StateDir)
+	}
+	name := "UID " + strconv.Itoa(s.UID)
+	if entry, err := user.LookupId(strconv.Itoa(s.UID)); err == nil {
+		name = entry.Username
+	}
+	return fmt.Sprintf("rootless store of %s (%s)", name, s.StateDir)
+}
+
+// ensureStoreDir creates one of the store's directories, or checks that an
+// existing one belongs to the store's user, and keeps other users from
+// listing it
+func ensureStoreDir(kind string, path string) error {
+	if path == "" {
+		return fmt.Errorf("no home directory for UID %d to keep its containers in", defaultStore.UID)
+	}
+	if err := os.MkdirAll(path, storeDirMode); err != nil {
+		return fmt.Errorf("failed to create %s directory %s: %v", kind, path, err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("failed to read %s directory %s: %v", kind, path, err)
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && int(stat.Uid) != defaultStore.UID {
+		return fmt.Errorf("%s directory %s belongs to UID %d, not to UID %d whose store it is", kind, path, stat.Uid, defaultStore.UID)
+	}
+	if info.Mode().Perm()&0066 != 0 {
+		if err := os.Chmod(path, info.Mode().Perm()&^0066); err != nil {
+			return fmt.Errorf("failed to restrict %s directory %s: %v", kind, path, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+//go:build linux
+
+package ns
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Subordinate IDs
+//
+// /etc/subuid and /etc/subgid list the host ID ranges each user may map
+// into user namespaces, one "user:start:count" line per range. The user is
+// named either by login name or by UID, and may have several ranges.
+// newuidmap and newgidmap enforce these files, but only at clone time and
+// with terse errors, so nsctl reads them itself to plan mappings and to
+// reject ones the helpers would refuse.
+
+// subIDRange is a contiguous range of host IDs
+type subIDRange struct {
+	Start int
+	Size  int
+}
+
+// end returns the first ID after the range
+func (r subIDRange) end() int {
+	return r.Start + r.Size
+}
+
+func (r subIDRange) String() string {
+	return fmt.Sprintf("%d-%d", r.Start, r.end()-1)
+}
+
+// readSubIDRanges returns the ranges a user is granted in /etc/subuid or
+// /etc/subgid, sorted and with overlapping or adjacent ranges merged
+func readSubIDRanges(filePath string, userName string, uid int) ([]subIDRange, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%s does not exist, so user %s has no subordinate IDs", filePath, userName)
+		}
+		return nil, fmt.Errorf("failed to read %s: %v", filePath, err)
+	}
+	defer file.Close()
+
+	var ranges []subIDRange
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Split(line, ":")
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d: expected user:start:count", filePath, lineNumber)
+		}
+		if fields[0] != userName && fields[0] != strconv.Itoa(uid) {
+			continue
+		}
+
+		start, startErr := strconv.Atoi(fields[1])
+		size, sizeErr := strconv.Atoi(fields[2])
+		if startErr != nil || sizeErr != nil || start < 0 || size <= 0 {
+			return nil, fmt.Errorf("%s:%d: invalid range %s:%s", filePath, lineNumber, fields[1], fields[2])
+		}
+		ranges = append(ranges, subIDRange{Start: start, Size: size})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", filePath, err)
+	}
+
+	if len(ranges) == 0 {
+		return nil, fmt.Errorf("user %s has no entries in %s", userName, filePath)
+	}
+	return mergeSubIDRanges(ranges), nil
+}
+
+// mergeSubIDRanges sorts ranges and joins those that overlap or touch
+func mergeSubIDRanges(ranges []subIDRange) []subIDRange {
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].Start < ranges[j].Start
+	})
+
+	merged := []subIDRange{ranges[0]}
+	for _, next := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if next.Start <= last.end() {
+			last.Size = max(last.end(), next.end()) - last.Start
+			continue
+		}
+		merged = append(merged, next)
+	}
+	return merged
+}
+
+// subIDMappings maps the ranges to container IDs from 0, skipping
+// ownID, which the user's own ID is mapped to
+// With ownID 0 this is the default rootless layout; with keep-id, container
+// IDs below and above the user's ID are both backed by subordinate IDs.
+func subIDMappings(ranges []subIDRange, ownID int) []IDMap {
+	var mappings []IDMap
+	containerID := 0
+	for _, hostRange := range ranges {
+		for hostRange.Size > 0 {
+			if containerID == ownID {
+				containerID++
+			}
+			size := hostRange.Size
+			if containerID < ownID {
+				size = min(size, ownID-containerID)
+			}
+			mappings = append(mappings, IDMap{ContainerID: containerID, HostID: hostRange.Start, Size: size})
+			containerID += size
+			hostRange.Start += size
+			hostRange.Size -= size
+		}
+	}
+	return mappings
+}
+
+// validateIDMappings checks mappings an unprivileged user asks for
+// Every host ID must be the user's own ID or one of their subordinate IDs,
+// and no container ID may be mapped twice. kind is "uid" or "gid" and only
+// used in messages.
+func validateIDMappings(kind string, mappings []IDMap, ownID int, ranges []subIDRange, userName string) error {
+	allowed := append([]subIDRange{{Start: ownID, Size: 1}}, ranges...)
+
+	for i, mapping := range mappings {
+		if mapping.Size <= 0 || mapping.ContainerID < 0 || mapping.HostID < 0 {
+			return fmt.Errorf("invalid %s mapping %s", kind, formatIDMap(mapping))
+		}
+
+		hostRange := subIDRange{Start: mapping.HostID, Size: mapping.Size}
+		covered := false
+		for _, allowedRange := range allowed {
+			if hostRange.Start >= allowedRange.Start && hostRange.end() <= allowedRange.end() {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			var grants []string
+			for _, allowedRange := range ranges {
+				grants = append(grants, allowedRange.String())
+			}
+			return fmt.Errorf("%s mapping %s uses host IDs %s, but %s may only map %d and subordinate IDs %s",
+				kind, formatIDMap(mapping), hostRange, userName, ownID, strings.Join(grants, ", "))
+		}
+
+		for _, other := range mappings[:i] {
+			if mapping.ContainerID < other.ContainerID+other.Size && other.ContainerID < mapping.ContainerID+mapping.Size {
+				return fmt.Errorf("%s mappings %s and %s overlap inside the container", kind, formatIDMap(other), formatIDMap(mapping))
+			}
+		}
+	}
+	return nil
+}
+
+// formatIDMap renders a mapping as container:host:size
+func formatIDMap(mapping IDMap) string {
+	return fmt.Sprintf("%d:%d:%d", mapping.ContainerID, mapping.HostID, mapping.Size)
+}
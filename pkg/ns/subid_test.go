@@ -0,0 +1,174 @@
+//go:build linux
+
+package ns
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadSubIDRanges(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		want     []subIDRange
+	}{
+		{
+			name:     "by name",
+			contents: "alice:100000:65536\nbob:165536:65536\n",
+			want:     []subIDRange{{Start: 100000, Size: 65536}},
+		},
+		{
+			name:     "by UID",
+			contents: "1000:200000:1000\n",
+			want:     []subIDRange{{Start: 200000, Size: 1000}},
+		},
+		{
+			name:     "comments and blank lines",
+			contents: "# subordinate IDs\n\n  alice:100000:10  \n",
+			want:     []subIDRange{{Start: 100000, Size: 10}},
+		},
+		{
+			name:     "sorted and merged",
+			contents: "alice:300000:10\nalice:100000:10\n1000:100010:5\nalice:100012:10\n",
+			want:     []subIDRange{{Start: 100000, Size: 22}, {Start: 300000, Size: 10}},
+		},
+		{
+			name:     "another user's bad line is still an error",
+			contents: "bob:100000\n",
+		},
+		{
+			name:     "invalid range",
+			contents: "alice:100000:0\n",
+		},
+		{
+			name:     "no entries",
+			contents: "bob:100000:65536\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "subuid")
+			if err := os.WriteFile(path, []byte(test.contents), 0644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := readSubIDRanges(path, "alice", 1000)
+			if test.want == nil {
+				if err == nil {
+					t.Errorf("readSubIDRanges = %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readSubIDRanges: %v", err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("readSubIDRanges = %v, want %v", got, test.want)
+			}
+		})
+	}
+
+	if _, err := readSubIDRanges(filepath.Join(t.TempDir(), "missing"), "alice", 1000); err == nil || !strings.Contains(err.Error(), "has no subordinate IDs") {
+		t.Errorf("readSubIDRanges of a missing file: error = %v", err)
+	}
+}
+
+func TestSubIDMappings(t *testing.T) {
+	tests := []struct {
+		name   string
+		ranges []subIDRange
+		ownID  int
+		want   []IDMap
+	}{
+		{
+			name:   "rootless default",
+			ranges: []subIDRange{{Start: 100000, Size: 65536}},
+			ownID:  0,
+			want:   []IDMap{{ContainerID: 1, HostID: 100000, Size: 65536}},
+		},
+		{
+			name:   "keep-id",
+			ranges: []subIDRange{{Start: 100000, Size: 65536}},
+			ownID:  1000,
+			want: []IDMap{
+				{ContainerID: 0, HostID: 100000, Size: 1000},
+				{ContainerID: 1001, HostID: 101000, Size: 64536},
+			},
+		},
+		{
+			name:   "several ranges",
+			ranges: []subIDRange{{Start: 100000, Size: 10}, {Start: 300000, Size: 10}},
+			ownID:  5,
+			want: []IDMap{
+				{ContainerID: 0, HostID: 100000, Size: 5},
+				{ContainerID: 6, HostID: 100005, Size: 5},
+				{ContainerID: 11, HostID: 300000, Size: 10},
+			},
+		},
+	}
+	for _, test := range tests {
+		if got := subIDMappings(test.ranges, test.ownID); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: subIDMappings = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestValidateIDMappings(t *testing.T) {
+	ranges := []subIDRange{{Start: 100000, Size: 65536}}
+
+	tests := []struct {
+		name     string
+		mappings []IDMap
+		want     string // empty for success, else part of the error
+	}{
+		{
+			name:     "own ID only",
+			mappings: []IDMap{{ContainerID: 0, HostID: 1000, Size: 1}},
+		},
+		{
+			name: "own ID and subordinate IDs",
+			mappings: []IDMap{
+				{ContainerID: 0, HostID: 1000, Size: 1},
+				{ContainerID: 1, HostID: 100000, Size: 65536},
+			},
+		},
+		{
+			name:     "beyond the subordinate range",
+			mappings: []IDMap{{ContainerID: 1, HostID: 100000, Size: 65537}},
+			want:     "uid mapping 1:100000:65537 uses host IDs 100000-165536, but alice may only map 1000 and subordinate IDs 100000-165535",
+		},
+		{
+			name:     "someone else's ID",
+			mappings: []IDMap{{ContainerID: 0, HostID: 0, Size: 1}},
+			want:     "uses host IDs 0-0",
+		},
+		{
+			name: "overlapping container IDs",
+			mappings: []IDMap{
+				{ContainerID: 0, HostID: 1000, Size: 1},
+				{ContainerID: 0, HostID: 100000, Size: 10},
+			},
+			want: "uid mappings 0:1000:1 and 0:100000:10 overlap inside the container",
+		},
+		{
+			name:     "empty mapping",
+			mappings: []IDMap{{ContainerID: 0, HostID: 1000, Size: 0}},
+			want:     "invalid uid mapping 0:1000:0",
+		},
+	}
+	for _, test := range tests {
+		err := validateIDMappings("uid", test.mappings, 1000, ranges, "alice")
+		if test.want == "" {
+			if err != nil {
+				t.Errorf("%s: validateIDMappings: %v", test.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: validateIDMappings error = %v, want one containing %q", test.name, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+//go:build linux
+
+package ns
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// /sys inside the container
+//
+// Left alone, the container would see the host's /sys, writable for root:
+// enough to change kernel and device settings for the whole host. Setup
+// therefore covers it with a fresh sysfs mounted read-only. Mounting sysfs
+// requires privileges over the network namespace, which a rootless
+// container sharing the host's doesn't have; it gets a read-only
+// recursive bind of the host's /sys instead.
+//
+// Either way the subtrees that expose firmware and power controls, or
+// kernel interfaces mounted below /sys on the host, are masked along with
+// the sensitive parts of /proc (see masked_paths.go), and
+// /sys/fs/cgroup shows only the container's own cgroup, read-only, so
+// runtimes like the JVM or Go can discover their limits. A privileged
+// container gets all of it read-write and unmasked, e.g. to run containers
+// in its cgroup.
+//
+// --sysfs chooses how the container gets its /sys. The default, mount,
+// tries a fresh sysfs first. bind goes straight to the bind of the host's,
+// e.g. for containers on the host's network, where a fresh sysfs would
+// still list the host's network devices and mounting it takes privileges
+// over the host's network namespace. none gives the container no /sys at
+// all, nor its cgroup: an empty read-only tmpfs covers the directory, for
+// workloads that have no business there.
+
+// Sysfs modes
+const (
+	SysfsMount = "mount"
+	SysfsBind  = "bind"
+	SysfsNone  = "none"
+)
+
+// maskedSysPaths are among the paths masked by default
+var maskedSysPaths = []string{
+	"/sys/firmware",
+	"/sys/devices/virtual/powercap",
+	"/sys/kernel/security",
+	"/sys/kernel/debug",
+	"/sys/kernel/tracing",
+	"/sys/fs/bpf",
+}
+
+// validateSysfs checks the --sysfs mode
+func validateSysfs(mode string) error {
+	switch mode {
+	case "", SysfsMount, SysfsBind, SysfsNone:
+		return nil
+	}
+	return fmt.Errorf("invalid sysfs mode %q: expected %s, %s or %s", mode, SysfsMount, SysfsBind, SysfsNone)
+}
+
+// sysfsMountFlags are the flags /sys is mounted with in the container
+const sysfsMountFlags = unix.MS_RDONLY | unix.MS_NOSUID | unix.MS_NODEV | unix.MS_NOEXEC
+
+// mountSysfs makes the container's /sys a read-only sysfs, with the
+// container's own cgroup at /sys/fs/cgroup; a privileged container's is
+// writable
+//
+// The new tree is assembled in a staging directory and then moved over
+// /sys: without a network namespace of its own, the container shares the
+// host's sysfs superblock, which the kernel refuses to mount on /sys a
+// second time, and the cgroup directories to mount are only reachable
+// while the host's /sys is still in place.
+func mountSysfs(config ContainerConfig) error {
+	target := filepath.Join(config.Rootfs, "/sys")
+	if _, err := os.Stat(target); err != nil {
+		logf("[ns] No /sys in root filesystem, skipping\n")
+		return nil
+	}
+	if config.Sysfs == SysfsNone {
+		logf("[ns] Hiding /sys (--sysfs %s)\n", SysfsNone)
+		return maskPath(target)
+	}
+
+	stagingDir := filepath.Join(config.ContainerDir, "sys")
+	if err := os.Mkdir(stagingDir, 0700); err != nil && !os.IsExist(err) {
+		return fmt.Errorf("failed to create sysfs staging directory: %v", err)
+	}
+	defer os.Remove(stagingDir)
+
+	// The superblock is shared with the host's /sys, so only the new mount,
+	// not the filesystem, may be made read-only
+	mounted := false
+	if config.Sysfs != SysfsBind {
+		err := mountTraced("sysfs", stagingDir, "sysfs", sysfsMountFlags&^unix.MS_RDONLY, "")
+		if err != nil {
+			logf("[ns] Can't mount sysfs (%v), binding the host's /sys read-only\n", err)
+		}
+		mounted = err == nil
+	}
+	if !mounted {
+		if err := mountTraced("/sys", stagingDir, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+			return fmt.Errorf("failed to bind /sys: %v", err)
+		}
+	}
+
+	if len(config.CgroupPaths) > 0 {
+		if err := mountContainerCgroup(filepath.Join(stagingDir, "fs", "cgroup"), config.CgroupPaths); err != nil {
+			unix.Unmount(stagingDir, unix.MNT_DETACH)
+			return err
+		}
+	}
+
+	attributes := uint64(sysfsMountAttributes)
+	if config.Privileged {
+		attributes &^= unix.MOUNT_ATTR_RDONLY
+	}
+	if err := restrictMount(stagingDir, attributes, true); err != nil {
+		unix.Unmount(stagingDir, unix.MNT_DETACH)
+		return err
+	}
+	if err := mountTraced(stagingDir, target, "", unix.MS_MOVE, ""); err != nil {
+		unix.Unmount(stagingDir, unix.MNT_DETACH)
+		return fmt.Errorf("failed to mount /sys: %v", err)
+	}
+	return nil
+}
+
+// mountContainerCgroup mounts the container's cgroup directories at target,
+// so it sees its own limits and usage but no other group
+// On v2 the group itself is bound there; on v1 a tmpfs gets one directory
+// per controller, like the host's /sys/fs/cgroup. In the container's cgroup
+// namespace both /proc/self/cgroup and the mount's root in
+// /proc/self/mountinfo show the group as /; with --cgroupns host they both
+// show its full path, which runtimes such as the JVM match up.
+func mountContainerCgroup(target string, paths map[string]string) error {
+	if unifiedPath, found := paths[""]; found {
+		if err := mountTraced(unifiedPath, target, "", unix.MS_BIND, ""); err != nil {
+			return fmt.Errorf("failed to mount cgroup %s: %v", unifiedPath, err)
+		}
+		return nil
+	}
+
+	if err := mountTraced("tmpfs", target, "tmpfs", unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, "mode=755"); err != nil {
+		return fmt.Errorf("failed to mount cgroup tmpfs: %v", err)
+	}
+	for controller, path := range paths {
+		controllerDir := filepath.Join(target, controller)
+		if err := os.Mkdir(controllerDir, 0755); err != nil {
+			return fmt.Errorf("failed to create %s: %v", controllerDir, err)
+		}
+		if err := mountTraced(path, controllerDir, "", unix.MS_BIND, ""); err != nil {
+			return fmt.Errorf("failed to mount cgroup %s: %v", path, err)
+		}
+	}
+	return nil
+}
+
+// sysfsMountAttributes are sysfsMountFlags as mount_setattr(2) attributes
+const sysfsMountAttributes = unix.MOUNT_ATTR_RDONLY | unix.MOUNT_ATTR_NOSUID | unix.MOUNT_ATTR_NODEV | unix.MOUNT_ATTR_NOEXEC
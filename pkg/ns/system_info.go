@@ -0,0 +1,216 @@
+//go:build linux
+
+package ns
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strings"
+
+	"golang.org/x/sys/unix"
+
+	"nsctl/pkg/cgroup"
+)
+
+// SystemInfo describes the host as seen by the runtime ("nsctl system info")
+type SystemInfo struct {
+	KernelVersion string `json:"kernel_version"`
+	Architecture  string `json:"architecture"`
+	CgroupVersion string `json:"cgroup_version"`
+
+	// Rootless is true when nsctl runs without root privileges
+	Rootless bool `json:"rootless"`
+
+	// Store describes the store in use (see store.go)
+	Store    string `json:"store"`
+	StateDir string `json:"state_dir"`
+	DataRoot string `json:"data_root"`
+
+	// StorageDriver and Network describe how containers get their
+	// filesystem and network
+	StorageDriver string `json:"storage_driver"`
+	Network       string `json:"network"`
+
+	// Security modules the kernel offers
+	Seccomp  bool `json:"seccomp"`
+	AppArmor bool `json:"apparmor"`
+	SELinux  bool `json:"selinux"`
+
+	// LandlockABI is the kernel's Landlock ABI version; 0 means unavailable
+	LandlockABI int `json:"landlock_abi"`
+
+	// Offline is set when nsctl may not use the network (--offline)
+	Offline bool `json:"offline"`
+
+	// RootlessFeatures is the capability matrix for unprivileged use: what
+	// rootless containers can and can't do on this host
+	RootlessFeatures []RootlessFeature `json:"rootless_features"`
+
+	// Warnings lists host problems that limit what containers can do
+	Warnings []string `json:"warnings,omitempty"`
+
+	Containers        int `json:"containers"`
+	ContainersRunning int `json:"containers_running"`
+	ContainersCreated int `json:"containers_created"`
+	ContainersExited  int `json:"containers_exited"`
+}
+
+// GetSystemInfo collects runtime-wide information about the host
+func GetSystemInfo() (*SystemInfo, error) {
+	info := &SystemInfo{
+		CgroupVersion: detectCgroupVersion(),
+		Rootless:      os.Geteuid() != 0,
+		StorageDriver: "none (host filesystem, or the --rootfs directory)",
+		Network:       fmt.Sprintf("bridge %s (%s)", bridgeName, bridgeSubnet),
+		Seccomp:       detectSeccomp(),
+		AppArmor:      detectAppArmor(),
+		SELinux:       detectSELinux(),
+		LandlockABI:   landlockABIVersion(),
+		Offline:       IsOffline(),
+	}
+
+	if info.Rootless {
+		info.Network = "host (rootless containers can't have the bridge)"
+	}
+
+	info.RootlessFeatures = detectRootlessFeatures()
+	for _, problem := range findFeatureProblems(ContainerConfig{}) {
+		info.Warnings = append(info.Warnings, problem.String())
+	}
+
+	// uname(2) gives us the kernel release and machine architecture
+	var uname unix.Utsname
+	if err := unix.Uname(&uname); err == nil {
+		info.KernelVersion = unix.ByteSliceToString(uname.Release[:])
+		info.Architecture = unix.ByteSliceToString(uname.Machine[:])
+	}
+
+	containers, err := ListContainers()
+	if err != nil {
+		return nil, err
+	}
+	info.Store = CurrentStore().String()
+	info.StateDir = currentStateDir
+
+	dataRoot, err := EnsureDataDir()
+	if err != nil {
+		return nil, err
+	}
+	info.DataRoot = dataRoot
+
+	info.Containers = len(containers)
+	for _, container := range containers {
+		switch container.Status {
+		case StatusRunning:
+			info.ContainersRunning++
+		case StatusCreated:
+			info.ContainersCreated++
+		case StatusExited:
+			info.ContainersExited++
+		}
+	}
+
+	return info, nil
+}
+
+// RootlessFeature is one row of the rootless capability matrix
+type RootlessFeature struct {
+	Name      string `json:"name"`
+	Available bool   `json:"available"`
+
+	// Detail says what is missing, or what the feature provides
+	Detail string `json:"detail"`
+}
+
+// detectRootlessFeatures checks what rootless containers can do here
+func detectRootlessFeatures() []RootlessFeature {
+	var features []RootlessFeature
+	add := func(name string, err error, detail string) {
+		feature := RootlessFeature{Name: name, Available: err == nil, Detail: detail}
+		if err != nil {
+			feature.Detail = err.Error()
+		}
+		features = append(features, feature)
+	}
+
+	var userNamespaceErr error
+	if problem := checkUserNamespaces(); problem != nil {
+		userNamespaceErr = fmt.Errorf("%s", problem)
+	}
+	add("User namespaces", userNamespaceErr, "rootless containers can run")
+
+	_, uidmapErr := exec.LookPath("newuidmap")
+	if uidmapErr == nil {
+		_, uidmapErr = exec.LookPath("newgidmap")
+	}
+	if uidmapErr != nil {
+		uidmapErr = fmt.Errorf("newuidmap/newgidmap not found (install the uidmap package)")
+	}
+	add("ID mapping helpers", uidmapErr, "newuidmap and newgidmap can map subordinate IDs")
+
+	var subIDErr error
+	if currentUser, err := user.Current(); err != nil {
+		subIDErr = err
+	} else if subUIDs, err := readSubIDRanges(subUIDFile, currentUser.Username, os.Getuid()); err != nil {
+		subIDErr = err
+	} else {
+		var ranges []string
+		for _, subUIDRange := range subUIDs {
+			ranges = append(ranges, subUIDRange.String())
+		}
+		add("Subordinate IDs", nil, fmt.Sprintf("%s for %s", strings.Join(ranges, ", "), currentUser.Username))
+	}
+	if subIDErr != nil {
+		add("Subordinate IDs", subIDErr, "")
+	}
+
+	add("Cgroup delegation", cgroup.CanDelegate(), "--memory and --cpus work without root")
+
+	var idmapErr error
+	if !idmappedMountsSupported() {
+		idmapErr = fmt.Errorf("needs Linux 5.12 or later")
+	}
+	add("ID-mapped mounts", idmapErr, "the kernel can ID-map mounts; host filesystems need root to do so")
+	return features
+}
+
+// detectCgroupVersion works out which cgroup hierarchy is mounted
+// The filesystem type of /sys/fs/cgroup tells them apart: cgroup2 means the
+// unified v2 hierarchy; a tmpfs holding per-controller v1 mounts is v1,
+// or "hybrid" when a v2 hierarchy is additionally mounted at unified/
+func detectCgroupVersion() string {
+	var stat unix.Statfs_t
+	if err := unix.Statfs("/sys/fs/cgroup", &stat); err != nil {
+		return "unknown"
+	}
+	if stat.Type == unix.CGROUP2_SUPER_MAGIC {
+		return "2"
+	}
+
+	var unifiedStat unix.Statfs_t
+	if err := unix.Statfs("/sys/fs/cgroup/unified", &unifiedStat); err == nil && unifiedStat.Type == unix.CGROUP2_SUPER_MAGIC {
+		return "1 (hybrid)"
+	}
+	return "1"
+}
+
+// detectSeccomp reports whether the kernel supports seccomp filters
+// Every process has a "Seccomp:" line in its status on such kernels
+func detectSeccomp() bool {
+	status, err := os.ReadFile("/proc/self/status")
+	return err == nil && strings.Contains(string(status), "\nSeccomp:")
+}
+
+// detectAppArmor reports whether AppArmor is enabled
+func detectAppArmor() bool {
+	enabled, err := os.ReadFile("/sys/module/apparmor/parameters/enabled")
+	return err == nil && strings.TrimSpace(string(enabled)) == "Y"
+}
+
+// detectSELinux reports whether SELinux is enabled (selinuxfs is mounted)
+func detectSELinux() bool {
+	_, err := os.Stat("/sys/fs/selinux/enforce")
+	return err == nil
+}
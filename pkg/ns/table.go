@@ -0,0 +1,152 @@
+//go:build linux
+
+package ns
+
+import (
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/sys/unix"
+)
+
+// Tables
+//
+// Listings like "ps" are printed as tables sized to their content. On a
+// terminal they're also fitted to its width, cutting the last column (the
+// command, usually) short, and statuses are colored: running green,
+// restarting yellow, exited red. Piped or redirected output, --no-color and
+// NO_COLOR (https://no-color.org) turn the colors off; only a terminal
+// limits the width.
+
+// noColorEnvVar turns colors off when set to anything, as the convention goes
+const noColorEnvVar = "NO_COLOR"
+
+// Colors of table cells
+const (
+	ColorNone   = ""
+	ColorGreen  = "\x1b[32m"
+	ColorRed    = "\x1b[31m"
+	ColorYellow = "\x1b[33m"
+
+	colorReset = "\x1b[0m"
+)
+
+const (
+	// tableColumnGap separates the columns of a table
+	tableColumnGap = "   "
+
+	// minFlexibleWidth is as narrow as the last column gets to fit a table
+	// into the terminal
+	minFlexibleWidth = 12
+)
+
+// SetNoColor turns colors off for this process and those it starts
+func SetNoColor() {
+	os.Setenv(noColorEnvVar, "1")
+}
+
+// TableStyle says how a table is rendered
+type TableStyle struct {
+	// Color enables colored cells
+	Color bool
+
+	// Width is the width the table is fitted into; 0 means no limit
+	Width int
+}
+
+// StdoutTableStyle returns the style of tables printed on stdout: colored
+// and as wide as the terminal if stdout is one
+func StdoutTableStyle() TableStyle {
+	if !IsTerminal(os.Stdout) {
+		return TableStyle{}
+	}
+	style := TableStyle{Color: os.Getenv(noColorEnvVar) == ""}
+	if size, err := unix.IoctlGetWinsize(int(os.Stdout.Fd()), unix.TIOCGWINSZ); err == nil {
+		style.Width = int(size.Col)
+	}
+	return style
+}
+
+// Table collects the rows of a listing
+type Table struct {
+	headers []string
+	rows    [][]string
+	colors  [][]string
+}
+
+// NewTable starts a table with the given column headers
+func NewTable(headers ...string) *Table {
+	return &Table{headers: headers}
+}
+
+// AddRow appends a row, one cell per column
+func (t *Table) AddRow(cells ...string) {
+	t.rows = append(t.rows, cells)
+	t.colors = append(t.colors, make([]string, len(cells)))
+}
+
+// SetColor colors a cell of the last row added
+func (t *Table) SetColor(column int, color string) {
+	t.colors[len(t.colors)-1][column] = color
+}
+
+// Render formats the table: headers, then the rows, columns aligned
+func (t *Table) Render(style TableStyle) string {
+	widths := make([]int, len(t.headers))
+	for column, header := range t.headers {
+		widths[column] = utf8.RuneCountInString(header)
+	}
+	for _, row := range t.rows {
+		for column, cell := range row {
+			widths[column] = max(widths[column], utf8.RuneCountInString(cell))
+		}
+	}
+
+	// Fit the table into the terminal by narrowing the last column
+	last := len(widths) - 1
+	if style.Width > 0 {
+		total := len(tableColumnGap) * last
+		for _, width := range widths {
+			total += width
+		}
+		if total > style.Width {
+			widths[last] = max(minFlexibleWidth, widths[last]-(total-style.Width))
+		}
+	}
+
+	var output strings.Builder
+	writeRow := func(cells []string, colors []string) {
+		for column, cell := range cells {
+			cell = truncateCell(cell, widths[column])
+			if column > 0 {
+				output.WriteString(tableColumnGap)
+			}
+			if style.Color && colors != nil && colors[column] != ColorNone {
+				output.WriteString(colors[column] + cell + colorReset)
+			} else {
+				output.WriteString(cell)
+			}
+			// No trailing spaces after the last column
+			if column < last {
+				output.WriteString(strings.Repeat(" ", widths[column]-utf8.RuneCountInString(cell)))
+			}
+		}
+		output.WriteString("\n")
+	}
+
+	writeRow(t.headers, nil)
+	for index, row := range t.rows {
+		writeRow(row, t.colors[index])
+	}
+	return output.String()
+}
+
+// truncateCell shortens a cell to width, marking the cut with "..."
+func truncateCell(cell string, width int) string {
+	if utf8.RuneCountInString(cell) <= width {
+		return cell
+	}
+	runes := []rune(cell)
+	return string(runes[:width-3]) + "..."
+}
@@ -0,0 +1,140 @@
+//go:build linux
+
+package ns
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Time namespaces (--time-offset)
+//
+// A time namespace (Linux 5.6) shifts the monotonic and boot-time clocks
+// its processes see, e.g. to test how software copes with a machine that
+// has been up for 200 days, without touching the host's clocks. The
+// wall clock is the host's either way. Containers only get a time
+// namespace when an offset is asked for:
+//
+//	nsctl run --time-offset boottime=200d ... (d, h, m, s and smaller units)
+//
+// The offsets of a time namespace can only be written before any process
+// is in it, and a process only enters the namespace it creates when it
+// execs. Setup therefore unshares it and writes the offsets to
+// timens_offsets, which apply to the namespace it is about to enter; the
+// workload starts in it on exec, with /proc/uptime shifted too. Namespaces
+// belong to threads, and /proc/self is the main thread's, so the file is
+// the one of the thread that execs.
+
+// Clocks a time namespace can shift
+const (
+	ClockMonotonic = "monotonic"
+	ClockBoottime  = "boottime"
+)
+
+// timensOffsetsFile holds the offsets of a task's time namespace for its
+// children, in its /proc/<pid> directory
+const timensOffsetsFile = "timens_offsets"
+
+// TimeOffset shifts one of a container's clocks
+type TimeOffset struct {
+	Clock  string        `json:"clock"`
+	Offset time.Duration `json:"offset"`
+}
+
+func (offset TimeOffset) String() string {
+	return fmt.Sprintf("%s=%s", offset.Clock, offset.Offset)
+}
+
+// ParseTimeOffset parses a --time-offset value, <clock>=<duration>, where
+// the duration may be negative and also be given in days, e.g. 30d
+func ParseTimeOffset(value string) (TimeOffset, error) {
+	var offset TimeOffset
+	clock, duration, found := strings.Cut(value, "=")
+	if !found || (clock != ClockMonotonic && clock != ClockBoottime) {
+		return offset, fmt.Errorf("invalid time offset %q: expected %s|%s=<duration>", value, ClockMonotonic, ClockBoottime)
+	}
+	offset.Clock = clock
+
+	days, isDays := strings.CutSuffix(duration, "d")
+	if isDays {
+		duration = days + "h"
+	}
+	parsed, err := time.ParseDuration(duration)
+	if err != nil {
+		return offset, fmt.Errorf("invalid time offset %q: %v", value, err)
+	}
+	if isDays {
+		parsed *= 24
+	}
+	offset.Offset = parsed
+	return offset, nil
+}
+
+// validateTimeOffsets checks that each clock is shifted once at most
+func validateTimeOffsets(config ContainerConfig) error {
+	seen := map[string]bool{}
+	for _, offset := range config.TimeOffsets {
+		if seen[offset.Clock] {
+			return fmt.Errorf("the %s clock has more than one --time-offset", offset.Clock)
+		}
+		seen[offset.Clock] = true
+	}
+	if len(config.TimeOffsets) > 0 && config.Isolation == IsolationChroot {
+		return fmt.Errorf("--isolation %s can't have --time-offset: the container has no namespaces", IsolationChroot)
+	}
+	return nil
+}
+
+// hasOwnTimeNamespace reports whether a container gets a time namespace
+func hasOwnTimeNamespace(config ContainerConfig) bool {
+	return len(config.TimeOffsets) > 0
+}
+
+// clockIDs are the clock IDs timens_offsets takes
+var clockIDs = map[string]int{
+	ClockMonotonic: unix.CLOCK_MONOTONIC,
+	ClockBoottime:  unix.CLOCK_BOOTTIME,
+}
+
+// splitTimeOffset splits an offset into seconds and nanoseconds, which are
+// never negative: -1.5s is -2s plus 0.5s
+func splitTimeOffset(offset time.Duration) (int64, int64) {
+	seconds := offset.Truncate(time.Second)
+	if seconds > offset {
+		seconds -= time.Second
+	}
+	return int64(seconds / time.Second), int64(offset - seconds)
+}
+
+// unshareTimeNamespace creates the time namespace the workload enters on
+// exec and sets its offsets; it runs on the thread that execs
+func unshareTimeNamespace(config ContainerConfig) error {
+	if !hasOwnTimeNamespace(config) {
+		return nil
+	}
+	if err := unix.Unshare(unix.CLONE_NEWTIME); err != nil {
+		return fmt.Errorf("failed to create time namespace: %v", err)
+	}
+
+	var offsets strings.Builder
+	for _, offset := range config.TimeOffsets {
+		seconds, nanoseconds := splitTimeOffset(offset.Offset)
+		fmt.Fprintf(&offsets, "%d %d %d\n", clockIDs[offset.Clock], seconds, nanoseconds)
+	}
+	// /proc/thread-self points to <pid>/task/<tid>, and /proc/<tid> is the
+	// thread's own view of the process directory
+	threadSelf, err := os.Readlink("/proc/thread-self")
+	if err != nil {
+		return fmt.Errorf("failed to find the thread's /proc directory: %v", err)
+	}
+	offsetsPath := filepath.Join("/proc", filepath.Base(threadSelf), timensOffsetsFile)
+	if err := os.WriteFile(offsetsPath, []byte(offsets.String()), 0); err != nil {
+		return fmt.Errorf("failed to set the clock offsets (a clock can't be shifted before boot): %v", err)
+	}
+	return nil
+}
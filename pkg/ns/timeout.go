@@ -0,0 +1,67 @@
+//go:build linux
+
+package ns
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+const (
+	// timeoutGracePeriod is how long a timed-out container gets between
+	// SIGTERM and SIGKILL to shut down cleanly
+	timeoutGracePeriod = 10 * time.Second
+
+	// FinishReasonTimedOut marks containers stopped by --timeout
+	FinishReasonTimedOut = "timed out"
+)
+
+// enforceTimeout stops the container once it has run for longer than timeout
+// It is run by the shim in its own goroutine and returns early when exited
+// is closed. It reports whether it had to stop the container.
+//
+// The workload is PID 1 of its PID namespace. The kernel only delivers
+// signals from outside the namespace to it if it installed a handler, so a
+// program that doesn't handle SIGTERM is left running and SIGKILL (which
+// can't be ignored) follows after the grace period.
+func enforceTimeout(containerID string, process *os.Process, timeout time.Duration, exited <-chan struct{}) bool {
+	// A created container's clock only starts once it is started
+	if !waitUntilStarted(containerID, exited) {
+		return false
+	}
+
+	select {
+	case <-exited:
+		return false
+	case <-time.After(timeout):
+	}
+
+	logf("[shim] Container %s exceeded its %s timeout, sending SIGTERM\n", ShortID(containerID), timeout)
+	process.Signal(syscall.SIGTERM)
+
+	select {
+	case <-exited:
+	case <-time.After(timeoutGracePeriod):
+		logf("[shim] Container %s still running after %s, sending SIGKILL\n", ShortID(containerID), timeoutGracePeriod)
+		process.Kill()
+	}
+	return true
+}
+
+// waitUntilStarted polls the container record until it leaves the created
+// state; it returns false if the container exits first
+func waitUntilStarted(containerID string, exited <-chan struct{}) bool {
+	for {
+		containerInfo, err := loadContainerInfo(containerID)
+		if err != nil || containerInfo.Status != StatusCreated {
+			return true
+		}
+
+		select {
+		case <-exited:
+			return false
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,84 @@
+//go:build linux
+
+package ns
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Timezones (--tz)
+//
+// A container's /etc/localtime is one of the managed /etc files (see
+// etc_files.go): a copy of the host's, or with --tz Europe/Berlin, of that
+// zone's file from the host's zoneinfo database. --tz also sets TZ, so
+// programs that go by either agree. /etc/localtime is usually a symlink into
+// the zoneinfo database; the copy is mounted over the symlink itself, so the
+// zone file it points at keeps its contents for programs that ask for that
+// zone by name.
+
+const (
+	// zoneinfoDir is the host's zoneinfo database
+	zoneinfoDir = "/usr/share/zoneinfo"
+
+	hostLocaltimePath = "/etc/localtime"
+)
+
+// zoneinfoMagic starts every compiled zoneinfo file
+var zoneinfoMagic = []byte("TZif")
+
+// validateTimezone checks that a --tz zone is in the host's zoneinfo database
+func validateTimezone(timezone string) error {
+	if timezone == "" {
+		return nil
+	}
+	_, err := readZoneinfo(timezone)
+	return err
+}
+
+// readZoneinfo reads the zoneinfo file of a zone, e.g. "Europe/Berlin"
+func readZoneinfo(timezone string) ([]byte, error) {
+	if !filepath.IsLocal(timezone) {
+		return nil, fmt.Errorf("invalid timezone %q: expected a zone name like Europe/Berlin", timezone)
+	}
+	path := filepath.Join(zoneinfoDir, timezone)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unknown timezone %q: %v", timezone, err)
+	}
+	// The database also holds tables like zone.tab, which aren't zones
+	if !bytes.HasPrefix(data, zoneinfoMagic) {
+		return nil, fmt.Errorf("unknown timezone %q: %s is not a zoneinfo file", timezone, path)
+	}
+	return data, nil
+}
+
+// localtimeContent returns the /etc/localtime of a container with timezone,
+// the host's for none
+func localtimeContent(timezone string) ([]byte, error) {
+	if timezone != "" {
+		return readZoneinfo(timezone)
+	}
+	data, err := os.ReadFile(hostLocaltimePath)
+	if err != nil {
+		// Without one of its own the container has the host's (lack of)
+		// /etc/localtime anyway, and the mount is skipped
+		return nil, nil
+	}
+	return data, nil
+}
+
+// timezoneFromEnv returns the zone TZ names in a container's environment,
+// if it names one of the database rather than, say, a POSIX rule like
+// "CET-1" that --preserve-env passed through
+func timezoneFromEnv(env []string) string {
+	for _, variable := range env {
+		if timezone, found := strings.CutPrefix(variable, "TZ="); found && validateTimezone(timezone) == nil {
+			return timezone
+		}
+	}
+	return ""
+}
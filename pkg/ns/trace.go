@@ -0,0 +1,123 @@
+//go:build linux
+
+package ns
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Setup tracing (--trace-setup)
+//
+// "The container is slow to start" and "a mount failed" are hard to act on
+// from the usual "[ns]" lines. With --trace-setup the setup process logs
+// every step as it starts and ends, with its duration, and the mount, mount
+// attribute and credential syscalls inside the steps with their arguments,
+// result and duration:
+//
+//	[trace] +1.2ms mounts private: start
+//	[trace] +1.3ms   mount("", "/", "", MS_REC|MS_PRIVATE, "") = ok (45µs)
+//	[trace] +1.4ms mounts private: done in 160µs
+//
+// The offsets count from the start of the setup process. The lines go where
+// the other setup diagnostics go: stderr in the foreground; detached or
+// created containers have them in shim.log, from which the CLI prints those
+// written until the container was ready (the steps after the start remain
+// only in shim.log).
+
+// tracePrefix starts every trace line
+const tracePrefix = "[trace]"
+
+var (
+	// setupTracing is set in a setup process started with --trace-setup
+	setupTracing bool
+
+	// traceStart is what the trace's offsets count from
+	traceStart = time.Now()
+)
+
+// traced runs a setup step, logging its start and its end, with its
+// duration and error, when tracing
+func traced(name string, step func() error) error {
+	if !setupTracing {
+		return step()
+	}
+	started := time.Now()
+	tracef("%s: start", name)
+	err := step()
+	if err != nil {
+		tracef("%s: failed in %s: %v", name, time.Since(started).Round(time.Microsecond), err)
+		return err
+	}
+	tracef("%s: done in %s", name, time.Since(started).Round(time.Microsecond))
+	return nil
+}
+
+// traceSyscall logs a syscall made in a step, when tracing; started is when
+// it was made
+func traceSyscall(started time.Time, err error, format string, args ...any) {
+	if !setupTracing {
+		return
+	}
+	result := "ok"
+	if err != nil {
+		result = err.Error()
+	}
+	tracef("  %s = %s (%s)", fmt.Sprintf(format, args...), result, time.Since(started).Round(time.Microsecond))
+}
+
+// tracef logs one trace line
+func tracef(format string, args ...any) {
+	logf("%s +%s %s\n", tracePrefix, time.Since(traceStart).Round(time.Microsecond), fmt.Sprintf(format, args...))
+}
+
+// mountTraced is unix.Mount, traced
+func mountTraced(source string, target string, fstype string, flags uintptr, data string) error {
+	started := time.Now()
+	err := unix.Mount(source, target, fstype, flags, data)
+	traceSyscall(started, err, "mount(%q, %q, %q, %s, %q)", source, target, fstype, formatMountFlags(flags), data)
+	return err
+}
+
+// mountFlagNames names the mount(2) flags setup uses
+var mountFlagNames = []struct {
+	flag uintptr
+	name string
+}{
+	{unix.MS_RDONLY, "MS_RDONLY"},
+	{unix.MS_NOSUID, "MS_NOSUID"},
+	{unix.MS_NODEV, "MS_NODEV"},
+	{unix.MS_NOEXEC, "MS_NOEXEC"},
+	{unix.MS_REMOUNT, "MS_REMOUNT"},
+	{unix.MS_NOATIME, "MS_NOATIME"},
+	{unix.MS_NODIRATIME, "MS_NODIRATIME"},
+	{unix.MS_BIND, "MS_BIND"},
+	{unix.MS_MOVE, "MS_MOVE"},
+	{unix.MS_REC, "MS_REC"},
+	{unix.MS_UNBINDABLE, "MS_UNBINDABLE"},
+	{unix.MS_PRIVATE, "MS_PRIVATE"},
+	{unix.MS_SLAVE, "MS_SLAVE"},
+	{unix.MS_SHARED, "MS_SHARED"},
+	{unix.MS_RELATIME, "MS_RELATIME"},
+}
+
+// formatMountFlags formats mount(2) flags the way strace does
+func formatMountFlags(flags uintptr) string {
+	var names []string
+	for _, named := range mountFlagNames {
+		if flags&named.flag != 0 {
+			names = append(names, named.name)
+			flags &^= named.flag
+		}
+	}
+	if flags != 0 {
+		names = append(names, fmt.Sprintf("%#x", flags))
+	}
+	if len(names) == 0 {
+		return "0"
+	}
+	return strings.Join(names, "|")
+}
@@ -0,0 +1,189 @@
+//go:build linux
+
+package ns
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// Files consulted to resolve --user, read from the container's own root
+	passwdFile = "/etc/passwd"
+	groupFile  = "/etc/group"
+)
+
+// containerUser is a --user value resolved against the container's passwd file
+type containerUser struct {
+	UID  int
+	GID  int
+	Home string
+
+	// Groups are the supplementary groups from --group-add
+	Groups []int
+}
+
+// resolveUser turns a --user spec ("name", "uid", "name:group", "uid:gid")
+// into numeric IDs and a home directory
+//
+// Names are looked up in the container's /etc/passwd and /etc/group, not the
+// host's, because that is the user database the workload will see. Numeric
+// IDs without a passwd entry are allowed and get "/" as their home.
+func resolveUser(userSpec string) (containerUser, error) {
+	if userSpec == "" {
+		userSpec = "0"
+	}
+
+	userPart, groupPart, hasGroup := strings.Cut(userSpec, ":")
+	resolvedUser := containerUser{Home: "/"}
+
+	// Look up the user part in /etc/passwd by name or by UID
+	entry, found, err := findPasswdEntry(userPart)
+	if err != nil {
+		return containerUser{}, err
+	}
+	if found {
+		resolvedUser.UID = entry.uid
+		resolvedUser.GID = entry.gid
+		resolvedUser.Home = entry.home
+	} else {
+		uid, convErr := strconv.Atoi(userPart)
+		if convErr != nil || uid < 0 {
+			return containerUser{}, fmt.Errorf("unable to find user %s: no matching entries in %s", userPart, passwdFile)
+		}
+		resolvedUser.UID = uid
+		resolvedUser.GID = uid
+	}
+
+	// An explicit group overrides the user's primary group
+	if hasGroup {
+		gid, err := resolveGroup(groupPart)
+		if err != nil {
+			return containerUser{}, err
+		}
+		resolvedUser.GID = gid
+	}
+
+	return resolvedUser, nil
+}
+
+// resolveGroups looks up the --group-add groups in the container's
+// /etc/group
+func resolveGroups(groupSpecs []string) ([]int, error) {
+	var groups []int
+	for _, groupSpec := range groupSpecs {
+		gid, err := resolveGroup(groupSpec)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, gid)
+	}
+	return groups, nil
+}
+
+// passwdEntry holds the fields of an /etc/passwd line that we care about
+type passwdEntry struct {
+	name string
+	uid  int
+	gid  int
+	home string
+}
+
+// findPasswdEntry searches /etc/passwd for a user name or numeric UID
+func findPasswdEntry(nameOrUID string) (passwdEntry, bool, error) {
+	file, err := os.Open(passwdFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return passwdEntry{}, false, nil
+		}
+		return passwdEntry{}, false, fmt.Errorf("failed to open %s: %v", passwdFile, err)
+	}
+	defer file.Close()
+
+	// Format: name:password:UID:GID:GECOS:home:shell
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) < 7 {
+			continue
+		}
+		if fields[0] != nameOrUID && fields[2] != nameOrUID {
+			continue
+		}
+		uid, uidErr := strconv.Atoi(fields[2])
+		gid, gidErr := strconv.Atoi(fields[3])
+		if uidErr != nil || gidErr != nil {
+			continue
+		}
+		return passwdEntry{name: fields[0], uid: uid, gid: gid, home: fields[5]}, true, nil
+	}
+	return passwdEntry{}, false, scanner.Err()
+}
+
+// resolveGroup looks up a group name or numeric GID in /etc/group
+func resolveGroup(nameOrGID string) (int, error) {
+	file, err := os.Open(groupFile)
+	if err == nil {
+		defer file.Close()
+
+		// Format: name:password:GID:members
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			fields := strings.Split(scanner.Text(), ":")
+			if len(fields) < 3 || (fields[0] != nameOrGID && fields[2] != nameOrGID) {
+				continue
+			}
+			if gid, convErr := strconv.Atoi(fields[2]); convErr == nil {
+				return gid, nil
+			}
+		}
+	}
+
+	gid, convErr := strconv.Atoi(nameOrGID)
+	if convErr != nil || gid < 0 {
+		return 0, fmt.Errorf("unable to find group %s: no matching entries in %s", nameOrGID, groupFile)
+	}
+	return gid, nil
+}
+
+// switchUser changes the credentials of the current process to the given user
+// Groups must be changed first: once we drop to a non-root UID we no longer
+// have the privilege to change them
+func switchUser(user containerUser) error {
+	logf("[ns] Switching to UID %d, GID %d\n", user.UID, user.GID)
+
+	// Replace the supplementary groups inherited from the host with the
+	// --group-add ones; a rootless container without newgidmap can't, but
+	// has no other groups mapped anyway
+	if setgroupsDenied() {
+		if len(user.Groups) > 0 {
+			return fmt.Errorf("--group-add needs setgroups, which is disabled without newgidmap")
+		}
+	} else {
+		started := time.Now()
+		err := unix.Setgroups(append([]int{}, user.Groups...))
+		traceSyscall(started, err, "setgroups(%v)", user.Groups)
+		if err != nil {
+			return fmt.Errorf("failed to set supplementary groups %v: %v", user.Groups, err)
+		}
+	}
+	started := time.Now()
+	err := unix.Setresgid(user.GID, user.GID, user.GID)
+	traceSyscall(started, err, "setresgid(%d, %d, %d)", user.GID, user.GID, user.GID)
+	if err != nil {
+		return fmt.Errorf("failed to set GID %d: %v", user.GID, err)
+	}
+	started = time.Now()
+	err = unix.Setresuid(user.UID, user.UID, user.UID)
+	traceSyscall(started, err, "setresuid(%d, %d, %d)", user.UID, user.UID, user.UID)
+	if err != nil {
+		return fmt.Errorf("failed to set UID %d: %v", user.UID, err)
+	}
+	return nil
+}
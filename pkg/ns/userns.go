@@ -0,0 +1,318 @@
+//go:build linux
+
+package ns
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Rootless containers
+//
+// Without root, nsctl creates the container in a new user namespace in
+// which the invoking user is root. That alone only maps a single ID, so
+// "--user nobody" or a package manager that chowns files would fail. Like
+// other rootless runtimes, nsctl therefore also maps the user's subordinate
+// ID range from /etc/subuid and /etc/subgid:
+//
+//	container 0        -> host <uid>
+//	container 1..65536 -> host <subuid start>..
+//
+// Only root may write such mappings, which is what the setuid helpers
+// newuidmap and newgidmap (from the "uidmap" or "shadow" package) are for.
+// Without them, or without subordinate IDs, nsctl falls back to mapping just
+// the user.
+//
+// The mappings can only be written once the setup process exists, so the
+// shim writes them after starting it and before sending it its config. The
+// setup process has exec'd by then, and a process whose UID isn't 0 in its
+// namespace loses its capabilities on exec; it is therefore started with
+// all of them raised as ambient capabilities, which survive the exec. With
+// --userns=keep-id it never becomes root, so it relies on them throughout.
+
+// IDMap maps a range of IDs inside the container to IDs on the host
+type IDMap struct {
+	ContainerID int `json:"container_id"`
+	HostID      int `json:"host_id"`
+	Size        int `json:"size"`
+}
+
+// Files listing the subordinate IDs users may map
+const (
+	subUIDFile = "/etc/subuid"
+	subGIDFile = "/etc/subgid"
+)
+
+// User namespace modes (--userns)
+const (
+	// UsernsKeepID maps the invoking user to the same IDs in the container
+	UsernsKeepID = "keep-id"
+)
+
+// configureRootless fills in the ID mappings of a container started by an
+// unprivileged user
+func configureRootless(config *ContainerConfig) error {
+	currentUser, err := user.Current()
+	if err != nil {
+		return fmt.Errorf("failed to look up the current user: %v", err)
+	}
+	uid, gid := os.Getuid(), os.Getgid()
+
+	// By default the user becomes root in the container; with keep-id they
+	// keep their IDs, and the workload runs as them unless --user says otherwise
+	mappedAs := "root"
+	ownUID, ownGID := 0, 0
+	if config.UserNamespace == UsernsKeepID {
+		mappedAs = "your own user"
+		ownUID, ownGID = uid, gid
+		if config.User == "" {
+			config.User = fmt.Sprintf("%d:%d", uid, gid)
+		}
+	}
+
+	config.UIDMappings = []IDMap{{ContainerID: ownUID, HostID: uid, Size: 1}}
+	config.GIDMappings = []IDMap{{ContainerID: ownGID, HostID: gid, Size: 1}}
+
+	if _, err := exec.LookPath("newuidmap"); err != nil {
+		logf("[ns] Warning: newuidmap not found, only %s is mapped in the container (install the uidmap package)\n", mappedAs)
+		return nil
+	}
+	if _, err := exec.LookPath("newgidmap"); err != nil {
+		logf("[ns] Warning: newgidmap not found, only %s is mapped in the container (install the uidmap package)\n", mappedAs)
+		return nil
+	}
+
+	subUIDs, err := readSubIDRanges(subUIDFile, currentUser.Username, uid)
+	if err == nil {
+		var subGIDs []subIDRange
+		subGIDs, err = readSubIDRanges(subGIDFile, currentUser.Username, uid)
+		if err == nil {
+			config.UIDMappings = append(config.UIDMappings, subIDMappings(subUIDs, ownUID)...)
+			config.GIDMappings = append(config.GIDMappings, subIDMappings(subGIDs, ownGID)...)
+			return nil
+		}
+	}
+
+	logf("[ns] Warning: %v; only %s is mapped in the container (add a range with: usermod --add-subuids 100000-165535 --add-subgids 100000-165535 %s)\n", err, mappedAs, currentUser.Username)
+	return nil
+}
+
+// prepareUserNamespace settles the container's user namespace before
+// anything is created: explicit --uidmap/--gidmap mappings are completed
+// and, for an unprivileged user, checked against their subordinate IDs;
+// otherwise rootless containers get the default (or keep-id) mappings
+func prepareUserNamespace(config *ContainerConfig) error {
+	if err := validateUsernsMode(*config); err != nil {
+		return err
+	}
+
+	explicit := len(config.UIDMappings) > 0 || len(config.GIDMappings) > 0
+	if explicit && config.UserNamespace != "" {
+		return fmt.Errorf("--userns=%s can't be combined with --uidmap or --gidmap", config.UserNamespace)
+	}
+
+	// Like other runtimes, a single kind of mapping applies to both
+	if len(config.GIDMappings) == 0 {
+		config.GIDMappings = config.UIDMappings
+	}
+	if len(config.UIDMappings) == 0 {
+		config.UIDMappings = config.GIDMappings
+	}
+
+	if os.Geteuid() == 0 {
+		// Root may map any host IDs
+		return nil
+	}
+	config.Rootless = true
+	if !explicit {
+		if err := configureRootless(config); err != nil {
+			return err
+		}
+	}
+	if mapsOwnIDsOnly(*config) {
+		// Without newgidmap, setgroups(2) has to be disabled in the container
+		if len(config.GroupAdd) > 0 {
+			return fmt.Errorf("--group-add needs newgidmap and subordinate GIDs in rootless containers")
+		}
+	} else {
+		for _, helper := range []string{"newuidmap", "newgidmap"} {
+			if _, err := exec.LookPath(helper); err != nil {
+				return fmt.Errorf("mapping more than your own uid and gid needs %s (install the uidmap package)", helper)
+			}
+		}
+	}
+	return validateRootlessMappings(*config)
+}
+
+// validateUsernsMode checks a --userns value
+func validateUsernsMode(config ContainerConfig) error {
+	switch config.UserNamespace {
+	case "":
+		return nil
+	case UsernsKeepID:
+		if os.Geteuid() == 0 {
+			return fmt.Errorf("--userns=%s is only supported for rootless containers", UsernsKeepID)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown user namespace mode %q (expected %q)", config.UserNamespace, UsernsKeepID)
+	}
+}
+
+// ParseIDMap parses a --uidmap or --gidmap value, container:host:size
+func ParseIDMap(spec string) (IDMap, error) {
+	fields := strings.Split(spec, ":")
+	if len(fields) != 3 {
+		return IDMap{}, fmt.Errorf("invalid ID mapping %q: expected container:host:size", spec)
+	}
+
+	var values [3]int
+	for i, field := range fields {
+		value, err := strconv.Atoi(field)
+		if err != nil || value < 0 {
+			return IDMap{}, fmt.Errorf("invalid ID mapping %q: %q is not a valid ID or size", spec, field)
+		}
+		values[i] = value
+	}
+	if values[2] == 0 {
+		return IDMap{}, fmt.Errorf("invalid ID mapping %q: size must be at least 1", spec)
+	}
+	return IDMap{ContainerID: values[0], HostID: values[1], Size: values[2]}, nil
+}
+
+// validateRootlessMappings makes sure an unprivileged user only maps IDs
+// newuidmap and newgidmap will accept, before anything is created
+func validateRootlessMappings(config ContainerConfig) error {
+	currentUser, err := user.Current()
+	if err != nil {
+		return fmt.Errorf("failed to look up the current user: %v", err)
+	}
+	uid, gid := os.Getuid(), os.Getgid()
+
+	// Mapping just our own IDs needs no subordinate IDs at all
+	subUIDs, uidErr := readSubIDRanges(subUIDFile, currentUser.Username, uid)
+	subGIDs, gidErr := readSubIDRanges(subGIDFile, currentUser.Username, uid)
+
+	if err := validateIDMappings("uid", config.UIDMappings, uid, subUIDs, currentUser.Username); err != nil {
+		if uidErr != nil {
+			return fmt.Errorf("%v (%v)", err, uidErr)
+		}
+		return err
+	}
+	if err := validateIDMappings("gid", config.GIDMappings, gid, subGIDs, currentUser.Username); err != nil {
+		if gidErr != nil {
+			return fmt.Errorf("%v (%v)", err, gidErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// writeIDMappings sets up the user namespace of a freshly started process
+// Root and a caller mapping just their own IDs can write the maps directly;
+// anything else goes through newuidmap and newgidmap
+func writeIDMappings(pid int, config ContainerConfig) error {
+	procDir := filepath.Join("/proc", strconv.Itoa(pid))
+	if os.Geteuid() == 0 {
+		if err := os.WriteFile(filepath.Join(procDir, "uid_map"), []byte(formatIDMappings(config.UIDMappings)), 0); err != nil {
+			return fmt.Errorf("failed to write uid_map: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(procDir, "gid_map"), []byte(formatIDMappings(config.GIDMappings)), 0); err != nil {
+			return fmt.Errorf("failed to write gid_map: %v", err)
+		}
+		return nil
+	}
+
+	if mapsOwnIDsOnly(config) {
+		// An unprivileged gid_map requires setgroups to be disabled first,
+		// or the process could drop groups used to deny it access to files
+		if err := os.WriteFile(filepath.Join(procDir, "setgroups"), []byte("deny"), 0); err != nil {
+			return fmt.Errorf("failed to disable setgroups: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(procDir, "uid_map"), []byte(formatIDMappings(config.UIDMappings)), 0); err != nil {
+			return fmt.Errorf("failed to write uid_map: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(procDir, "gid_map"), []byte(formatIDMappings(config.GIDMappings)), 0); err != nil {
+			return fmt.Errorf("failed to write gid_map: %v", err)
+		}
+		return nil
+	}
+
+	for _, helper := range []struct {
+		name     string
+		mappings []IDMap
+	}{
+		{name: "newuidmap", mappings: config.UIDMappings},
+		{name: "newgidmap", mappings: config.GIDMappings},
+	} {
+		args := []string{strconv.Itoa(pid)}
+		for _, mapping := range helper.mappings {
+			args = append(args, strconv.Itoa(mapping.ContainerID), strconv.Itoa(mapping.HostID), strconv.Itoa(mapping.Size))
+		}
+		if output, err := exec.Command(helper.name, args...).CombinedOutput(); err != nil {
+			return fmt.Errorf("%s failed: %v: %s", helper.name, err, strings.TrimSpace(string(output)))
+		}
+	}
+	return nil
+}
+
+// mapsOwnIDsOnly reports whether config maps nothing but the caller's own
+// uid and gid, which needs no helpers
+func mapsOwnIDsOnly(config ContainerConfig) bool {
+	return len(config.UIDMappings) == 1 && config.UIDMappings[0].HostID == os.Getuid() && config.UIDMappings[0].Size == 1 &&
+		len(config.GIDMappings) == 1 && config.GIDMappings[0].HostID == os.Getgid() && config.GIDMappings[0].Size == 1
+}
+
+// formatIDMappings renders mappings in the format of /proc/<pid>/uid_map
+func formatIDMappings(mappings []IDMap) string {
+	var lines []string
+	for _, mapping := range mappings {
+		lines = append(lines, fmt.Sprintf("%d %d %d", mapping.ContainerID, mapping.HostID, mapping.Size))
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// setupCapabilities lists every capability the kernel knows, which the setup
+// process keeps as ambient capabilities across its exec
+func setupCapabilities() []uintptr {
+	lastCap := lastCapability()
+	capabilities := make([]uintptr, 0, lastCap+1)
+	for capability := 0; capability <= lastCap; capability++ {
+		capabilities = append(capabilities, uintptr(capability))
+	}
+	return capabilities
+}
+
+// dropSetupCapabilities clears the ambient and inheritable sets raised for
+// setup before the workload is exec'd, so a non-root workload doesn't
+// inherit the setup's capabilities
+func dropSetupCapabilities() error {
+	if err := unix.Prctl(unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_CLEAR_ALL, 0, 0, 0); err != nil {
+		return fmt.Errorf("failed to drop ambient capabilities: %v", err)
+	}
+
+	header := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var data [2]unix.CapUserData
+	if err := unix.Capget(&header, &data[0]); err != nil {
+		return fmt.Errorf("failed to read capabilities: %v", err)
+	}
+	data[0].Inheritable, data[1].Inheritable = 0, 0
+	if err := unix.Capset(&header, &data[0]); err != nil {
+		return fmt.Errorf("failed to drop inheritable capabilities: %v", err)
+	}
+	return nil
+}
+
+// setgroupsDenied reports whether setgroups(2) is disabled in our user
+// namespace, as it is when the gid_map was written without newgidmap
+func setgroupsDenied() bool {
+	setgroups, err := os.ReadFile("/proc/self/setgroups")
+	return err == nil && strings.TrimSpace(string(setgroups)) == "deny"
+}
@@ -0,0 +1,345 @@
+//go:build linux
+
+package ns
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"nsctl/pkg/cgroup"
+)
+
+// Volume backup and restore ("volume export" and "volume import")
+//
+// A volume travels as a tarball of its contents, paths relative to the
+// volume's root. Running containers using the volume are frozen while it
+// is exported, so the tarball captures the data at one point in time
+// rather than halfway through a write; they carry on once it's written.
+// Importing refuses a volume a running container uses, and unpacks over
+// what the volume already holds.
+
+// ExportVolume writes the contents of a volume to w as a tarball
+func ExportVolume(name string, w io.Writer) error {
+	volume, err := LookupVolume(name)
+	if err != nil {
+		return err
+	}
+
+	thaw, err := freezeVolumeUsers(volume.Name)
+	if err != nil {
+		return err
+	}
+	stopThawOnSignal := thawOnSignal(thaw)
+	defer stopThawOnSignal()
+	defer thaw()
+
+	archive := tar.NewWriter(w)
+	err = filepath.WalkDir(volume.Mountpoint, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		relativePath, err := filepath.Rel(volume.Mountpoint, path)
+		if err != nil || relativePath == "." {
+			return err
+		}
+		return addToArchive(archive, path, relativePath)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to export volume %s: %v", volume.Name, err)
+	}
+	if err := archive.Close(); err != nil {
+		return fmt.Errorf("failed to export volume %s: %v", volume.Name, err)
+	}
+	return nil
+}
+
+// addToArchive writes one file, directory, link or device to the tarball
+func addToArchive(archive *tar.Writer, path string, name string) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	var linkTarget string
+	if info.Mode()&os.ModeSymlink != 0 {
+		if linkTarget, err = os.Readlink(path); err != nil {
+			return err
+		}
+	}
+
+	header, err := tar.FileInfoHeader(info, linkTarget)
+	if err != nil {
+		return err
+	}
+	header.Name = filepath.ToSlash(name)
+	if info.IsDir() {
+		header.Name += "/"
+	}
+	// Names would only be looked up in the host's user database
+	header.Uname, header.Gname = "", ""
+
+	if err := archive.WriteHeader(header); err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(archive, file)
+	return err
+}
+
+// ImportVolume unpacks a tarball from r into a volume, creating the volume
+// if it doesn't exist
+func ImportVolume(name string, r io.Reader) error {
+	volume, err := CreateVolume(name)
+	if err != nil {
+		return err
+	}
+	inUse, err := volumesInUse()
+	if err != nil {
+		return err
+	}
+	if inUse[volume.Name] {
+		return fmt.Errorf("volume %s is in use by a running container", volume.Name)
+	}
+
+	// Ownership can only be restored with the privileges to chown; rootless,
+	// everything belongs to the user, i.e. to root in their containers
+	restoreOwners := os.Geteuid() == 0
+
+	archive := tar.NewReader(r)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to import volume %s: %v", volume.Name, err)
+		}
+		if err := extractFromArchive(archive, header, volume.Mountpoint, restoreOwners); err != nil {
+			return fmt.Errorf("failed to import volume %s: %s: %v", volume.Name, header.Name, err)
+		}
+	}
+	return nil
+}
+
+// extractFromArchive creates one tarball entry below root
+func extractFromArchive(archive *tar.Reader, header *tar.Header, root string, restoreOwners bool) error {
+	path, err := archiveEntryPath(root, header.Name)
+	if err != nil || path == root {
+		return err
+	}
+
+	switch header.Typeflag {
+	case tar.TypeDir:
+		// An earlier entry may have planted a symlink here, which chmod would
+		// follow anywhere on the host
+		if err := os.Mkdir(path, 0700); err != nil && !os.IsExist(err) {
+			return err
+		}
+		if info, err := os.Lstat(path); err != nil {
+			return err
+		} else if !info.IsDir() {
+			return fmt.Errorf("refusing directory %q: the path exists and is not a directory", header.Name)
+		}
+	case tar.TypeReg:
+		os.Remove(path)
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(file, archive)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		os.Remove(path)
+		if err := os.Symlink(header.Linkname, path); err != nil {
+			return err
+		}
+	case tar.TypeLink:
+		target, err := archiveEntryPath(root, header.Linkname)
+		if err != nil {
+			return err
+		}
+		os.Remove(path)
+		return os.Link(target, path)
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		os.Remove(path)
+		if err := mknodFromHeader(path, header); err != nil {
+			return err
+		}
+	default:
+		logf("[ns] Warning: skipping %s of unsupported type %q\n", header.Name, header.Typeflag)
+		return nil
+	}
+
+	if restoreOwners {
+		if err := os.Lchown(path, header.Uid, header.Gid); err != nil {
+			return err
+		}
+	}
+	if header.Typeflag == tar.TypeSymlink {
+		return nil
+	}
+	// After chown, which clears the setuid and setgid bits
+	if err := chmodNoFollow(path, uint32(header.Mode)&07777); err != nil {
+		return err
+	}
+	times := []unix.Timespec{{Nsec: unix.UTIME_OMIT}, unix.NsecToTimespec(header.ModTime.UnixNano())}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, path, times, unix.AT_SYMLINK_NOFOLLOW)
+}
+
+// chmodNoFollow changes the mode of path, refusing a symlink rather than
+// following it
+// fchmodat(2) has no working AT_SYMLINK_NOFOLLOW, so the mode is applied
+// through an O_PATH descriptor of the path itself.
+func chmodNoFollow(path string, mode uint32) error {
+	fd, err := unix.Open(path, unix.O_PATH|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	var stat unix.Stat_t
+	if err := unix.Fstat(fd, &stat); err != nil {
+		return err
+	}
+	if stat.Mode&unix.S_IFMT == unix.S_IFLNK {
+		return fmt.Errorf("refusing to chmod symlink %s", path)
+	}
+	return unix.Chmod(fmt.Sprintf("/proc/self/fd/%d", fd), mode)
+}
+
+// archiveEntryPath resolves a name from a tarball to a path below root,
+// creating missing parent directories
+// Names leading out of root, or through a symlink (which an earlier entry
+// may have planted to point anywhere), are refused.
+func archiveEntryPath(root string, name string) (string, error) {
+	cleaned := filepath.Clean(name)
+	if filepath.IsAbs(cleaned) || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", fmt.Errorf("refusing path %q outside the volume", name)
+	}
+	if cleaned == "." {
+		return root, nil
+	}
+
+	path := root
+	components := strings.Split(cleaned, "/")
+	for _, component := range components[:len(components)-1] {
+		path = filepath.Join(path, component)
+		info, err := os.Lstat(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			if err := os.Mkdir(path, 0755); err != nil {
+				return "", err
+			}
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if !info.IsDir() {
+			return "", fmt.Errorf("refusing path %q: %s is not a directory", name, component)
+		}
+	}
+	return filepath.Join(path, components[len(components)-1]), nil
+}
+
+// mknodFromHeader creates a device node or FIFO described by a tarball entry
+func mknodFromHeader(path string, header *tar.Header) error {
+	mode := uint32(header.Mode) & 07777
+	switch header.Typeflag {
+	case tar.TypeChar:
+		mode |= unix.S_IFCHR
+	case tar.TypeBlock:
+		mode |= unix.S_IFBLK
+	case tar.TypeFifo:
+		mode |= unix.S_IFIFO
+	}
+	device := unix.Mkdev(uint32(header.Devmajor), uint32(header.Devminor))
+	return unix.Mknod(path, mode, int(device))
+}
+
+// freezeVolumeUsers freezes the running containers that use a volume and
+// returns a function thawing them again, which may be called more than once
+func freezeVolumeUsers(name string) (func(), error) {
+	users, err := volumeUsers(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var frozen []*cgroup.Cgroup
+	var thawOnce sync.Once
+	thaw := func() {
+		thawOnce.Do(func() {
+			for _, containerCgroup := range frozen {
+				if err := containerCgroup.Freeze(false); err != nil {
+					logf("[ns] Warning: failed to thaw container: %v\n", err)
+				}
+			}
+		})
+	}
+	for _, user := range users {
+		if user.Status != StatusRunning {
+			continue
+		}
+		if user.CgroupPath == "" {
+			logf("[ns] Warning: container %s has no cgroup to pause; the export may catch it mid-write\n", ShortID(user.ID))
+			continue
+		}
+		containerCgroup := cgroup.Load(user.CgroupPath)
+		if err := containerCgroup.Freeze(true); err != nil {
+			// A half-frozen group is thawed again rather than left behind
+			containerCgroup.Freeze(false)
+			logf("[ns] Warning: failed to pause container %s (%v); the export may catch it mid-write\n", ShortID(user.ID), err)
+			continue
+		}
+		logf("[ns] Paused container %s for the export\n", ShortID(user.ID))
+		frozen = append(frozen, containerCgroup)
+	}
+	return thaw, nil
+}
+
+// thawOnSignal makes sure the containers frozen for an export are thawed
+// even if nsctl is interrupted: a closed pipe, e.g. to ssh, fails the write
+// instead of killing nsctl, and SIGINT, SIGTERM and SIGHUP thaw before
+// exiting. It returns a function restoring the default signal handling.
+func thawOnSignal(thaw func()) func() {
+	signal.Ignore(syscall.SIGPIPE)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case received := <-signals:
+			thaw()
+			logf("[ns] Export interrupted by %v\n", received)
+			os.Exit(128 + int(received.(syscall.Signal)))
+		case <-done:
+		}
+	}()
+	return func() {
+		signal.Stop(signals)
+		signal.Reset(syscall.SIGPIPE)
+		close(done)
+	}
+}
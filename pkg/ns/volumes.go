@@ -0,0 +1,352 @@
+//go:build linux
+
+package ns
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// Managed volumes
+//
+// A volume is a directory nsctl keeps in the data directory, under
+// volumes/<name>/_data, for data that should outlive a container without
+// the user having to pick a host path for it:
+//
+//	-v cache:/var/cache/app   named volume, created on first use
+//	-v /var/lib/app           anonymous volume with a random name
+//	--mount type=volume,src=cache,dst=/var/cache/app
+//
+// Anonymous volumes belong to the container they were created for and are
+// what a VOLUME declaration in an image config maps to; "rm -v" and --rm
+// remove them along with the container. Named volumes stay until
+// "volume rm".
+
+// Volume is a managed volume's record
+type Volume struct {
+	// SchemaVersion is the version of the record's format (see
+	// state_schema.go)
+	SchemaVersion int `json:"schema_version"`
+
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+
+	// Anonymous volumes were created for a single container
+	Anonymous bool `json:"anonymous"`
+
+	// Mountpoint is the host directory holding the volume's data
+	Mountpoint string `json:"mountpoint"`
+}
+
+const (
+	volumesDirName     = "volumes"
+	volumeDataDirName  = "_data"
+	volumeInfoFileName = "volume.json"
+)
+
+// volumeNamePattern is what volume names may look like; it keeps them
+// apart from host paths and safe to use as directory names
+var volumeNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// isVolumeName reports whether a -v source names a volume rather than a
+// host path
+func isVolumeName(source string) bool {
+	return volumeNamePattern.MatchString(source)
+}
+
+// volumesDir returns the directory holding all volumes
+func volumesDir() (string, error) {
+	dataDir, err := EnsureDataDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dataDir, volumesDirName), nil
+}
+
+// CreateVolume creates a named volume, or returns it if it exists
+func CreateVolume(name string) (Volume, error) {
+	if !isVolumeName(name) {
+		return Volume{}, fmt.Errorf("invalid volume name %q: use letters, digits, '_', '.' and '-'", name)
+	}
+	if volume, err := LookupVolume(name); err == nil {
+		return volume, nil
+	}
+	return createVolume(name, false)
+}
+
+// createAnonymousVolume creates a volume with a random name
+func createAnonymousVolume() (Volume, error) {
+	randomBytes := make([]byte, 32)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return Volume{}, fmt.Errorf("failed to generate volume name: %v", err)
+	}
+	return createVolume(hex.EncodeToString(randomBytes), true)
+}
+
+// createVolume makes a volume's directories and record
+func createVolume(name string, anonymous bool) (Volume, error) {
+	dir, err := volumesDir()
+	if err != nil {
+		return Volume{}, err
+	}
+	volumeDir := filepath.Join(dir, name)
+
+	volume := Volume{
+		SchemaVersion: volumeSchemaVersion,
+		Name:          name,
+		CreatedAt:     time.Now(),
+		Anonymous:     anonymous,
+		Mountpoint:    filepath.Join(volumeDir, volumeDataDirName),
+	}
+	if err := os.MkdirAll(volume.Mountpoint, 0755); err != nil {
+		return Volume{}, fmt.Errorf("failed to create volume %s: %v", name, err)
+	}
+
+	if err := saveVolume(volumeDir, volume); err != nil {
+		os.RemoveAll(volumeDir)
+		return Volume{}, err
+	}
+	logf("[ns] Created volume %s\n", name)
+	return volume, nil
+}
+
+// LookupVolume finds a volume by name
+func LookupVolume(name string) (Volume, error) {
+	if !isVolumeName(name) {
+		return Volume{}, fmt.Errorf("no such volume: %s", name)
+	}
+	dir, err := volumesDir()
+	if err != nil {
+		return Volume{}, err
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, name, volumeInfoFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return Volume{}, fmt.Errorf("no such volume: %s", name)
+		}
+		return Volume{}, fmt.Errorf("failed to read volume %s: %v", name, err)
+	}
+	var volume Volume
+	migrated, err := decodeRecord("volume", name, data, volumeMigrations, &volume)
+	if err != nil {
+		if _, newer := err.(*NewerSchemaError); newer {
+			return Volume{}, err
+		}
+		return Volume{}, fmt.Errorf("failed to parse volume %s: %v", name, err)
+	}
+	if migrated {
+		if err := saveVolume(filepath.Join(dir, name), volume); err != nil {
+			logf("[ns] Warning: failed to save migrated volume %s: %v\n", name, err)
+		}
+	}
+	return volume, nil
+}
+
+// saveVolume writes a volume's record, in the current schema version
+func saveVolume(volumeDir string, volume Volume) error {
+	volume.SchemaVersion = volumeSchemaVersion
+	data, err := json.MarshalIndent(volume, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal volume: %v", err)
+	}
+	infoPath := filepath.Join(volumeDir, volumeInfoFileName)
+	tempPath := infoPath + ".tmp"
+	if err := os.WriteFile(tempPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write volume %s: %v", volume.Name, err)
+	}
+	if err := os.Rename(tempPath, infoPath); err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("failed to write volume %s: %v", volume.Name, err)
+	}
+	return nil
+}
+
+// ListVolumes returns all volumes, sorted by name
+func ListVolumes() ([]Volume, error) {
+	dir, err := volumesDir()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read volumes: %v", err)
+	}
+
+	var volumes []Volume
+	for _, entry := range entries {
+		volume, err := LookupVolume(entry.Name())
+		if err != nil {
+			if _, newer := err.(*NewerSchemaError); newer {
+				return nil, err
+			}
+			logf("[ns] Warning: %v\n", err)
+			continue
+		}
+		volumes = append(volumes, volume)
+	}
+	sort.Slice(volumes, func(i, j int) bool { return volumes[i].Name < volumes[j].Name })
+	return volumes, nil
+}
+
+// volumeUsers returns the containers whose record lists the volume
+func volumeUsers(name string) ([]ContainerInfo, error) {
+	containers, err := ListContainers()
+	if err != nil {
+		return nil, err
+	}
+	var users []ContainerInfo
+	for _, container := range containers {
+		for _, volumeName := range container.Volumes {
+			if volumeName == name {
+				users = append(users, container)
+				break
+			}
+		}
+	}
+	return users, nil
+}
+
+// RemoveVolume deletes a volume and its data; like a container's files, a
+// volume a container (even an exited one) refers to is kept
+func RemoveVolume(name string) error {
+	volume, err := LookupVolume(name)
+	if err != nil {
+		return err
+	}
+	users, err := volumeUsers(volume.Name)
+	if err != nil {
+		return err
+	}
+	if len(users) > 0 {
+		return fmt.Errorf("volume %s is in use by container %s", volume.Name, ShortID(users[0].ID))
+	}
+	return removeVolumeDir(volume.Name)
+}
+
+// removeVolumeDir deletes a volume without checking for users
+func removeVolumeDir(name string) error {
+	dir, err := volumesDir()
+	if err != nil {
+		return err
+	}
+	if err := os.RemoveAll(filepath.Join(dir, name)); err != nil {
+		return fmt.Errorf("failed to remove volume %s: %v", name, err)
+	}
+	logf("[ns] Removed volume %s\n", name)
+	return nil
+}
+
+// removeAnonymousVolumes deletes the anonymous volumes of a container that
+// is being removed
+func removeAnonymousVolumes(names []string) {
+	for _, name := range names {
+		volume, err := LookupVolume(name)
+		if err != nil || !volume.Anonymous {
+			continue
+		}
+		if err := removeVolumeDir(name); err != nil {
+			logf("[ns] Warning: %v\n", err)
+		}
+	}
+}
+
+// PruneVolumes removes every volume no container refers to and reports
+// which ones were removed and how much space that freed
+func PruneVolumes() ([]string, int64, error) {
+	volumes, err := ListVolumes()
+	if err != nil {
+		return nil, 0, err
+	}
+	inUse, err := volumesInUse()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var removed []string
+	var reclaimed int64
+	for _, volume := range volumes {
+		if _, used := inUse[volume.Name]; used {
+			continue
+		}
+		size, _ := directorySize(volume.Mountpoint)
+		if err := removeVolumeDir(volume.Name); err != nil {
+			logf("[ns] Warning: %v\n", err)
+			continue
+		}
+		removed = append(removed, volume.Name)
+		reclaimed += size
+	}
+	return removed, reclaimed, nil
+}
+
+// volumesInUse maps the names of the volumes containers refer to to
+// whether a live container uses them
+func volumesInUse() (map[string]bool, error) {
+	containers, err := ListContainers()
+	if err != nil {
+		return nil, err
+	}
+	inUse := map[string]bool{}
+	for _, container := range containers {
+		isActive := container.Status == StatusRunning || container.Status == StatusCreated
+		for _, name := range container.Volumes {
+			inUse[name] = inUse[name] || isActive
+		}
+	}
+	return inUse, nil
+}
+
+// describeVolumes points volume mounts at their data directories without
+// creating anything, for describing a container rather than running it
+func describeVolumes(mounts []Mount) error {
+	dir, err := volumesDir()
+	if err != nil {
+		return err
+	}
+	for i := range mounts {
+		mount := &mounts[i]
+		if mount.Type != MountTypeVolume {
+			continue
+		}
+		if mount.Source == "" {
+			return fmt.Errorf("an anonymous volume at %s can only be created by running the container; name it instead", mount.Destination)
+		}
+		mount.VolumeName = mount.Source
+		mount.Source = filepath.Join(dir, mount.VolumeName, volumeDataDirName)
+	}
+	return nil
+}
+
+// prepareVolumes creates the volumes the container's mounts refer to and
+// points the mounts at their data, recording the names in config.Volumes
+func prepareVolumes(config *ContainerConfig) error {
+	for i := range config.Mounts {
+		mount := &config.Mounts[i]
+		if mount.Type != MountTypeVolume {
+			continue
+		}
+
+		var volume Volume
+		var err error
+		if mount.Source == "" {
+			volume, err = createAnonymousVolume()
+		} else {
+			volume, err = CreateVolume(mount.Source)
+		}
+		if err != nil {
+			return err
+		}
+		mount.VolumeName = volume.Name
+		mount.Source = volume.Mountpoint
+		config.Volumes = append(config.Volumes, volume.Name)
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+//go:build linux
+
+package ns
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// Conditions "nsctl wait" can wait for
+const (
+	// WaitExited waits until the container has exited for good, i.e. not
+	// to be restarted
+	WaitExited = "exited"
+
+	// WaitRunning waits until a created container has been started
+	WaitRunning = "running"
+
+	// WaitHealthy waits until the container's health check passes; it fails
+	// once the container is unhealthy
+	WaitHealthy = "healthy"
+
+	// WaitRemoved waits until the container's record is gone, e.g. after
+	// --rm or "nsctl rm"
+	WaitRemoved = "removed"
+)
+
+// waitPollInterval is how often the container record is checked
+const waitPollInterval = 100 * time.Millisecond
+
+// ErrWaitTimeout is returned when a condition isn't met in time
+var ErrWaitTimeout = fmt.Errorf("timed out")
+
+// WaitForContainer blocks until a container meets a condition, or timeout
+// (if not zero) passes; it returns the container's last record, which is
+// nil once it's been removed
+func WaitForContainer(containerID string, condition string, timeout time.Duration) (*ContainerInfo, error) {
+	if condition != WaitExited && condition != WaitRunning && condition != WaitHealthy && condition != WaitRemoved {
+		return nil, fmt.Errorf("unknown condition %q (expected %s, %s, %s or %s)", condition, WaitExited, WaitRunning, WaitHealthy, WaitRemoved)
+	}
+	if condition == WaitHealthy {
+		config, err := readContainerConfig(containerID)
+		if err != nil {
+			return nil, err
+		}
+		if config.HealthCheck.Type == "" {
+			return nil, fmt.Errorf("container %s has no health check to wait for", ShortID(containerID))
+		}
+	}
+
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	for {
+		// Records are replaced by a rename, so one that's there can be read
+		if _, err := os.Stat(getContainerFilePath(containerID)); os.IsNotExist(err) {
+			if condition == WaitRemoved {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("container %s was removed", ShortID(containerID))
+		}
+		containerInfo, err := loadContainerInfo(containerID)
+		if err != nil {
+			return nil, err
+		}
+
+		switch status := refreshStatus(&containerInfo); {
+		case condition == WaitExited && status == StatusExited:
+			return &containerInfo, nil
+		case condition == WaitRunning && status == StatusRunning:
+			return &containerInfo, nil
+		case (condition == WaitRunning || condition == WaitHealthy) && status == StatusExited:
+			return &containerInfo, fmt.Errorf("container %s exited with code %d", ShortID(containerID), containerInfo.ExitCode)
+		case condition == WaitHealthy && status == StatusRunning && containerInfo.Health != nil:
+			switch containerInfo.Health.Status {
+			case HealthHealthy:
+				return &containerInfo, nil
+			case HealthUnhealthy:
+				return &containerInfo, fmt.Errorf("container %s is unhealthy", ShortID(containerID))
+			}
+		}
+
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return &containerInfo, ErrWaitTimeout
+		}
+		time.Sleep(waitPollInterval)
+	}
+}
@@ -0,0 +1,145 @@
+//go:build linux
+
+package ns
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+)
+
+// Webhooks
+//
+// Instead of following "nsctl events", a script can have events POSTed to
+// it. Every webhook in the runtime config gets the events it asks for (all
+// of them by default) as the same JSON objects "events --json" prints:
+//
+//	{"webhooks": [{
+//	  "url": "https://alerts.example.com/nsctl",
+//	  "secret": "s3cret",
+//	  "events": ["die", "oom"]
+//	}]}
+//
+// With a secret, each request carries an HMAC-SHA256 of its body under that
+// key in the X-Nsctl-Signature header ("sha256=<hex>"), as GitHub's
+// webhooks do, so the receiver can tell it came from nsctl. Webhooks are
+// called by whichever process emits the event (the shim, or the CLI for
+// "start"), once and with a short timeout; a failed delivery is only
+// logged. In offline mode none are called.
+
+const (
+	// webhookSignatureHeader carries the HMAC of the request body
+	webhookSignatureHeader = "X-Nsctl-Signature"
+
+	// webhookEventHeader names the event type, for routing without
+	// parsing the body
+	webhookEventHeader = "X-Nsctl-Event"
+
+	// defaultWebhookTimeout bounds a delivery unless the webhook sets its
+	// own timeout
+	defaultWebhookTimeout = 5 * time.Second
+)
+
+// WebhookConfig is one webhook of the runtime config
+type WebhookConfig struct {
+	URL string `json:"url"`
+
+	// Secret signs the requests; empty means they aren't signed
+	Secret string `json:"secret,omitempty"`
+
+	// Events are the event types sent; empty means all of them
+	Events []string `json:"events,omitempty"`
+
+	// Timeout of a delivery, e.g. "10s"; empty means defaultWebhookTimeout
+	Timeout string `json:"timeout,omitempty"`
+}
+
+// validate checks a webhook when the runtime config is loaded
+func (w WebhookConfig) validate() error {
+	endpoint, err := url.Parse(w.URL)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return fmt.Errorf("URL %q is not an http:// or https:// URL", w.URL)
+	}
+	if w.Timeout != "" {
+		if timeout, err := time.ParseDuration(w.Timeout); err != nil || timeout <= 0 {
+			return fmt.Errorf("timeout %q of %s is not a positive duration", w.Timeout, w.URL)
+		}
+	}
+	return nil
+}
+
+// wants reports whether the webhook subscribes to an event type
+func (w WebhookConfig) wants(eventType string) bool {
+	return len(w.Events) == 0 || slices.Contains(w.Events, eventType)
+}
+
+// signWebhookPayload returns the signature header value of a request body
+func signWebhookPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// notifyWebhooks sends an event to the webhooks that subscribe to it
+// Like emitting the event itself, this never fails; problems are logged
+func notifyWebhooks(event Event, body []byte) {
+	runtimeConfig, err := LoadRuntimeConfig()
+	if err != nil {
+		logf("[ns] Warning: not calling webhooks: %v\n", err)
+		return
+	}
+
+	for _, webhook := range runtimeConfig.Webhooks {
+		if !webhook.wants(event.Type) {
+			continue
+		}
+		if err := CheckOnline("calling webhook " + webhook.URL); err != nil {
+			logf("[ns] Warning: %v\n", err)
+			return
+		}
+		if err := deliverWebhook(webhook, event.Type, body); err != nil {
+			logf("[ns] Warning: failed to send %s event to %s: %v\n", event.Type, webhook.URL, err)
+		}
+	}
+}
+
+// deliverWebhook POSTs one event to a webhook
+func deliverWebhook(webhook WebhookConfig, eventType string, body []byte) error {
+	timeout := defaultWebhookTimeout
+	if webhook.Timeout != "" {
+		timeout, _ = time.ParseDuration(webhook.Timeout)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "nsctl")
+	request.Header.Set(webhookEventHeader, eventType)
+	if webhook.Secret != "" {
+		request.Header.Set(webhookSignatureHeader, signWebhookPayload(webhook.Secret, body))
+	}
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(response.Body, 64<<10))
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("%s", response.Status)
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package schedule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CronExpression is a parsed standard 5-field cron expression:
+//
+//	┌───────────── minute (0-59)
+//	│ ┌─────────── hour (0-23)
+//	│ │ ┌───────── day of month (1-31)
+//	│ │ │ ┌─────── month (1-12)
+//	│ │ │ │ ┌───── day of week (0-7, 0 and 7 are Sunday)
+//	* * * * *
+//
+// Each field accepts "*", numbers, ranges "a-b", lists "a,b" and steps
+// "*/n" or "a-b/n". The macros @hourly, @daily, @weekly, @monthly and
+// @yearly are accepted as shorthands.
+type CronExpression struct {
+	minutes     uint64 // bit n set = minute n matches
+	hours       uint64
+	daysOfMonth uint64
+	months      uint64
+	daysOfWeek  uint64
+
+	// Classic cron quirk: when both day fields are restricted, a day
+	// matches if EITHER of them matches
+	daysOfMonthRestricted bool
+	daysOfWeekRestricted  bool
+}
+
+// cronMacros maps the @-shorthands to their 5-field equivalents
+var cronMacros = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+	"@yearly":  "0 0 1 1 *",
+}
+
+// ParseCron parses a cron expression such as "*/5 * * * *"
+func ParseCron(expression string) (*CronExpression, error) {
+	expression = strings.TrimSpace(expression)
+	if macro, ok := cronMacros[expression]; ok {
+		expression = macro
+	}
+
+	fields := strings.Fields(expression)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression %q must have 5 fields (minute hour day-of-month month day-of-week)", expression)
+	}
+
+	cron := &CronExpression{}
+	var err error
+	if cron.minutes, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, fmt.Errorf("invalid minute field: %v", err)
+	}
+	if cron.hours, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, fmt.Errorf("invalid hour field: %v", err)
+	}
+	if cron.daysOfMonth, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, fmt.Errorf("invalid day-of-month field: %v", err)
+	}
+	if cron.months, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, fmt.Errorf("invalid month field: %v", err)
+	}
+	if cron.daysOfWeek, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, fmt.Errorf("invalid day-of-week field: %v", err)
+	}
+
+	// 7 is an alias for Sunday
+	if cron.daysOfWeek&(1<<7) != 0 {
+		cron.daysOfWeek |= 1 << 0
+	}
+
+	cron.daysOfMonthRestricted = fields[2] != "*"
+	cron.daysOfWeekRestricted = fields[4] != "*"
+	return cron, nil
+}
+
+// parseCronField turns one field into a bitmask of the values it matches
+func parseCronField(field string, minimum int, maximum int) (uint64, error) {
+	var bits uint64
+
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+
+		step := 1
+		if hasStep {
+			parsedStep, err := strconv.Atoi(stepPart)
+			if err != nil || parsedStep <= 0 {
+				return 0, fmt.Errorf("bad step %q", stepPart)
+			}
+			step = parsedStep
+		}
+
+		var start, end int
+		switch {
+		case rangePart == "*":
+			start, end = minimum, maximum
+		case strings.Contains(rangePart, "-"):
+			startText, endText, _ := strings.Cut(rangePart, "-")
+			var errStart, errEnd error
+			start, errStart = strconv.Atoi(startText)
+			end, errEnd = strconv.Atoi(endText)
+			if errStart != nil || errEnd != nil {
+				return 0, fmt.Errorf("bad range %q", rangePart)
+			}
+		default:
+			value, err := strconv.Atoi(rangePart)
+			if err != nil {
+				return 0, fmt.Errorf("bad value %q", rangePart)
+			}
+			// "5/15" means "from 5 to the end, every 15"
+			start, end = value, value
+			if hasStep {
+				end = maximum
+			}
+		}
+
+		if start < minimum || end > maximum || start > end {
+			return 0, fmt.Errorf("%q is outside %d-%d", part, minimum, maximum)
+		}
+		for value := start; value <= end; value += step {
+			bits |= 1 << uint(value)
+		}
+	}
+
+	return bits, nil
+}
+
+// Matches reports whether the expression fires during the minute of t
+func (cron *CronExpression) Matches(t time.Time) bool {
+	if cron.minutes&(1<<uint(t.Minute())) == 0 ||
+		cron.hours&(1<<uint(t.Hour())) == 0 ||
+		cron.months&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+
+	dayOfMonthMatches := cron.daysOfMonth&(1<<uint(t.Day())) != 0
+	dayOfWeekMatches := cron.daysOfWeek&(1<<uint(t.Weekday())) != 0
+	if cron.daysOfMonthRestricted && cron.daysOfWeekRestricted {
+		return dayOfMonthMatches || dayOfWeekMatches
+	}
+	return dayOfMonthMatches && dayOfWeekMatches
+}
+
+// Next returns the first minute strictly after t at which the expression
+// fires, or the zero time if there is none within the next five years
+// (e.g. "0 0 30 2 *", February 30th)
+func (cron *CronExpression) Next(after time.Time) time.Time {
+	candidate := after.Truncate(time.Minute).Add(time.Minute)
+	limit := after.AddDate(5, 0, 0)
+
+	for candidate.Before(limit) {
+		if cron.Matches(candidate) {
+			return candidate
+		}
+		candidate = candidate.Add(time.Minute)
+	}
+	return time.Time{}
+}
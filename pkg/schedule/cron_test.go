@@ -0,0 +1,83 @@
+package schedule
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	at := func(value string) time.Time {
+		parsed, err := time.Parse("2006-01-02 15:04", value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed
+	}
+
+	tests := []struct {
+		expression string
+		after      string
+		want       string // empty for no firing within five years
+	}{
+		{"* * * * *", "2026-03-10 12:00", "2026-03-10 12:01"},
+		{"*/15 * * * *", "2026-03-10 12:01", "2026-03-10 12:15"},
+		{"5/20 * * * *", "2026-03-10 12:26", "2026-03-10 12:45"},
+		{"0 9-17/4 * * *", "2026-03-10 13:00", "2026-03-10 17:00"},
+		{"30 2 * * *", "2026-03-10 02:30", "2026-03-11 02:30"},
+		{"0 0 1,15 * *", "2026-03-02 00:00", "2026-03-15 00:00"},
+		{"0 0 * * 1-5", "2026-03-13 23:59", "2026-03-16 00:00"}, // Friday to Monday
+		{"0 0 * * 7", "2026-03-10 00:00", "2026-03-15 00:00"},   // 7 is Sunday
+		{"0 0 13 * 5", "2026-03-10 00:00", "2026-03-13 00:00"},  // the 13th or a Friday
+		{"0 0 31 * *", "2026-04-01 00:00", "2026-05-31 00:00"},
+		{"0 0 29 2 *", "2026-03-01 00:00", "2028-02-29 00:00"},
+		{"0 0 30 2 *", "2026-03-01 00:00", ""},
+		{"@hourly", "2026-03-10 12:00", "2026-03-10 13:00"},
+		{"@daily", "2026-03-10 12:00", "2026-03-11 00:00"},
+		{"@weekly", "2026-03-10 12:00", "2026-03-15 00:00"},
+		{"@monthly", "2026-03-10 12:00", "2026-04-01 00:00"},
+		{" @yearly ", "2026-03-10 12:00", "2027-01-01 00:00"},
+	}
+	for _, test := range tests {
+		cron, err := ParseCron(test.expression)
+		if err != nil {
+			t.Errorf("ParseCron(%q): %v", test.expression, err)
+			continue
+		}
+		var want time.Time
+		if test.want != "" {
+			want = at(test.want)
+		}
+		if got := cron.Next(at(test.after)); !got.Equal(want) {
+			t.Errorf("ParseCron(%q).Next(%s) = %s, want %s", test.expression, test.after, got, want)
+		}
+	}
+}
+
+func TestParseCronErrors(t *testing.T) {
+	tests := []struct {
+		expression string
+		want       string
+	}{
+		{"", "must have 5 fields"},
+		{"* * * *", "must have 5 fields"},
+		{"* * * * * *", "must have 5 fields"},
+		{"@often", "must have 5 fields"},
+		{"60 * * * *", "invalid minute field"},
+		{"* 24 * * *", "invalid hour field"},
+		{"* * 0 * *", "invalid day-of-month field"},
+		{"* * * 13 *", "invalid month field"},
+		{"* * * * 8", "invalid day-of-week field"},
+		{"*/0 * * * *", `bad step "0"`},
+		{"*/x * * * *", `bad step "x"`},
+		{"a-5 * * * *", `bad range "a-5"`},
+		{"10-5 * * * *", "outside 0-59"},
+		{"1,,2 * * * *", `bad value ""`},
+		{"mon * * * *", `bad value "mon"`},
+	}
+	for _, test := range tests {
+		if _, err := ParseCron(test.expression); err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("ParseCron(%q) error = %v, want one containing %q", test.expression, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+//go:build linux
+
+package schedule
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"nsctl/pkg/ns"
+)
+
+// RunScheduler is the main loop of "nsctl daemon"
+// Once a minute it re-reads the schedule files (so "schedule create" and
+// "schedule rm" take effect without talking to the daemon) and launches a
+// container for every schedule that fires in that minute. Alongside, it
+// keeps the container index up to date. It never returns.
+func RunScheduler(execPath string) {
+	fmt.Fprintf(os.Stderr, "[schedule] Scheduler started\n")
+
+	// Keeps ps fast however many containers there are
+	go func() {
+		if err := ns.MaintainContainerIndex(); err != nil {
+			fmt.Fprintf(os.Stderr, "[schedule] Not maintaining the container index: %v\n", err)
+		}
+	}()
+
+	for {
+		// Sleep until the start of the next minute, which is the resolution
+		// of cron expressions
+		now := time.Now()
+		nextMinute := now.Truncate(time.Minute).Add(time.Minute)
+		time.Sleep(time.Until(nextMinute))
+
+		runDueSchedules(execPath, nextMinute)
+	}
+}
+
+// runDueSchedules launches the schedules that fire at the given minute
+func runDueSchedules(execPath string, minute time.Time) {
+	schedules, err := List()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[schedule] Failed to load schedules: %v\n", err)
+		return
+	}
+
+	for i := range schedules {
+		schedule := &schedules[i]
+
+		cron, err := ParseCron(schedule.Cron)
+		if err != nil || !cron.Matches(minute) {
+			continue
+		}
+
+		run := Run{ScheduledFor: minute}
+
+		// Never let a slow job pile up copies of itself
+		if schedule.lastRunStillActive() {
+			fmt.Fprintf(os.Stderr, "[schedule] %s: previous run still active, skipping\n", schedule.ID)
+			run.Skipped = true
+		} else {
+			fmt.Fprintf(os.Stderr, "[schedule] %s: starting %s %v\n", schedule.ID, schedule.Container.Command, schedule.Container.Args)
+
+			// Each run is a fresh container with its own ID
+			containerConfig := schedule.Container
+			containerConfig.ID = ""
+			containerID, err := ns.RunWithConfig(execPath, containerConfig)
+			if err == nil {
+				run.ContainerID = containerID
+			} else {
+				fmt.Fprintf(os.Stderr, "[schedule] %s: failed to start: %v\n", schedule.ID, err)
+				run.Error = err.Error()
+			}
+		}
+
+		// The schedule may have been removed while we were starting it
+		if _, err := Lookup(schedule.ID); err != nil {
+			continue
+		}
+		schedule.recordRun(run)
+		if err := save(schedule); err != nil {
+			fmt.Fprintf(os.Stderr, "[schedule] %s: failed to save history: %v\n", schedule.ID, err)
+		}
+	}
+}
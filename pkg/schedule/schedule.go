@@ -0,0 +1,232 @@
+//go:build linux
+
+package schedule
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"nsctl/pkg/ns"
+)
+
+// Schedule launches a container every time its cron expression fires
+// Schedules are stored as JSON files in <data dir>/schedules and are picked
+// up by "nsctl daemon", which checks them once a minute.
+type Schedule struct {
+	ID        string             `json:"id"`
+	Cron      string             `json:"cron"`
+	Container ns.ContainerConfig `json:"container"`
+	CreatedAt time.Time          `json:"created_at"`
+
+	// History of recent runs, oldest first
+	History []Run `json:"history"`
+}
+
+// Run is one firing of a schedule
+type Run struct {
+	ScheduledFor time.Time `json:"scheduled_for"`
+	ContainerID  string    `json:"container_id,omitempty"`
+
+	// Skipped is set when the previous run was still going, so the
+	// schedule didn't start an overlapping one
+	Skipped bool   `json:"skipped,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+const (
+	// maxHistory bounds the run history kept per schedule; the containers of
+	// runs that drop out of the history are removed as well
+	maxHistory = 20
+
+	schedulesDirName = "schedules"
+)
+
+// schedulesDir returns (and creates) the directory holding schedule files
+func schedulesDir() (string, error) {
+	dataDir, err := ns.EnsureDataDir()
+	if err != nil {
+		return "", err
+	}
+
+	// Schedules hold whole container configs, for the store's user only
+	dir := filepath.Join(dataDir, schedulesDirName)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("failed to create schedules directory: %v", err)
+	}
+	if err := os.Chmod(dir, 0700); err != nil {
+		return "", fmt.Errorf("failed to restrict schedules directory: %v", err)
+	}
+	return dir, nil
+}
+
+// Create validates and stores a new schedule
+func Create(cronExpression string, container ns.ContainerConfig) (*Schedule, error) {
+	if _, err := ParseCron(cronExpression); err != nil {
+		return nil, err
+	}
+
+	randomBytes := make([]byte, 6)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return nil, fmt.Errorf("failed to generate schedule ID: %v", err)
+	}
+
+	// Scheduled containers always run in the background and are kept after
+	// they exit, so that the history can show how each run went
+	container.Detach = true
+	container.AutoRemove = false
+
+	schedule := &Schedule{
+		ID:        hex.EncodeToString(randomBytes),
+		Cron:      cronExpression,
+		Container: container,
+		CreatedAt: time.Now(),
+	}
+	if err := save(schedule); err != nil {
+		return nil, err
+	}
+	return schedule, nil
+}
+
+// save writes a schedule file atomically
+func save(schedule *Schedule) error {
+	dir, err := schedulesDir()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(schedule, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal schedule: %v", err)
+	}
+
+	filePath := filepath.Join(dir, schedule.ID+".json")
+	tempPath := filePath + ".tmp"
+	if err := os.WriteFile(tempPath, data, 0600); err != nil {
+		return fmt.Errorf("failed to write schedule: %v", err)
+	}
+	return os.Rename(tempPath, filePath)
+}
+
+// List returns all stored schedules ordered by creation time
+func List() ([]Schedule, error) {
+	dir, err := schedulesDir()
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schedules directory: %v", err)
+	}
+
+	var schedules []Schedule
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[schedule] Warning: failed to read %s: %v\n", entry.Name(), err)
+			continue
+		}
+		var schedule Schedule
+		if err := json.Unmarshal(data, &schedule); err != nil {
+			fmt.Fprintf(os.Stderr, "[schedule] Warning: failed to parse %s: %v\n", entry.Name(), err)
+			continue
+		}
+		schedules = append(schedules, schedule)
+	}
+
+	sort.Slice(schedules, func(i, j int) bool {
+		return schedules[i].CreatedAt.Before(schedules[j].CreatedAt)
+	})
+	return schedules, nil
+}
+
+// Lookup finds a schedule by its ID or a unique ID prefix
+func Lookup(idOrPrefix string) (*Schedule, error) {
+	schedules, err := List()
+	if err != nil {
+		return nil, err
+	}
+
+	var matches []Schedule
+	for _, schedule := range schedules {
+		if strings.HasPrefix(schedule.ID, idOrPrefix) {
+			matches = append(matches, schedule)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("no such schedule: %s", idOrPrefix)
+	case 1:
+		return &matches[0], nil
+	default:
+		return nil, fmt.Errorf("schedule ID prefix %s is ambiguous (%d matches)", idOrPrefix, len(matches))
+	}
+}
+
+// Remove deletes a schedule; containers it already started are left alone
+func Remove(scheduleID string) error {
+	dir, err := schedulesDir()
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(dir, scheduleID+".json")); err != nil {
+		return fmt.Errorf("failed to remove schedule: %v", err)
+	}
+	return nil
+}
+
+// NextRun returns when the schedule fires next after t
+func (schedule *Schedule) NextRun(after time.Time) time.Time {
+	cron, err := ParseCron(schedule.Cron)
+	if err != nil {
+		return time.Time{}
+	}
+	return cron.Next(after)
+}
+
+// lastRunStillActive reports whether the most recent run's container is
+// still created or running
+func (schedule *Schedule) lastRunStillActive() bool {
+	for i := len(schedule.History) - 1; i >= 0; i-- {
+		containerID := schedule.History[i].ContainerID
+		if containerID == "" {
+			continue
+		}
+
+		container, err := ns.LookupContainer(containerID)
+		if err != nil {
+			return false
+		}
+		return container.Status == ns.StatusRunning || container.Status == ns.StatusCreated
+	}
+	return false
+}
+
+// recordRun appends a run to the history, trimming it to maxHistory and
+// removing the containers of runs that fall out of it
+func (schedule *Schedule) recordRun(run Run) {
+	schedule.History = append(schedule.History, run)
+
+	for len(schedule.History) > maxHistory {
+		dropped := schedule.History[0]
+		schedule.History = schedule.History[1:]
+
+		if dropped.ContainerID != "" {
+			if err := ns.RemoveContainer(dropped.ContainerID, false, true); err != nil {
+				fmt.Fprintf(os.Stderr, "[schedule] Warning: failed to remove old container %s: %v\n", ns.ShortID(dropped.ContainerID), err)
+			}
+		}
+	}
+}